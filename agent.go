@@ -0,0 +1,460 @@
+package ssk
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Files of the agent in the agent directory.
+const (
+	agentStateFile = "agent.json"
+	agentPIDFile   = "agent.pid"
+	agentLogFile   = "agent.log"
+)
+
+// agentReadyFDEnv is the environment variable that tells a detached agent the
+// file descriptor to report its state to the parent process.
+const agentReadyFDEnv = "SSK_AGENT_READY_FD"
+
+// agentStartTimeout is how long `agent` waits for the detached agent to start.
+const agentStartTimeout = 30 * time.Second
+
+// DefaultAgentAddr is the address the agent listens on unless SSK_SERVER_ADDR
+// is set explicitly: a random port of the loopback interface.
+const DefaultAgentAddr = "127.0.0.1:0"
+
+// AgentState is the state of a running agent, stored in the agent directory.
+type AgentState struct {
+	PID       int       `json:"pid"`
+	Addr      string    `json:"addr"`
+	Token     string    `json:"token"`
+	KeyID     string    `json:"key_id,omitempty"`
+	StartedAt time.Time `json:"started_at"`
+}
+
+// Env returns the environment variables to configure SOPS to use the agent,
+// as RunServer does. SOPS_VAULT_URIS points to keyID, or to the key ID of the
+// agent if keyID is empty.
+func (s *AgentState) Env(keyID string) map[string]string {
+	env := map[string]string{
+		"VAULT_ADDR":  "http://" + s.Addr,
+		"VAULT_TOKEN": s.Token,
+	}
+	if keyID == "" {
+		keyID = s.KeyID
+	}
+	if keyID != "" {
+		env["SOPS_VAULT_URIS"] = fmt.Sprintf("http://%s/v1/transit/encrypt/%s", s.Addr, keyID)
+	}
+	return env
+}
+
+// DefaultAgentDir returns the directory of the agent pidfile and state file:
+// $XDG_RUNTIME_DIR/sops-sakura-kms, or sops-sakura-kms-<uid> in the
+// temporary directory if XDG_RUNTIME_DIR is not set.
+func DefaultAgentDir() string {
+	if d := os.Getenv("XDG_RUNTIME_DIR"); d != "" {
+		return filepath.Join(d, "sops-sakura-kms")
+	}
+	return filepath.Join(os.TempDir(), fmt.Sprintf("sops-sakura-kms-%d", os.Getuid()))
+}
+
+func (e *Env) agentDir() string {
+	if e.AgentDir != "" {
+		return e.AgentDir
+	}
+	return DefaultAgentDir()
+}
+
+// agentAddr returns the address for the agent: SSK_SERVER_ADDR if it is set
+// by the flag, the environment or a configuration file, or DefaultAgentAddr.
+func agentAddr(fs *flag.FlagSet, e *Env) (string, error) {
+	set := false
+	fs.Visit(func(f *flag.Flag) {
+		set = set || f.Name == "server-addr"
+	})
+	if !set {
+		_, sources, err := loadEnv()
+		if err != nil {
+			return "", err
+		}
+		set = sources["ServerAddr"] != "default"
+	}
+	if set {
+		return e.ServerAddr, nil
+	}
+	return DefaultAgentAddr, nil
+}
+
+// FindAgent returns the state of the agent running with the agent directory dir,
+// or nil if no agent is running. A state file left by an agent that is gone is
+// ignored, as is a server at the address that does not accept the token of the state.
+func FindAgent(ctx context.Context, dir string) (*AgentState, error) {
+	s, err := readAgentState(dir)
+	if err != nil || s == nil {
+		return nil, err
+	}
+	if !processAlive(s.PID) || !agentHealthy(ctx, s.Addr) || !agentOwnsState(ctx, s) {
+		return nil, nil
+	}
+	return s, nil
+}
+
+// checkAgentDir checks that the agent directory is private to the user:
+// a directory, not a symlink, owned by the user and with mode 0700.
+// It returns fs.ErrNotExist if the directory does not exist.
+func checkAgentDir(dir string) error {
+	fi, err := os.Lstat(dir)
+	if err != nil {
+		return err
+	}
+	if !fi.IsDir() {
+		return fmt.Errorf("the agent directory %s is not a directory", dir)
+	}
+	return checkPrivate(dir, fi, 0o700)
+}
+
+// ensureAgentDir creates the agent directory if needed, and checks it.
+func ensureAgentDir(dir string) error {
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return fmt.Errorf("failed to create the agent directory: %w", err)
+	}
+	return checkAgentDir(dir)
+}
+
+func readAgentState(dir string) (*AgentState, error) {
+	if err := checkAgentDir(dir); errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	path := filepath.Join(dir, agentStateFile)
+	fi, err := os.Lstat(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	if !fi.Mode().IsRegular() {
+		return nil, fmt.Errorf("the agent state file %s is not a regular file", path)
+	}
+	if err := checkPrivate(path, fi, 0o600); err != nil {
+		return nil, err
+	}
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var s AgentState
+	if err := json.Unmarshal(b, &s); err != nil {
+		return nil, fmt.Errorf("invalid agent state file %s: %w", path, err)
+	}
+	return &s, nil
+}
+
+func agentHealthy(ctx context.Context, addr string) bool {
+	client := &http.Client{Timeout: time.Second}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, "http://"+addr+"/health", nil)
+	if err != nil {
+		return false
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return false
+	}
+	resp.Body.Close()
+	return resp.StatusCode == http.StatusOK
+}
+
+// agentOwnsState reports whether the server at the address of s is the agent
+// of s: it accepts the token and runs as the pid.
+func agentOwnsState(ctx context.Context, s *AgentState) bool {
+	client := &http.Client{Timeout: time.Second}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, "http://"+s.Addr+"/v1/auth/token/lookup-self", nil)
+	if err != nil {
+		return false
+	}
+	req.Header.Set("X-Vault-Token", s.Token)
+	resp, err := client.Do(req)
+	if err != nil {
+		return false
+	}
+	defer resp.Body.Close()
+	var res VaultTokenLookupResponse
+	if resp.StatusCode != http.StatusOK || json.NewDecoder(resp.Body).Decode(&res) != nil {
+		return false
+	}
+	return res.Meta["pid"] == strconv.Itoa(s.PID)
+}
+
+// writeAgentState writes the state file and the pidfile of the agent.
+// The state file holds the token, so the directory and the files are private to the user.
+func writeAgentState(dir string, s *AgentState) error {
+	if err := ensureAgentDir(dir); err != nil {
+		return err
+	}
+	b, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(filepath.Join(dir, agentStateFile), b, 0o600); err != nil {
+		return fmt.Errorf("failed to write the agent state file: %w", err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, agentPIDFile), []byte(strconv.Itoa(s.PID)+"\n"), 0o600); err != nil {
+		return fmt.Errorf("failed to write the agent pidfile: %w", err)
+	}
+	return nil
+}
+
+// removeAgentState removes the state file and the pidfile if they belong to the agent of pid.
+func removeAgentState(dir string, pid int) {
+	s, err := readAgentState(dir)
+	if err != nil || s == nil || s.PID != pid {
+		return
+	}
+	os.Remove(filepath.Join(dir, agentStateFile))
+	os.Remove(filepath.Join(dir, agentPIDFile))
+}
+
+// writeAgentExports writes the shell statements to use the agent, in the style of ssh-agent.
+func writeAgentExports(w io.Writer, s *AgentState) {
+	env := s.Env("")
+	for _, k := range []string{"VAULT_ADDR", "VAULT_TOKEN", "SOPS_VAULT_URIS"} {
+		if v, ok := env[k]; ok {
+			fmt.Fprintf(w, "%s=%s; export %s;\n", k, shellQuote(v), k)
+		}
+	}
+	fmt.Fprintf(w, "SSK_AGENT_PID=%d; export SSK_AGENT_PID;\n", s.PID)
+	fmt.Fprintf(w, "echo Agent pid %d;\n", s.PID)
+}
+
+func newAgentToken() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// RunAgent runs the agent subcommand. Like ssh-agent, it starts the
+// Vault-compatible server in the background and prints the shell statements
+// to use it. Later invocations of sops-sakura-kms reuse the running agent
+// instead of starting their own server.
+func RunAgent(ctx context.Context, args []string, w io.Writer) (int, error) {
+	fs, e, err := envFlagSet("agent", "agent [options]")
+	if err != nil {
+		return ExitCodeError, err
+	}
+	kill := fs.Bool("k", false, "stop the running agent")
+	foreground := fs.Bool("foreground", false, "run the agent in the foreground")
+	if err := fs.Parse(args); err != nil {
+		return ExitCodeError, err
+	}
+	if fs.NArg() > 0 {
+		fs.Usage()
+		return ExitCodeError, fmt.Errorf("unexpected arguments: %v", fs.Args())
+	}
+	dir := e.agentDir()
+	if *kill {
+		if err := stopAgent(ctx, dir, w); err != nil {
+			return ExitCodeError, err
+		}
+		return 0, nil
+	}
+
+	if s, err := FindAgent(ctx, dir); err != nil {
+		return ExitCodeError, err
+	} else if s != nil {
+		slog.Info("agent is already running", "pid", s.PID, "addr", s.Addr)
+		writeAgentExports(w, s)
+		return 0, nil
+	}
+	if e.ServerAddr, err = agentAddr(fs, e); err != nil {
+		return ExitCodeError, err
+	}
+	if *foreground {
+		return runAgent(ctx, e, dir, w)
+	}
+	if len(e.ConfirmKeys) > 0 && e.Askpass == "" {
+		return ExitCodeError, errors.New("the detached agent has no terminal to ask for confirmation; set SSK_ASKPASS or run `agent --foreground`")
+	}
+	s, err := startAgent(ctx, dir, args)
+	if err != nil {
+		return ExitCodeError, err
+	}
+	writeAgentExports(w, s)
+	return 0, nil
+}
+
+// runAgent runs the agent server until ctx is done.
+func runAgent(ctx context.Context, e *Env, dir string, w io.Writer) (int, error) {
+	if err := e.applyLogLevel(); err != nil {
+		return ExitCodeError, err
+	}
+	limits, err := e.SessionLimits()
+	if err != nil {
+		return ExitCodeError, err
+	}
+	cipher, _, policy, err := newServerConfig(e)
+	if err != nil {
+		return ExitCodeError, err
+	}
+	token, err := newAgentToken()
+	if err != nil {
+		return ExitCodeError, fmt.Errorf("failed to generate a token: %w", err)
+	}
+	ctx, cancel := context.WithCancelCause(ctx)
+	defer cancel(nil)
+	limits.OnExpire = cancel
+	opts := []Option{WithCipher(cipher), WithHandlerOptions(append([]HandlerOption{WithToken(token), WithSessionLimits(limits)}, policy...)...)}
+	addEnv, shutdown, err := RunServer(ctx, e.ServerAddr, e.KMSKeyID, opts...)
+	if err != nil {
+		return ExitCodeError, fmt.Errorf("failed to start server: %w", err)
+	}
+	defer shutdown(context.Background())
+
+	s := &AgentState{
+		PID:       os.Getpid(),
+		Addr:      strings.TrimPrefix(addEnv["VAULT_ADDR"], "http://"),
+		Token:     token,
+		KeyID:     e.KMSKeyID,
+		StartedAt: time.Now(),
+	}
+	if err := writeAgentState(dir, s); err != nil {
+		return ExitCodeError, err
+	}
+	defer removeAgentState(dir, s.PID)
+
+	if v := os.Getenv(agentReadyFDEnv); v != "" {
+		fd, err := strconv.Atoi(v)
+		if err != nil {
+			return ExitCodeError, fmt.Errorf("invalid %s: %w", agentReadyFDEnv, err)
+		}
+		f := os.NewFile(uintptr(fd), "ready")
+		err = json.NewEncoder(f).Encode(s)
+		f.Close()
+		if err != nil {
+			return ExitCodeError, fmt.Errorf("failed to report the agent state: %w", err)
+		}
+	} else {
+		writeAgentExports(w, s)
+	}
+	slog.Info("Agent started", "pid", s.PID, "addr", s.Addr, "key_id", s.KeyID)
+	<-ctx.Done()
+	slog.Info("Agent stopped", "pid", s.PID, "reason", context.Cause(ctx))
+	return 0, nil
+}
+
+// startAgent starts the agent as a detached process running `agent --foreground`,
+// and waits for it to report its state. The output of the agent is written to
+// agent.log in dir.
+func startAgent(ctx context.Context, dir string, args []string) (*AgentState, error) {
+	if runtime.GOOS == "windows" {
+		return nil, errors.New("the detached agent is not supported on Windows; run `agent --foreground` instead")
+	}
+	exe, err := os.Executable()
+	if err != nil {
+		return nil, fmt.Errorf("failed to find the executable: %w", err)
+	}
+	if err := ensureAgentDir(dir); err != nil {
+		return nil, err
+	}
+	logPath := filepath.Join(dir, agentLogFile)
+	logFile, err := os.OpenFile(logPath, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o600)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open the agent log: %w", err)
+	}
+	defer logFile.Close()
+	r, pw, err := os.Pipe()
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	cmd := exec.Command(exe, append([]string{"agent", "--foreground"}, args...)...)
+	cmd.Env = append(childEnviron(), agentReadyFDEnv+"=3")
+	cmd.Stdout = logFile
+	cmd.Stderr = logFile
+	cmd.ExtraFiles = []*os.File{pw}
+	cmd.SysProcAttr = detachedProcAttr()
+	err = cmd.Start()
+	pw.Close()
+	if err != nil {
+		return nil, fmt.Errorf("failed to start the agent: %w", err)
+	}
+	pid := cmd.Process.Pid
+	// reap the agent if it exits while this process is still running
+	go cmd.Wait()
+
+	type result struct {
+		s   *AgentState
+		err error
+	}
+	ch := make(chan result, 1)
+	go func() {
+		var s AgentState
+		err := json.NewDecoder(r).Decode(&s)
+		ch <- result{&s, err}
+	}()
+	select {
+	case res := <-ch:
+		if res.err != nil {
+			return nil, fmt.Errorf("agent (pid %d) exited before it started; see %s", pid, logPath)
+		}
+		return res.s, nil
+	case <-time.After(agentStartTimeout):
+		return nil, fmt.Errorf("agent (pid %d) did not start in %s; see %s", pid, agentStartTimeout, logPath)
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// stopAgent stops the agent running with dir and writes the shell statements to unset its variables.
+// The process is signaled only if it is the agent of the state file, not
+// another process that reused the pid of an agent that is gone.
+func stopAgent(ctx context.Context, dir string, w io.Writer) error {
+	s, err := readAgentState(dir)
+	if err != nil {
+		return err
+	}
+	if s == nil {
+		return fmt.Errorf("no agent is running (no state file in %s)", dir)
+	}
+	if processAlive(s.PID) && !agentOwnsState(ctx, s) {
+		slog.Warn("the agent does not answer with its token; removing the stale state file without signaling the process", "pid", s.PID, "addr", s.Addr)
+	} else if processAlive(s.PID) {
+		if err := terminateProcess(s.PID); err != nil {
+			return fmt.Errorf("failed to stop the agent (pid %d): %w", s.PID, err)
+		}
+		for range 50 {
+			if !processAlive(s.PID) {
+				break
+			}
+			time.Sleep(100 * time.Millisecond)
+		}
+		if processAlive(s.PID) {
+			return fmt.Errorf("agent (pid %d) did not stop", s.PID)
+		}
+	}
+	// the agent removes them on exit, unless it was killed
+	removeAgentState(dir, s.PID)
+	fmt.Fprintln(w, "unset VAULT_ADDR VAULT_TOKEN SOPS_VAULT_URIS SSK_AGENT_PID;")
+	fmt.Fprintf(w, "echo Agent pid %d killed;\n", s.PID)
+	return nil
+}
@@ -0,0 +1,246 @@
+package ssk_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	ssk "github.com/fujiwara/sops-sakura-kms"
+)
+
+func waitForAgent(t *testing.T, dir string) *ssk.AgentState {
+	t.Helper()
+	for range 50 {
+		s, err := ssk.FindAgent(context.Background(), dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if s != nil {
+			return s
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	t.Fatal("agent did not start")
+	return nil
+}
+
+func transitStatus(t *testing.T, addr, token string) int {
+	t.Helper()
+	req, _ := http.NewRequest(http.MethodPut, "http://"+addr+"/v1/transit/encrypt/111111111111",
+		strings.NewReader(`{"plaintext":"aGVsbG8="}`))
+	if token != "" {
+		req.Header.Set("X-Vault-Token", token)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	return resp.StatusCode
+}
+
+func TestRunAgentForeground(t *testing.T) {
+	_, srv := newFakeKMS(t, "111111111111")
+	setFakeKMSEnv(t, srv.URL)
+	dir := filepath.Join(t.TempDir(), "agent")
+	t.Setenv("SSK_AGENT_DIR", dir)
+	t.Setenv("SAKURA_KMS_KEY_ID", "111111111111")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	done := make(chan int)
+	go func() {
+		code, err := ssk.RunCLI(ctx, []string{"agent", "--foreground", "--server-addr", "127.0.0.1:0"}, &bytes.Buffer{})
+		if err != nil {
+			t.Error(err)
+		}
+		done <- code
+	}()
+	s := waitForAgent(t, dir)
+	if s.PID != os.Getpid() || s.KeyID != "111111111111" || s.Token == "" {
+		t.Errorf("unexpected agent state: %+v", s)
+	}
+	if b, err := os.ReadFile(filepath.Join(dir, "agent.pid")); err != nil || strings.TrimSpace(string(b)) != strconv.Itoa(s.PID) {
+		t.Errorf("pidfile = %q, %v", b, err)
+	}
+	if st, err := os.Stat(filepath.Join(dir, "agent.json")); err != nil || (runtime.GOOS != "windows" && st.Mode().Perm() != 0o600) {
+		t.Errorf("state file: %v, %v", st, err)
+	}
+
+	if code := transitStatus(t, s.Addr, ""); code != http.StatusForbidden {
+		t.Errorf("status without token = %d, want 403", code)
+	}
+	if code := transitStatus(t, s.Addr, "wrong"); code != http.StatusForbidden {
+		t.Errorf("status with wrong token = %d, want 403", code)
+	}
+	if code := transitStatus(t, s.Addr, s.Token); code != http.StatusOK {
+		t.Errorf("status with token = %d, want 200", code)
+	}
+
+	// the wrapper reuses the agent instead of starting its own server
+	t.Setenv("SSK_COMMAND", "sh")
+	t.Setenv("SSK_SERVER_ADDR", freeAddr(t))
+	script := `test "$VAULT_ADDR" = "http://` + s.Addr + `" && test "$VAULT_TOKEN" = "` + s.Token +
+		`" && test "$SOPS_VAULT_URIS" = "http://` + s.Addr + `/v1/transit/encrypt/111111111111"`
+	if code, err := ssk.RunWrapper(context.Background(), []string{"-c", script}); err != nil || code != 0 {
+		t.Errorf("wrapper did not use the agent: code=%d err=%v", code, err)
+	}
+	t.Setenv("SSK_NO_AGENT", "true")
+	if code, err := ssk.RunWrapper(context.Background(), []string{"-c", `test "$VAULT_TOKEN" = dummy`}); err != nil || code != 0 {
+		t.Errorf("wrapper used the agent with SSK_NO_AGENT: code=%d err=%v", code, err)
+	}
+
+	cancel()
+	if code := <-done; code != 0 {
+		t.Errorf("exit code = %d, want 0", code)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "agent.json")); !os.IsNotExist(err) {
+		t.Errorf("state file was not removed: %v", err)
+	}
+}
+
+func TestRunAgentDetached(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("the detached agent is not supported on Windows")
+	}
+	_, srv := newFakeKMS(t, "111111111111")
+	setFakeKMSEnv(t, srv.URL)
+	dir := filepath.Join(t.TempDir(), "agent")
+	t.Setenv("SSK_AGENT_DIR", dir)
+	t.Setenv("SAKURA_KMS_KEY_ID", "111111111111")
+	ctx := context.Background()
+
+	var out bytes.Buffer
+	if code, err := ssk.RunCLI(ctx, []string{"agent"}, &out); err != nil || code != 0 {
+		t.Fatalf("agent: code=%d err=%v", code, err)
+	}
+	s := waitForAgent(t, dir)
+	t.Cleanup(func() { ssk.RunCLI(ctx, []string{"agent", "-k"}, &bytes.Buffer{}) })
+	if s.PID == os.Getpid() {
+		t.Fatal("agent is not detached")
+	}
+	// a random port without SSK_SERVER_ADDR
+	if !strings.HasPrefix(s.Addr, "127.0.0.1:") || s.Addr == "127.0.0.1:8200" {
+		t.Errorf("agent address = %s, want a random port", s.Addr)
+	}
+	for _, want := range []string{
+		"VAULT_ADDR='http://" + s.Addr + "'; export VAULT_ADDR;\n",
+		"VAULT_TOKEN='" + s.Token + "'; export VAULT_TOKEN;\n",
+		"SOPS_VAULT_URIS='http://" + s.Addr + "/v1/transit/encrypt/111111111111'; export SOPS_VAULT_URIS;\n",
+		"SSK_AGENT_PID=" + strconv.Itoa(s.PID) + "; export SSK_AGENT_PID;\n",
+	} {
+		if !strings.Contains(out.String(), want) {
+			t.Errorf("output does not contain %q:\n%s", want, out.String())
+		}
+	}
+	if code := transitStatus(t, s.Addr, s.Token); code != http.StatusOK {
+		t.Errorf("status with token = %d, want 200", code)
+	}
+
+	// a second agent reuses the running one
+	out.Reset()
+	if code, err := ssk.RunCLI(ctx, []string{"agent"}, &out); err != nil || code != 0 {
+		t.Fatalf("agent: code=%d err=%v", code, err)
+	}
+	if !strings.Contains(out.String(), "SSK_AGENT_PID="+strconv.Itoa(s.PID)+";") {
+		t.Errorf("second agent did not reuse the running one:\n%s", out.String())
+	}
+
+	out.Reset()
+	if code, err := ssk.RunCLI(ctx, []string{"agent", "-k"}, &out); err != nil || code != 0 {
+		t.Fatalf("agent -k: code=%d err=%v", code, err)
+	}
+	if !strings.Contains(out.String(), "unset VAULT_ADDR VAULT_TOKEN SOPS_VAULT_URIS SSK_AGENT_PID;") {
+		t.Errorf("unexpected output of agent -k:\n%s", out.String())
+	}
+	if s, err := ssk.FindAgent(ctx, dir); err != nil || s != nil {
+		t.Errorf("agent is still running: %+v, %v", s, err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "agent.pid")); !os.IsNotExist(err) {
+		t.Errorf("pidfile was not removed: %v", err)
+	}
+	if _, err := ssk.RunCLI(ctx, []string{"agent", "-k"}, &out); err == nil {
+		t.Error("agent -k without an agent should fail")
+	}
+}
+
+func writeAgentStateFile(t *testing.T, dir string, s *ssk.AgentState) {
+	t.Helper()
+	b, err := json.Marshal(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "agent.json"), b, 0o600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestAgentDirInsecure(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("the permissions are not checked on Windows")
+	}
+	dir := t.TempDir()
+	if err := os.Chmod(dir, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	writeAgentStateFile(t, dir, &ssk.AgentState{PID: os.Getpid(), Addr: "127.0.0.1:1", Token: "x"})
+	if _, err := ssk.FindAgent(context.Background(), dir); err == nil || !strings.Contains(err.Error(), "mode") {
+		t.Errorf("expected an error for a directory with mode 0755: %v", err)
+	}
+
+	if err := os.Chmod(dir, 0o700); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chmod(filepath.Join(dir, "agent.json"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ssk.FindAgent(context.Background(), dir); err == nil || !strings.Contains(err.Error(), "mode") {
+		t.Errorf("expected an error for a state file with mode 0644: %v", err)
+	}
+
+	link := filepath.Join(t.TempDir(), "link")
+	if err := os.Symlink(dir, link); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ssk.FindAgent(context.Background(), link); err == nil {
+		t.Error("expected an error for a symlink")
+	}
+}
+
+func TestStopAgentStale(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("the test process requires sleep")
+	}
+	// a process that reused the pid of an agent that is gone
+	cmd := exec.Command("sleep", "30")
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { cmd.Process.Kill(); cmd.Wait() })
+	dir := filepath.Join(t.TempDir(), "agent")
+	if err := os.Mkdir(dir, 0o700); err != nil {
+		t.Fatal(err)
+	}
+	writeAgentStateFile(t, dir, &ssk.AgentState{PID: cmd.Process.Pid, Addr: freeAddr(t), Token: "x"})
+	t.Setenv("SSK_AGENT_DIR", dir)
+
+	if code, err := ssk.RunCLI(context.Background(), []string{"agent", "-k"}, &bytes.Buffer{}); err != nil || code != 0 {
+		t.Fatalf("agent -k: code=%d err=%v", code, err)
+	}
+	if err := cmd.Process.Signal(syscall.Signal(0)); err != nil {
+		t.Errorf("agent -k signaled a process that is not the agent: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "agent.json")); !os.IsNotExist(err) {
+		t.Errorf("the stale state file was not removed: %v", err)
+	}
+}
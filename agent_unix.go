@@ -0,0 +1,42 @@
+//go:build !windows
+
+package ssk
+
+import (
+	"fmt"
+	"io/fs"
+	"os"
+	"syscall"
+)
+
+// detachedProcAttr runs the agent in a new session, detached from the terminal.
+func detachedProcAttr() *syscall.SysProcAttr {
+	return &syscall.SysProcAttr{Setsid: true}
+}
+
+func processAlive(pid int) bool {
+	if pid <= 0 {
+		return false
+	}
+	// EPERM means the process belongs to another user, so it is not our agent
+	return syscall.Kill(pid, 0) == nil
+}
+
+// checkPrivate checks that the file of fi is owned by the effective user and
+// has no permission bits other than perm.
+func checkPrivate(path string, fi fs.FileInfo, perm fs.FileMode) error {
+	if fi.Mode()&fs.ModeSymlink != 0 {
+		return fmt.Errorf("%s is a symlink", path)
+	}
+	if st, ok := fi.Sys().(*syscall.Stat_t); ok && int(st.Uid) != os.Geteuid() {
+		return fmt.Errorf("%s is owned by uid %d, not by the user (uid %d)", path, st.Uid, os.Geteuid())
+	}
+	if fi.Mode().Perm()&^perm != 0 {
+		return fmt.Errorf("%s has mode %04o, must be %04o", path, fi.Mode().Perm(), perm)
+	}
+	return nil
+}
+
+func terminateProcess(pid int) error {
+	return syscall.Kill(pid, syscall.SIGTERM)
+}
@@ -0,0 +1,68 @@
+package ssk
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+
+	v1 "github.com/sacloud/kms-api-go/apis/v1"
+)
+
+// DefaultAlgorithm is the encryption algorithm used when none is configured.
+const DefaultAlgorithm = v1.KeyEncryptAlgoEnumAes256Gcm
+
+// vaultKeyTypes maps Vault Transit key type names to Sakura Cloud KMS algorithms,
+// so that Vault-style "type" hints work as well as the native names.
+var vaultKeyTypes = map[string]v1.KeyEncryptAlgoEnum{
+	"aes256-gcm96": v1.KeyEncryptAlgoEnumAes256Gcm,
+}
+
+// Algorithms returns the encryption algorithms supported by Sakura Cloud KMS.
+func Algorithms() []v1.KeyEncryptAlgoEnum {
+	return v1.KeyEncryptAlgoEnum("").AllValues()
+}
+
+// ParseAlgorithm parses an encryption algorithm name.
+// It accepts Sakura Cloud KMS names (e.g. "aes-256-gcm") and
+// Vault Transit key type names (e.g. "aes256-gcm96").
+func ParseAlgorithm(s string) (v1.KeyEncryptAlgoEnum, error) {
+	name := strings.ToLower(strings.TrimSpace(s))
+	if algo, ok := vaultKeyTypes[name]; ok {
+		return algo, nil
+	}
+	algo := v1.KeyEncryptAlgoEnum(name)
+	if !slices.Contains(Algorithms(), algo) {
+		return "", fmt.Errorf("unsupported algorithm %q (supported: %s)", s, joinAlgorithms(Algorithms()))
+	}
+	return algo, nil
+}
+
+// ParseKeyAlgorithms parses a comma-separated list of key_id=algorithm pairs
+// (e.g. "123456789012=aes-256-cbc,210987654321=aes-256-kw").
+func ParseKeyAlgorithms(s string) (map[string]v1.KeyEncryptAlgoEnum, error) {
+	m := make(map[string]v1.KeyEncryptAlgoEnum)
+	for pair := range strings.SplitSeq(s, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		keyID, name, ok := strings.Cut(pair, "=")
+		if !ok || strings.TrimSpace(keyID) == "" {
+			return nil, fmt.Errorf("invalid key algorithm %q: must be key_id=algorithm", pair)
+		}
+		algo, err := ParseAlgorithm(name)
+		if err != nil {
+			return nil, fmt.Errorf("invalid key algorithm for %s: %w", keyID, err)
+		}
+		m[strings.TrimSpace(keyID)] = algo
+	}
+	return m, nil
+}
+
+func joinAlgorithms(algos []v1.KeyEncryptAlgoEnum) string {
+	s := make([]string, len(algos))
+	for i, a := range algos {
+		s[i] = string(a)
+	}
+	return strings.Join(s, ", ")
+}
@@ -0,0 +1,125 @@
+package ssk_test
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	ssk "github.com/fujiwara/sops-sakura-kms"
+	"github.com/google/go-cmp/cmp"
+	v1 "github.com/sacloud/kms-api-go/apis/v1"
+)
+
+func TestParseAlgorithm(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    v1.KeyEncryptAlgoEnum
+		wantErr bool
+	}{
+		{in: "aes-256-gcm", want: v1.KeyEncryptAlgoEnumAes256Gcm},
+		{in: "AES-256-CBC", want: v1.KeyEncryptAlgoEnumAes256Cbc},
+		{in: "aes-256-kw", want: v1.KeyEncryptAlgoEnumAes256Kw},
+		{in: "aes256-gcm96", want: v1.KeyEncryptAlgoEnumAes256Gcm},
+		{in: "rsa-2048", wantErr: true},
+		{in: "", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.in, func(t *testing.T) {
+			got, err := ssk.ParseAlgorithm(tt.in)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ParseAlgorithm(%q) error = %v, wantErr %v", tt.in, err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("ParseAlgorithm(%q) = %q, want %q", tt.in, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseKeyAlgorithms(t *testing.T) {
+	got, err := ssk.ParseKeyAlgorithms("111111111111=aes-256-cbc, 222222222222=aes256-gcm96,")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]v1.KeyEncryptAlgoEnum{
+		"111111111111": v1.KeyEncryptAlgoEnumAes256Cbc,
+		"222222222222": v1.KeyEncryptAlgoEnumAes256Gcm,
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("ParseKeyAlgorithms mismatch (-want +got):\n%s", diff)
+	}
+
+	for _, s := range []string{"111111111111", "=aes-256-gcm", "111111111111=des"} {
+		if _, err := ssk.ParseKeyAlgorithms(s); err == nil {
+			t.Errorf("ParseKeyAlgorithms(%q) expected error, got nil", s)
+		}
+	}
+}
+
+func TestEncryptHandlerAlgorithm(t *testing.T) {
+	_, srv := newFakeKMS(t, "111111111111", "222222222222")
+	c, err := ssk.NewSakuraKMSWithClient(newFakeKMSClient(t, srv),
+		ssk.WithAlgorithm(v1.KeyEncryptAlgoEnumAes256Kw),
+		ssk.WithKeyAlgorithms(map[string]v1.KeyEncryptAlgoEnum{
+			"222222222222": v1.KeyEncryptAlgoEnumAes256Cbc,
+		}),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mux := ssk.NewMux(c)
+
+	tests := []struct {
+		name       string
+		keyID      string
+		typ        string
+		wantStatus int
+		wantAlgo   string
+	}{
+		{name: "global default", keyID: "111111111111", wantStatus: http.StatusOK, wantAlgo: "aes-256-kw"},
+		{name: "per key", keyID: "222222222222", wantStatus: http.StatusOK, wantAlgo: "aes-256-cbc"},
+		{name: "per request", keyID: "222222222222", typ: "aes256-gcm96", wantStatus: http.StatusOK, wantAlgo: "aes-256-gcm"},
+		{name: "unsupported type", keyID: "111111111111", typ: "rsa-2048", wantStatus: http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			body, _ := json.Marshal(ssk.VaultEncryptRequest{
+				Plaintext: base64.StdEncoding.EncodeToString([]byte("data key")),
+				Type:      tt.typ,
+			})
+			req := httptest.NewRequest("PUT", "/v1/transit/encrypt/"+tt.keyID, bytes.NewReader(body))
+			rec := httptest.NewRecorder()
+			mux.ServeHTTP(rec, req)
+			if rec.Code != tt.wantStatus {
+				t.Fatalf("status code = %d, want %d", rec.Code, tt.wantStatus)
+			}
+			if tt.wantStatus != http.StatusOK {
+				return
+			}
+			var res ssk.VaultEncryptResponse
+			if err := json.NewDecoder(rec.Body).Decode(&res); err != nil {
+				t.Fatal(err)
+			}
+			if res.Algorithm != tt.wantAlgo {
+				t.Errorf("algorithm = %q, want %q", res.Algorithm, tt.wantAlgo)
+			}
+		})
+	}
+}
+
+func TestEncryptHandlerTypeUnsupportedCipher(t *testing.T) {
+	mux := ssk.NewMux(&mockCipher{})
+	body, _ := json.Marshal(ssk.VaultEncryptRequest{
+		Plaintext: base64.StdEncoding.EncodeToString([]byte("data key")),
+		Type:      "aes-256-cbc",
+	})
+	req := httptest.NewRequest("PUT", "/v1/transit/encrypt/test-key", bytes.NewReader(body))
+	rec := httptest.NewRecorder()
+	mux.ServeHTTP(rec, req)
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("status code = %d, want %d", rec.Code, http.StatusBadRequest)
+	}
+}
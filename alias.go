@@ -0,0 +1,134 @@
+package ssk
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ErrKeyAlias is returned when a key alias cannot be resolved to a KMS resource ID.
+var ErrKeyAlias = errors.New("cannot resolve the key alias")
+
+// keyNamesTTL is how long the names of the KMS keys are cached for resolving aliases.
+const keyNamesTTL = time.Minute
+
+// KeyResolver is implemented by ciphers that accept key aliases in place of KMS resource IDs.
+type KeyResolver interface {
+	// ResolveKeyID returns the KMS resource ID of keyID, which is a resource ID or an alias.
+	ResolveKeyID(ctx context.Context, keyID string) (string, error)
+}
+
+var _ KeyResolver = (*SakuraKMS)(nil)
+
+// keyNames caches the names of the KMS keys.
+type keyNames struct {
+	mu        sync.Mutex
+	ids       map[string][]string
+	fetchedAt time.Time
+}
+
+// WithKeyAliases sets aliases of the KMS resource IDs, e.g. {"prod-app": "113702485493"}.
+func WithKeyAliases(aliases map[string]string) SakuraKMSOption {
+	return func(c *SakuraKMS) {
+		for alias, keyID := range aliases {
+			c.keyAliases[alias] = keyID
+		}
+	}
+}
+
+// IsKeyResourceID reports whether s is a KMS resource ID (a number such as
+// "113702485493"), not an alias.
+func IsKeyResourceID(s string) bool {
+	if s == "" {
+		return false
+	}
+	for _, r := range s {
+		if r < '0' || r > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+// ResolveKeyID returns the KMS resource ID of keyID. A resource ID is returned
+// as is, and an alias set by WithKeyAliases is replaced. Otherwise the key
+// whose ID or name is keyID is looked up with the API; the names are cached
+// for a minute.
+func (c *SakuraKMS) ResolveKeyID(ctx context.Context, keyID string) (string, error) {
+	if IsKeyResourceID(keyID) {
+		return keyID, nil
+	}
+	if id, ok := c.keyAliases[keyID]; ok {
+		return id, nil
+	}
+	ids, err := c.lookupKeyName(ctx, keyID)
+	if err != nil {
+		return "", err
+	}
+	switch len(ids) {
+	case 0:
+		return "", fmt.Errorf("%w %q: no KMS key has the name", ErrKeyAlias, keyID)
+	case 1:
+		slog.Debug("Resolved the key alias by the key name", "alias", keyID, "key_id", ids[0])
+		return ids[0], nil
+	default:
+		return "", fmt.Errorf("%w %q: multiple KMS keys have the name (%s)", ErrKeyAlias, keyID, strings.Join(ids, ", "))
+	}
+}
+
+// lookupKeyName returns the IDs of the keys whose ID or name is name.
+func (c *SakuraKMS) lookupKeyName(ctx context.Context, name string) ([]string, error) {
+	c.names.mu.Lock()
+	defer c.names.mu.Unlock()
+	if c.names.ids == nil || time.Since(c.names.fetchedAt) > keyNamesTTL {
+		keys, err := c.keyOp.List(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("failed to list the keys to resolve the key alias %q: %w", name, err)
+		}
+		c.names.ids = make(map[string][]string, len(keys))
+		for _, k := range keys {
+			c.names.ids[k.Name] = append(c.names.ids[k.Name], k.ID)
+			if k.Name != k.ID {
+				c.names.ids[k.ID] = append(c.names.ids[k.ID], k.ID)
+			}
+		}
+		c.names.fetchedAt = time.Now()
+	}
+	return c.names.ids[name], nil
+}
+
+// resolveKey wraps h to replace the key alias in the path with the resource ID,
+// if cipher is a KeyResolver.
+func resolveKey(cipher Cipher, h http.HandlerFunc) http.HandlerFunc {
+	resolver, ok := cipher.(KeyResolver)
+	if !ok {
+		return h
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		keyID, err := resolver.ResolveKeyID(r.Context(), r.PathValue(KeyIDPathParam))
+		if err != nil {
+			errorResponse(w, err, keyAliasErrorStatus(err))
+			return
+		}
+		r.SetPathValue(KeyIDPathParam, keyID)
+		h(w, r)
+	}
+}
+
+// isKeyAlias reports whether keyID is an alias to be resolved by cipher.
+func isKeyAlias(cipher Cipher, keyID string) bool {
+	_, ok := cipher.(KeyResolver)
+	return ok && !IsKeyResourceID(keyID)
+}
+
+func keyAliasErrorStatus(err error) int {
+	if errors.Is(err, ErrKeyAlias) {
+		return http.StatusBadRequest
+	}
+	return http.StatusInternalServerError
+}
@@ -0,0 +1,177 @@
+package ssk_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	ssk "github.com/fujiwara/sops-sakura-kms"
+)
+
+func TestResolveKeyID(t *testing.T) {
+	f, srv := newFakeKMS(t, "111111111111", "222222222222")
+	f.addKey("333333333333").Name = "key-222222222222" // duplicated name
+	c, err := ssk.NewSakuraKMSWithClient(newFakeKMSClient(t, srv),
+		ssk.WithKeyAliases(map[string]string{"prod-app": "111111111111"}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for keyID, want := range map[string]string{
+		"111111111111":     "111111111111",
+		"999999999999":     "999999999999", // resource IDs are not looked up
+		"prod-app":         "111111111111",
+		"key-111111111111": "111111111111",
+	} {
+		got, err := c.ResolveKeyID(t.Context(), keyID)
+		if err != nil {
+			t.Errorf("%s: %v", keyID, err)
+		} else if got != want {
+			t.Errorf("%s: resolved to %s, want %s", keyID, got, want)
+		}
+	}
+	for _, keyID := range []string{"missing", "key-222222222222"} {
+		if _, err := c.ResolveKeyID(t.Context(), keyID); !errors.Is(err, ssk.ErrKeyAlias) {
+			t.Errorf("%s: expected ErrKeyAlias, got %v", keyID, err)
+		}
+	}
+	if !ssk.IsKeyResourceID("113702485493") || ssk.IsKeyResourceID("prod-app") || ssk.IsKeyResourceID("") {
+		t.Error("IsKeyResourceID returned unexpected results")
+	}
+}
+
+func transitRequest(t *testing.T, mux http.Handler, op, keyID string, body any) *httptest.ResponseRecorder {
+	t.Helper()
+	b, _ := json.Marshal(body)
+	req := httptest.NewRequest(http.MethodPut, "/v1/transit/"+op+"/"+keyID, bytes.NewReader(b))
+	rec := httptest.NewRecorder()
+	mux.ServeHTTP(rec, req)
+	return rec
+}
+
+func TestKeyAliasServer(t *testing.T) {
+	_, srv := newFakeKMS(t, "111111111111", "222222222222")
+	client := newFakeKMSClient(t, srv)
+	newMux := func(aliases map[string]string, opts ...ssk.HandlerOption) http.Handler {
+		t.Helper()
+		c, err := ssk.NewSakuraKMSWithClient(client, ssk.WithKeyAliases(aliases))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return ssk.NewMux(c, opts...)
+	}
+
+	mux := newMux(map[string]string{"prod-app": "111111111111"}, ssk.WithAllowedKeys("111111111111"))
+	rec := transitRequest(t, mux, "encrypt", "prod-app", ssk.VaultEncryptRequest{Plaintext: "c2VjcmV0"})
+	if rec.Code != http.StatusOK {
+		t.Fatalf("encrypt: status = %d, body = %s", rec.Code, rec.Body)
+	}
+	var enc ssk.VaultEncryptResponse
+	if err := json.NewDecoder(rec.Body).Decode(&enc); err != nil {
+		t.Fatal(err)
+	}
+	ct, err := ssk.ParseCiphertext(enc.Ciphertext)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ct.KeyID != "111111111111" {
+		t.Errorf("the ciphertext records %s, want the resolved ID", ct.KeyID)
+	}
+
+	// allowed keys are checked with the resolved ID
+	rec = transitRequest(t, mux, "encrypt", "key-222222222222", ssk.VaultEncryptRequest{Plaintext: "c2VjcmV0"})
+	if rec.Code != http.StatusForbidden {
+		t.Errorf("encrypt with a key not allowed: status = %d, want 403", rec.Code)
+	}
+	rec = transitRequest(t, mux, "encrypt", "missing", ssk.VaultEncryptRequest{Plaintext: "c2VjcmV0"})
+	if rec.Code != http.StatusBadRequest || !strings.Contains(rec.Body.String(), "missing") {
+		t.Errorf("encrypt with an unknown alias: status = %d, body = %s", rec.Code, rec.Body)
+	}
+
+	// the alias now points to another key, but the ciphertext is decrypted with the recorded key
+	mux = newMux(map[string]string{"prod-app": "222222222222"})
+	rec = transitRequest(t, mux, "decrypt", "prod-app", ssk.VaultDecryptRequest{Ciphertext: enc.Ciphertext})
+	if rec.Code != http.StatusOK {
+		t.Fatalf("decrypt after changing the alias: status = %d, body = %s", rec.Code, rec.Body)
+	}
+	var dec ssk.VaultDecryptResponse
+	if err := json.NewDecoder(rec.Body).Decode(&dec); err != nil {
+		t.Fatal(err)
+	}
+	if dec.Plaintext != "c2VjcmV0" {
+		t.Errorf("plaintext = %s", dec.Plaintext)
+	}
+
+	// a removed alias does not break decryption either
+	rec = transitRequest(t, mux, "decrypt", "removed-app", ssk.VaultDecryptRequest{Ciphertext: enc.Ciphertext})
+	if rec.Code != http.StatusOK {
+		t.Errorf("decrypt with a removed alias: status = %d, body = %s", rec.Code, rec.Body)
+	}
+
+	// allowed keys are checked with the recorded key
+	mux = newMux(map[string]string{"prod-app": "222222222222"}, ssk.WithAllowedKeys("222222222222"))
+	rec = transitRequest(t, mux, "decrypt", "prod-app", ssk.VaultDecryptRequest{Ciphertext: enc.Ciphertext})
+	if rec.Code != http.StatusForbidden {
+		t.Errorf("decrypt with the recorded key not allowed: status = %d, want 403", rec.Code)
+	}
+
+	// a resource ID in the path is still checked against the ciphertext
+	rec = transitRequest(t, mux, "decrypt", "222222222222", ssk.VaultDecryptRequest{Ciphertext: enc.Ciphertext})
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("decrypt with another resource ID: status = %d, want 400", rec.Code)
+	}
+}
+
+func TestKeyAliasEnv(t *testing.T) {
+	_, srv := newFakeKMS(t, "111111111111")
+	setFakeKMSEnv(t, srv.URL)
+	t.Setenv("SAKURA_KMS_KEY_ID", "prod-app")
+	t.Setenv("SSK_KEY_ALIASES", "prod-app=111111111111")
+	t.Setenv("SSK_CONFIRM_KEYS", "prod-app")
+
+	env, shutdown, err := ssk.RunServer(context.Background(), freeAddr(t), "prod-app",
+		ssk.WithKMSOptions(ssk.WithKeyAliases(map[string]string{"prod-app": "111111111111"})), ssk.WithHandlerOptions(ssk.WithAllowedKeys("111111111111")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer shutdown(context.Background())
+	if !strings.HasSuffix(env["SOPS_VAULT_URIS"], "/encrypt/prod-app") {
+		t.Errorf("SOPS_VAULT_URIS = %s", env["SOPS_VAULT_URIS"])
+	}
+	if code := encryptStatus(t, env["VAULT_ADDR"], "prod-app"); code != http.StatusOK {
+		t.Errorf("encrypt: status = %d", code)
+	}
+
+	e, err := ssk.LoadEnv()
+	if err != nil {
+		t.Fatal(err)
+	}
+	kmsOpts, err := e.KMSOptions()
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := ssk.NewSakuraKMS(kmsOpts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := c.Preflight(t.Context(), e.KMSKeyID, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if key.ID != "111111111111" {
+		t.Errorf("preflight checked %s", key.ID)
+	}
+	// the policies use the resource IDs of the aliases in SSK_KEY_ALIASES
+	if p, err := e.ConfirmPolicy(); err != nil || p.KeyIDs[0] != "111111111111" {
+		t.Errorf("unexpected confirm policy: %+v, %v", p, err)
+	}
+	_, err = c.Preflight(t.Context(), "missing", false)
+	var pe *ssk.PreflightError
+	if !errors.As(err, &pe) || pe.Check != "alias" {
+		t.Errorf("expected an alias preflight error, got %v", err)
+	}
+}
@@ -0,0 +1,91 @@
+package ssk_test
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	ssk "github.com/fujiwara/sops-sakura-kms"
+)
+
+const benchKeyID = "113702485493"
+
+// newBenchMux returns a Vault-compatible mux backed by SakuraKMS talking
+// to a local fake KMS server, so the whole handler + cipher path
+// including HTTP round-trips to KMS is measured.
+func newBenchMux(b *testing.B) http.Handler {
+	b.Helper()
+	_, srv := newFakeKMS(b, benchKeyID)
+	c, err := ssk.NewSakuraKMSWithClient(newFakeKMSClient(b, srv))
+	if err != nil {
+		b.Fatal(err)
+	}
+	return ssk.NewMux(c)
+}
+
+func benchRequest(b *testing.B, mux http.Handler, path string, body any) []byte {
+	b.Helper()
+	reqBody, err := json.Marshal(body)
+	if err != nil {
+		b.Fatal(err)
+	}
+	req := httptest.NewRequest("PUT", path, bytes.NewReader(reqBody))
+	rec := httptest.NewRecorder()
+	mux.ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK {
+		b.Fatalf("status code = %d, body = %s", rec.Code, rec.Body.String())
+	}
+	return rec.Body.Bytes()
+}
+
+// dataKey is the size of a SOPS data key.
+var dataKey = base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{0x42}, 32))
+
+func BenchmarkEncryptHandler(b *testing.B) {
+	mux := newBenchMux(b)
+	req := ssk.VaultEncryptRequest{Plaintext: dataKey}
+	for b.Loop() {
+		benchRequest(b, mux, "/v1/transit/encrypt/"+benchKeyID, req)
+	}
+}
+
+func BenchmarkDecryptHandler(b *testing.B) {
+	mux := newBenchMux(b)
+	var enc ssk.VaultEncryptResponse
+	res := benchRequest(b, mux, "/v1/transit/encrypt/"+benchKeyID, ssk.VaultEncryptRequest{Plaintext: dataKey})
+	if err := json.Unmarshal(res, &enc); err != nil {
+		b.Fatal(err)
+	}
+	req := ssk.VaultDecryptRequest{Ciphertext: enc.Ciphertext}
+	for b.Loop() {
+		benchRequest(b, mux, "/v1/transit/decrypt/"+benchKeyID, req)
+	}
+}
+
+func BenchmarkEncryptHandlerParallel(b *testing.B) {
+	mux := newBenchMux(b)
+	req := ssk.VaultEncryptRequest{Plaintext: dataKey}
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			benchRequest(b, mux, "/v1/transit/encrypt/"+benchKeyID, req)
+		}
+	})
+}
+
+func BenchmarkDecryptHandlerParallel(b *testing.B) {
+	mux := newBenchMux(b)
+	var enc ssk.VaultEncryptResponse
+	res := benchRequest(b, mux, "/v1/transit/encrypt/"+benchKeyID, ssk.VaultEncryptRequest{Plaintext: dataKey})
+	if err := json.Unmarshal(res, &enc); err != nil {
+		b.Fatal(err)
+	}
+	req := ssk.VaultDecryptRequest{Ciphertext: enc.Ciphertext}
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			benchRequest(b, mux, "/v1/transit/decrypt/"+benchKeyID, req)
+		}
+	})
+}
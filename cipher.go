@@ -20,51 +20,160 @@ type Cipher interface {
 	Decrypt(ctx context.Context, keyID string, ciphertext string) ([]byte, error)
 }
 
+// AlgorithmCipher is implemented by ciphers that can encrypt with a caller-selected algorithm.
+type AlgorithmCipher interface {
+	Cipher
+	// EncryptWithAlgorithm encrypts plaintext using the specified key ID and algorithm.
+	// If algo is empty, the algorithm configured for the key is used.
+	// Returns base64-encoded ciphertext string and the algorithm actually used.
+	EncryptWithAlgorithm(ctx context.Context, keyID string, plaintext []byte, algo v1.KeyEncryptAlgoEnum) (string, v1.KeyEncryptAlgoEnum, error)
+}
+
 // SakuraKMS implements Cipher interface using Sakura Cloud KMS.
+// It holds a single long-lived KMS client with a keep-alive HTTP transport
+// that keeps up to kmsMaxIdleConnsPerHost idle connections, so that the
+// connections are reused across requests, including parallel ones.
+// SakuraKMS is safe for concurrent use by multiple goroutines.
 type SakuraKMS struct {
-	client *v1.Client
+	keyOp         kms.KeyAPI
+	algorithm     v1.KeyEncryptAlgoEnum
+	keyAlgorithms map[string]v1.KeyEncryptAlgoEnum
+	keyAliases    map[string]string
+	names         keyNames
+
+	credentialProcess *credentialProcess
+	credentials       *Credentials
+	profile           string
+	profileDir        string
+}
+
+var _ AlgorithmCipher = (*SakuraKMS)(nil)
+
+// SakuraKMSOption is a functional option for NewSakuraKMS and NewSakuraKMSWithClient.
+type SakuraKMSOption func(*SakuraKMS)
+
+// WithAlgorithm sets the default encryption algorithm. The default is AES-256-GCM.
+func WithAlgorithm(algo v1.KeyEncryptAlgoEnum) SakuraKMSOption {
+	return func(c *SakuraKMS) {
+		c.algorithm = algo
+	}
+}
+
+// WithKeyAlgorithms sets encryption algorithms per key ID.
+// These take precedence over the default algorithm.
+func WithKeyAlgorithms(m map[string]v1.KeyEncryptAlgoEnum) SakuraKMSOption {
+	return func(c *SakuraKMS) {
+		for keyID, algo := range m {
+			c.keyAlgorithms[keyID] = algo
+		}
+	}
 }
 
 // NewSakuraKMS creates a new SakuraKMS instance.
-// It reads credentials from environment variables (SAKURACLOUD_ACCESS_TOKEN, SAKURACLOUD_ACCESS_TOKEN_SECRET).
-func NewSakuraKMS() (*SakuraKMS, error) {
+// It reads credentials from WithCredentials, environment variables
+// (SAKURACLOUD_ACCESS_TOKEN, SAKURACLOUD_ACCESS_TOKEN_SECRET) or the profile.
+func NewSakuraKMS(opts ...SakuraKMSOption) (*SakuraKMS, error) {
+	k := newSakuraKMS(opts...)
 	var sc saclient.Client
-	sc.SetEnviron(os.Environ())
+	sc.SetEnviron(k.environ(os.Environ()))
 	if err := sc.Populate(); err != nil {
 		return nil, fmt.Errorf("failed to configure saclient: %w", err)
 	}
-	return newSakuraKMSFromClient(&sc)
+	return k.setClient(&sc)
 }
 
 // NewSakuraKMSWithClient creates a new SakuraKMS instance with the given saclient.ClientAPI.
-func NewSakuraKMSWithClient(c saclient.ClientAPI) (*SakuraKMS, error) {
-	return newSakuraKMSFromClient(c)
+// WithProfile is ignored, as the client is already configured.
+func NewSakuraKMSWithClient(c saclient.ClientAPI, opts ...SakuraKMSOption) (*SakuraKMS, error) {
+	return newSakuraKMS(opts...).setClient(c)
+}
+
+func newSakuraKMS(opts ...SakuraKMSOption) *SakuraKMS {
+	k := &SakuraKMS{
+		algorithm:     DefaultAlgorithm,
+		keyAlgorithms: make(map[string]v1.KeyEncryptAlgoEnum),
+		keyAliases:    make(map[string]string),
+	}
+	for _, opt := range opts {
+		opt(k)
+	}
+	return k
 }
 
-func newSakuraKMSFromClient(c saclient.ClientAPI) (*SakuraKMS, error) {
+func (k *SakuraKMS) setClient(c saclient.ClientAPI) (*SakuraKMS, error) {
+	middlewares := []saclient.Middleware{newKMSTransport(c).middleware}
+	switch {
+	case k.credentialProcess != nil:
+		middlewares = append(middlewares, k.credentialProcess.middleware)
+	case k.credentials != nil:
+		middlewares = append(middlewares, k.credentials.middleware)
+	}
+	// a copy of the client is not populated yet, so that the middlewares can be added
+	c = c.Dup()
+	oc, ok := c.(saclient.ClientOptionAPI)
+	if !ok {
+		return nil, fmt.Errorf("the client does not support middlewares")
+	}
+	if err := oc.SetWith(saclient.WithMiddleware(middlewares...)); err != nil {
+		return nil, fmt.Errorf("failed to configure the client: %w", err)
+	}
 	client, err := kms.NewClient(c)
 	if err != nil {
 		return nil, err
 	}
-	return &SakuraKMS{
-		client: client,
-	}, nil
+	k.keyOp = kms.NewKeyOp(client)
+	return k, nil
+}
+
+// Keys returns the key management API of the KMS client.
+func (c *SakuraKMS) Keys() kms.KeyAPI {
+	return c.keyOp
+}
+
+// Algorithm returns the encryption algorithm configured for the key ID.
+func (c *SakuraKMS) Algorithm(keyID string) v1.KeyEncryptAlgoEnum {
+	if algo, ok := c.keyAlgorithms[keyID]; ok {
+		return algo
+	}
+	return c.algorithm
 }
 
-// Encrypt encrypts plaintext using Sakura Cloud KMS with AES-256-GCM algorithm.
+// Encrypt encrypts plaintext using Sakura Cloud KMS with the algorithm configured for the key.
 func (c *SakuraKMS) Encrypt(ctx context.Context, keyID string, plaintext []byte) (string, error) {
-	keyOp := kms.NewKeyOp(c.client)
-	ciphertext, err := keyOp.Encrypt(ctx, keyID, plaintext, v1.KeyEncryptAlgoEnumAes256Gcm)
+	ciphertext, _, err := c.EncryptWithAlgorithm(ctx, keyID, plaintext, "")
+	return ciphertext, err
+}
+
+// EncryptWithAlgorithm encrypts plaintext using Sakura Cloud KMS with the given algorithm.
+// If algo is empty, the algorithm configured for the key is used.
+// A key alias is resolved by ResolveKeyID, and the ciphertext records the resource ID.
+func (c *SakuraKMS) EncryptWithAlgorithm(ctx context.Context, keyID string, plaintext []byte, algo v1.KeyEncryptAlgoEnum) (string, v1.KeyEncryptAlgoEnum, error) {
+	keyID, err := c.ResolveKeyID(ctx, keyID)
 	if err != nil {
-		return "", fmt.Errorf("failed to encrypt: %w", err)
+		return "", "", err
+	}
+	if algo == "" {
+		algo = c.Algorithm(keyID)
 	}
-	return ciphertext, nil
+	ciphertext, err := c.keyOp.Encrypt(ctx, keyID, plaintext, algo)
+	if err != nil {
+		return "", "", fmt.Errorf("failed to encrypt: %w", err)
+	}
+	return ciphertext, algo, nil
 }
 
 // Decrypt decrypts ciphertext using Sakura Cloud KMS.
+// If keyID is an alias, the resource ID recorded in the ciphertext is used,
+// so that changing the alias does not break decryption.
 func (c *SakuraKMS) Decrypt(ctx context.Context, keyID string, ciphertext string) ([]byte, error) {
-	keyOp := kms.NewKeyOp(c.client)
-	plaintext, err := keyOp.Decrypt(ctx, keyID, ciphertext)
+	if !IsKeyResourceID(keyID) {
+		if ct, err := ParseCiphertext(ciphertext); err == nil {
+			keyID = ct.KeyID
+		} else if keyID, err = c.ResolveKeyID(ctx, keyID); err != nil {
+			return nil, err
+		}
+	}
+	plaintext, err := c.keyOp.Decrypt(ctx, keyID, ciphertext)
 	if err != nil {
 		return nil, fmt.Errorf("failed to decrypt: %w", err)
 	}
@@ -0,0 +1,84 @@
+package ssk
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// ErrNotKMSCiphertext is returned by ParseCiphertext when the input is not
+// a Sakura Cloud KMS ciphertext blob.
+var ErrNotKMSCiphertext = errors.New("not a Sakura Cloud KMS ciphertext")
+
+// Ciphertext is the decoded metadata of a Sakura Cloud KMS ciphertext blob.
+//
+// Sakura Cloud KMS returns ciphertexts as base64-encoded MessagePack documents
+// that embed the algorithm and the key used, so they can be inspected
+// offline without calling the KMS API.
+type Ciphertext struct {
+	// Algorithm is the encryption algorithm (e.g. "aes-256-gcm").
+	Algorithm string `json:"algorithm"`
+	// KeyID is the KMS resource ID of the key.
+	KeyID string `json:"key_id"`
+	// KeyVersion is the version of the key used for encryption.
+	KeyVersion int64 `json:"key_version"`
+	// WrappedKey is the wrapped data encryption key, opaque to clients.
+	WrappedKey string `json:"-"`
+	// Value is the encrypted payload.
+	Value []byte `json:"-"`
+}
+
+// ParseCiphertext parses a Sakura Cloud KMS ciphertext blob.
+// The "vault:v1:" prefix is stripped if present.
+// It returns an error wrapping ErrNotKMSCiphertext if s is not a KMS blob.
+func ParseCiphertext(s string) (*Ciphertext, error) {
+	s = strings.TrimPrefix(s, VaultPrefix)
+	b, err := base64.StdEncoding.DecodeString(s)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrNotKMSCiphertext, err)
+	}
+	v, err := decodeMsgpack(b)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrNotKMSCiphertext, err)
+	}
+	doc, ok := v.(map[string]any)
+	if !ok {
+		return nil, fmt.Errorf("%w: top level is %T, not a map", ErrNotKMSCiphertext, v)
+	}
+	key, ok := doc["key"].(map[string]any)
+	if !ok {
+		return nil, fmt.Errorf("%w: missing key", ErrNotKMSCiphertext)
+	}
+	ct := &Ciphertext{}
+	if ct.KeyID, ok = key["id"].(string); !ok || ct.KeyID == "" {
+		return nil, fmt.Errorf("%w: missing key.id", ErrNotKMSCiphertext)
+	}
+	if ct.KeyVersion, ok = key["kv"].(int64); !ok {
+		return nil, fmt.Errorf("%w: missing key.kv", ErrNotKMSCiphertext)
+	}
+	ct.WrappedKey, _ = key["cip"].(string)
+	ct.Algorithm, _ = doc["alg"].(string)
+	ct.Value, _ = doc["val"].([]byte)
+	return ct, nil
+}
+
+// KeyIDMismatchMode controls how the decrypt endpoint handles a request
+// whose path key ID differs from the key ID embedded in the ciphertext.
+type KeyIDMismatchMode string
+
+const (
+	// KeyIDMismatchReject rejects the request with 400 Bad Request.
+	KeyIDMismatchReject KeyIDMismatchMode = "reject"
+	// KeyIDMismatchCorrect decrypts with the key ID embedded in the ciphertext.
+	KeyIDMismatchCorrect KeyIDMismatchMode = "correct"
+)
+
+// ParseKeyIDMismatchMode parses a KeyIDMismatchMode ("reject" or "correct").
+func ParseKeyIDMismatchMode(s string) (KeyIDMismatchMode, error) {
+	switch m := KeyIDMismatchMode(strings.ToLower(strings.TrimSpace(s))); m {
+	case KeyIDMismatchReject, KeyIDMismatchCorrect:
+		return m, nil
+	}
+	return "", fmt.Errorf("invalid key ID mismatch mode %q (must be %s or %s)", s, KeyIDMismatchReject, KeyIDMismatchCorrect)
+}
@@ -0,0 +1,121 @@
+package ssk_test
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	ssk "github.com/fujiwara/sops-sakura-kms"
+)
+
+// testCiphertext is the hc_vault enc value from test.enc.yml.
+const testCiphertext = "vault:v1:g6NhbGerYWVzLTI1Ni1nY22ja2V5g6JpZKwxMTM3MDI0ODU0OTOia3YAo2NpcNl3c29zOnYxOmc2UmliRzlpeENCendsRmdKckVnWkFrQXp6VXhPVnhsb2NiR1R5NGg5eTNTdFpnNHpjVE43S0pwZHNRUVE3WDFYMkRXcG1SWjE4YWdHRG5zNWFOMFlXZkVFSE5Fc2UrSmtXbWp1RDlpVjM1bmF2az2jdmFsxFB5MHaQRGHEoAofXCu/ZOnVxaaSUOmp/E2hwtOjueKAFRGxxf1n2tbHebWOi89KE5oUfByENdnGqliU1etZNS/Iv14iyjvREBzIg5sxokYXZA=="
+
+func TestParseCiphertext(t *testing.T) {
+	ct, err := ssk.ParseCiphertext(testCiphertext)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ct.KeyID != "113702485493" {
+		t.Errorf("KeyID = %q, want %q", ct.KeyID, "113702485493")
+	}
+	if ct.KeyVersion != 0 {
+		t.Errorf("KeyVersion = %d, want 0", ct.KeyVersion)
+	}
+	if ct.Algorithm != "aes-256-gcm" {
+		t.Errorf("Algorithm = %q, want %q", ct.Algorithm, "aes-256-gcm")
+	}
+	if len(ct.Value) != 80 {
+		t.Errorf("len(Value) = %d, want 80", len(ct.Value))
+	}
+	if ct.WrappedKey == "" {
+		t.Error("WrappedKey is empty")
+	}
+}
+
+func TestParseCiphertextFake(t *testing.T) {
+	blob := fakeCiphertext("aes-256-cbc", "123456789012", 3, []byte("plain"))
+	ct, err := ssk.ParseCiphertext(blob)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ct.KeyID != "123456789012" || ct.KeyVersion != 3 || ct.Algorithm != "aes-256-cbc" || string(ct.Value) != "plain" {
+		t.Errorf("unexpected ciphertext: %+v", ct)
+	}
+}
+
+func TestParseCiphertextInvalid(t *testing.T) {
+	for _, s := range []string{
+		"",
+		"not base64!",
+		base64.StdEncoding.EncodeToString([]byte("Hello, World!")),
+		base64.StdEncoding.EncodeToString([]byte{0x81, 0xa3, 'k', 'e', 'y', 0x80}), // {"key": {}}
+		testCiphertext[:len(testCiphertext)-8],
+		base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{0x91}, 1<<20)), // deeply nested arrays
+	} {
+		_, err := ssk.ParseCiphertext(s)
+		if !errors.Is(err, ssk.ErrNotKMSCiphertext) {
+			t.Errorf("ParseCiphertext(%q) error = %v, want ErrNotKMSCiphertext", s, err)
+		}
+	}
+}
+
+func TestDecryptHandlerKeyIDMismatch(t *testing.T) {
+	_, srv := newFakeKMS(t, "111111111111", "222222222222")
+	c, err := ssk.NewSakuraKMSWithClient(newFakeKMSClient(t, srv))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ciphertext, err := c.Encrypt(t.Context(), "111111111111", []byte("data key"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := json.Marshal(ssk.VaultDecryptRequest{Ciphertext: ssk.VaultPrefix + ciphertext})
+
+	tests := []struct {
+		name       string
+		opts       []ssk.HandlerOption
+		keyID      string
+		wantStatus int
+	}{
+		{name: "matching key ID", keyID: "111111111111", wantStatus: http.StatusOK},
+		{name: "mismatch rejected by default", keyID: "222222222222", wantStatus: http.StatusBadRequest},
+		{name: "mismatch corrected", opts: []ssk.HandlerOption{ssk.WithKeyIDMismatch(ssk.KeyIDMismatchCorrect)}, keyID: "222222222222", wantStatus: http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mux := ssk.NewMux(c, tt.opts...)
+			req := httptest.NewRequest("PUT", "/v1/transit/decrypt/"+tt.keyID, bytes.NewReader(body))
+			rec := httptest.NewRecorder()
+			mux.ServeHTTP(rec, req)
+			if rec.Code != tt.wantStatus {
+				t.Fatalf("status code = %d, want %d: %s", rec.Code, tt.wantStatus, rec.Body.String())
+			}
+			if tt.wantStatus != http.StatusOK {
+				return
+			}
+			var res ssk.VaultDecryptResponse
+			if err := json.NewDecoder(rec.Body).Decode(&res); err != nil {
+				t.Fatal(err)
+			}
+			if want := base64.StdEncoding.EncodeToString([]byte("data key")); res.Plaintext != want {
+				t.Errorf("plaintext = %q, want %q", res.Plaintext, want)
+			}
+		})
+	}
+}
+
+func TestParseKeyIDMismatchMode(t *testing.T) {
+	for _, s := range []string{"reject", "Correct"} {
+		if _, err := ssk.ParseKeyIDMismatchMode(s); err != nil {
+			t.Errorf("ParseKeyIDMismatchMode(%q) unexpected error: %v", s, err)
+		}
+	}
+	if _, err := ssk.ParseKeyIDMismatchMode("ignore"); err == nil {
+		t.Error("ParseKeyIDMismatchMode(ignore) expected error, got nil")
+	}
+}
@@ -0,0 +1,143 @@
+package ssk
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+)
+
+// Subcommand is a subcommand of the sops-sakura-kms CLI.
+type Subcommand struct {
+	// Name is the name of the subcommand.
+	Name string
+	// Summary is a one-line description of the subcommand.
+	Summary string
+	// Run runs the subcommand with the arguments following its name.
+	Run func(ctx context.Context, args []string, w io.Writer) (int, error)
+}
+
+// Subcommands returns the reserved subcommands of the CLI.
+// Any other first argument is passed through to the wrapped command (sops).
+func Subcommands() []Subcommand {
+	return []Subcommand{
+		{Name: "server", Summary: "run the Vault-compatible API server only", Run: runServerCommand},
+		{Name: "agent", Summary: "start the server in the background and print the shell statements to use it", Run: RunAgent},
+		{Name: "exec", Summary: "run the server and execute the command with the given arguments", Run: runExecCommand},
+		{Name: "version", Summary: "show the versions of sops-sakura-kms and sops", Run: runVersionCommand},
+		{Name: "config", Summary: "show the effective configuration and where each value comes from", Run: RunConfig},
+		{Name: "doctor", Summary: "diagnose the setup", Run: RunDoctor},
+		{Name: "init", Summary: "generate or update creation rules of .sops.yaml", Run: RunInit},
+		{Name: "migrate", Summary: "add a Sakura Cloud KMS key to SOPS files in a directory tree", Run: RunMigrate},
+		{Name: "rotate-all", Summary: "rotate the data keys of SOPS files in parallel through a single server", Run: RunRotateAll},
+		{Name: "rewrite-address", Summary: "rewrite the vault_address of Sakura Cloud KMS entries in SOPS files", Run: RunRewriteAddress},
+		{Name: "verify", Summary: "check that SOPS files are decryptable, for CI", Run: RunVerify},
+		{Name: "lint", Summary: "check encrypted files and .sops.yaml against a policy", Run: RunLint},
+		{Name: "export", Summary: "decrypt a file and print its values as dotenv, shell, JSON or GitHub Actions variables", Run: RunExport},
+		{Name: "keys", Summary: "manage Sakura Cloud KMS keys", Run: RunKeys},
+		{Name: "encrypt-file", Summary: "encrypt a file or stream with envelope encryption", Run: RunEncryptFile},
+		{Name: "decrypt-file", Summary: "decrypt a file or stream encrypted by encrypt-file", Run: RunDecryptFile},
+		{Name: "inspect", Summary: "show the keys protecting encrypted files or ciphertexts", Run: RunInspect},
+	}
+}
+
+// RunCLI runs the sops-sakura-kms command line.
+//
+// If the first argument is a reserved subcommand, the subcommand is run.
+// Otherwise (or after a leading "--"), all arguments are passed through
+// to the wrapped command as RunWrapper does.
+func RunCLI(ctx context.Context, args []string, w io.Writer) (int, error) {
+	if len(args) == 0 {
+		return RunWrapper(ctx, args)
+	}
+	if args[0] == "--" {
+		return RunWrapper(ctx, args[1:])
+	}
+	for _, sub := range Subcommands() {
+		if sub.Name == args[0] {
+			return sub.Run(ctx, args[1:], w)
+		}
+	}
+	// Handle --version flag
+	for _, arg := range args {
+		if arg == "--version" || arg == "-version" {
+			return ShowVersion(ctx, w)
+		}
+	}
+	return RunWrapper(ctx, args)
+}
+
+// envFlagSet returns a flag set with the flags of Env, loaded from environment variables.
+func envFlagSet(name, usage string) (*flag.FlagSet, *Env, error) {
+	e, err := LoadEnv()
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to load environment variables: %w", err)
+	}
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	e.RegisterFlags(fs)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: sops-sakura-kms %s\n", usage)
+		fs.PrintDefaults()
+	}
+	return fs, e, nil
+}
+
+func runServerCommand(ctx context.Context, args []string, w io.Writer) (int, error) {
+	fs, e, err := envFlagSet("server", "server [options]")
+	if err != nil {
+		return ExitCodeError, err
+	}
+	if err := fs.Parse(args); err != nil {
+		return ExitCodeError, err
+	}
+	if fs.NArg() > 0 {
+		fs.Usage()
+		return ExitCodeError, fmt.Errorf("unexpected arguments: %v", fs.Args())
+	}
+	e.ServerOnly = true
+	load := reloadEnvFlags("server", "server [options]", args, func(e *Env) { e.ServerOnly = true })
+	return runWrapper(ctx, e, nil, load)
+}
+
+// reloadEnvFlags returns a function that loads the Env again with the same
+// flags, so that the settings of the flags are kept on reload. set is called
+// on the loaded Env, if not nil.
+func reloadEnvFlags(name, usage string, args []string, set func(*Env)) func() (*Env, error) {
+	return func() (*Env, error) {
+		fs, e, err := envFlagSet(name, usage)
+		if err != nil {
+			return nil, err
+		}
+		fs.SetOutput(io.Discard)
+		if err := fs.Parse(args); err != nil {
+			return nil, err
+		}
+		if set != nil {
+			set(e)
+		}
+		return e, nil
+	}
+}
+
+func runExecCommand(ctx context.Context, args []string, w io.Writer) (int, error) {
+	fs, e, err := envFlagSet("exec", "exec [options] [--] [command arguments...]")
+	if err != nil {
+		return ExitCodeError, err
+	}
+	if err := fs.Parse(args); err != nil {
+		return ExitCodeError, err
+	}
+	load := reloadEnvFlags("exec", "exec [options] [--] [command arguments...]", args, nil)
+	return runWrapper(ctx, e, fs.Args(), load)
+}
+
+func runVersionCommand(ctx context.Context, args []string, w io.Writer) (int, error) {
+	fs, e, err := envFlagSet("version", "version [options]")
+	if err != nil {
+		return ExitCodeError, err
+	}
+	if err := fs.Parse(args); err != nil {
+		return ExitCodeError, err
+	}
+	return ShowVersionWithEnv(ctx, e, w)
+}
@@ -0,0 +1,115 @@
+package ssk_test
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	ssk "github.com/fujiwara/sops-sakura-kms"
+)
+
+func TestRunCLIPassThrough(t *testing.T) {
+	t.Setenv("SAKURA_KMS_KEY_ID", "")
+	t.Setenv("SSK_COMMAND", "sh")
+	tests := []struct {
+		name string
+		args []string
+		want int
+	}{
+		{name: "not a subcommand", args: []string{"-c", "exit 3"}, want: 3},
+		{name: "after --", args: []string{"--", "-c", "exit 4"}, want: 4},
+		{name: "exec", args: []string{"exec", "--", "-c", "exit 5"}, want: 5},
+		{name: "exec with flags", args: []string{"exec", "--command", "sh", "--key-id", "", "--", "-c", "exit 6"}, want: 6},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			code, err := ssk.RunCLI(context.Background(), tt.args, &bytes.Buffer{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if code != tt.want {
+				t.Errorf("exit code = %d, want %d", code, tt.want)
+			}
+		})
+	}
+}
+
+func TestRunCLIFlagOverridesEnv(t *testing.T) {
+	t.Setenv("SAKURA_KMS_KEY_ID", "")
+	t.Setenv("SSK_COMMAND", "false")
+	code, err := ssk.RunCLI(context.Background(), []string{"exec", "-command", "true"}, &bytes.Buffer{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if code != 0 {
+		t.Errorf("exit code = %d, want 0 (flag should override SSK_COMMAND)", code)
+	}
+}
+
+func TestRunCLIUnknownFlag(t *testing.T) {
+	code, err := ssk.RunCLI(context.Background(), []string{"exec", "--no-such-flag"}, &bytes.Buffer{})
+	if err == nil {
+		t.Fatal("expected an error for an unknown flag")
+	}
+	if code != ssk.ExitCodeError {
+		t.Errorf("exit code = %d, want %d", code, ssk.ExitCodeError)
+	}
+}
+
+func TestRunCLIVersion(t *testing.T) {
+	sops := writeFakeSOPS(t, "3.10.2")
+	for _, args := range [][]string{
+		{"version", "--command", sops},
+		{"--command=" + sops, "--version"},
+	} {
+		t.Setenv("SSK_COMMAND", sops)
+		var buf bytes.Buffer
+		code, err := ssk.RunCLI(context.Background(), args, &buf)
+		if err != nil || code != 0 {
+			t.Fatalf("%v: RunCLI = %d, %v", args, code, err)
+		}
+		out := buf.String()
+		if !strings.Contains(out, "sops 3.10.2") || !strings.Contains(out, "sops-sakura-kms version "+ssk.Version) {
+			t.Errorf("%v: unexpected output: %s", args, out)
+		}
+	}
+}
+
+func TestRunCLIServer(t *testing.T) {
+	t.Setenv("SAKURA_KMS_KEY_ID", "")
+	addr := freeAddr(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	done := make(chan int)
+	go func() {
+		code, err := ssk.RunCLI(ctx, []string{"server", "--server-addr", addr}, &bytes.Buffer{})
+		if err != nil {
+			t.Error(err)
+		}
+		done <- code
+	}()
+
+	healthy := false
+	for range 50 {
+		resp, err := http.Get("http://" + addr + "/health")
+		if err == nil {
+			resp.Body.Close()
+			healthy = resp.StatusCode == http.StatusOK
+			break
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	if !healthy {
+		t.Error("server did not become healthy")
+	}
+	// let RunWrapper finish its own startup health check before shutting down
+	time.Sleep(500 * time.Millisecond)
+	cancel()
+	if code := <-done; code != 0 {
+		t.Errorf("exit code = %d, want 0", code)
+	}
+}
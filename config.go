@@ -0,0 +1,295 @@
+package ssk
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"reflect"
+	"text/tabwriter"
+
+	"github.com/BurntSushi/toml"
+	"go.yaml.in/yaml/v3"
+)
+
+// ProjectConfigFile is the name of the project-level configuration file,
+// looked up in the current directory and its parents.
+const ProjectConfigFile = ".sops-sakura-kms.yaml"
+
+// ProjectConfigFileTOML is the name of the project-level configuration file in TOML.
+const ProjectConfigFileTOML = ".sops-sakura-kms.toml"
+
+const configUsage = `Usage: sops-sakura-kms config <command> [options]
+
+Commands:
+  show      show the effective configuration and the source of each value
+
+Run 'sops-sakura-kms config <command> -h' for the options of a command.
+`
+
+// configFile is a loaded configuration file.
+type configFile struct {
+	path   string
+	values map[string]yaml.Node
+}
+
+// UserConfigFile returns the path of the user-level configuration file,
+// $XDG_CONFIG_HOME/sops-sakura-kms/config.yaml or ~/.config/sops-sakura-kms/config.yaml.
+// config.toml in the same directory can be used instead.
+func UserConfigFile() (string, error) {
+	dir := os.Getenv("XDG_CONFIG_HOME")
+	if dir == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return "", err
+		}
+		dir = filepath.Join(home, ".config")
+	}
+	return filepath.Join(dir, "sops-sakura-kms", "config.yaml"), nil
+}
+
+// findConfigFile returns the path of the file in dir with one of names.
+// It returns an empty string if none exists, and an error if more than one exist,
+// as it is not clear which is used.
+func findConfigFile(dir string, names ...string) (string, error) {
+	var found string
+	for _, name := range names {
+		path := filepath.Join(dir, name)
+		if _, err := os.Stat(path); errors.Is(err, fs.ErrNotExist) {
+			continue
+		} else if err != nil {
+			return "", err
+		}
+		if found != "" {
+			return "", fmt.Errorf("both %s and %s exist; remove one of them", found, path)
+		}
+		found = path
+	}
+	return found, nil
+}
+
+// findProjectConfig looks for ProjectConfigFile or ProjectConfigFileTOML in dir
+// and its parents. It returns an empty string if not found.
+func findProjectConfig(dir string) (string, error) {
+	for {
+		path, err := findConfigFile(dir, ProjectConfigFile, ProjectConfigFileTOML)
+		if err != nil || path != "" {
+			return path, err
+		}
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return "", nil
+		}
+		dir = parent
+	}
+}
+
+// configFilePaths returns the paths of the user-level and the project-level
+// configuration files. A path is empty if the file does not exist.
+func configFilePaths() (user, project string, err error) {
+	if path, err := UserConfigFile(); err == nil {
+		user, err = findConfigFile(filepath.Dir(path), "config.yaml", "config.toml")
+		if err != nil {
+			return "", "", err
+		}
+	}
+	wd, err := os.Getwd()
+	if err != nil {
+		return "", "", err
+	}
+	project, err = findProjectConfig(wd)
+	if err != nil {
+		return "", "", err
+	}
+	if project == user {
+		project = ""
+	}
+	return user, project, nil
+}
+
+// loadConfigFiles reads the configuration files in order of increasing precedence:
+// the user-level file, then the project-level file.
+func loadConfigFiles() ([]configFile, error) {
+	user, project, err := configFilePaths()
+	if err != nil {
+		return nil, fmt.Errorf("failed to find the configuration files: %w", err)
+	}
+	var files []configFile
+	for _, path := range []string{user, project} {
+		if path == "" {
+			continue
+		}
+		f, err := loadConfigFile(path, path == project)
+		if err != nil {
+			return nil, err
+		}
+		files = append(files, *f)
+	}
+	return files, nil
+}
+
+// loadConfigFile reads a configuration file. Unknown keys are an error,
+// so that a misspelled key is not silently ignored. A project-level file may
+// only set the fields with the "project" tag.
+func loadConfigFile(path string, project bool) (*configFile, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %s: %w", path, err)
+	}
+	f := &configFile{path: path}
+	if filepath.Ext(path) == ".toml" {
+		f.values, err = parseTOML(b)
+	} else {
+		err = yaml.Unmarshal(b, &f.values)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %w", path, err)
+	}
+	fields := make(map[string]reflect.StructField)
+	t := reflect.TypeFor[Env]()
+	for i := 0; i < t.NumField(); i++ {
+		fields[t.Field(i).Tag.Get("yaml")] = t.Field(i)
+	}
+	for key := range f.values {
+		field, ok := fields[key]
+		if key == "-" || !ok {
+			return nil, fmt.Errorf("unknown key %q in %s", key, path)
+		}
+		if project && field.Tag.Get("project") != "true" {
+			return nil, fmt.Errorf("%q is not allowed in the project-level configuration file %s; set it in %s, the environment or a flag", key, path, userConfigFileName())
+		}
+	}
+	return f, nil
+}
+
+// parseTOML parses a TOML configuration file into YAML nodes, so that the
+// values are decoded in the same way as the YAML files.
+func parseTOML(b []byte) (map[string]yaml.Node, error) {
+	var m map[string]any
+	if err := toml.Unmarshal(b, &m); err != nil {
+		return nil, err
+	}
+	values := make(map[string]yaml.Node, len(m))
+	for key, v := range m {
+		var n yaml.Node
+		if err := n.Encode(v); err != nil {
+			return nil, fmt.Errorf("invalid value for %s: %w", key, err)
+		}
+		values[key] = n
+	}
+	return values, nil
+}
+
+// userConfigFileName returns the path of the user-level configuration file for messages.
+func userConfigFileName() string {
+	if path, err := UserConfigFile(); err == nil {
+		return path
+	}
+	return "the user-level configuration file"
+}
+
+// ConfigEntry is an entry of the effective configuration shown by `config show`.
+type ConfigEntry struct {
+	Name   string `json:"name"`
+	Value  string `json:"value"`
+	Source string `json:"source"`
+}
+
+// RunConfig runs the config subcommand.
+func RunConfig(ctx context.Context, args []string, w io.Writer) (int, error) {
+	if len(args) == 0 {
+		fmt.Fprint(w, configUsage)
+		return ExitCodeError, fmt.Errorf("no command given")
+	}
+	switch args[0] {
+	case "show":
+		return runConfigShow(args[1:], w)
+	case "-h", "-help", "--help", "help":
+		fmt.Fprint(w, configUsage)
+		return 0, nil
+	default:
+		fmt.Fprint(w, configUsage)
+		return ExitCodeError, fmt.Errorf("unknown config command: %s", args[0])
+	}
+}
+
+func runConfigShow(args []string, w io.Writer) (int, error) {
+	e, sources, err := loadEnv()
+	if err != nil {
+		return ExitCodeError, err
+	}
+	fs := flag.NewFlagSet("config show", flag.ContinueOnError)
+	e.RegisterFlags(fs)
+	asJSON := fs.Bool("json", false, "output in JSON format")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Usage: sops-sakura-kms config show [options]")
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return ExitCodeError, err
+	}
+	if fs.NArg() > 0 {
+		fs.Usage()
+		return ExitCodeError, fmt.Errorf("unexpected arguments: %v", fs.Args())
+	}
+	entries := e.configEntries(sources, fs)
+	if *asJSON {
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(entries); err != nil {
+			return ExitCodeError, err
+		}
+		return 0, nil
+	}
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "NAME\tVALUE\tSOURCE")
+	for _, entry := range entries {
+		value, source := entry.Value, entry.Source
+		if value == "" {
+			value = "-"
+		}
+		if source == "" {
+			source = "-"
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\n", entry.Name, value, source)
+	}
+	tw.Flush()
+	return 0, nil
+}
+
+// configEntries returns the effective configuration with the sources of the
+// values. The flags set in fs take precedence over the sources. Secrets are masked.
+func (e *Env) configEntries(sources map[string]string, fs *flag.FlagSet) []ConfigEntry {
+	flagSet := make(map[string]bool)
+	fs.Visit(func(f *flag.Flag) {
+		flagSet[f.Name] = true
+	})
+	v := reflect.ValueOf(e).Elem()
+	t := v.Type()
+	var entries []ConfigEntry
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		name := field.Tag.Get("yaml")
+		if name == "" || name == "-" {
+			continue
+		}
+		entry := ConfigEntry{
+			Name:   name,
+			Value:  formatField(v.Field(i)),
+			Source: sources[field.Name],
+		}
+		if f := field.Tag.Get("flag"); f != "" && flagSet[f] {
+			entry.Source = "--" + f
+		}
+		if field.Tag.Get("secret") != "" && entry.Value != "" {
+			entry.Value = "********"
+		}
+		entries = append(entries, entry)
+	}
+	return entries
+}
@@ -0,0 +1,309 @@
+package ssk_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	ssk "github.com/fujiwara/sops-sakura-kms"
+	"github.com/google/go-cmp/cmp"
+)
+
+// setupConfigFiles writes the user-level and project-level configuration
+// files, and changes the current directory to a subdirectory of the project.
+func setupConfigFiles(t *testing.T, user, project string) (userPath, projectPath string) {
+	t.Helper()
+	configHome := t.TempDir()
+	t.Setenv("XDG_CONFIG_HOME", configHome)
+	userPath = filepath.Join(configHome, "sops-sakura-kms", "config.yaml")
+	if user != "" {
+		if err := os.MkdirAll(filepath.Dir(userPath), 0o700); err != nil {
+			t.Fatal(err)
+		}
+		writeEnvFile(t, userPath, user)
+	}
+	dir := t.TempDir()
+	projectPath = filepath.Join(dir, ssk.ProjectConfigFile)
+	if project != "" {
+		writeEnvFile(t, projectPath, project)
+	}
+	sub := filepath.Join(dir, "sub")
+	if err := os.Mkdir(sub, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	t.Chdir(sub)
+	return userPath, projectPath
+}
+
+func TestLoadEnvConfigFiles(t *testing.T) {
+	setupConfigFiles(t, `
+key_id: "111111111111"
+algorithm: aes-256-cbc
+max_lifetime: 8h
+max_decrypts: 100
+confirm_keys: ["222222222222"]
+allowed_keys: 111111111111,222222222222
+`, `
+key_id: "222222222222"
+key_algorithms:
+  222222222222: aes-256-kw
+`)
+	t.Setenv("SAKURA_KMS_KEY_ID", "")
+	t.Setenv("SAKURACLOUD_KMS_KEY_ID", "")
+	t.Setenv("SSK_ALGORITHM", "aes-256-gcm")
+	e, err := ssk.LoadEnv()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff(&ssk.Env{
+		KMSKeyID:      "222222222222",
+		ServerAddr:    "127.0.0.1:8200",
+		Command:       "sops",
+		Algorithm:     "aes-256-gcm",
+		KeyAlgorithms: map[string]string{"222222222222": "aes-256-kw"},
+		KeyIDMismatch: "reject",
+		MaxLifetime:   8 * time.Hour,
+		MaxDecrypts:   100,
+		ConfirmKeys:   []string{"222222222222"},
+		ConfirmTTL:    ssk.DefaultConfirmTTL,
+		AllowedKeys:   []string{"111111111111", "222222222222"},
+	}, e); diff != "" {
+		t.Errorf("LoadEnv mismatch (-want +got):\n%s", diff)
+	}
+}
+
+func TestLoadEnvConfigFilesTOML(t *testing.T) {
+	user, project := setupConfigFiles(t, "", "")
+	user = strings.TrimSuffix(user, ".yaml") + ".toml"
+	project = strings.TrimSuffix(project, ".yaml") + ".toml"
+	if err := os.MkdirAll(filepath.Dir(user), 0o700); err != nil {
+		t.Fatal(err)
+	}
+	writeEnvFile(t, user, `
+algorithm = "aes-256-cbc"
+max_lifetime = "8h"
+max_decrypts = 100
+preflight = true
+allowed_keys = ["111111111111", "222222222222"]
+`)
+	writeEnvFile(t, project, `
+key_id = "222222222222"
+
+[key_algorithms]
+222222222222 = "aes-256-kw"
+`)
+	t.Setenv("SAKURA_KMS_KEY_ID", "")
+	t.Setenv("SAKURACLOUD_KMS_KEY_ID", "")
+	t.Setenv("SSK_ALGORITHM", "")
+	e, err := ssk.LoadEnv()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff(&ssk.Env{
+		KMSKeyID:      "222222222222",
+		ServerAddr:    "127.0.0.1:8200",
+		Command:       "sops",
+		Algorithm:     "aes-256-cbc",
+		KeyAlgorithms: map[string]string{"222222222222": "aes-256-kw"},
+		KeyIDMismatch: "reject",
+		Preflight:     true,
+		MaxLifetime:   8 * time.Hour,
+		MaxDecrypts:   100,
+		ConfirmTTL:    ssk.DefaultConfirmTTL,
+		AllowedKeys:   []string{"111111111111", "222222222222"},
+	}, e); diff != "" {
+		t.Errorf("LoadEnv mismatch (-want +got):\n%s", diff)
+	}
+	var buf bytes.Buffer
+	if _, err := ssk.RunConfig(context.Background(), []string{"show", "--json"}, &buf); err != nil {
+		t.Fatal(err)
+	}
+	var entries []ssk.ConfigEntry
+	if err := json.Unmarshal(buf.Bytes(), &entries); err != nil {
+		t.Fatal(err)
+	}
+	for _, entry := range entries {
+		if entry.Name == "key_id" && entry.Source != project || entry.Name == "algorithm" && entry.Source != user {
+			t.Errorf("unexpected source: %+v", entry)
+		}
+	}
+
+	// the project-level file is restricted in TOML, too
+	writeEnvFile(t, project, "command = \"/tmp/evil\"\n")
+	if _, err := ssk.LoadEnv(); err == nil || !strings.Contains(err.Error(), "not allowed in the project-level configuration file") {
+		t.Errorf("expected an error for the project-level file: %v", err)
+	}
+
+	writeEnvFile(t, project, "key_id = [\n")
+	if _, err := ssk.LoadEnv(); err == nil || !strings.Contains(err.Error(), project) {
+		t.Errorf("expected an error with the path: %v", err)
+	}
+
+	// both YAML and TOML in the same directory
+	os.Remove(project)
+	writeEnvFile(t, strings.TrimSuffix(user, ".toml")+".yaml", "algorithm: aes-256-gcm\n")
+	if _, err := ssk.LoadEnv(); err == nil || !strings.Contains(err.Error(), "remove one of them") {
+		t.Errorf("expected an error for both files: %v", err)
+	}
+}
+
+func TestLoadEnvConfigFileErrors(t *testing.T) {
+	for name, tc := range map[string]struct {
+		user, project string
+	}{
+		"unknown key":      {project: "key-id: 111111111111\n"},
+		"invalid duration": {user: "max_lifetime: 8\n"},
+		"invalid type":     {user: "allowed_keys: {a: b}\n"},
+		"invalid yaml":     {project: "key_id: [\n"},
+	} {
+		t.Run(name, func(t *testing.T) {
+			user, project := setupConfigFiles(t, tc.user, tc.project)
+			path := project
+			if tc.user != "" {
+				path = user
+			}
+			_, err := ssk.LoadEnv()
+			if err == nil || !strings.Contains(err.Error(), path) {
+				t.Errorf("expected an error with the path: %v", err)
+			}
+		})
+	}
+}
+
+func TestLoadEnvProjectConfigRestricted(t *testing.T) {
+	for _, content := range []string{
+		"command: /tmp/evil\n",
+		"askpass: /tmp/evil\n",
+		"server_addr: 0.0.0.0:8200\n",
+		"allowed_keys: 999999999999\n",
+		"credential_process: curl http://example.com\n",
+		"access_token: token\n",
+		"confirm_keys: []\n",
+		"key_aliases: {prod: \"999999999999\"}\n",
+	} {
+		t.Run(content, func(t *testing.T) {
+			_, project := setupConfigFiles(t, "", content)
+			_, err := ssk.LoadEnv()
+			if err == nil || !strings.Contains(err.Error(), "not allowed in the project-level configuration file "+project) {
+				t.Errorf("expected an error for the project-level file: %v", err)
+			}
+		})
+	}
+
+	// the same keys are accepted in the user-level file
+	setupConfigFiles(t, "command: /usr/local/bin/sops\nserver_addr: 127.0.0.1:18200\n", "key_id: \"111111111111\"\nalgorithm: aes-256-gcm\n")
+	t.Setenv("SSK_COMMAND", "")
+	t.Setenv("SSK_SERVER_ADDR", "")
+	t.Setenv("SAKURA_KMS_KEY_ID", "")
+	t.Setenv("SAKURACLOUD_KMS_KEY_ID", "")
+	e, err := ssk.LoadEnv()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e.Command != "/usr/local/bin/sops" || e.ServerAddr != "127.0.0.1:18200" || e.KMSKeyID != "111111111111" {
+		t.Errorf("unexpected configuration: %+v", e)
+	}
+}
+
+func TestLoadEnvSecretFile(t *testing.T) {
+	f, srv := newFakeKMS(t, "111111111111")
+	setFakeKMSEnv(t, srv.URL)
+	setupConfigFiles(t, "access_token: token-from-config\n", "")
+	secret := filepath.Join(t.TempDir(), "secret")
+	writeEnvFile(t, secret, "secret-from-file\n")
+	t.Setenv("SAKURA_ACCESS_TOKEN", "")
+	t.Setenv("SAKURA_ACCESS_TOKEN_SECRET", "")
+	t.Setenv("SAKURA_ACCESS_TOKEN_SECRET_FILE", secret)
+	e, err := ssk.LoadEnv()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e.AccessToken != "token-from-config" || e.AccessTokenSecret != "secret-from-file" {
+		t.Errorf("unexpected credentials: %q, %q", e.AccessToken, e.AccessTokenSecret)
+	}
+	// not exported to the environment of the child processes
+	if v := os.Getenv("SAKURA_ACCESS_TOKEN"); v != "" {
+		t.Errorf("SAKURA_ACCESS_TOKEN = %q", v)
+	}
+	if v := os.Getenv("SAKURA_ACCESS_TOKEN_SECRET"); v != "" {
+		t.Errorf("SAKURA_ACCESS_TOKEN_SECRET = %q", v)
+	}
+
+	// passed to the client directly
+	kmsOpts, err := e.KMSOptions()
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := ssk.NewSakuraKMS(kmsOpts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.Encrypt(t.Context(), "111111111111", []byte("secret")); err != nil {
+		t.Fatal(err)
+	}
+	if users := f.requestUsers(); !slices.Equal(users, []string{"token-from-config"}) {
+		t.Errorf("requests are sent as %v", users)
+	}
+
+	t.Setenv("SAKURA_ACCESS_TOKEN_SECRET_FILE", filepath.Join(t.TempDir(), "missing"))
+	if _, err := ssk.LoadEnv(); err == nil || !strings.Contains(err.Error(), "SAKURA_ACCESS_TOKEN_SECRET_FILE") {
+		t.Errorf("expected an error for a missing file: %v", err)
+	}
+}
+
+func TestConfigShow(t *testing.T) {
+	user, project := setupConfigFiles(t, "algorithm: aes-256-cbc\naccess_token: token-from-config\n", "preflight: true\n")
+	t.Setenv("SAKURA_ACCESS_TOKEN", "")
+	t.Setenv("SAKURA_KMS_KEY_ID", "333333333333")
+	t.Setenv("SSK_ALLOWED_KEYS", "a,b")
+	t.Setenv("SSK_COMMAND", "")
+
+	var buf bytes.Buffer
+	code, err := ssk.RunConfig(context.Background(), []string{"show", "--json", "--command", "/usr/local/bin/sops"}, &buf)
+	if err != nil || code != 0 {
+		t.Fatalf("config show failed: %d, %v", code, err)
+	}
+	var entries []ssk.ConfigEntry
+	if err := json.Unmarshal(buf.Bytes(), &entries); err != nil {
+		t.Fatal(err)
+	}
+	got := make(map[string]ssk.ConfigEntry)
+	for _, entry := range entries {
+		got[entry.Name] = entry
+	}
+	for _, want := range []ssk.ConfigEntry{
+		{Name: "key_id", Value: "333333333333", Source: "$SAKURA_KMS_KEY_ID"},
+		{Name: "access_token", Value: "********", Source: user},
+		{Name: "access_token_secret", Value: "", Source: ""},
+		{Name: "algorithm", Value: "aes-256-cbc", Source: user},
+		{Name: "preflight", Value: "true", Source: project},
+		{Name: "allowed_keys", Value: "a,b", Source: "$SSK_ALLOWED_KEYS"},
+		{Name: "command", Value: "/usr/local/bin/sops", Source: "--command"},
+		{Name: "server_addr", Value: "127.0.0.1:8200", Source: "default"},
+	} {
+		if diff := cmp.Diff(want, got[want.Name]); diff != "" {
+			t.Errorf("%s mismatch (-want +got):\n%s", want.Name, diff)
+		}
+	}
+	if strings.Contains(buf.String(), "token-from-config") {
+		t.Error("the secret is not masked")
+	}
+
+	buf.Reset()
+	if _, err := ssk.RunConfig(context.Background(), []string{"show"}, &buf); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(buf.String(), "NAME") || !strings.Contains(buf.String(), "access_token_secret  -") {
+		t.Errorf("unexpected table:\n%s", buf.String())
+	}
+
+	if _, err := ssk.RunConfig(context.Background(), []string{"unknown"}, &buf); err == nil {
+		t.Error("expected an error for an unknown command")
+	}
+}
@@ -0,0 +1,138 @@
+package ssk
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"os/exec"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultConfirmTTL is how long an approval of a key is cached by default.
+const DefaultConfirmTTL = time.Minute
+
+// ErrNotApproved is returned when the user did not approve a decrypt request.
+var ErrNotApproved = errors.New("permission denied: decrypt was not approved")
+
+// Confirmer asks the user to approve an operation.
+type Confirmer interface {
+	Confirm(ctx context.Context, prompt string) (bool, error)
+}
+
+// TerminalConfirmer asks on a terminal, reading "y" or "yes" to approve.
+// In and Out default to /dev/tty.
+type TerminalConfirmer struct {
+	In  io.Reader
+	Out io.Writer
+}
+
+// Confirm implements Confirmer.
+func (c *TerminalConfirmer) Confirm(ctx context.Context, prompt string) (bool, error) {
+	in, out := c.In, c.Out
+	if in == nil || out == nil {
+		tty, err := os.OpenFile("/dev/tty", os.O_RDWR, 0)
+		if err != nil {
+			return false, fmt.Errorf("cannot ask for confirmation (set SSK_ASKPASS for a program to ask): %w", err)
+		}
+		defer tty.Close()
+		in, out = tty, tty
+	}
+	fmt.Fprintf(out, "%s [y/N] ", prompt)
+	ch := make(chan string, 1)
+	go func() {
+		line, _ := bufio.NewReader(in).ReadString('\n')
+		ch <- line
+	}()
+	select {
+	case line := <-ch:
+		answer := strings.ToLower(strings.TrimSpace(line))
+		return answer == "y" || answer == "yes", nil
+	case <-ctx.Done():
+		fmt.Fprintln(out)
+		return false, ctx.Err()
+	}
+}
+
+// AskpassConfirmer runs Command with the prompt as the argument, like
+// ssh-askpass with SSH_ASKPASS_PROMPT=confirm. Exit status 0 approves.
+type AskpassConfirmer struct {
+	Command string
+}
+
+// Confirm implements Confirmer.
+func (c *AskpassConfirmer) Confirm(ctx context.Context, prompt string) (bool, error) {
+	cmd := exec.CommandContext(ctx, c.Command, prompt)
+	cmd.Env = append(childEnviron(), "SSH_ASKPASS_PROMPT=confirm", "SSK_ASKPASS_PROMPT=confirm")
+	cmd.Stderr = os.Stderr
+	err := cmd.Run()
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		return false, nil
+	} else if err != nil {
+		return false, fmt.Errorf("failed to run %s: %w", c.Command, err)
+	}
+	return true, nil
+}
+
+// ConfirmPolicy requires the user's approval for each decrypt request with the keys,
+// like `ssh-add -c`.
+type ConfirmPolicy struct {
+	// KeyIDs are the keys that need approval; "*" matches all keys.
+	KeyIDs []string
+	// Confirmer asks the user.
+	Confirmer Confirmer
+	// TTL is how long an approval of a key is cached. Zero asks every time.
+	TTL time.Duration
+}
+
+func (p *ConfirmPolicy) match(keyID string) bool {
+	return slices.Contains(p.KeyIDs, "*") || slices.Contains(p.KeyIDs, keyID)
+}
+
+// confirmGate asks for approvals one at a time and caches them per key.
+type confirmGate struct {
+	policy ConfirmPolicy
+
+	mu       sync.Mutex
+	approved map[string]time.Time
+}
+
+func newConfirmGate(p ConfirmPolicy) *confirmGate {
+	return &confirmGate{policy: p, approved: make(map[string]time.Time)}
+}
+
+// approve blocks until the decrypt request with keyID from remote is approved,
+// and returns ErrNotApproved if it is denied.
+func (g *confirmGate) approve(ctx context.Context, keyID, remote string) error {
+	if g == nil || !g.policy.match(keyID) {
+		return nil
+	}
+	// one prompt at a time; concurrent requests for the key are approved by the first
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if until, ok := g.approved[keyID]; ok && time.Now().Before(until) {
+		return nil
+	}
+	prompt := fmt.Sprintf("Allow decrypting with Sakura Cloud KMS key %s (requested from %s)?", keyID, remote)
+	ok, err := g.policy.Confirmer.Confirm(ctx, prompt)
+	if err != nil {
+		slog.Warn("failed to ask for confirmation", "key_id", keyID, "error", err)
+		return fmt.Errorf("%w: %s", ErrNotApproved, err)
+	}
+	if !ok {
+		slog.Warn("decrypt was denied", "key_id", keyID, "remote", remote)
+		return ErrNotApproved
+	}
+	slog.Info("decrypt was approved", "key_id", keyID, "remote", remote)
+	if g.policy.TTL > 0 {
+		g.approved[keyID] = time.Now().Add(g.policy.TTL)
+	}
+	return nil
+}
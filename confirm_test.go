@@ -0,0 +1,173 @@
+package ssk_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	ssk "github.com/fujiwara/sops-sakura-kms"
+)
+
+type fakeConfirmer struct {
+	mu      sync.Mutex
+	answer  bool
+	prompts []string
+}
+
+func (c *fakeConfirmer) Confirm(ctx context.Context, prompt string) (bool, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.prompts = append(c.prompts, prompt)
+	return c.answer, nil
+}
+
+func decryptWithMux(t *testing.T, mux http.Handler, keyID string) *httptest.ResponseRecorder {
+	t.Helper()
+	body, _ := json.Marshal(ssk.VaultDecryptRequest{
+		Ciphertext: ssk.VaultPrefix + base64.StdEncoding.EncodeToString([]byte("secret")),
+	})
+	req := httptest.NewRequest(http.MethodPut, "/v1/transit/decrypt/"+keyID, bytes.NewReader(body))
+	rec := httptest.NewRecorder()
+	mux.ServeHTTP(rec, req)
+	return rec
+}
+
+func TestConfirmDecrypt(t *testing.T) {
+	c := &fakeConfirmer{answer: true}
+	mux := ssk.NewMux(&mockCipher{}, ssk.WithConfirm(ssk.ConfirmPolicy{
+		KeyIDs:    []string{"prod"},
+		Confirmer: c,
+		TTL:       time.Minute,
+	}))
+	for range 3 {
+		if rec := decryptWithMux(t, mux, "prod"); rec.Code != http.StatusOK {
+			t.Fatalf("status = %d, body = %s", rec.Code, rec.Body)
+		}
+	}
+	if len(c.prompts) != 1 {
+		t.Errorf("asked %d times, want 1 (cached)", len(c.prompts))
+	} else if !strings.Contains(c.prompts[0], "key prod") {
+		t.Errorf("unexpected prompt: %s", c.prompts[0])
+	}
+	if rec := decryptWithMux(t, mux, "dev"); rec.Code != http.StatusOK {
+		t.Errorf("dev: status = %d, body = %s", rec.Code, rec.Body)
+	}
+	if len(c.prompts) != 1 {
+		t.Errorf("asked for a key without confirm mode")
+	}
+}
+
+func TestConfirmDecryptDenied(t *testing.T) {
+	c := &fakeConfirmer{answer: false}
+	mux := ssk.NewMux(&mockCipher{}, ssk.WithConfirm(ssk.ConfirmPolicy{
+		KeyIDs:    []string{"*"},
+		Confirmer: c,
+	}))
+	for range 2 {
+		rec := decryptWithMux(t, mux, "prod")
+		if rec.Code != http.StatusForbidden {
+			t.Fatalf("status = %d, want 403", rec.Code)
+		}
+		var res ssk.VaultErrorResponse
+		if err := json.NewDecoder(rec.Body).Decode(&res); err != nil || len(res.Errors) != 1 || !strings.Contains(res.Errors[0], "not approved") {
+			t.Errorf("unexpected error response: %+v, %v", res, err)
+		}
+	}
+	if len(c.prompts) != 2 {
+		t.Errorf("asked %d times, want 2 (denials are not cached)", len(c.prompts))
+	}
+}
+
+func TestTerminalConfirmer(t *testing.T) {
+	for input, want := range map[string]bool{"y\n": true, "YES\n": true, "n\n": false, "\n": false, "": false} {
+		var out bytes.Buffer
+		c := &ssk.TerminalConfirmer{In: strings.NewReader(input), Out: &out}
+		got, err := c.Confirm(context.Background(), "Allow?")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != want {
+			t.Errorf("%q: got %v, want %v", input, got, want)
+		}
+		if out.String() != "Allow? [y/N] " {
+			t.Errorf("unexpected prompt: %q", out.String())
+		}
+	}
+}
+
+func TestAskpassConfirmer(t *testing.T) {
+	dir := t.TempDir()
+	promptFile := filepath.Join(dir, "prompt")
+	for _, tc := range []struct {
+		code string
+		want bool
+	}{{"0", true}, {"1", false}} {
+		script := filepath.Join(dir, "askpass-"+tc.code)
+		if err := os.WriteFile(script, []byte("#!/bin/sh\necho \"$SSH_ASKPASS_PROMPT $1\" > "+promptFile+"\nexit "+tc.code+"\n"), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		got, err := (&ssk.AskpassConfirmer{Command: script}).Confirm(context.Background(), "Allow decrypting?")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != tc.want {
+			t.Errorf("exit %s: got %v, want %v", tc.code, got, tc.want)
+		}
+		if b, _ := os.ReadFile(promptFile); string(b) != "confirm Allow decrypting?\n" {
+			t.Errorf("unexpected askpass arguments: %q", b)
+		}
+	}
+	if _, err := (&ssk.AskpassConfirmer{Command: filepath.Join(dir, "missing")}).Confirm(context.Background(), "?"); err == nil {
+		t.Error("expected an error for a missing program")
+	}
+}
+
+func TestEnvConfirmPolicy(t *testing.T) {
+	if p, err := (&ssk.Env{}).ConfirmPolicy(); err != nil || p != nil {
+		t.Errorf("without keys: %+v, %v", p, err)
+	}
+	p, err := (&ssk.Env{ConfirmKeys: []string{"111111111111", "222222222222"}, ConfirmTTL: 30 * time.Second, Askpass: "/usr/bin/ssh-askpass"}).ConfirmPolicy()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(p.KeyIDs) != 2 || p.KeyIDs[1] != "222222222222" || p.TTL != 30*time.Second {
+		t.Errorf("unexpected policy: %+v", p)
+	}
+	if c, ok := p.Confirmer.(*ssk.AskpassConfirmer); !ok || c.Command != "/usr/bin/ssh-askpass" {
+		t.Errorf("unexpected confirmer: %#v", p.Confirmer)
+	}
+
+	t.Setenv("SSK_CONFIRM_KEYS", "*")
+	t.Setenv("SSK_CONFIRM_TTL", "")
+	t.Setenv("SSK_ASKPASS", "")
+	e, err := ssk.LoadEnv()
+	if err != nil {
+		t.Fatal(err)
+	}
+	p, err = e.ConfirmPolicy()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.TTL != ssk.DefaultConfirmTTL {
+		t.Errorf("TTL = %s, want %s", p.TTL, ssk.DefaultConfirmTTL)
+	}
+	if _, ok := p.Confirmer.(*ssk.TerminalConfirmer); !ok {
+		t.Errorf("unexpected confirmer: %#v", p.Confirmer)
+	}
+	if _, err := (&ssk.Env{ConfirmKeys: []string{"*"}, ConfirmTTL: -time.Second}).ConfirmPolicy(); err == nil {
+		t.Error("expected an error for a negative TTL")
+	}
+	t.Setenv("SSK_CONFIRM_TTL", "1")
+	if _, err := ssk.LoadEnv(); err == nil {
+		t.Error("expected an error for an invalid TTL")
+	}
+}
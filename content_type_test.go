@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"net/http"
 	"net/http/httptest"
+	"strings"
 	"testing"
 
 	ssk "github.com/fujiwara/sops-sakura-kms"
@@ -62,3 +63,16 @@ func TestContentTypeValidation(t *testing.T) {
 		})
 	}
 }
+
+func TestRequestBodyLimit(t *testing.T) {
+	mux := ssk.NewMux(&mockCipher{})
+	for _, op := range []string{"encrypt", "decrypt"} {
+		body := `{"plaintext":"` + strings.Repeat("A", ssk.MaxRequestBodySize) + `"}`
+		req := httptest.NewRequest("PUT", "/v1/transit/"+op+"/test-key", strings.NewReader(body))
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, req)
+		if w.Code != http.StatusRequestEntityTooLarge {
+			t.Errorf("%s: status = %d, want %d", op, w.Code, http.StatusRequestEntityTooLarge)
+		}
+	}
+}
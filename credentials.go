@@ -0,0 +1,163 @@
+package ssk
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sacloud/saclient-go"
+)
+
+// credentialProcessTimeout limits how long a credential process may run.
+const credentialProcessTimeout = time.Minute
+
+// credentialExpiryMargin is how long before the expiration the credentials are refreshed.
+const credentialExpiryMargin = time.Minute
+
+// Credentials are the Sakura Cloud API credentials printed by a credential process
+// as JSON, with the same keys as a usacloud profile:
+//
+//	{"AccessToken": "...", "AccessTokenSecret": "...", "Expiration": "2025-01-01T00:00:00Z"}
+//
+// Expiration is optional; credentials without it are used until the process exits.
+type Credentials struct {
+	AccessToken       string    `json:"AccessToken"`
+	AccessTokenSecret string    `json:"AccessTokenSecret"`
+	Expiration        time.Time `json:"Expiration,omitzero"`
+}
+
+// expired reports whether the credentials must be refreshed at now.
+func (c *Credentials) expired(now time.Time) bool {
+	return !c.Expiration.IsZero() && now.Add(credentialExpiryMargin).After(c.Expiration)
+}
+
+// RunCredentialProcess runs command with the shell and parses the credentials
+// printed to its stdout. The stderr of the command is passed through, so that
+// it can ask the user, e.g. to unlock a password manager.
+func RunCredentialProcess(ctx context.Context, command string) (*Credentials, error) {
+	ctx, cancel := context.WithTimeout(ctx, credentialProcessTimeout)
+	defer cancel()
+	var stdout bytes.Buffer
+	cmd := shellCommand(ctx, command)
+	cmd.Stdout = &stdout
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		return nil, fmt.Errorf("failed to run the credential process %q: %w", command, err)
+	}
+	var c Credentials
+	if err := json.Unmarshal(stdout.Bytes(), &c); err != nil {
+		return nil, fmt.Errorf("failed to parse the output of the credential process %q: %w", command, err)
+	}
+	if c.AccessToken == "" || c.AccessTokenSecret == "" {
+		return nil, fmt.Errorf("the credential process %q printed no AccessToken or AccessTokenSecret", command)
+	}
+	return &c, nil
+}
+
+// credentialProcess caches the credentials of a credential process until they expire.
+type credentialProcess struct {
+	command string
+	mu      sync.Mutex
+	creds   *Credentials
+}
+
+func (p *credentialProcess) credentials(ctx context.Context) (*Credentials, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.creds != nil && !p.creds.expired(time.Now()) {
+		return p.creds, nil
+	}
+	c, err := RunCredentialProcess(ctx, p.command)
+	if err != nil {
+		return nil, err
+	}
+	slog.Debug("Fetched the credentials with the credential process", "expiration", c.Expiration)
+	p.creds = c
+	return c, nil
+}
+
+// middleware sets the credentials to the requests to the Sakura Cloud API,
+// in preference to the credentials of saclient.
+func (p *credentialProcess) middleware(req *http.Request, pull func() (saclient.Middleware, bool)) (*http.Response, error) {
+	c, err := p.credentials(req.Context())
+	if err != nil {
+		return nil, err
+	}
+	return c.middleware(req, pull)
+}
+
+// middleware sets the credentials to the requests to the Sakura Cloud API,
+// in preference to the credentials of saclient.
+func (c *Credentials) middleware(req *http.Request, pull func() (saclient.Middleware, bool)) (*http.Response, error) {
+	req.SetBasicAuth(c.AccessToken, c.AccessTokenSecret)
+	next, ok := pull()
+	if !ok {
+		return nil, errors.New("no next middleware")
+	}
+	return next(req, pull)
+}
+
+// WithCredentialProcess sets a command that prints the API credentials as JSON
+// (see Credentials), like credential_process of the AWS CLI. The command is run
+// with the shell on the first request and again when the credentials expire.
+// The credentials take precedence over the environment variables and the profile.
+func WithCredentialProcess(command string) SakuraKMSOption {
+	return func(c *SakuraKMS) {
+		if command = strings.TrimSpace(command); command != "" {
+			c.credentialProcess = &credentialProcess{command: command}
+		}
+	}
+}
+
+// WithCredentials sets the API credentials, in preference to the environment
+// variables and the profile. They are passed to the client only, not to the
+// environment of the child processes. Empty values are ignored.
+func WithCredentials(accessToken, accessTokenSecret string) SakuraKMSOption {
+	return func(c *SakuraKMS) {
+		if accessToken != "" && accessTokenSecret != "" {
+			c.credentials = &Credentials{AccessToken: accessToken, AccessTokenSecret: accessTokenSecret}
+		}
+	}
+}
+
+// WithProfile sets the name and the directory of the usacloud profile to read
+// the credentials from, in preference to SAKURA_PROFILE and SAKURA_PROFILE_DIR.
+// Empty values are ignored. It is used only by NewSakuraKMS.
+func WithProfile(name, dir string) SakuraKMSOption {
+	return func(c *SakuraKMS) {
+		if name != "" {
+			c.profile = name
+		}
+		if dir != "" {
+			c.profileDir = dir
+		}
+	}
+}
+
+// environ returns env with the profile of the options, for saclient.
+func (c *SakuraKMS) environ(env []string) []string {
+	if c.profile != "" {
+		env = setEnviron(env, "SAKURA_PROFILE", c.profile)
+	}
+	if c.profileDir != "" {
+		env = setEnviron(env, "SAKURA_PROFILE_DIR", c.profileDir)
+	}
+	return env
+}
+
+// setEnviron returns env with the variable name set to value.
+func setEnviron(env []string, name, value string) []string {
+	env = slices.DeleteFunc(slices.Clone(env), func(kv string) bool {
+		return strings.HasPrefix(kv, name+"=")
+	})
+	return append(env, name+"="+value)
+}
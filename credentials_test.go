@@ -0,0 +1,256 @@
+package ssk_test
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"os"
+	"path/filepath"
+	"runtime"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	ssk "github.com/fujiwara/sops-sakura-kms"
+)
+
+// writeCredentialProcess writes a script printing the credentials, which
+// counts its runs in the returned file.
+func writeCredentialProcess(t *testing.T, creds ssk.Credentials) (command, countFile string) {
+	t.Helper()
+	if runtime.GOOS == "windows" {
+		t.Skip("the credential process script requires /bin/sh")
+	}
+	dir := t.TempDir()
+	b, err := json.Marshal(creds)
+	if err != nil {
+		t.Fatal(err)
+	}
+	countFile = filepath.Join(dir, "count")
+	command = filepath.Join(dir, "credential-process")
+	writeEnvFile(t, command, "#!/bin/sh\necho run >> "+countFile+"\necho '"+string(b)+"'\n")
+	if err := os.Chmod(command, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	return command, countFile
+}
+
+func countRuns(t *testing.T, countFile string) int {
+	t.Helper()
+	b, err := os.ReadFile(countFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return strings.Count(string(b), "run\n")
+}
+
+func (f *fakeKMS) requestUsers() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return slices.Clone(f.users)
+}
+
+func TestCredentialProcess(t *testing.T) {
+	for name, tc := range map[string]struct {
+		expiration time.Time
+		runs       int
+	}{
+		"cached":        {expiration: time.Now().Add(time.Hour), runs: 1},
+		"no expiration": {runs: 1},
+		"expiring":      {expiration: time.Now().Add(30 * time.Second), runs: 2},
+	} {
+		t.Run(name, func(t *testing.T) {
+			f, srv := newFakeKMS(t, "111111111111")
+			command, countFile := writeCredentialProcess(t, ssk.Credentials{
+				AccessToken:       "token-from-process",
+				AccessTokenSecret: "secret-from-process",
+				Expiration:        tc.expiration,
+			})
+			// the client has the dummy credentials, which the credential process overrides
+			c, err := ssk.NewSakuraKMSWithClient(newFakeKMSClient(t, srv), ssk.WithCredentialProcess(command+" --profile work"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			for range 2 {
+				if _, err := c.Encrypt(t.Context(), "111111111111", []byte("secret")); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if users := f.requestUsers(); !slices.Equal(users, []string{"token-from-process", "token-from-process"}) {
+				t.Errorf("requests are sent as %v", users)
+			}
+			if runs := countRuns(t, countFile); runs != tc.runs {
+				t.Errorf("the credential process ran %d times, want %d", runs, tc.runs)
+			}
+		})
+	}
+}
+
+func TestCredentialProcessFromConfig(t *testing.T) {
+	f, srv := newFakeKMS(t, "111111111111")
+	setFakeKMSEnv(t, srv.URL)
+	t.Setenv("SSK_CREDENTIAL_PROCESS", "")
+	command, countFile := writeCredentialProcess(t, ssk.Credentials{
+		AccessToken:       "token-from-process",
+		AccessTokenSecret: "secret-from-process",
+	})
+
+	// a repository must not run a command with the project-level file
+	setupConfigFiles(t, "", "credential_process: "+command+"\n")
+	if _, err := ssk.RunWrapper(context.Background(), []string{"exec-env", "secrets.enc.yaml", "true"}); err == nil || !strings.Contains(err.Error(), "credential_process") {
+		t.Errorf("expected an error for credential_process in the project-level file: %v", err)
+	}
+	if _, err := os.Stat(countFile); !os.IsNotExist(err) {
+		t.Errorf("the credential process of the project-level file ran: %v", err)
+	}
+
+	setupConfigFiles(t, "credential_process: "+command+"\n", "")
+	e, err := ssk.LoadEnv()
+	if err != nil {
+		t.Fatal(err)
+	}
+	kmsOpts, err := e.KMSOptions()
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := ssk.NewSakuraKMS(kmsOpts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.Encrypt(t.Context(), "111111111111", []byte("secret")); err != nil {
+		t.Fatal(err)
+	}
+	if users := f.requestUsers(); !slices.Equal(users, []string{"token-from-process"}) {
+		t.Errorf("requests are sent as %v", users)
+	}
+}
+
+func TestRunCredentialProcessErrors(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("the commands require /bin/sh")
+	}
+	for name, command := range map[string]string{
+		"exit status":    "exit 1",
+		"invalid output": "echo not json",
+		"no secret":      `echo '{"AccessToken": "token"}'`,
+	} {
+		t.Run(name, func(t *testing.T) {
+			_, err := ssk.RunCredentialProcess(context.Background(), command)
+			if err == nil || !strings.Contains(err.Error(), "credential process") {
+				t.Errorf("expected an error of the credential process: %v", err)
+			}
+		})
+	}
+
+	_, srv := newFakeKMS(t, "111111111111")
+	c, err := ssk.NewSakuraKMSWithClient(newFakeKMSClient(t, srv), ssk.WithCredentialProcess("exit 1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.Encrypt(t.Context(), "111111111111", []byte("secret")); err == nil || !strings.Contains(err.Error(), "credential process") {
+		t.Errorf("expected an error of the credential process: %v", err)
+	}
+}
+
+// writeProfile writes a usacloud-style profile in dir.
+func writeProfile(t *testing.T, dir, name, token string) {
+	t.Helper()
+	if err := os.MkdirAll(filepath.Join(dir, name), 0o700); err != nil {
+		t.Fatal(err)
+	}
+	b, err := json.Marshal(map[string]string{"AccessToken": token, "AccessTokenSecret": "secret-" + token})
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeEnvFile(t, filepath.Join(dir, name, "config.json"), string(b))
+}
+
+func TestProfileFromConfig(t *testing.T) {
+	f, srv := newFakeKMS(t, "111111111111")
+	setFakeKMSEnv(t, srv.URL)
+	// saclient prefers the environment variables to the profile, even if empty.
+	for _, name := range []string{"SAKURA_ACCESS_TOKEN", "SAKURA_ACCESS_TOKEN_SECRET", "SAKURA_PROFILE", "SAKURA_PROFILE_DIR"} {
+		t.Setenv(name, "")
+		os.Unsetenv(name)
+	}
+	profileDir := t.TempDir()
+	writeProfile(t, profileDir, "default", "token-default")
+	writeProfile(t, profileDir, "work", "token-work")
+	user, _ := setupConfigFiles(t, "profile_dir: "+profileDir+"\nprofile: work\n", "")
+
+	e, err := ssk.LoadEnv()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e.Profile != "work" || e.ProfileDir != profileDir {
+		t.Fatalf("unexpected profile: %+v", e)
+	}
+	if _, ok := os.LookupEnv("SAKURA_PROFILE"); ok {
+		t.Error("the profile is exported to the environment")
+	}
+	kmsOpts, err := e.KMSOptions()
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := ssk.NewSakuraKMS(kmsOpts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.Encrypt(t.Context(), "111111111111", []byte("secret")); err != nil {
+		t.Fatal(err)
+	}
+	if users := f.requestUsers(); !slices.Equal(users, []string{"token-work"}) {
+		t.Errorf("requests are sent as %v", users)
+	}
+
+	r := ssk.RunDoctorChecks(t.Context(), t.TempDir())
+	for _, check := range r.Checks {
+		if check.Name == "credentials" && (check.Status != ssk.CheckPass || !strings.Contains(check.Message, `"work"`)) {
+			t.Errorf("unexpected credentials check: %+v", check)
+		}
+	}
+
+	writeEnvFile(t, user, "profile_dir: "+profileDir+"\nprofile: missing\n")
+	r = ssk.RunDoctorChecks(t.Context(), t.TempDir())
+	if got := doctorStatuses(r); got["credentials"] != ssk.CheckFail {
+		t.Errorf("credentials check with a missing profile: %v", got["credentials"])
+	}
+}
+
+func TestProfileFlag(t *testing.T) {
+	f, srv := newFakeKMS(t, "111111111111")
+	setFakeKMSEnv(t, srv.URL)
+	for _, name := range []string{"SAKURA_ACCESS_TOKEN", "SAKURA_ACCESS_TOKEN_SECRET"} {
+		t.Setenv(name, "")
+		os.Unsetenv(name)
+	}
+	t.Setenv("SAKURA_PROFILE", "default")
+	profileDir := t.TempDir()
+	writeProfile(t, profileDir, "default", "token-default")
+	writeProfile(t, profileDir, "work", "token-work")
+
+	e, err := ssk.LoadEnv()
+	if err != nil {
+		t.Fatal(err)
+	}
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	e.RegisterFlags(fs)
+	if err := fs.Parse([]string{"--profile", "work", "--profile-dir", profileDir}); err != nil {
+		t.Fatal(err)
+	}
+	kmsOpts, err := e.KMSOptions()
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := ssk.NewSakuraKMS(kmsOpts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.Encrypt(t.Context(), "111111111111", []byte("secret")); err != nil {
+		t.Fatal(err)
+	}
+	if users := f.requestUsers(); !slices.Equal(users, []string{"token-work"}) {
+		t.Errorf("requests are sent as %v", users)
+	}
+}
@@ -0,0 +1,13 @@
+//go:build !windows
+
+package ssk
+
+import (
+	"context"
+	"os/exec"
+)
+
+// shellCommand returns a command to run command with the shell.
+func shellCommand(ctx context.Context, command string) *exec.Cmd {
+	return exec.CommandContext(ctx, "/bin/sh", "-c", command)
+}
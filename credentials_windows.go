@@ -0,0 +1,13 @@
+//go:build windows
+
+package ssk
+
+import (
+	"context"
+	"os/exec"
+)
+
+// shellCommand returns a command to run command with cmd.exe.
+func shellCommand(ctx context.Context, command string) *exec.Cmd {
+	return exec.CommandContext(ctx, "cmd.exe", "/C", command)
+}
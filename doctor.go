@@ -0,0 +1,315 @@
+package ssk
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/sacloud/saclient-go"
+)
+
+// MinSOPSVersion is the oldest sops version supported by the wrapper.
+// rotate-all runs the `sops rotate` subcommand, added in sops 3.9.0
+// (getsops/sops#1391); the version check uses --disable-version-check,
+// added in sops 3.8.0 (getsops/sops#1115).
+const MinSOPSVersion = "3.9.0"
+
+// CheckStatus is the result of a doctor check.
+type CheckStatus string
+
+const (
+	CheckPass CheckStatus = "pass"
+	CheckWarn CheckStatus = "warn"
+	CheckFail CheckStatus = "fail"
+	CheckSkip CheckStatus = "skip"
+)
+
+// CheckResult is the result of a single doctor check.
+type CheckResult struct {
+	Name    string      `json:"name"`
+	Status  CheckStatus `json:"status"`
+	Message string      `json:"message"`
+	Hint    string      `json:"hint,omitempty"`
+}
+
+// DoctorReport is the result of RunDoctorChecks.
+type DoctorReport struct {
+	Checks []CheckResult `json:"checks"`
+}
+
+// OK reports whether no check failed.
+func (r *DoctorReport) OK() bool {
+	for _, c := range r.Checks {
+		if c.Status == CheckFail {
+			return false
+		}
+	}
+	return true
+}
+
+func (r *DoctorReport) add(name string, status CheckStatus, message, hint string) {
+	r.Checks = append(r.Checks, CheckResult{Name: name, Status: status, Message: message, Hint: hint})
+}
+
+var sopsVersionRegexp = regexp.MustCompile(`sops (\d+\.\d+\.\d+)`)
+
+// RunDoctorChecks diagnoses the environment: the configuration, the sops command,
+// the Sakura Cloud API credentials, the server address, .sops.yaml in dir and the KMS key.
+func RunDoctorChecks(ctx context.Context, dir string) *DoctorReport {
+	r := &DoctorReport{}
+
+	e, err := LoadEnv()
+	if err != nil {
+		r.add("env", CheckFail, err.Error(), "fix the SSK_* and SAKURA_* environment variables")
+		return r
+	}
+	return runDoctorChecks(ctx, e, dir)
+}
+
+func runDoctorChecks(ctx context.Context, e *Env, dir string) *DoctorReport {
+	r := &DoctorReport{}
+	if _, err := e.KMSOptions(); err != nil {
+		r.add("env", CheckFail, err.Error(), "fix SSK_ALGORITHM or SSK_KEY_ALGORITHMS")
+	} else if _, err := ParseKeyIDMismatchMode(e.KeyIDMismatch); err != nil {
+		r.add("env", CheckFail, err.Error(), "fix SSK_KEY_ID_MISMATCH")
+	} else {
+		r.add("env", CheckPass, "environment variables are valid", "")
+	}
+
+	checkSOPSCommand(ctx, r, e)
+	credentials := checkCredentials(r, e)
+	checkServerAddr(r, e)
+	checkSOPSConfig(r, e, dir)
+	checkKMSKey(ctx, r, e, credentials)
+	return r
+}
+
+func checkSOPSCommand(ctx context.Context, r *DoctorReport, e *Env) {
+	path, err := exec.LookPath(e.Command)
+	if err != nil {
+		r.add("sops", CheckFail, fmt.Sprintf("%s not found in PATH", e.Command),
+			"install sops (https://github.com/getsops/sops) or set SSK_COMMAND to its path")
+		return
+	}
+	output, err := sopsVersionOutput(ctx, path)
+	if err != nil {
+		r.add("sops", CheckFail, err.Error(), fmt.Sprintf("sops %s or later is required", MinSOPSVersion))
+		return
+	}
+	m := sopsVersionRegexp.FindSubmatch(output)
+	if m == nil {
+		r.add("sops", CheckWarn, fmt.Sprintf("%s: unknown version %q", path, strings.TrimSpace(string(output))), "")
+		return
+	}
+	version := string(m[1])
+	if compareVersions(version, MinSOPSVersion) < 0 {
+		r.add("sops", CheckFail, fmt.Sprintf("%s: sops %s is too old", path, version),
+			fmt.Sprintf("upgrade sops to %s or later", MinSOPSVersion))
+		return
+	}
+	r.add("sops", CheckPass, fmt.Sprintf("%s: sops %s", path, version), "")
+}
+
+// checkCredentials reports whether Sakura Cloud API credentials are configured:
+// a credential process, an access token, or a usacloud-style profile.
+func checkCredentials(r *DoctorReport, e *Env) bool {
+	if e.CredentialProcess != "" {
+		r.add("credentials", CheckPass, fmt.Sprintf("using the credential process %q", e.CredentialProcess), "")
+		return true
+	}
+	switch {
+	case e.AccessToken != "" && e.AccessTokenSecret != "":
+		r.add("credentials", CheckPass, "SAKURA_ACCESS_TOKEN and SAKURA_ACCESS_TOKEN_SECRET are set", "")
+		return true
+	case e.AccessToken != "":
+		r.add("credentials", CheckFail, "SAKURA_ACCESS_TOKEN is set but SAKURA_ACCESS_TOKEN_SECRET is not",
+			"set SAKURA_ACCESS_TOKEN_SECRET or access_token_secret in the configuration file")
+		return false
+	case e.AccessTokenSecret != "":
+		r.add("credentials", CheckFail, "SAKURA_ACCESS_TOKEN_SECRET is set but SAKURA_ACCESS_TOKEN is not",
+			"set SAKURA_ACCESS_TOKEN or access_token in the configuration file")
+		return false
+	}
+	profiles := saclient.NewProfileOp(newSakuraKMS(WithProfile(e.Profile, e.ProfileDir)).environ(os.Environ()))
+	name, source := e.Profile, "SAKURA_PROFILE"
+	if name == "" {
+		current, err := profiles.GetCurrentName()
+		if err != nil || current == "" {
+			r.add("credentials", CheckFail, "Sakura Cloud API credentials are not set",
+				"set SAKURA_ACCESS_TOKEN and SAKURA_ACCESS_TOKEN_SECRET, SAKURA_PROFILE or SSK_CREDENTIAL_PROCESS")
+			return false
+		}
+		name, source = current, "the current profile"
+	}
+	p, err := profiles.Read(name)
+	if err != nil {
+		r.add("credentials", CheckFail, fmt.Sprintf("cannot read the profile %q in %s: %s", name, profiles.Dir(), err),
+			"create the profile with `usacloud config` or set SAKURA_PROFILE_DIR")
+		return false
+	}
+	for _, key := range []string{"AccessToken", "AccessTokenSecret"} {
+		if v, _ := p.Get(key); v == nil || v == "" {
+			r.add("credentials", CheckFail, fmt.Sprintf("the profile %q has no %s", name, key),
+				"set AccessToken and AccessTokenSecret in "+p.Pathname())
+			return false
+		}
+	}
+	r.add("credentials", CheckPass, fmt.Sprintf("using the profile %q (%s) in %s", name, source, profiles.Dir()), "")
+	return true
+}
+
+func checkServerAddr(r *DoctorReport, e *Env) {
+	l, err := net.Listen("tcp", e.ServerAddr)
+	if err != nil {
+		r.add("server_addr", CheckFail, fmt.Sprintf("cannot listen on %s: %s", e.ServerAddr, err),
+			"stop the process using the address or set SSK_SERVER_ADDR to a free address")
+		return
+	}
+	l.Close()
+	r.add("server_addr", CheckPass, fmt.Sprintf("%s is available", e.ServerAddr), "")
+}
+
+func checkSOPSConfig(r *DoctorReport, e *Env, dir string) {
+	path, err := findSOPSConfig(dir)
+	if err != nil {
+		if e.KMSKeyID != "" {
+			r.add("sops_config", CheckWarn, ".sops.yaml not found; new files are encrypted with SAKURA_KMS_KEY_ID only",
+				"add .sops.yaml with creation_rules")
+		} else {
+			r.add("sops_config", CheckWarn, ".sops.yaml not found and SAKURA_KMS_KEY_ID is not set; files cannot be encrypted",
+				"add .sops.yaml with creation_rules or set SAKURA_KMS_KEY_ID")
+		}
+		return
+	}
+	conf, err := loadSOPSConfig(path)
+	if err != nil {
+		r.add("sops_config", CheckFail, err.Error(), "fix the YAML syntax of .sops.yaml")
+		return
+	}
+	if len(conf.CreationRules) == 0 {
+		r.add("sops_config", CheckWarn, fmt.Sprintf("%s has no creation_rules", path),
+			"add creation_rules with hc_vault_transit_uri")
+		return
+	}
+	for _, rule := range conf.CreationRules {
+		if len(rule.vaultURIs()) > 0 {
+			r.add("sops_config", CheckPass, fmt.Sprintf("%s has %d creation rule(s)", path, len(conf.CreationRules)), "")
+			return
+		}
+	}
+	if e.KMSKeyID == "" {
+		r.add("sops_config", CheckWarn, fmt.Sprintf("no creation rule in %s uses hc_vault_transit_uri", path),
+			"add hc_vault_transit_uri to creation_rules or set SAKURA_KMS_KEY_ID")
+		return
+	}
+	r.add("sops_config", CheckPass, fmt.Sprintf("%s has %d creation rule(s)", path, len(conf.CreationRules)), "")
+}
+
+func checkKMSKey(ctx context.Context, r *DoctorReport, e *Env, credentials bool) {
+	if e.KMSKeyID == "" {
+		r.add("kms_key", CheckSkip, "SAKURA_KMS_KEY_ID is not set", "set SAKURA_KMS_KEY_ID to check the key")
+		return
+	}
+	if !credentials {
+		r.add("kms_key", CheckSkip, "no credentials", "")
+		return
+	}
+	kmsOpts, err := e.KMSOptions()
+	if err != nil {
+		r.add("kms_key", CheckSkip, "invalid configuration", "")
+		return
+	}
+	c, err := NewSakuraKMS(kmsOpts...)
+	if err != nil {
+		r.add("kms_key", CheckFail, err.Error(), "")
+		return
+	}
+	key, err := c.Preflight(ctx, e.KMSKeyID, false)
+	if err != nil {
+		var pe *PreflightError
+		if errors.As(err, &pe) {
+			r.add("kms_key", CheckFail, pe.Err.Error(), pe.Hint)
+		} else {
+			r.add("kms_key", CheckFail, err.Error(), "")
+		}
+		return
+	}
+	r.add("kms_key", CheckPass, fmt.Sprintf("key %s (%s) is %s", key.ID, key.Name, key.Status), "")
+}
+
+// compareVersions compares dotted numeric versions like "3.9.0".
+func compareVersions(a, b string) int {
+	as, bs := strings.Split(a, "."), strings.Split(b, ".")
+	for i := 0; i < len(as) || i < len(bs); i++ {
+		var x, y int
+		if i < len(as) {
+			x, _ = strconv.Atoi(as[i])
+		}
+		if i < len(bs) {
+			y, _ = strconv.Atoi(bs[i])
+		}
+		if x != y {
+			if x < y {
+				return -1
+			}
+			return 1
+		}
+	}
+	return 0
+}
+
+// RunDoctor runs the doctor subcommand. It exits with ExitCodeError if any check fails.
+func RunDoctor(ctx context.Context, args []string, w io.Writer) (int, error) {
+	fs := flag.NewFlagSet("doctor", flag.ContinueOnError)
+	asJSON := fs.Bool("json", false, "output in JSON format")
+	e, envErr := LoadEnv()
+	if envErr == nil {
+		e.RegisterFlags(fs)
+	}
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: sops-sakura-kms doctor [options]\n")
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return ExitCodeError, err
+	}
+	dir, err := os.Getwd()
+	if err != nil {
+		return ExitCodeError, err
+	}
+
+	var report *DoctorReport
+	if envErr != nil {
+		report = &DoctorReport{}
+		report.add("env", CheckFail, envErr.Error(), "fix the SSK_* and SAKURA_* environment variables")
+	} else {
+		report = runDoctorChecks(ctx, e, dir)
+	}
+	if *asJSON {
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(report); err != nil {
+			return ExitCodeError, err
+		}
+	} else {
+		for _, c := range report.Checks {
+			fmt.Fprintf(w, "[%s] %s: %s\n", c.Status, c.Name, c.Message)
+			if c.Hint != "" && c.Status != CheckPass {
+				fmt.Fprintf(w, "       hint: %s\n", c.Hint)
+			}
+		}
+	}
+	if !report.OK() {
+		return ExitCodeError, nil
+	}
+	return 0, nil
+}
@@ -0,0 +1,170 @@
+package ssk_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	ssk "github.com/fujiwara/sops-sakura-kms"
+	v1 "github.com/sacloud/kms-api-go/apis/v1"
+)
+
+// writeFakeSOPS writes a shell script that prints the given sops version.
+func writeFakeSOPS(t *testing.T, version string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "sops")
+	script := "#!/bin/sh\necho 'sops " + version + " (latest)'\n"
+	if err := os.WriteFile(path, []byte(script), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func freeAddr(t *testing.T) string {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	return l.Addr().String()
+}
+
+func setFakeKMSEnv(t *testing.T, url string) {
+	t.Helper()
+	t.Setenv("SAKURA_ACCESS_TOKEN", "dummy")
+	t.Setenv("SAKURA_ACCESS_TOKEN_SECRET", "dummy")
+	t.Setenv("SAKURA_RETRY_MAX", "0")
+	t.Setenv("SAKURA_RATE_LIMIT", "100000")
+	t.Setenv("SAKURA_ENDPOINTS_KMS", url)
+	t.Setenv("HOME", t.TempDir())
+}
+
+func doctorStatuses(r *ssk.DoctorReport) map[string]ssk.CheckStatus {
+	m := make(map[string]ssk.CheckStatus)
+	for _, c := range r.Checks {
+		m[c.Name] = c.Status
+	}
+	return m
+}
+
+func TestDoctorChecks(t *testing.T) {
+	_, srv := newFakeKMS(t, "111111111111")
+	setFakeKMSEnv(t, srv.URL)
+	t.Setenv("SSK_COMMAND", writeFakeSOPS(t, "3.10.2"))
+	t.Setenv("SSK_SERVER_ADDR", freeAddr(t))
+	t.Setenv("SAKURA_KMS_KEY_ID", "111111111111")
+
+	dir := t.TempDir()
+	conf := "creation_rules:\n  - path_regex: \\.enc\\.yaml$\n    hc_vault_transit_uri: http://127.0.0.1:8200/v1/transit/keys/111111111111\n"
+	if err := os.WriteFile(filepath.Join(dir, ".sops.yaml"), []byte(conf), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	r := ssk.RunDoctorChecks(context.Background(), dir)
+	for _, c := range r.Checks {
+		if c.Status != ssk.CheckPass {
+			t.Errorf("%s: %s: %s", c.Name, c.Status, c.Message)
+		}
+	}
+	if !r.OK() {
+		t.Error("report should be OK")
+	}
+}
+
+func TestDoctorChecksFailures(t *testing.T) {
+	f, srv := newFakeKMS(t, "111111111111")
+	f.setStatus("111111111111", v1.KeyStatusEnumSuspended)
+	setFakeKMSEnv(t, srv.URL)
+	t.Setenv("SSK_COMMAND", writeFakeSOPS(t, "3.8.1"))
+	t.Setenv("SAKURA_KMS_KEY_ID", "111111111111")
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	t.Setenv("SSK_SERVER_ADDR", l.Addr().String())
+
+	r := ssk.RunDoctorChecks(context.Background(), t.TempDir())
+	want := map[string]ssk.CheckStatus{
+		"env":         ssk.CheckPass,
+		"sops":        ssk.CheckFail,
+		"credentials": ssk.CheckPass,
+		"server_addr": ssk.CheckFail,
+		"sops_config": ssk.CheckWarn,
+		"kms_key":     ssk.CheckFail,
+	}
+	got := doctorStatuses(r)
+	for name, status := range want {
+		if got[name] != status {
+			t.Errorf("%s: status = %s, want %s", name, got[name], status)
+		}
+	}
+	for _, c := range r.Checks {
+		if c.Status == ssk.CheckFail && c.Hint == "" {
+			t.Errorf("%s: failed check without a hint", c.Name)
+		}
+	}
+}
+
+func TestRunDoctorJSON(t *testing.T) {
+	for _, k := range []string{"SAKURA_ACCESS_TOKEN", "SAKURA_ACCESS_TOKEN_SECRET", "SAKURACLOUD_ACCESS_TOKEN", "SAKURACLOUD_ACCESS_TOKEN_SECRET", "SAKURA_PROFILE", "SAKURACLOUD_PROFILE"} {
+		t.Setenv(k, "")
+	}
+	t.Setenv("SSK_COMMAND", "sops-not-installed")
+	t.Setenv("SSK_SERVER_ADDR", freeAddr(t))
+	t.Setenv("SAKURA_KMS_KEY_ID", "111111111111")
+	t.Chdir(t.TempDir())
+
+	var buf bytes.Buffer
+	code, err := ssk.RunDoctor(context.Background(), []string{"--json"}, &buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if code != ssk.ExitCodeError {
+		t.Errorf("exit code = %d, want %d", code, ssk.ExitCodeError)
+	}
+	var r ssk.DoctorReport
+	if err := json.Unmarshal(buf.Bytes(), &r); err != nil {
+		t.Fatalf("invalid JSON: %v\n%s", err, buf.String())
+	}
+	got := doctorStatuses(&r)
+	if got["sops"] != ssk.CheckFail || got["credentials"] != ssk.CheckFail || got["kms_key"] != ssk.CheckSkip {
+		t.Errorf("unexpected statuses: %v", got)
+	}
+}
+
+func TestDoctorIncompleteCredentials(t *testing.T) {
+	_, srv := newFakeKMS(t, "111111111111")
+	setFakeKMSEnv(t, srv.URL)
+	t.Setenv("SSK_SERVER_ADDR", freeAddr(t))
+	t.Setenv("SAKURA_KMS_KEY_ID", "111111111111")
+	t.Setenv("SSK_CREDENTIAL_PROCESS", "")
+	setupConfigFiles(t, "", "")
+
+	t.Setenv("SAKURA_ACCESS_TOKEN_SECRET", "")
+	if got := doctorStatuses(ssk.RunDoctorChecks(t.Context(), t.TempDir())); got["credentials"] != ssk.CheckFail {
+		t.Errorf("credentials check without the secret: %v", got["credentials"])
+	}
+
+	t.Setenv("SAKURA_ACCESS_TOKEN", "")
+	profileDir := t.TempDir()
+	if err := os.Mkdir(filepath.Join(profileDir, "work"), 0o700); err != nil {
+		t.Fatal(err)
+	}
+	writeEnvFile(t, filepath.Join(profileDir, "work", "config.json"), `{"AccessToken": "token-work"}`)
+	t.Setenv("SAKURA_PROFILE", "work")
+	t.Setenv("SAKURA_PROFILE_DIR", profileDir)
+	r := ssk.RunDoctorChecks(t.Context(), t.TempDir())
+	for _, check := range r.Checks {
+		if check.Name == "credentials" && (check.Status != ssk.CheckFail || !strings.Contains(check.Message, "AccessTokenSecret")) {
+			t.Errorf("unexpected credentials check for a profile without the secret: %+v", check)
+		}
+	}
+}
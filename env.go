@@ -1,25 +1,93 @@
 package ssk
 
 import (
+	"flag"
 	"fmt"
+	"log/slog"
 	"os"
 	"reflect"
+	"slices"
 	"strconv"
 	"strings"
+	"time"
+
+	v1 "github.com/sacloud/kms-api-go/apis/v1"
+	"go.yaml.in/yaml/v3"
 )
 
+// Env is the configuration of sops-sakura-kms.
+// Each field is read from the environment variables in its "env" tag or the
+// key in its "yaml" tag of the configuration files, and can be overridden by
+// the command-line flag in its "flag" tag. Fields with the "secret" tag are
+// masked by `config show`. Only the fields with the "project" tag may be set
+// in the project-level configuration file, which comes with a repository:
+// it must not choose the command, the credentials or the server.
 type Env struct {
-	KMSKeyID   string `env:"SAKURA_KMS_KEY_ID,SAKURACLOUD_KMS_KEY_ID"`
-	ServerOnly bool   `env:"SSK_SERVER_ONLY" default:"false"`
-	ServerAddr string `env:"SSK_SERVER_ADDR" default:"127.0.0.1:8200"`
-	Command    string `env:"SSK_COMMAND" default:"sops"`
+	KMSKeyID           string            `env:"SAKURA_KMS_KEY_ID,SAKURACLOUD_KMS_KEY_ID" yaml:"key_id" project:"true" flag:"key-id" usage:"Sakura Cloud KMS resource ID"`
+	AccessToken        string            `env:"SAKURA_ACCESS_TOKEN,SAKURACLOUD_ACCESS_TOKEN" yaml:"access_token" secret:"true"`
+	AccessTokenSecret  string            `env:"SAKURA_ACCESS_TOKEN_SECRET,SAKURACLOUD_ACCESS_TOKEN_SECRET" yaml:"access_token_secret" secret:"true"`
+	Profile            string            `env:"SAKURA_PROFILE,SAKURACLOUD_PROFILE,USACLOUD_PROFILE" yaml:"profile" flag:"profile" usage:"name of the usacloud profile for the credentials"`
+	ProfileDir         string            `env:"SAKURA_PROFILE_DIR,SAKURACLOUD_PROFILE_DIR,USACLOUD_PROFILE_DIR" yaml:"profile_dir" flag:"profile-dir" usage:"directory of the usacloud profiles"`
+	CredentialProcess  string            `env:"SSK_CREDENTIAL_PROCESS" yaml:"credential_process" flag:"credential-process" usage:"command printing the credentials as JSON"`
+	ServerOnly         bool              `env:"SSK_SERVER_ONLY" yaml:"server_only" default:"false" flag:"server-only" usage:"run the server without executing the command"`
+	ServerAddr         string            `env:"SSK_SERVER_ADDR" yaml:"server_addr" default:"127.0.0.1:8200" flag:"server-addr" usage:"server listen address"`
+	Command            string            `env:"SSK_COMMAND" yaml:"command" default:"sops" flag:"command" usage:"command to execute"`
+	Algorithm          string            `env:"SSK_ALGORITHM" yaml:"algorithm" project:"true" default:"aes-256-gcm" flag:"algorithm" usage:"encryption algorithm"`
+	KeyAlgorithms      map[string]string `env:"SSK_KEY_ALGORITHMS" yaml:"key_algorithms" project:"true" flag:"key-algorithms" usage:"encryption algorithm per key ID (id=algo,...)"`
+	KeyAliases         map[string]string `env:"SSK_KEY_ALIASES" yaml:"key_aliases" flag:"key-aliases" usage:"aliases of KMS resource IDs (alias=id,...)"`
+	KeyIDMismatch      string            `env:"SSK_KEY_ID_MISMATCH" yaml:"key_id_mismatch" default:"reject" flag:"key-id-mismatch" usage:"how to handle a key ID mismatch on decrypt (reject or correct)"`
+	Preflight          bool              `env:"SSK_PREFLIGHT" yaml:"preflight" project:"true" default:"false" flag:"preflight" usage:"check the key before executing the command"`
+	PreflightRoundTrip bool              `env:"SSK_PREFLIGHT_ROUNDTRIP" yaml:"preflight_roundtrip" project:"true" default:"false" flag:"preflight-roundtrip" usage:"also do an encrypt/decrypt round-trip in the preflight check"`
+	Native             bool              `env:"SSK_NATIVE" yaml:"native" default:"false" flag:"native" usage:"run exec-env and exec-file in-process without the sops command"`
+	AgentDir           string            `env:"SSK_AGENT_DIR" yaml:"agent_dir" flag:"agent-dir" usage:"directory of the agent pidfile and state file (default: $XDG_RUNTIME_DIR/sops-sakura-kms)"`
+	NoAgent            bool              `env:"SSK_NO_AGENT" yaml:"no_agent" default:"false" flag:"no-agent" usage:"start a server even if an agent is running"`
+	MaxLifetime        time.Duration     `env:"SSK_MAX_LIFETIME" yaml:"max_lifetime" flag:"max-lifetime" usage:"shut down the server after this duration, e.g. 8h"`
+	IdleTimeout        time.Duration     `env:"SSK_IDLE_TIMEOUT" yaml:"idle_timeout" flag:"idle-timeout" usage:"shut down the server after no requests for this duration, e.g. 30m"`
+	MaxDecrypts        int               `env:"SSK_MAX_DECRYPTS" yaml:"max_decrypts" flag:"max-decrypts" usage:"shut down the server after this number of decrypt operations"`
+	ConfirmKeys        []string          `env:"SSK_CONFIRM_KEYS" yaml:"confirm_keys" flag:"confirm-keys" usage:"key IDs whose decrypt requests need the user's approval (comma-separated, * for all)"`
+	ConfirmTTL         time.Duration     `env:"SSK_CONFIRM_TTL" yaml:"confirm_ttl" default:"1m" flag:"confirm-ttl" usage:"how long an approval is cached (0 asks every time)"`
+	Askpass            string            `env:"SSK_ASKPASS" yaml:"askpass" flag:"askpass" usage:"program to ask for approval instead of the terminal"`
+	AllowedKeys        []string          `env:"SSK_ALLOWED_KEYS" yaml:"allowed_keys" flag:"allowed-keys" usage:"key IDs the server accepts (comma-separated, default all)"`
+	LogLevel           string            `env:"SSK_LOG_LEVEL" yaml:"log_level" flag:"log-level" usage:"log level (debug, info, warn or error; default info)"`
+	EnvFile            string            `env:"SSK_ENV_FILE" yaml:"-" usage:"dotenv file loaded into the environment, again on reload"`
 }
 
-// LoadEnv loads environment variables into an Env struct based on struct tags.
-// It reads the "env" tag for the environment variable name,
-// "default" tag for default values, and "required" tag for required fields.
+// LoadEnv loads the configuration into an Env struct based on struct tags.
+// Each field is set from the first of:
+//
+//   - the environment variables in the "env" tag (first match wins), or the
+//     file named by the variable with the "_FILE" suffix (e.g. SAKURA_ACCESS_TOKEN_FILE)
+//   - the key in the "yaml" tag of the project-level configuration file
+//     (.sops-sakura-kms.yaml in the current directory or its parents)
+//   - the key in the user-level configuration file
+//     ($XDG_CONFIG_HOME/sops-sakura-kms/config.yaml, default ~/.config/sops-sakura-kms/config.yaml)
+//   - the "default" tag
+//
+// A field with the "required" tag must be set. Command-line flags defined by
+// RegisterFlags take precedence over all of them.
+//
+// If SSK_ENV_FILE is set, the variables in the dotenv file are set to the
+// environment first, overriding the existing ones.
 func LoadEnv() (*Env, error) {
+	env, _, err := loadEnv()
+	return env, err
+}
+
+// loadEnv loads the configuration as LoadEnv does, and returns the source of
+// each field by the field name: "$NAME" for an environment variable, the path
+// of a configuration file, or "default".
+func loadEnv() (*Env, map[string]string, error) {
+	if path := os.Getenv("SSK_ENV_FILE"); path != "" {
+		if err := applyEnvFile(path); err != nil {
+			return nil, nil, err
+		}
+	}
+	files, err := loadConfigFiles()
+	if err != nil {
+		return nil, nil, err
+	}
 	env := &Env{}
+	sources := make(map[string]string)
 	v := reflect.ValueOf(env).Elem()
 	t := v.Type()
 
@@ -32,40 +100,286 @@ func LoadEnv() (*Env, error) {
 			continue
 		}
 
+		var value, source string
+		if value = field.Tag.Get("default"); value != "" {
+			source = "default"
+		}
+
+		// Lower-priority configuration files first
+		var node *yaml.Node
+		key := field.Tag.Get("yaml")
+		for _, f := range files {
+			if n, ok := f.values[key]; ok && n.Tag != "!!null" {
+				node, source = &n, f.path
+			}
+		}
+
 		// Support comma-separated environment variable names (first match wins)
 		envNames := strings.Split(envTag, ",")
-		var value string
 		for _, envName := range envNames {
 			envName = strings.TrimSpace(envName)
 			if v := os.Getenv(envName); v != "" {
-				value = v
+				value, source, node = v, "$"+envName, nil
+				break
+			}
+			if path := os.Getenv(envName + "_FILE"); path != "" {
+				b, err := os.ReadFile(path)
+				if err != nil {
+					return nil, nil, fmt.Errorf("failed to read %s_FILE: %w", envName, err)
+				}
+				value, source, node = strings.TrimRight(string(b), "\r\n"), "$"+envName+"_FILE", nil
 				break
 			}
-		}
-		if value == "" {
-			value = field.Tag.Get("default")
 		}
 
 		_, required := field.Tag.Lookup("required")
-		if required && value == "" {
-			return nil, fmt.Errorf("required environment variable %s is not set", strings.Join(envNames, " or "))
+		if required && value == "" && node == nil {
+			return nil, nil, fmt.Errorf("required environment variable %s is not set", strings.Join(envNames, " or "))
 		}
 
-		switch fieldValue.Kind() {
-		case reflect.String:
-			fieldValue.SetString(value)
-		case reflect.Bool:
-			if value != "" {
-				b, err := strconv.ParseBool(value)
-				if err != nil {
-					return nil, fmt.Errorf("invalid boolean value for %s: %w", envTag, err)
-				}
-				fieldValue.SetBool(b)
+		if node != nil {
+			if err := decodeField(fieldValue, node); err != nil {
+				return nil, nil, fmt.Errorf("invalid value for %s in %s: %w", key, source, err)
 			}
-		default:
-			return nil, fmt.Errorf("unsupported field type: %s", fieldValue.Kind())
+		} else if err := setField(fieldValue, value); err != nil {
+			return nil, nil, fmt.Errorf("invalid value for %s: %w", envTag, err)
 		}
+		sources[field.Name] = source
 	}
 
-	return env, nil
+	return env, sources, nil
+}
+
+// setField sets the string value of an environment variable or a flag to the field.
+// Lists are comma-separated, and maps are comma-separated key=value pairs.
+func setField(v reflect.Value, s string) error {
+	switch p := v.Addr().Interface().(type) {
+	case *string:
+		*p = s
+	case *bool:
+		if s != "" {
+			b, err := strconv.ParseBool(s)
+			if err != nil {
+				return err
+			}
+			*p = b
+		}
+	case *int:
+		if s != "" {
+			n, err := strconv.Atoi(s)
+			if err != nil {
+				return err
+			}
+			*p = n
+		}
+	case *time.Duration:
+		if s != "" {
+			d, err := time.ParseDuration(s)
+			if err != nil {
+				return err
+			}
+			*p = d
+		}
+	case *[]string:
+		*p = splitList(s)
+	case *map[string]string:
+		m, err := parseMap(s)
+		if err != nil {
+			return err
+		}
+		*p = m
+	default:
+		return fmt.Errorf("unsupported field type: %s", v.Type())
+	}
+	return nil
+}
+
+// decodeField sets the value of a configuration file to the field.
+// A scalar is parsed as the value of an environment variable, so that
+// "8h" is a duration and "a,b" is a list.
+func decodeField(v reflect.Value, node *yaml.Node) error {
+	if node.Kind == yaml.ScalarNode {
+		return setField(v, node.Value)
+	}
+	return node.Decode(v.Addr().Interface())
+}
+
+// parseMap parses comma-separated key=value pairs.
+func parseMap(s string) (map[string]string, error) {
+	var m map[string]string
+	for pair := range strings.SplitSeq(s, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		k, v, ok := strings.Cut(pair, "=")
+		if !ok || strings.TrimSpace(k) == "" {
+			return nil, fmt.Errorf("invalid pair %q: must be key=value", pair)
+		}
+		if m == nil {
+			m = make(map[string]string)
+		}
+		m[strings.TrimSpace(k)] = strings.TrimSpace(v)
+	}
+	return m, nil
+}
+
+// formatField formats the value of the field as an environment variable.
+func formatField(v reflect.Value) string {
+	switch x := v.Interface().(type) {
+	case []string:
+		return strings.Join(x, ",")
+	case map[string]string:
+		pairs := make([]string, 0, len(x))
+		for k, v := range x {
+			pairs = append(pairs, k+"="+v)
+		}
+		slices.Sort(pairs)
+		return strings.Join(pairs, ",")
+	default:
+		return fmt.Sprint(x)
+	}
+}
+
+// KMSOptions returns the SakuraKMS options for the algorithms configured in the Env.
+func (e *Env) KMSOptions() ([]SakuraKMSOption, error) {
+	var opts []SakuraKMSOption
+	if e.Algorithm != "" {
+		algo, err := ParseAlgorithm(e.Algorithm)
+		if err != nil {
+			return nil, fmt.Errorf("invalid SSK_ALGORITHM: %w", err)
+		}
+		opts = append(opts, WithAlgorithm(algo))
+	}
+	if len(e.KeyAlgorithms) > 0 {
+		m := make(map[string]v1.KeyEncryptAlgoEnum, len(e.KeyAlgorithms))
+		for keyID, name := range e.KeyAlgorithms {
+			algo, err := ParseAlgorithm(name)
+			if err != nil {
+				return nil, fmt.Errorf("invalid SSK_KEY_ALGORITHMS: invalid key algorithm for %s: %w", keyID, err)
+			}
+			m[e.resolveAlias(keyID)] = algo
+		}
+		opts = append(opts, WithKeyAlgorithms(m))
+	}
+	if len(e.KeyAliases) > 0 {
+		opts = append(opts, WithKeyAliases(e.KeyAliases))
+	}
+	if e.AccessToken != "" && e.AccessTokenSecret != "" {
+		opts = append(opts, WithCredentials(e.AccessToken, e.AccessTokenSecret))
+	}
+	if e.Profile != "" || e.ProfileDir != "" {
+		opts = append(opts, WithProfile(e.Profile, e.ProfileDir))
+	}
+	if e.CredentialProcess != "" {
+		opts = append(opts, WithCredentialProcess(e.CredentialProcess))
+	}
+	return opts, nil
+}
+
+// SessionLimits returns the session limits of the server configured in the Env.
+func (e *Env) SessionLimits() (SessionLimits, error) {
+	l := SessionLimits{MaxLifetime: e.MaxLifetime, IdleTimeout: e.IdleTimeout, MaxDecrypts: e.MaxDecrypts}
+	if l.MaxLifetime < 0 || l.IdleTimeout < 0 || l.MaxDecrypts < 0 {
+		return l, fmt.Errorf("session limits must not be negative")
+	}
+	return l, nil
+}
+
+// ConfirmPolicy returns the confirm policy configured in the Env, or nil if no keys need approval.
+func (e *Env) ConfirmPolicy() (*ConfirmPolicy, error) {
+	if len(e.ConfirmKeys) == 0 {
+		return nil, nil
+	}
+	if e.ConfirmTTL < 0 {
+		return nil, fmt.Errorf("invalid SSK_CONFIRM_TTL: must not be negative")
+	}
+	p := &ConfirmPolicy{KeyIDs: e.resolveAliases(e.ConfirmKeys), TTL: e.ConfirmTTL}
+	if e.Askpass != "" {
+		p.Confirmer = &AskpassConfirmer{Command: e.Askpass}
+	} else {
+		p.Confirmer = &TerminalConfirmer{}
+	}
+	return p, nil
+}
+
+// resolveAlias returns the resource ID of keyID if it is an alias in KeyAliases, or keyID.
+// The names of the KMS keys are not looked up, as the policies must not
+// change by renaming a key.
+func (e *Env) resolveAlias(keyID string) string {
+	if id, ok := e.KeyAliases[keyID]; ok {
+		return id
+	}
+	return keyID
+}
+
+// resolveAliases is resolveAlias for a list of key IDs.
+func (e *Env) resolveAliases(keyIDs []string) []string {
+	if len(keyIDs) == 0 {
+		return nil
+	}
+	ids := make([]string, len(keyIDs))
+	for i, keyID := range keyIDs {
+		ids[i] = e.resolveAlias(keyID)
+	}
+	return ids
+}
+
+// applyLogLevel sets the level of the default logger to the log level configured in the Env.
+func (e *Env) applyLogLevel() error {
+	level := slog.LevelInfo
+	if e.LogLevel != "" {
+		if err := level.UnmarshalText([]byte(e.LogLevel)); err != nil {
+			return fmt.Errorf("invalid SSK_LOG_LEVEL: %w", err)
+		}
+	}
+	slog.SetLogLoggerLevel(level)
+	return nil
+}
+
+// RegisterFlags defines a command-line flag for each field of e that has a "flag" tag.
+// The current values of e are used as the defaults, so flags take precedence
+// over environment variables.
+func (e *Env) RegisterFlags(fs *flag.FlagSet) {
+	v := reflect.ValueOf(e).Elem()
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		name := field.Tag.Get("flag")
+		if name == "" {
+			continue
+		}
+		usage := field.Tag.Get("usage")
+		if envTag := field.Tag.Get("env"); envTag != "" {
+			usage += " ($" + strings.Split(envTag, ",")[0] + ")"
+		}
+		switch p := v.Field(i).Addr().Interface().(type) {
+		case *string:
+			fs.StringVar(p, name, *p, usage)
+		case *bool:
+			fs.BoolVar(p, name, *p, usage)
+		case *int:
+			fs.IntVar(p, name, *p, usage)
+		case *time.Duration:
+			fs.DurationVar(p, name, *p, usage)
+		case *[]string, *map[string]string:
+			fs.Var(&fieldFlag{v.Field(i)}, name, usage)
+		}
+	}
+}
+
+// fieldFlag is a flag.Value of a list or map field of Env.
+type fieldFlag struct {
+	v reflect.Value
+}
+
+func (f *fieldFlag) String() string {
+	if !f.v.IsValid() {
+		return ""
+	}
+	return formatField(f.v)
+}
+
+func (f *fieldFlag) Set(s string) error {
+	return setField(f.v, s)
 }
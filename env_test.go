@@ -1,19 +1,40 @@
 package ssk_test
 
 import (
+	"flag"
 	"os"
+	"reflect"
+	"slices"
 	"strconv"
 	"testing"
+	"time"
 
 	ssk "github.com/fujiwara/sops-sakura-kms"
 	"github.com/google/go-cmp/cmp"
 )
 
 var envSet = map[string]string{
-	"SAKURACLOUD_KMS_KEY_ID": "example-key-id-2",
-	"SSK_SERVER_ADDR":        "192.168.0.1:8200",
-	"SSK_COMMAND":            "/usr/local/bin/sops",
-	"SSK_SERVER_ONLY":        "true",
+	"SAKURACLOUD_KMS_KEY_ID":  "example-key-id-2",
+	"SSK_SERVER_ADDR":         "192.168.0.1:8200",
+	"SSK_COMMAND":             "/usr/local/bin/sops",
+	"SSK_SERVER_ONLY":         "true",
+	"SSK_ALGORITHM":           "aes-256-cbc",
+	"SSK_KEY_ALGORITHMS":      "example-key-id-2=aes-256-kw",
+	"SSK_KEY_ALIASES":         "prod-app=113702485493, dev-app=210987654321",
+	"SSK_PREFLIGHT":           "true",
+	"SSK_PREFLIGHT_ROUNDTRIP": "true",
+	"SSK_NATIVE":              "true",
+	"SSK_KEY_ID_MISMATCH":     "correct",
+	"SSK_AGENT_DIR":           "/run/user/1000/ssk",
+	"SSK_NO_AGENT":            "true",
+	"SSK_MAX_LIFETIME":        "8h",
+	"SSK_IDLE_TIMEOUT":        "30m",
+	"SSK_MAX_DECRYPTS":        "100",
+	"SSK_CONFIRM_KEYS":        "example-key-id-2",
+	"SSK_CONFIRM_TTL":         "30s",
+	"SSK_ASKPASS":             "/usr/bin/ssh-askpass",
+	"SSK_ALLOWED_KEYS":        "example-key-id,example-key-id-2",
+	"SSK_LOG_LEVEL":           "debug",
 }
 
 func TestParseEnv(t *testing.T) {
@@ -25,11 +46,31 @@ func TestParseEnv(t *testing.T) {
 		t.Fatalf("failed to create parser: %v", err)
 	}
 	serverOnly, _ := strconv.ParseBool(os.Getenv("SSK_SERVER_ONLY")) // default is false
+	preflight, _ := strconv.ParseBool(os.Getenv("SSK_PREFLIGHT"))
+	preflightRoundTrip, _ := strconv.ParseBool(os.Getenv("SSK_PREFLIGHT_ROUNDTRIP"))
+	native, _ := strconv.ParseBool(os.Getenv("SSK_NATIVE"))
 	if diff := cmp.Diff(&ssk.Env{
-		ServerAddr: os.Getenv("SSK_SERVER_ADDR"),
-		Command:    os.Getenv("SSK_COMMAND"),
-		KMSKeyID:   os.Getenv("SAKURACLOUD_KMS_KEY_ID"),
-		ServerOnly: serverOnly,
+		ServerAddr:         os.Getenv("SSK_SERVER_ADDR"),
+		Command:            os.Getenv("SSK_COMMAND"),
+		KMSKeyID:           os.Getenv("SAKURACLOUD_KMS_KEY_ID"),
+		ServerOnly:         serverOnly,
+		Algorithm:          os.Getenv("SSK_ALGORITHM"),
+		KeyAlgorithms:      map[string]string{"example-key-id-2": "aes-256-kw"},
+		KeyAliases:         map[string]string{"prod-app": "113702485493", "dev-app": "210987654321"},
+		KeyIDMismatch:      os.Getenv("SSK_KEY_ID_MISMATCH"),
+		Preflight:          preflight,
+		PreflightRoundTrip: preflightRoundTrip,
+		Native:             native,
+		AgentDir:           os.Getenv("SSK_AGENT_DIR"),
+		NoAgent:            true,
+		MaxLifetime:        8 * time.Hour,
+		IdleTimeout:        30 * time.Minute,
+		MaxDecrypts:        100,
+		ConfirmKeys:        []string{"example-key-id-2"},
+		ConfirmTTL:         30 * time.Second,
+		Askpass:            os.Getenv("SSK_ASKPASS"),
+		AllowedKeys:        []string{"example-key-id", "example-key-id-2"},
+		LogLevel:           os.Getenv("SSK_LOG_LEVEL"),
 	}, e); diff != "" {
 		t.Errorf("parsed env mismatch (-want +got):\n%s", diff)
 	}
@@ -42,10 +83,13 @@ func TestParseEnvDefault(t *testing.T) {
 		t.Fatalf("failed to load environment variables: %v", err)
 	}
 	if diff := cmp.Diff(&ssk.Env{
-		ServerAddr: "127.0.0.1:8200",
-		Command:    "sops",
-		KMSKeyID:   os.Getenv("SAKURACLOUD_KMS_KEY_ID"),
-		ServerOnly: false,
+		ServerAddr:    "127.0.0.1:8200",
+		Command:       "sops",
+		KMSKeyID:      os.Getenv("SAKURACLOUD_KMS_KEY_ID"),
+		ServerOnly:    false,
+		Algorithm:     "aes-256-gcm",
+		KeyIDMismatch: "reject",
+		ConfirmTTL:    ssk.DefaultConfirmTTL,
 	}, e); diff != "" {
 		t.Errorf("parsed env mismatch (-want +got):\n%s", diff)
 	}
@@ -74,10 +118,27 @@ func TestLoadEnv(t *testing.T) {
 		}
 		serverOnly, _ := strconv.ParseBool(envSet["SSK_SERVER_ONLY"])
 		if diff := cmp.Diff(&ssk.Env{
-			KMSKeyID:   envSet["SAKURACLOUD_KMS_KEY_ID"],
-			ServerOnly: serverOnly,
-			ServerAddr: envSet["SSK_SERVER_ADDR"],
-			Command:    envSet["SSK_COMMAND"],
+			KMSKeyID:           envSet["SAKURACLOUD_KMS_KEY_ID"],
+			ServerOnly:         serverOnly,
+			ServerAddr:         envSet["SSK_SERVER_ADDR"],
+			Command:            envSet["SSK_COMMAND"],
+			Algorithm:          envSet["SSK_ALGORITHM"],
+			KeyAlgorithms:      map[string]string{"example-key-id-2": "aes-256-kw"},
+			KeyAliases:         map[string]string{"prod-app": "113702485493", "dev-app": "210987654321"},
+			KeyIDMismatch:      envSet["SSK_KEY_ID_MISMATCH"],
+			Preflight:          true,
+			PreflightRoundTrip: true,
+			Native:             true,
+			AgentDir:           envSet["SSK_AGENT_DIR"],
+			NoAgent:            true,
+			MaxLifetime:        8 * time.Hour,
+			IdleTimeout:        30 * time.Minute,
+			MaxDecrypts:        100,
+			ConfirmKeys:        []string{"example-key-id-2"},
+			ConfirmTTL:         30 * time.Second,
+			Askpass:            envSet["SSK_ASKPASS"],
+			AllowedKeys:        []string{"example-key-id", "example-key-id-2"},
+			LogLevel:           envSet["SSK_LOG_LEVEL"],
 		}, env); diff != "" {
 			t.Errorf("LoadEnv mismatch (-want +got):\n%s", diff)
 		}
@@ -91,10 +152,13 @@ func TestLoadEnv(t *testing.T) {
 			t.Fatalf("unexpected error: %v", err)
 		}
 		if diff := cmp.Diff(&ssk.Env{
-			KMSKeyID:   "test-key-id",
-			ServerOnly: false,
-			ServerAddr: "127.0.0.1:8200",
-			Command:    "sops",
+			KMSKeyID:      "test-key-id",
+			ServerOnly:    false,
+			ServerAddr:    "127.0.0.1:8200",
+			Command:       "sops",
+			Algorithm:     "aes-256-gcm",
+			KeyIDMismatch: "reject",
+			ConfirmTTL:    ssk.DefaultConfirmTTL,
 		}, env); diff != "" {
 			t.Errorf("LoadEnv mismatch (-want +got):\n%s", diff)
 		}
@@ -146,3 +210,26 @@ func TestLoadEnv(t *testing.T) {
 		}
 	})
 }
+
+// TestRegisterFlagsCoversEnv fails when a field of Env has no command-line flag.
+func TestRegisterFlagsCoversEnv(t *testing.T) {
+	// secrets must not appear in the process list, and the env file is read before the flags
+	noFlag := []string{"AccessToken", "AccessTokenSecret", "EnvFile"}
+	var e ssk.Env
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	e.RegisterFlags(fs)
+	typ := reflect.TypeFor[ssk.Env]()
+	for i := 0; i < typ.NumField(); i++ {
+		field := typ.Field(i)
+		name := field.Tag.Get("flag")
+		if slices.Contains(noFlag, field.Name) {
+			if name != "" {
+				t.Errorf("%s must not have a flag", field.Name)
+			}
+			continue
+		}
+		if name == "" || fs.Lookup(name) == nil {
+			t.Errorf("%s has no flag", field.Name)
+		}
+	}
+}
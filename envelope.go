@@ -0,0 +1,376 @@
+package ssk
+
+import (
+	"bufio"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Envelope file format
+//
+// A file encrypted by EncryptStream consists of:
+//
+//	magic       8 bytes   "SSKENV\x00\x01"
+//	header_len  4 bytes   big-endian length of the header
+//	header      JSON      EnvelopeHeader
+//	chunks      ...       AES-256-GCM encrypted chunks
+//
+// The plaintext is split into chunks of header.chunk_size bytes (the last
+// chunk may be shorter or empty). Each chunk is sealed with the data key and
+// the 12-byte nonce nonce_prefix (7 bytes) || chunk index (4 bytes, big-endian)
+// || last flag (1 byte, 1 for the last chunk), with the magic, header_len
+// and header as additional data. Every chunk but the last is therefore
+// chunk_size+16 bytes long. Truncation, reordering and header tampering
+// are detected on decryption.
+//
+// The 32-byte data key is encrypted by Cipher.Encrypt for each KMS key in
+// header.keys; any one of them can decrypt the file.
+
+const (
+	envelopeMagic          = "SSKENV\x00\x01"
+	envelopeVersion        = 1
+	envelopeCipher         = "AES-256-GCM"
+	envelopeNoncePrefixLen = 7
+	envelopeDataKeyLen     = 32
+	maxEnvelopeHeaderLen   = 1 << 20
+	minEnvelopeChunkSize   = 1 << 10
+	maxEnvelopeChunkSize   = 16 << 20
+
+	// DefaultChunkSize is the default plaintext chunk size of EncryptStream.
+	DefaultChunkSize = 64 << 10
+)
+
+// ErrNotEnvelope is returned when the input is not an envelope-encrypted file.
+var ErrNotEnvelope = errors.New("not a sops-sakura-kms envelope")
+
+// EnvelopeHeader is the self-describing header of an envelope-encrypted file.
+type EnvelopeHeader struct {
+	Version     int           `json:"version"`
+	Cipher      string        `json:"cipher"`
+	ChunkSize   int           `json:"chunk_size"`
+	NoncePrefix []byte        `json:"nonce_prefix"`
+	Keys        []EnvelopeKey `json:"keys"`
+}
+
+// EnvelopeKey is the data key encrypted with a KMS key.
+type EnvelopeKey struct {
+	KeyID        string `json:"key_id"`
+	EncryptedKey string `json:"encrypted_key"`
+}
+
+// EncryptStream reads plaintext from src and writes it to dst with envelope
+// encryption: the stream is encrypted with a random data key in chunks, and
+// the data key is encrypted with cipher for each of keyIDs.
+// If chunkSize is 0, DefaultChunkSize is used.
+func EncryptStream(ctx context.Context, c Cipher, keyIDs []string, dst io.Writer, src io.Reader, chunkSize int) error {
+	if len(keyIDs) == 0 {
+		return errors.New("no KMS key IDs given")
+	}
+	if chunkSize == 0 {
+		chunkSize = DefaultChunkSize
+	}
+	if chunkSize < minEnvelopeChunkSize || chunkSize > maxEnvelopeChunkSize {
+		return fmt.Errorf("chunk size must be between %d and %d", minEnvelopeChunkSize, maxEnvelopeChunkSize)
+	}
+	dataKey := make([]byte, envelopeDataKeyLen)
+	if _, err := rand.Read(dataKey); err != nil {
+		return err
+	}
+	header := EnvelopeHeader{
+		Version:     envelopeVersion,
+		Cipher:      envelopeCipher,
+		ChunkSize:   chunkSize,
+		NoncePrefix: make([]byte, envelopeNoncePrefixLen),
+	}
+	if _, err := rand.Read(header.NoncePrefix); err != nil {
+		return err
+	}
+	for _, keyID := range keyIDs {
+		// record the resource ID of a key alias, as the alias may be changed
+		if r, ok := c.(KeyResolver); ok {
+			resolved, err := r.ResolveKeyID(ctx, keyID)
+			if err != nil {
+				return err
+			}
+			keyID = resolved
+		}
+		encrypted, err := c.Encrypt(ctx, keyID, dataKey)
+		if err != nil {
+			return fmt.Errorf("failed to encrypt the data key with %s: %w", keyID, err)
+		}
+		header.Keys = append(header.Keys, EnvelopeKey{KeyID: keyID, EncryptedKey: encrypted})
+	}
+
+	hb, err := json.Marshal(header)
+	if err != nil {
+		return err
+	}
+	prefix := make([]byte, 0, len(envelopeMagic)+4+len(hb))
+	prefix = append(prefix, envelopeMagic...)
+	prefix = binary.BigEndian.AppendUint32(prefix, uint32(len(hb)))
+	prefix = append(prefix, hb...)
+	if _, err := dst.Write(prefix); err != nil {
+		return err
+	}
+
+	aead, err := newEnvelopeAEAD(dataKey)
+	if err != nil {
+		return err
+	}
+	// Read one byte beyond the chunk to know whether it is the last one.
+	buf := make([]byte, chunkSize+1)
+	n, err := io.ReadFull(src, buf)
+	for index := uint32(0); ; index++ {
+		last := false
+		switch {
+		case err == io.EOF || err == io.ErrUnexpectedEOF:
+			last = true
+		case err != nil:
+			return err
+		}
+		size := min(n, chunkSize)
+		sealed := aead.Seal(nil, envelopeNonce(header.NoncePrefix, index, last), buf[:size], prefix)
+		if _, err := dst.Write(sealed); err != nil {
+			return err
+		}
+		if last {
+			return nil
+		}
+		if index == ^uint32(0) {
+			return errors.New("input is too large")
+		}
+		// carry over the extra byte
+		buf[0] = buf[chunkSize]
+		var m int
+		m, err = io.ReadFull(src, buf[1:])
+		n = m + 1
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+	}
+}
+
+// ReadEnvelopeHeader reads the header of an envelope-encrypted file.
+func ReadEnvelopeHeader(r io.Reader) (*EnvelopeHeader, error) {
+	h, _, err := readEnvelopeHeader(r)
+	return h, err
+}
+
+func readEnvelopeHeader(r io.Reader) (*EnvelopeHeader, []byte, error) {
+	prefix := make([]byte, len(envelopeMagic)+4)
+	if _, err := io.ReadFull(r, prefix); err != nil {
+		return nil, nil, fmt.Errorf("%w: %w", ErrNotEnvelope, err)
+	}
+	if string(prefix[:len(envelopeMagic)]) != envelopeMagic {
+		return nil, nil, ErrNotEnvelope
+	}
+	hlen := binary.BigEndian.Uint32(prefix[len(envelopeMagic):])
+	if hlen > maxEnvelopeHeaderLen {
+		return nil, nil, fmt.Errorf("%w: header too large", ErrNotEnvelope)
+	}
+	hb := make([]byte, hlen)
+	if _, err := io.ReadFull(r, hb); err != nil {
+		return nil, nil, fmt.Errorf("%w: %w", ErrNotEnvelope, err)
+	}
+	var h EnvelopeHeader
+	if err := json.Unmarshal(hb, &h); err != nil {
+		return nil, nil, fmt.Errorf("%w: %w", ErrNotEnvelope, err)
+	}
+	if h.Version != envelopeVersion || h.Cipher != envelopeCipher {
+		return nil, nil, fmt.Errorf("unsupported envelope version %d (%s)", h.Version, h.Cipher)
+	}
+	if h.ChunkSize < minEnvelopeChunkSize || h.ChunkSize > maxEnvelopeChunkSize || len(h.NoncePrefix) != envelopeNoncePrefixLen {
+		return nil, nil, fmt.Errorf("%w: invalid header", ErrNotEnvelope)
+	}
+	return &h, append(prefix, hb...), nil
+}
+
+// DecryptStream reads an envelope-encrypted file from src and writes the
+// plaintext to dst. The data key is decrypted with cipher using the first
+// KMS key in the header that succeeds.
+//
+// Chunks are written as soon as they are authenticated, so if an error is
+// returned, dst may have received a prefix of the plaintext and must be discarded.
+func DecryptStream(ctx context.Context, c Cipher, dst io.Writer, src io.Reader) error {
+	header, aad, err := readEnvelopeHeader(src)
+	if err != nil {
+		return err
+	}
+	var dataKey []byte
+	var errs []error
+	for _, k := range header.Keys {
+		key, err := c.Decrypt(ctx, k.KeyID, k.EncryptedKey)
+		if err == nil && len(key) != envelopeDataKeyLen {
+			// AES-128 or AES-192 must not be accepted for an AES-256-GCM envelope
+			err = fmt.Errorf("the data key is %d bytes, must be %d", len(key), envelopeDataKeyLen)
+		}
+		if err == nil {
+			dataKey = key
+			break
+		}
+		errs = append(errs, fmt.Errorf("%s: %w", k.KeyID, err))
+	}
+	if dataKey == nil {
+		return fmt.Errorf("failed to decrypt the data key: %w", errors.Join(errs...))
+	}
+	aead, err := newEnvelopeAEAD(dataKey)
+	if err != nil {
+		return err
+	}
+
+	br := bufio.NewReader(src)
+	buf := make([]byte, header.ChunkSize+aead.Overhead())
+	var plain []byte
+	for index := uint32(0); ; index++ {
+		n, err := io.ReadFull(br, buf)
+		if err != nil && err != io.ErrUnexpectedEOF {
+			if err == io.EOF {
+				return errors.New("envelope is truncated")
+			}
+			return err
+		}
+		last := err == io.ErrUnexpectedEOF
+		if !last {
+			if _, err := br.Peek(1); err == io.EOF {
+				last = true
+			}
+		}
+		plain, err = aead.Open(plain[:0], envelopeNonce(header.NoncePrefix, index, last), buf[:n], aad)
+		if err != nil {
+			return fmt.Errorf("failed to decrypt chunk %d: %w", index, err)
+		}
+		if _, err := dst.Write(plain); err != nil {
+			return err
+		}
+		if last {
+			return nil
+		}
+	}
+}
+
+func newEnvelopeAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func envelopeNonce(prefix []byte, index uint32, last bool) []byte {
+	nonce := make([]byte, 0, 12)
+	nonce = append(nonce, prefix...)
+	nonce = binary.BigEndian.AppendUint32(nonce, index)
+	if last {
+		return append(nonce, 1)
+	}
+	return append(nonce, 0)
+}
+
+// RunEncryptFile runs the encrypt-file subcommand, envelope-encrypting a file
+// (or stdin) with one or more KMS keys.
+func RunEncryptFile(ctx context.Context, args []string, w io.Writer) (int, error) {
+	return runEnvelopeCommand(ctx, "encrypt-file", args, w)
+}
+
+// RunDecryptFile runs the decrypt-file subcommand, decrypting a file (or stdin)
+// encrypted by encrypt-file.
+func RunDecryptFile(ctx context.Context, args []string, w io.Writer) (int, error) {
+	return runEnvelopeCommand(ctx, "decrypt-file", args, w)
+}
+
+func runEnvelopeCommand(ctx context.Context, name string, args []string, w io.Writer) (int, error) {
+	fs, e, err := envFlagSet(name, name+" [options] [<file>|-]")
+	if err != nil {
+		return ExitCodeError, err
+	}
+	output := fs.String("o", "-", "output file (- for stdout)")
+	var (
+		chunkSize int
+		keyIDs    stringsFlag
+	)
+	if name == "encrypt-file" {
+		fs.IntVar(&chunkSize, "chunk-size", DefaultChunkSize, "plaintext chunk size in bytes")
+		fs.Var(&keyIDs, "key", "KMS key ID or alias to encrypt the data key with (repeatable, default --key-id)")
+	}
+	if err := fs.Parse(args); err != nil {
+		return ExitCodeError, err
+	}
+	input := "-"
+	switch fs.NArg() {
+	case 0:
+	case 1:
+		input = fs.Arg(0)
+	default:
+		fs.Usage()
+		return ExitCodeError, fmt.Errorf("%s accepts at most one file", name)
+	}
+	if name == "encrypt-file" && len(keyIDs) == 0 {
+		if e.KMSKeyID == "" {
+			return ExitCodeError, fmt.Errorf("no KMS key ID; set --key, --key-id or SAKURA_KMS_KEY_ID")
+		}
+		if strings.Contains(e.KMSKeyID, ",") {
+			return ExitCodeError, fmt.Errorf("SAKURA_KMS_KEY_ID must be a single key ID; use --key for each of multiple keys")
+		}
+		keyIDs = stringsFlag{e.KMSKeyID}
+	}
+
+	kmsOpts, err := e.KMSOptions()
+	if err != nil {
+		return ExitCodeError, err
+	}
+	cipher, err := NewSakuraKMS(kmsOpts...)
+	if err != nil {
+		return ExitCodeError, fmt.Errorf("failed to create cipher: %w", err)
+	}
+
+	var src io.Reader = os.Stdin
+	if input != "-" {
+		f, err := os.Open(input)
+		if err != nil {
+			return ExitCodeError, err
+		}
+		defer f.Close()
+		src = f
+	}
+	err = writeOutput(*output, w, func(dst io.Writer) error {
+		if name == "encrypt-file" {
+			return EncryptStream(ctx, cipher, keyIDs, dst, src, chunkSize)
+		}
+		return DecryptStream(ctx, cipher, dst, src)
+	})
+	if err != nil {
+		return ExitCodeError, fmt.Errorf("%s failed: %w", name, err)
+	}
+	return 0, nil
+}
+
+// writeOutput calls fn with w if path is "-", or with a temporary file that
+// replaces path only when fn succeeds.
+func writeOutput(path string, w io.Writer, fn func(io.Writer) error) error {
+	if path == "-" {
+		return fn(w)
+	}
+	f, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+	if err := fn(f); err != nil {
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), path)
+}
@@ -0,0 +1,174 @@
+package ssk_test
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	ssk "github.com/fujiwara/sops-sakura-kms"
+)
+
+func TestEnvelopeRoundTrip(t *testing.T) {
+	ctx := context.Background()
+	chunk := 1024
+	for _, size := range []int{0, 1, chunk - 1, chunk, chunk + 1, 3 * chunk, 3*chunk + 17} {
+		plain := make([]byte, size)
+		rand.Read(plain)
+		var enc bytes.Buffer
+		if err := ssk.EncryptStream(ctx, &mockCipher{}, []string{"111111111111", "222222222222"}, &enc, bytes.NewReader(plain), chunk); err != nil {
+			t.Fatalf("size %d: %v", size, err)
+		}
+		header, err := ssk.ReadEnvelopeHeader(bytes.NewReader(enc.Bytes()))
+		if err != nil {
+			t.Fatalf("size %d: %v", size, err)
+		}
+		if header.ChunkSize != chunk || len(header.Keys) != 2 || header.Keys[1].KeyID != "222222222222" {
+			t.Errorf("size %d: unexpected header %+v", size, header)
+		}
+		var dec bytes.Buffer
+		if err := ssk.DecryptStream(ctx, &mockCipher{}, &dec, bytes.NewReader(enc.Bytes())); err != nil {
+			t.Fatalf("size %d: %v", size, err)
+		}
+		if !bytes.Equal(dec.Bytes(), plain) {
+			t.Errorf("size %d: round trip mismatch", size)
+		}
+	}
+}
+
+func TestEnvelopeTampered(t *testing.T) {
+	ctx := context.Background()
+	plain := make([]byte, 5000)
+	rand.Read(plain)
+	var enc bytes.Buffer
+	if err := ssk.EncryptStream(ctx, &mockCipher{}, []string{"111111111111"}, &enc, bytes.NewReader(plain), 1024); err != nil {
+		t.Fatal(err)
+	}
+	ciphertext := enc.Bytes()
+	overhead := 1024 + 16
+
+	tests := []struct {
+		name string
+		data []byte
+	}{
+		{name: "truncated at a chunk boundary", data: ciphertext[:len(ciphertext)-(5000-4*1024+16)]},
+		{name: "truncated in a chunk", data: ciphertext[:len(ciphertext)-10]},
+		{name: "flipped bit", data: func() []byte {
+			b := bytes.Clone(ciphertext)
+			b[len(b)-overhead] ^= 1
+			return b
+		}()},
+		{name: "header changed", data: bytes.Replace(ciphertext, []byte(`"chunk_size":1024`), []byte(`"chunk_size":1025`), 1)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := ssk.DecryptStream(ctx, &mockCipher{}, &bytes.Buffer{}, bytes.NewReader(tt.data))
+			if err == nil {
+				t.Fatal("expected error")
+			}
+		})
+	}
+
+	err := ssk.DecryptStream(ctx, &mockCipher{}, &bytes.Buffer{}, bytes.NewReader([]byte("plain text")))
+	if !errors.Is(err, ssk.ErrNotEnvelope) {
+		t.Errorf("expected ErrNotEnvelope, got %v", err)
+	}
+}
+
+func TestRunEncryptDecryptFile(t *testing.T) {
+	f, srv := newFakeKMS(t, "111111111111", "222222222222")
+	setFakeKMSEnv(t, srv.URL)
+	t.Setenv("SAKURA_KMS_KEY_ID", "111111111111")
+	ctx := context.Background()
+	dir := t.TempDir()
+	plain := bytes.Repeat([]byte("secret data\n"), 10000)
+	in := filepath.Join(dir, "data.txt")
+	if err := os.WriteFile(in, plain, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	enc := filepath.Join(dir, "data.txt.enc")
+	if code, err := ssk.RunCLI(ctx, []string{"encrypt-file", "--key", "111111111111", "--key", "222222222222", "-o", enc, in}, os.Stdout); err != nil || code != 0 {
+		t.Fatalf("encrypt-file: code=%d err=%v", code, err)
+	}
+	header, err := ssk.ReadEnvelopeHeader(mustOpen(t, enc))
+	if err != nil || len(header.Keys) != 2 {
+		t.Fatalf("unexpected header: %+v, %v", header, err)
+	}
+
+	// the file can be decrypted with either key
+	f.setStatus("111111111111", "suspended")
+	var out bytes.Buffer
+	if code, err := ssk.RunCLI(ctx, []string{"decrypt-file", enc}, &out); err != nil || code != 0 {
+		t.Fatalf("decrypt-file: code=%d err=%v", code, err)
+	}
+	if !bytes.Equal(out.Bytes(), plain) {
+		t.Error("decrypted data mismatch")
+	}
+
+	f.setStatus("222222222222", "suspended")
+	dec := filepath.Join(dir, "data.dec")
+	if code, err := ssk.RunCLI(ctx, []string{"decrypt-file", "-o", dec, enc}, &out); err == nil || code == 0 {
+		t.Fatal("expected error when no key can decrypt the data key")
+	}
+	if _, err := os.Stat(dec); !os.IsNotExist(err) {
+		t.Errorf("output file must not be created on failure: %v", err)
+	}
+}
+
+func mustOpen(t *testing.T, path string) *os.File {
+	t.Helper()
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { f.Close() })
+	return f
+}
+
+func TestRunEncryptFileKeyIDList(t *testing.T) {
+	_, srv := newFakeKMS(t, "111111111111", "222222222222")
+	setFakeKMSEnv(t, srv.URL)
+	t.Setenv("SAKURA_KMS_KEY_ID", "111111111111,222222222222")
+	in := filepath.Join(t.TempDir(), "data.txt")
+	writeEnvFile(t, in, "secret")
+	code, err := ssk.RunCLI(context.Background(), []string{"encrypt-file", in}, &bytes.Buffer{})
+	if err == nil || code == 0 || !strings.Contains(err.Error(), "--key") {
+		t.Errorf("expected an error for a list in SAKURA_KMS_KEY_ID, got %d, %v", code, err)
+	}
+
+	// the default key of SAKURA_KMS_KEY_ID
+	t.Setenv("SAKURA_KMS_KEY_ID", "222222222222")
+	var out bytes.Buffer
+	if code, err := ssk.RunCLI(context.Background(), []string{"encrypt-file", in}, &out); err != nil || code != 0 {
+		t.Fatalf("encrypt-file: code=%d err=%v", code, err)
+	}
+	header, err := ssk.ReadEnvelopeHeader(&out)
+	if err != nil || len(header.Keys) != 1 || header.Keys[0].KeyID != "222222222222" {
+		t.Errorf("unexpected header: %+v, %v", header, err)
+	}
+}
+
+// shortKeyCipher encrypts only the first 16 bytes of the data key.
+type shortKeyCipher struct {
+	mockCipher
+}
+
+func (c *shortKeyCipher) Encrypt(ctx context.Context, keyID string, plaintext []byte) (string, error) {
+	return c.mockCipher.Encrypt(ctx, keyID, plaintext[:16])
+}
+
+func TestEnvelopeDataKeyLength(t *testing.T) {
+	ctx := context.Background()
+	var enc bytes.Buffer
+	if err := ssk.EncryptStream(ctx, &shortKeyCipher{}, []string{"111111111111"}, &enc, strings.NewReader("secret"), 0); err != nil {
+		t.Fatal(err)
+	}
+	err := ssk.DecryptStream(ctx, &mockCipher{}, &bytes.Buffer{}, &enc)
+	if err == nil || !strings.Contains(err.Error(), "data key is 16 bytes") {
+		t.Errorf("expected an error for a 16-byte data key, got %v", err)
+	}
+}
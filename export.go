@@ -0,0 +1,271 @@
+package ssk
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/getsops/sops/v3"
+	"github.com/getsops/sops/v3/stores"
+)
+
+// Export formats supported by RunExport.
+const (
+	ExportDotenv       = "dotenv"
+	ExportShell        = "shell"
+	ExportJSON         = "json"
+	ExportGitHubEnv    = "github-env"
+	ExportGitHubOutput = "github-output"
+)
+
+var exportFormats = []string{ExportDotenv, ExportShell, ExportJSON, ExportGitHubEnv, ExportGitHubOutput}
+
+var envNameRegexp = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// ExportVar is a flattened key and its decrypted value.
+type ExportVar struct {
+	Key   string
+	Value string
+}
+
+// FlattenOptions controls how nested values are flattened by FlattenTree.
+type FlattenOptions struct {
+	// Separator joins the keys of nested maps and the indexes of lists (e.g. "_").
+	Separator string
+	// Upper converts the keys to upper case.
+	Upper bool
+	// Keys is an allowlist of flattened keys. If empty, all keys are exported.
+	Keys []string
+	// Prefixes keeps only the flattened keys starting with one of the prefixes.
+	Prefixes []string
+}
+
+// FlattenTree flattens a decrypted SOPS tree into a list of variables.
+// Nested keys are joined with opts.Separator, e.g. {db: {host: x}} becomes
+// "db_host=x", and list items are indexed, e.g. {hosts: [a, b]} becomes
+// "hosts_0=a" and "hosts_1=b". Comments are skipped.
+//
+// opts.Keys and opts.Prefixes match the flattened keys before opts.Upper.
+// It returns an error if two values are flattened to the same key,
+// e.g. "a_b" and {a: {b: ...}}.
+func FlattenTree(tree *sops.Tree, opts FlattenOptions) ([]ExportVar, error) {
+	var vars []ExportVar
+	var walk func(prefix string, v any)
+	walk = func(prefix string, v any) {
+		switch v := v.(type) {
+		case sops.TreeBranch:
+			for _, item := range v {
+				if _, ok := item.Key.(sops.Comment); ok {
+					continue
+				}
+				walk(joinKey(prefix, fmt.Sprint(item.Key), opts.Separator), item.Value)
+			}
+		case []any:
+			for i, item := range v {
+				walk(joinKey(prefix, strconv.Itoa(i), opts.Separator), item)
+			}
+		default:
+			vars = append(vars, ExportVar{Key: prefix, Value: stores.ValToString(v)})
+		}
+	}
+	for _, branch := range tree.Branches {
+		walk("", branch)
+	}
+	vars = slices.DeleteFunc(vars, func(v ExportVar) bool {
+		if len(opts.Keys) > 0 && !slices.Contains(opts.Keys, v.Key) {
+			return true
+		}
+		if len(opts.Prefixes) > 0 && !slices.ContainsFunc(opts.Prefixes, func(p string) bool { return strings.HasPrefix(v.Key, p) }) {
+			return true
+		}
+		return false
+	})
+	seen := make(map[string]string, len(vars))
+	for i, v := range vars {
+		key := v.Key
+		if opts.Upper {
+			key = strings.ToUpper(key)
+		}
+		if orig, ok := seen[key]; ok {
+			return nil, fmt.Errorf("%q and %q are both flattened to %q", orig, v.Key, key)
+		}
+		seen[key] = v.Key
+		vars[i].Key = key
+	}
+	return vars, nil
+}
+
+func joinKey(prefix, key, sep string) string {
+	if prefix == "" {
+		return key
+	}
+	return prefix + sep + key
+}
+
+// WriteExport writes vars to w in the given format (dotenv, shell or json).
+// The GitHub Actions formats are written by RunExport.
+func WriteExport(w io.Writer, format string, vars []ExportVar) error {
+	if format != ExportJSON {
+		for _, v := range vars {
+			if !envNameRegexp.MatchString(v.Key) {
+				return fmt.Errorf("invalid variable name %q for %s format", v.Key, format)
+			}
+		}
+	}
+	switch format {
+	case ExportDotenv:
+		for _, v := range vars {
+			fmt.Fprintf(w, "%s=%s\n", v.Key, dotenvQuote(v.Value))
+		}
+	case ExportShell:
+		for _, v := range vars {
+			fmt.Fprintf(w, "export %s=%s\n", v.Key, shellQuote(v.Value))
+		}
+	case ExportJSON:
+		var buf bytes.Buffer
+		buf.WriteString("{")
+		for i, v := range vars {
+			if i > 0 {
+				buf.WriteString(",")
+			}
+			k, _ := json.Marshal(v.Key)
+			val, _ := json.Marshal(v.Value)
+			fmt.Fprintf(&buf, "\n  %s: %s", k, val)
+		}
+		if len(vars) > 0 {
+			buf.WriteString("\n")
+		}
+		buf.WriteString("}\n")
+		_, err := w.Write(buf.Bytes())
+		return err
+	default:
+		return fmt.Errorf("unsupported export format %q", format)
+	}
+	return nil
+}
+
+// writeGitHub masks each value with ::add-mask:: on w and appends the
+// variables to the file named by the GITHUB_ENV or GITHUB_OUTPUT environment variable.
+func writeGitHub(w io.Writer, format string, vars []ExportVar) error {
+	envName := "GITHUB_ENV"
+	if format == ExportGitHubOutput {
+		envName = "GITHUB_OUTPUT"
+	}
+	path := os.Getenv(envName)
+	if path == "" {
+		return fmt.Errorf("%s is not set; %s format must run in GitHub Actions", envName, format)
+	}
+	var buf bytes.Buffer
+	for _, v := range vars {
+		if format == ExportGitHubEnv && !envNameRegexp.MatchString(v.Key) {
+			return fmt.Errorf("invalid variable name %q for %s format", v.Key, format)
+		}
+		for _, line := range strings.Split(v.Value, "\n") {
+			if strings.TrimSpace(line) != "" {
+				fmt.Fprintf(w, "::add-mask::%s\n", line)
+			}
+		}
+		delim := githubDelimiter()
+		fmt.Fprintf(&buf, "%s<<%s\n%s\n%s\n", v.Key, delim, v.Value, delim)
+	}
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o600)
+	if err != nil {
+		return fmt.Errorf("failed to open %s: %w", envName, err)
+	}
+	defer f.Close()
+	if _, err := f.Write(buf.Bytes()); err != nil {
+		return fmt.Errorf("failed to write %s: %w", envName, err)
+	}
+	return f.Close()
+}
+
+// githubDelimiter returns a random heredoc delimiter for GITHUB_ENV and GITHUB_OUTPUT.
+func githubDelimiter() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return "ghadelimiter_" + hex.EncodeToString(b)
+}
+
+// dotenvQuote quotes a dotenv value if needed.
+func dotenvQuote(s string) string {
+	if s != "" && !strings.ContainsAny(s, " \t\r\n\"'`#$\\=") {
+		return s
+	}
+	if !strings.ContainsAny(s, "'\r\n") {
+		return "'" + s + "'"
+	}
+	r := strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`, "\r", `\r`, "$", `\$`, "`", "\\`")
+	return `"` + r.Replace(s) + `"`
+}
+
+// shellQuote quotes s for POSIX shells.
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
+// RunExport runs the export subcommand, decrypting a SOPS file and writing
+// its values as dotenv, shell, JSON or GitHub Actions variables.
+func RunExport(ctx context.Context, args []string, w io.Writer) (int, error) {
+	fs, e, err := envFlagSet("export", "export [options] <file>")
+	if err != nil {
+		return ExitCodeError, err
+	}
+	format := fs.String("format", ExportDotenv, "output format ("+strings.Join(exportFormats, ", ")+")")
+	inputType := fs.String("input-type", "", "format of the encrypted file (yaml, json, dotenv, ini, binary)")
+	var opts FlattenOptions
+	fs.StringVar(&opts.Separator, "separator", "_", "separator for the keys of nested values")
+	fs.BoolVar(&opts.Upper, "upper", false, "convert the keys to upper case")
+	fs.Var((*stringsFlag)(&opts.Keys), "key", "export only this flattened key (repeatable)")
+	fs.Var((*stringsFlag)(&opts.Prefixes), "prefix", "export only the flattened keys with this prefix (repeatable)")
+	if err := fs.Parse(args); err != nil {
+		return ExitCodeError, err
+	}
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return ExitCodeError, fmt.Errorf("export requires exactly one file")
+	}
+	if !slices.Contains(exportFormats, *format) {
+		return ExitCodeError, fmt.Errorf("unsupported export format %q (must be one of %s)", *format, strings.Join(exportFormats, ", "))
+	}
+
+	kmsOpts, err := e.KMSOptions()
+	if err != nil {
+		return ExitCodeError, err
+	}
+	mismatch, err := ParseKeyIDMismatchMode(e.KeyIDMismatch)
+	if err != nil {
+		return ExitCodeError, fmt.Errorf("invalid SSK_KEY_ID_MISMATCH: %w", err)
+	}
+	cipher, err := NewSakuraKMS(kmsOpts...)
+	if err != nil {
+		return ExitCodeError, fmt.Errorf("failed to create cipher: %w", err)
+	}
+	tree, _, err := decryptSOPSFile(ctx, cipher, mismatch, fs.Arg(0), *inputType)
+	if err != nil {
+		return ExitCodeError, err
+	}
+	vars, err := FlattenTree(tree, opts)
+	if err != nil {
+		return ExitCodeError, err
+	}
+
+	switch *format {
+	case ExportGitHubEnv, ExportGitHubOutput:
+		err = writeGitHub(w, *format, vars)
+	default:
+		err = WriteExport(w, *format, vars)
+	}
+	if err != nil {
+		return ExitCodeError, err
+	}
+	return 0, nil
+}
@@ -0,0 +1,168 @@
+package ssk_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	ssk "github.com/fujiwara/sops-sakura-kms"
+)
+
+const testExportPlain = `db:
+  host: db.example.com
+  password: "p@ss w'rd"
+hosts:
+  - a
+  - b
+api_key: line1
+token: "multi\nline"
+`
+
+func runExport(t *testing.T, args ...string) string {
+	t.Helper()
+	var buf bytes.Buffer
+	code, err := ssk.RunExport(context.Background(), args, &buf)
+	if err != nil || code != 0 {
+		t.Fatalf("export %v = %d, %v", args, code, err)
+	}
+	return buf.String()
+}
+
+func TestExportJSON(t *testing.T) {
+	path := setupNative(t, testExportPlain)
+	var got map[string]string
+	if err := json.Unmarshal([]byte(runExport(t, "--format", "json", path)), &got); err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{
+		"db_host":     "db.example.com",
+		"db_password": "p@ss w'rd",
+		"hosts_0":     "a",
+		"hosts_1":     "b",
+		"api_key":     "line1",
+		"token":       "multi\nline",
+	}
+	if len(got) != len(want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	for k, v := range want {
+		if got[k] != v {
+			t.Errorf("%s = %q, want %q", k, got[k], v)
+		}
+	}
+}
+
+func TestExportFilter(t *testing.T) {
+	path := setupNative(t, testExportPlain)
+	out := runExport(t, "--upper", "--separator", "__", "--prefix", "db__", "--key", "db__host", path)
+	if out != "DB__HOST=db.example.com\n" {
+		t.Errorf("unexpected output: %q", out)
+	}
+	// the filters match the keys before --upper
+	if out := runExport(t, "--upper", "--prefix", "DB_", path); out != "" {
+		t.Errorf("unexpected output: %q", out)
+	}
+}
+
+func TestExportCollision(t *testing.T) {
+	for name, tc := range map[string]struct {
+		plain string
+		args  []string
+	}{
+		"nested":     {plain: "a_b: x\na:\n  b: y\n"},
+		"upper":      {plain: "key: x\nKEY: y\n", args: []string{"--upper"}},
+		"list index": {plain: "hosts_0: x\nhosts:\n  - y\n"},
+	} {
+		t.Run(name, func(t *testing.T) {
+			path := setupNative(t, tc.plain)
+			code, err := ssk.RunExport(context.Background(), append(tc.args, path), &bytes.Buffer{})
+			if err == nil || code != ssk.ExitCodeError || !strings.Contains(err.Error(), "both flattened") {
+				t.Errorf("expected a collision error, got %d, %v", code, err)
+			}
+		})
+	}
+	// a filtered-out key does not collide
+	path := setupNative(t, "a_b: x\na:\n  b: y\nc: z\n")
+	if out := runExport(t, "--key", "c", path); out != "c=z\n" {
+		t.Errorf("unexpected output: %q", out)
+	}
+}
+
+// TestExportShellRoundTrip checks that the shell output is read back by sh
+// with the original values.
+func TestExportShellRoundTrip(t *testing.T) {
+	path := setupNative(t, testExportPlain)
+	script := filepath.Join(t.TempDir(), "env.sh")
+	if err := os.WriteFile(script, []byte(runExport(t, "--format", "shell", path)), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	out, err := exec.Command("sh", "-c", `. "$1"; printf '%s|%s|%s' "$db_password" "$token" "$hosts_1"`, "sh", script).Output()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "p@ss w'rd|multi\nline|b"; string(out) != want {
+		t.Errorf("got %q, want %q", out, want)
+	}
+}
+
+func TestExportDotenv(t *testing.T) {
+	path := setupNative(t, testExportPlain)
+	want := `db_host=db.example.com
+db_password="p@ss w'rd"
+hosts_0=a
+hosts_1=b
+api_key=line1
+token="multi\nline"
+`
+	if got := runExport(t, path); got != want {
+		t.Errorf("got:\n%s\nwant:\n%s", got, want)
+	}
+}
+
+func TestExportGitHub(t *testing.T) {
+	path := setupNative(t, testExportPlain)
+	ghEnv := filepath.Join(t.TempDir(), "github_env")
+	t.Setenv("GITHUB_ENV", ghEnv)
+
+	out := runExport(t, "--format", "github-env", "--prefix", "db_", "--prefix", "token", path)
+	for _, mask := range []string{"::add-mask::db.example.com", "::add-mask::p@ss w'rd", "::add-mask::multi", "::add-mask::line"} {
+		if !strings.Contains(out, mask+"\n") {
+			t.Errorf("missing %q in output:\n%s", mask, out)
+		}
+	}
+	if strings.Contains(out, "hosts") {
+		t.Errorf("filtered keys should not be printed:\n%s", out)
+	}
+	b, err := os.ReadFile(ghEnv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(string(b), "\n")
+	if !strings.HasPrefix(lines[0], "db_host<<ghadelimiter_") || lines[1] != "db.example.com" || lines[2] != strings.TrimPrefix(lines[0], "db_host<<") {
+		t.Errorf("unexpected GITHUB_ENV content:\n%s", b)
+	}
+	if !strings.Contains(string(b), "\nmulti\nline\n") {
+		t.Errorf("multiline value not written:\n%s", b)
+	}
+
+	t.Setenv("GITHUB_OUTPUT", "")
+	if code, err := ssk.RunExport(context.Background(), []string{"--format", "github-output", path}, &bytes.Buffer{}); err == nil || code != ssk.ExitCodeError {
+		t.Errorf("expected an error without GITHUB_OUTPUT, got %d, %v", code, err)
+	}
+}
+
+func TestExportInvalidName(t *testing.T) {
+	path := setupNative(t, "my-key: value\n")
+	code, err := ssk.RunExport(context.Background(), []string{"--format", "shell", path}, &bytes.Buffer{})
+	if err == nil || code != ssk.ExitCodeError {
+		t.Errorf("expected an error for an invalid name, got %d, %v", code, err)
+	}
+	if out := runExport(t, "--format", "json", path); !strings.Contains(out, `"my-key": "value"`) {
+		t.Errorf("json format should accept any key: %s", out)
+	}
+}
@@ -0,0 +1,283 @@
+package ssk_test
+
+import (
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	ssk "github.com/fujiwara/sops-sakura-kms"
+	v1 "github.com/sacloud/kms-api-go/apis/v1"
+	"github.com/sacloud/saclient-go"
+)
+
+// fakeKMS is an in-memory stand-in for the Sakura Cloud KMS API.
+// It speaks the same JSON shapes as the real API and produces
+// ciphertexts in the same msgpack layout (alg, key.id, key.kv, val),
+// with the plaintext stored as-is in val.
+type fakeKMS struct {
+	mu     sync.Mutex
+	keys   map[string]*v1.Key
+	nextID int
+	// users are the basic auth user names of the requests, in order.
+	users []string
+}
+
+// newFakeKMS starts a fake KMS API server with the given key IDs
+// registered as active keys.
+func newFakeKMS(t testing.TB, keyIDs ...string) (*fakeKMS, *httptest.Server) {
+	t.Helper()
+	f := &fakeKMS{keys: make(map[string]*v1.Key), nextID: 900000000001}
+	for _, id := range keyIDs {
+		f.addKey(id)
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /kms/keys", f.list)
+	mux.HandleFunc("POST /kms/keys", f.create)
+	mux.HandleFunc("GET /kms/keys/{id}", f.read)
+	mux.HandleFunc("POST /kms/keys/{id}/rotate", f.rotate)
+	mux.HandleFunc("POST /kms/keys/{id}/status", f.status)
+	mux.HandleFunc("POST /kms/keys/{id}/schedule-destruction", f.scheduleDestruction)
+	mux.HandleFunc("POST /kms/keys/{id}/encrypt", f.encrypt)
+	mux.HandleFunc("POST /kms/keys/{id}/decrypt", f.decrypt)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user, _, _ := r.BasicAuth()
+		f.mu.Lock()
+		f.users = append(f.users, user)
+		f.mu.Unlock()
+		mux.ServeHTTP(w, r)
+	}))
+	t.Cleanup(srv.Close)
+	return f, srv
+}
+
+func (f *fakeKMS) addKey(id string) *v1.Key {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	k := &v1.Key{
+		ID:            id,
+		Name:          "key-" + id,
+		KeyOrigin:     v1.KeyOriginEnumGenerated,
+		LatestVersion: v1.NewOptInt(0),
+		Status:        v1.KeyStatusEnumActive,
+		CreatedAt:     v1.DateTime("2025-01-01T00:00:00+09:00"),
+		ModifiedAt:    v1.DateTime("2025-01-01T00:00:00+09:00"),
+		Tags:          []string{},
+	}
+	f.keys[id] = k
+	return k
+}
+
+func (f *fakeKMS) key(id string) (*v1.Key, bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	k, ok := f.keys[id]
+	return k, ok
+}
+
+func (f *fakeKMS) setStatus(id string, status v1.KeyStatusEnum) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.keys[id].Status = status
+}
+
+func (f *fakeKMS) read(w http.ResponseWriter, r *http.Request) {
+	k, ok := f.key(r.PathValue("id"))
+	if !ok {
+		http.Error(w, "not found", http.StatusNotFound)
+		return
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	writeFakeJSON(w, http.StatusOK, &v1.WrappedKey{Key: *k})
+}
+
+func (f *fakeKMS) list(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	keys := make([]v1.Key, 0, len(f.keys))
+	for _, k := range f.keys {
+		keys = append(keys, *k)
+	}
+	slices.SortFunc(keys, func(a, b v1.Key) int { return strings.Compare(a.ID, b.ID) })
+	writeFakeJSON(w, http.StatusOK, &v1.PaginatedKeyList{Count: len(keys), Total: v1.NewOptInt(len(keys)), Keys: keys})
+}
+
+func (f *fakeKMS) create(w http.ResponseWriter, r *http.Request) {
+	var req v1.WrappedCreateKey
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	f.mu.Lock()
+	id := strconv.Itoa(f.nextID)
+	f.nextID++
+	f.mu.Unlock()
+	k := f.addKey(id)
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	k.Name = req.Key.Name
+	k.Description = req.Key.Description.Or("")
+	k.Tags = append([]string{}, req.Key.Tags...)
+	writeFakeJSON(w, http.StatusCreated, &v1.WrappedCreateKey{Key: v1.CreateKey{
+		ID:          k.ID,
+		CreatedAt:   k.CreatedAt,
+		ModifiedAt:  k.ModifiedAt,
+		Name:        k.Name,
+		Description: req.Key.Description,
+		KeyOrigin:   k.KeyOrigin,
+		Tags:        k.Tags,
+	}})
+}
+
+func (f *fakeKMS) rotate(w http.ResponseWriter, r *http.Request) {
+	k, ok := f.key(r.PathValue("id"))
+	if !ok {
+		http.Error(w, "not found", http.StatusNotFound)
+		return
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if k.Status != v1.KeyStatusEnumActive {
+		http.Error(w, "key is not active", http.StatusForbidden)
+		return
+	}
+	k.LatestVersion = v1.NewOptInt(k.LatestVersion.Or(0) + 1)
+	writeFakeJSON(w, http.StatusOK, &v1.WrappedKey{Key: *k})
+}
+
+func (f *fakeKMS) status(w http.ResponseWriter, r *http.Request) {
+	k, ok := f.key(r.PathValue("id"))
+	if !ok {
+		http.Error(w, "not found", http.StatusNotFound)
+		return
+	}
+	var req v1.WrappedChangeKeyStatus
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	f.setStatus(k.ID, v1.KeyStatusEnum(req.Key.Status.Or("")))
+	w.WriteHeader(http.StatusOK)
+}
+
+func (f *fakeKMS) scheduleDestruction(w http.ResponseWriter, r *http.Request) {
+	k, ok := f.key(r.PathValue("id"))
+	if !ok {
+		http.Error(w, "not found", http.StatusNotFound)
+		return
+	}
+	var req v1.WrappedScheduleDestructionKey
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	f.setStatus(k.ID, v1.KeyStatusEnumPendingDestruction)
+	w.WriteHeader(http.StatusOK)
+}
+
+func (f *fakeKMS) encrypt(w http.ResponseWriter, r *http.Request) {
+	k, ok := f.key(r.PathValue("id"))
+	if !ok {
+		http.Error(w, "not found", http.StatusNotFound)
+		return
+	}
+	var req v1.WrappedKeyPlain
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	plain, err := base64.StdEncoding.DecodeString(req.Key.Plain)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	algo := req.Key.Algo.Or(v1.KeyEncryptAlgoEnumAes256Gcm)
+	blob := fakeCiphertext(string(algo), k.ID, k.LatestVersion.Or(0), plain)
+	writeFakeJSON(w, http.StatusOK, &v1.WrappedKeyCipher{Key: v1.KeyCipher{Cipher: blob}})
+}
+
+func (f *fakeKMS) decrypt(w http.ResponseWriter, r *http.Request) {
+	k, ok := f.key(r.PathValue("id"))
+	if !ok {
+		http.Error(w, "not found", http.StatusNotFound)
+		return
+	}
+	if k.Status != v1.KeyStatusEnumActive {
+		http.Error(w, "key is not active", http.StatusForbidden)
+		return
+	}
+	var req v1.WrappedKeyCipher
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	ct, err := ssk.ParseCiphertext(req.Key.Cipher)
+	if err != nil || ct.KeyID != k.ID {
+		http.Error(w, "invalid cipher", http.StatusBadRequest)
+		return
+	}
+	writeFakeJSON(w, http.StatusOK, &v1.WrappedKeyPlain{Key: v1.KeyPlain{Plain: base64.StdEncoding.EncodeToString(ct.Value)}})
+}
+
+func writeFakeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+// newFakeKMSClient returns a saclient configured to talk to the fake KMS server.
+func newFakeKMSClient(t testing.TB, srv *httptest.Server) saclient.ClientAPI {
+	t.Helper()
+	var sc saclient.Client
+	if err := sc.SetEnviron([]string{
+		"SAKURA_ACCESS_TOKEN=dummy",
+		"SAKURA_ACCESS_TOKEN_SECRET=dummy",
+		"SAKURA_RETRY_MAX=0",
+		"SAKURA_RATE_LIMIT=100000",
+		"SAKURA_ENDPOINTS_KMS=" + srv.URL,
+		"HOME=" + t.TempDir(),
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := sc.Populate(); err != nil {
+		t.Fatal(err)
+	}
+	return &sc
+}
+
+// fakeCiphertext builds a base64-encoded msgpack document shaped like
+// the blobs returned by Sakura Cloud KMS:
+//
+//	{"alg": alg, "key": {"id": keyID, "kv": version, "cip": ""}, "val": plain}
+func fakeCiphertext(alg, keyID string, version int, plain []byte) string {
+	var b []byte
+	b = append(b, 0x83)
+	b = appendMsgpackStr(b, "alg")
+	b = appendMsgpackStr(b, alg)
+	b = appendMsgpackStr(b, "key")
+	b = append(b, 0x83)
+	b = appendMsgpackStr(b, "id")
+	b = appendMsgpackStr(b, keyID)
+	b = appendMsgpackStr(b, "kv")
+	b = append(b, 0xce)
+	b = binary.BigEndian.AppendUint32(b, uint32(version))
+	b = appendMsgpackStr(b, "cip")
+	b = appendMsgpackStr(b, "")
+	b = appendMsgpackStr(b, "val")
+	b = append(b, 0xc6)
+	b = binary.BigEndian.AppendUint32(b, uint32(len(plain)))
+	b = append(b, plain...)
+	return base64.StdEncoding.EncodeToString(b)
+}
+
+func appendMsgpackStr(b []byte, s string) []byte {
+	b = append(b, 0xd9, byte(len(s)))
+	return append(b, s...)
+}
@@ -0,0 +1,331 @@
+package ssk
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/getsops/sops/v3/age"
+	"go.yaml.in/yaml/v3"
+)
+
+// CreationRule describes a .sops.yaml creation rule for Sakura Cloud KMS keys.
+type CreationRule struct {
+	// PathRegex is the path_regex of the rule. Empty matches all files.
+	PathRegex string
+	// KeyIDs are the Sakura Cloud KMS key IDs.
+	KeyIDs []string
+	// Age are age recipients for break-glass access without Sakura Cloud KMS.
+	Age []string
+	// ShamirThreshold splits the data key with Shamir's secret sharing if > 0:
+	// each KMS key is a key group and the age recipients form one more group,
+	// and ShamirThreshold groups are required to decrypt.
+	ShamirThreshold int
+	// ServerAddr is the address of the Vault-compatible server in the URIs.
+	ServerAddr string
+}
+
+// Validate checks the rule without accessing KMS.
+func (r *CreationRule) Validate() error {
+	if _, err := regexp.Compile(r.PathRegex); err != nil {
+		return fmt.Errorf("invalid path regex: %w", err)
+	}
+	if len(r.KeyIDs) == 0 {
+		return errors.New("no KMS key IDs given")
+	}
+	if len(r.Age) > 0 {
+		if _, err := age.MasterKeysFromRecipients(strings.Join(r.Age, ",")); err != nil {
+			return fmt.Errorf("invalid age recipient: %w", err)
+		}
+	}
+	if r.ShamirThreshold > 0 {
+		groups := len(r.keyGroups())
+		if groups < 2 {
+			return errors.New("Shamir key groups require at least two groups (KMS keys or age recipients)")
+		}
+		if r.ShamirThreshold > groups {
+			return fmt.Errorf("Shamir threshold %d exceeds the number of key groups %d", r.ShamirThreshold, groups)
+		}
+	}
+	return nil
+}
+
+func (r *CreationRule) vaultURIs() []string {
+	uris := make([]string, 0, len(r.KeyIDs))
+	for _, id := range r.KeyIDs {
+		uris = append(uris, fmt.Sprintf("http://%s/v1/transit/keys/%s", r.ServerAddr, id))
+	}
+	return uris
+}
+
+func (r *CreationRule) keyGroups() []sopsKeyGroup {
+	var groups []sopsKeyGroup
+	for _, uri := range r.vaultURIs() {
+		groups = append(groups, sopsKeyGroup{HCVault: []string{uri}})
+	}
+	if len(r.Age) > 0 {
+		groups = append(groups, sopsKeyGroup{Age: r.Age})
+	}
+	return groups
+}
+
+// sopsRule returns the rule in the .sops.yaml format.
+func (r *CreationRule) sopsRule() *sopsCreationRule {
+	rule := &sopsCreationRule{PathRegex: r.PathRegex}
+	if r.ShamirThreshold > 0 {
+		rule.KeyGroups = r.keyGroups()
+		rule.ShamirThreshold = r.ShamirThreshold
+		return rule
+	}
+	rule.HCVaultURI = r.vaultURIs()
+	if len(r.Age) > 0 {
+		rule.Age = r.Age
+	}
+	return rule
+}
+
+// UpdateSOPSConfig adds rule to the .sops.yaml content src and returns the new content.
+// A rule with the same path_regex is updated: the keys managed by CreationRule
+// are replaced, and the others, e.g. encrypted_regex, are kept. Otherwise the rule is inserted
+// before the first rule without path_regex, which matches all files, or appended.
+// Comments and other settings in src are preserved.
+func UpdateSOPSConfig(src []byte, rule *CreationRule) ([]byte, error) {
+	var doc yaml.Node
+	if err := yaml.Unmarshal(src, &doc); err != nil {
+		return nil, fmt.Errorf("failed to parse .sops.yaml: %w", err)
+	}
+	if doc.Kind == 0 {
+		doc = yaml.Node{Kind: yaml.DocumentNode, Content: []*yaml.Node{{Kind: yaml.MappingNode}}}
+	}
+	root := doc.Content[0]
+	if root.Kind != yaml.MappingNode {
+		return nil, errors.New("failed to parse .sops.yaml: not a mapping")
+	}
+	var rules *yaml.Node
+	for i := 0; i+1 < len(root.Content); i += 2 {
+		if root.Content[i].Value == "creation_rules" {
+			rules = root.Content[i+1]
+		}
+	}
+	if rules == nil {
+		rules = &yaml.Node{Kind: yaml.SequenceNode}
+		root.Content = append(root.Content,
+			&yaml.Node{Kind: yaml.ScalarNode, Value: "creation_rules"}, rules)
+	}
+	if rules.Kind != yaml.SequenceNode {
+		if rules.Tag != "!!null" {
+			return nil, errors.New("failed to parse .sops.yaml: creation_rules is not a list")
+		}
+		*rules = yaml.Node{Kind: yaml.SequenceNode}
+	}
+
+	var node yaml.Node
+	if err := node.Encode(rule.sopsRule()); err != nil {
+		return nil, err
+	}
+	insert := len(rules.Content)
+	for i, n := range rules.Content {
+		var existing sopsCreationRule
+		if err := n.Decode(&existing); err != nil {
+			return nil, fmt.Errorf("failed to parse creation_rules[%d]: %w", i, err)
+		}
+		if existing.PathRegex == rule.PathRegex {
+			mergeCreationRule(n, &node)
+			insert = -1
+			break
+		}
+		if existing.PathRegex == "" && insert == len(rules.Content) {
+			insert = i
+		}
+	}
+	if insert >= 0 {
+		rules.Content = append(rules.Content[:insert], append([]*yaml.Node{&node}, rules.Content[insert:]...)...)
+	}
+
+	var buf bytes.Buffer
+	enc := yaml.NewEncoder(&buf)
+	enc.SetIndent(2)
+	if err := enc.Encode(&doc); err != nil {
+		return nil, err
+	}
+	if err := enc.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// creationRuleKeys are the keys of a creation rule written by CreationRule.
+var creationRuleKeys = []string{"path_regex", "hc_vault_transit_uri", "age", "key_groups", "shamir_threshold"}
+
+// mergeCreationRule updates the creation rule mapping dst with src in place.
+// The keys in creationRuleKeys are replaced with those of src, or removed if
+// src does not have them. The other keys and the comments of dst are kept.
+func mergeCreationRule(dst, src *yaml.Node) {
+	values := make(map[string]*yaml.Node)
+	for i := 0; i+1 < len(src.Content); i += 2 {
+		values[src.Content[i].Value] = src.Content[i+1]
+	}
+	content := dst.Content[:0:0]
+	for i := 0; i+1 < len(dst.Content); i += 2 {
+		key, value := dst.Content[i], dst.Content[i+1]
+		if slices.Contains(creationRuleKeys, key.Value) {
+			v, ok := values[key.Value]
+			if !ok {
+				continue
+			}
+			value = v
+			delete(values, key.Value)
+		}
+		content = append(content, key, value)
+	}
+	for i := 0; i+1 < len(src.Content); i += 2 {
+		if v, ok := values[src.Content[i].Value]; ok {
+			content = append(content, src.Content[i], v)
+		}
+	}
+	dst.Content = content
+}
+
+// RunInit runs the init subcommand, generating or updating creation rules of .sops.yaml.
+func RunInit(ctx context.Context, args []string, w io.Writer) (int, error) {
+	fs, e, err := envFlagSet("init", "init [options]")
+	if err != nil {
+		return ExitCodeError, err
+	}
+	rule := &CreationRule{}
+	var ageRecipients stringsFlag
+	fs.StringVar(&rule.PathRegex, "path-regex", "", "path_regex of the rule (default: all files)")
+	fs.Var(&ageRecipients, "age", "age recipient for break-glass access (repeatable)")
+	fs.IntVar(&rule.ShamirThreshold, "shamir-threshold", 0, "number of key groups required to decrypt; 0 disables Shamir key groups")
+	configPath := fs.String("config", "", "path to .sops.yaml (default: .sops.yaml found in the current directory or its parents, or ./.sops.yaml)")
+	interactive := fs.Bool("interactive", false, "prompt for the rule (default when stdin is a terminal and no key ID is given)")
+	noValidate := fs.Bool("no-validate", false, "do not check that the KMS keys exist")
+	dryRun := fs.Bool("dry-run", false, "print the new .sops.yaml instead of writing it")
+	if err := fs.Parse(args); err != nil {
+		return ExitCodeError, err
+	}
+	if fs.NArg() > 0 {
+		fs.Usage()
+		return ExitCodeError, fmt.Errorf("unexpected arguments: %v", fs.Args())
+	}
+	rule.KeyIDs = splitList(e.KMSKeyID)
+	rule.Age = splitList(strings.Join(ageRecipients, ","))
+	rule.ServerAddr = e.ServerAddr
+
+	if *interactive || (len(rule.KeyIDs) == 0 && IsStdinTerminal()) {
+		if err := promptCreationRule(bufio.NewReader(os.Stdin), w, rule); err != nil {
+			return ExitCodeError, err
+		}
+	}
+	if err := rule.Validate(); err != nil {
+		return ExitCodeError, err
+	}
+	if !*noValidate {
+		kmsOpts, err := e.KMSOptions()
+		if err != nil {
+			return ExitCodeError, err
+		}
+		c, err := NewSakuraKMS(kmsOpts...)
+		if err != nil {
+			return ExitCodeError, err
+		}
+		for _, id := range rule.KeyIDs {
+			if _, err := c.Preflight(ctx, id, false); err != nil {
+				return ExitCodeError, err
+			}
+		}
+	}
+
+	path := *configPath
+	if path == "" {
+		if path, err = findSOPSConfig("."); err != nil {
+			path = ".sops.yaml"
+		}
+	}
+	src, err := os.ReadFile(path)
+	exists := err == nil
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return ExitCodeError, err
+	}
+	out, err := UpdateSOPSConfig(src, rule)
+	if err != nil {
+		return ExitCodeError, fmt.Errorf("%s: %w", path, err)
+	}
+	if *dryRun {
+		w.Write(out)
+		return 0, nil
+	}
+	if exists {
+		err = writeFileAtomic(path, out)
+	} else {
+		err = os.WriteFile(path, out, 0o644)
+	}
+	if err != nil {
+		return ExitCodeError, err
+	}
+	fmt.Fprintf(w, "wrote %s\n", path)
+	return 0, nil
+}
+
+// promptCreationRule asks for the fields of rule, using the current values as defaults.
+func promptCreationRule(r *bufio.Reader, w io.Writer, rule *CreationRule) error {
+	ask := func(question, def string) (string, error) {
+		if def != "" {
+			fmt.Fprintf(w, "%s [%s]: ", question, def)
+		} else {
+			fmt.Fprintf(w, "%s: ", question)
+		}
+		line, err := r.ReadString('\n')
+		if err != nil && (err != io.EOF || line == "") {
+			return "", fmt.Errorf("failed to read the answer: %w", err)
+		}
+		if line = strings.TrimSpace(line); line != "" {
+			return line, nil
+		}
+		return def, nil
+	}
+	var err error
+	if rule.PathRegex, err = ask("Path regex (empty for all files)", rule.PathRegex); err != nil {
+		return err
+	}
+	keys, err := ask("Sakura Cloud KMS key IDs (comma-separated)", strings.Join(rule.KeyIDs, ","))
+	if err != nil {
+		return err
+	}
+	rule.KeyIDs = splitList(keys)
+	recipients, err := ask("age recipients for break-glass access (comma-separated, empty for none)", strings.Join(rule.Age, ","))
+	if err != nil {
+		return err
+	}
+	rule.Age = splitList(recipients)
+	if len(rule.keyGroups()) < 2 {
+		return nil
+	}
+	threshold, err := ask("Shamir threshold (0 for no key groups)", strconv.Itoa(rule.ShamirThreshold))
+	if err != nil {
+		return err
+	}
+	if rule.ShamirThreshold, err = strconv.Atoi(threshold); err != nil {
+		return fmt.Errorf("invalid Shamir threshold: %w", err)
+	}
+	return nil
+}
+
+// splitList splits a comma-separated list, ignoring empty items.
+func splitList(s string) []string {
+	var out []string
+	for item := range strings.SplitSeq(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			out = append(out, item)
+		}
+	}
+	return out
+}
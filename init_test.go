@@ -0,0 +1,203 @@
+package ssk_test
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	ssk "github.com/fujiwara/sops-sakura-kms"
+)
+
+const testAgeRecipient = "age1eqfshuh9zzlpa80qvaqhkrf9ks7tj0w9z0vmnkr98qtkvkfaqeuqgn3jmy"
+
+func TestUpdateSOPSConfig(t *testing.T) {
+	src := `# managed by hand
+stores:
+  yaml:
+    indent: 2
+creation_rules:
+  # production secrets
+  - path_regex: prod/.*\.yaml$
+    age: ` + testAgeRecipient + `
+    encrypted_regex: ^(data|stringData)$
+    pgp: 85D77543B3D624B63CEA9E6DBC17301B491B3F21
+  - hc_vault_transit_uri: http://127.0.0.1:8200/v1/transit/keys/999999999999
+`
+	tests := []struct {
+		name string
+		rule ssk.CreationRule
+		want string
+	}{
+		{
+			name: "insert before catch-all",
+			rule: ssk.CreationRule{PathRegex: `dev/.*`, KeyIDs: []string{"111111111111"}, ServerAddr: "127.0.0.1:8200"},
+			want: `# managed by hand
+stores:
+  yaml:
+    indent: 2
+creation_rules:
+  # production secrets
+  - path_regex: prod/.*\.yaml$
+    age: ` + testAgeRecipient + `
+    encrypted_regex: ^(data|stringData)$
+    pgp: 85D77543B3D624B63CEA9E6DBC17301B491B3F21
+  - path_regex: dev/.*
+    hc_vault_transit_uri:
+      - http://127.0.0.1:8200/v1/transit/keys/111111111111
+  - hc_vault_transit_uri: http://127.0.0.1:8200/v1/transit/keys/999999999999
+`,
+		},
+		{
+			name: "update the same path regex, keeping the other settings",
+			rule: ssk.CreationRule{PathRegex: `prod/.*\.yaml$`, KeyIDs: []string{"111111111111"}, Age: []string{testAgeRecipient}, ServerAddr: "127.0.0.1:8200"},
+			want: `# managed by hand
+stores:
+  yaml:
+    indent: 2
+creation_rules:
+  # production secrets
+  - path_regex: prod/.*\.yaml$
+    age:
+      - ` + testAgeRecipient + `
+    encrypted_regex: ^(data|stringData)$
+    pgp: 85D77543B3D624B63CEA9E6DBC17301B491B3F21
+    hc_vault_transit_uri:
+      - http://127.0.0.1:8200/v1/transit/keys/111111111111
+  - hc_vault_transit_uri: http://127.0.0.1:8200/v1/transit/keys/999999999999
+`,
+		},
+		{
+			name: "shamir key groups",
+			rule: ssk.CreationRule{KeyIDs: []string{"111111111111", "222222222222"}, Age: []string{testAgeRecipient}, ShamirThreshold: 2, ServerAddr: "127.0.0.1:8200"},
+			want: `# managed by hand
+stores:
+  yaml:
+    indent: 2
+creation_rules:
+  # production secrets
+  - path_regex: prod/.*\.yaml$
+    age: ` + testAgeRecipient + `
+    encrypted_regex: ^(data|stringData)$
+    pgp: 85D77543B3D624B63CEA9E6DBC17301B491B3F21
+  - key_groups:
+      - hc_vault:
+          - http://127.0.0.1:8200/v1/transit/keys/111111111111
+      - hc_vault:
+          - http://127.0.0.1:8200/v1/transit/keys/222222222222
+      - age:
+          - ` + testAgeRecipient + `
+    shamir_threshold: 2
+`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.rule.Validate(); err != nil {
+				t.Fatal(err)
+			}
+			got, err := ssk.UpdateSOPSConfig([]byte(src), &tt.rule)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(got) != tt.want {
+				t.Errorf("unexpected output:\n%s\nwant:\n%s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCreationRuleValidate(t *testing.T) {
+	tests := []struct {
+		name string
+		rule ssk.CreationRule
+		want string
+	}{
+		{name: "no keys", rule: ssk.CreationRule{}, want: "no KMS key IDs"},
+		{name: "invalid regex", rule: ssk.CreationRule{PathRegex: "(", KeyIDs: []string{"111111111111"}}, want: "invalid path regex"},
+		{name: "invalid age", rule: ssk.CreationRule{KeyIDs: []string{"111111111111"}, Age: []string{"age1invalid"}}, want: "invalid age recipient"},
+		{name: "single group", rule: ssk.CreationRule{KeyIDs: []string{"111111111111"}, ShamirThreshold: 1}, want: "at least two groups"},
+		{name: "threshold too large", rule: ssk.CreationRule{KeyIDs: []string{"111111111111", "222222222222"}, ShamirThreshold: 3}, want: "exceeds"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.rule.Validate()
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("expected error containing %q, got %v", tt.want, err)
+			}
+		})
+	}
+}
+
+func TestRunInit(t *testing.T) {
+	_, srv := newFakeKMS(t, "111111111111", "222222222222")
+	setFakeKMSEnv(t, srv.URL)
+	t.Setenv("SAKURA_KMS_KEY_ID", "")
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), ".sops.yaml")
+
+	var out bytes.Buffer
+	code, err := ssk.RunCLI(ctx, []string{"init", "--config", path, "--key-id", "111111111111,222222222222", "--path-regex", `\.enc\.yaml$`}, &out)
+	if err != nil || code != 0 {
+		t.Fatalf("init: code=%d err=%v", code, err)
+	}
+	b, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{`path_regex: \.enc\.yaml$`, "/v1/transit/keys/111111111111", "/v1/transit/keys/222222222222"} {
+		if !bytes.Contains(b, []byte(want)) {
+			t.Errorf("%s does not contain %q:\n%s", path, want, b)
+		}
+	}
+
+	// updating an existing file keeps its permissions and the other settings of the rule
+	if err := os.Chmod(path, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	writeEnvFile(t, path, strings.Replace(string(b), `path_regex: \.enc\.yaml$`, `path_regex: \.enc\.yaml$`+"\n    encrypted_regex: ^data$", 1))
+	code, err = ssk.RunCLI(ctx, []string{"init", "--config", path, "--key-id", "111111111111", "--path-regex", `\.enc\.yaml$`}, &out)
+	if err != nil || code != 0 {
+		t.Fatalf("init again: code=%d err=%v", code, err)
+	}
+	if st, err := os.Stat(path); err != nil || st.Mode().Perm() != 0o600 {
+		t.Errorf("permission changed: %v, %v", st.Mode(), err)
+	}
+	b, _ = os.ReadFile(path)
+	if !bytes.Contains(b, []byte("encrypted_regex: ^data$")) || bytes.Contains(b, []byte("/v1/transit/keys/222222222222")) {
+		t.Errorf("unexpected rule:\n%s", b)
+	}
+
+	// nonexistent keys are rejected
+	code, err = ssk.RunCLI(ctx, []string{"init", "--config", path, "--key-id", "333333333333"}, &out)
+	if err == nil || code == 0 {
+		t.Error("expected error for a nonexistent key")
+	}
+
+	// interactive mode
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stdin := os.Stdin
+	os.Stdin = r
+	t.Cleanup(func() { os.Stdin = stdin })
+	w.WriteString("\\.env$\n111111111111,222222222222\n" + testAgeRecipient + "\n2\n")
+	w.Close()
+	out.Reset()
+	code, err = ssk.RunCLI(ctx, []string{"init", "--config", path, "--interactive"}, &out)
+	if err != nil || code != 0 {
+		t.Fatalf("init --interactive: code=%d err=%v", code, err)
+	}
+	if !strings.Contains(out.String(), "Shamir threshold") {
+		t.Errorf("unexpected prompts: %s", out.String())
+	}
+	b, _ = os.ReadFile(path)
+	for _, want := range []string{`path_regex: \.env$`, "shamir_threshold: 2", testAgeRecipient, `path_regex: \.enc\.yaml$`} {
+		if !bytes.Contains(b, []byte(want)) {
+			t.Errorf("%s does not contain %q:\n%s", path, want, b)
+		}
+	}
+}
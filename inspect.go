@@ -0,0 +1,196 @@
+package ssk
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/getsops/sops/v3"
+	"github.com/getsops/sops/v3/hcvault"
+)
+
+// FileInfo describes the keys protecting a SOPS-encrypted file.
+type FileInfo struct {
+	Path            string         `json:"path"`
+	Format          string         `json:"format"`
+	SOPSVersion     string         `json:"sops_version"`
+	LastModified    time.Time      `json:"last_modified"`
+	ShamirThreshold int            `json:"shamir_threshold,omitempty"`
+	KeyGroups       []KeyGroupInfo `json:"key_groups"`
+}
+
+// KeyGroupInfo describes a SOPS key group.
+type KeyGroupInfo struct {
+	Keys []KeyInfo `json:"keys"`
+}
+
+// KeyInfo describes a SOPS master key entry.
+type KeyInfo struct {
+	// Type is the SOPS key type (e.g. "hc_vault", "age", "pgp").
+	Type string `json:"type"`
+	// Identifier is the key identifier as printed by SOPS
+	// (Vault URI, age recipient, PGP fingerprint, ...).
+	Identifier string `json:"identifier"`
+	// CreatedAt is the time the data key was encrypted with this key.
+	CreatedAt string `json:"created_at,omitempty"`
+	// Vault is set for hc_vault entries.
+	Vault *VaultKeyInfo `json:"hc_vault,omitempty"`
+}
+
+// VaultKeyInfo describes an hc_vault key entry.
+type VaultKeyInfo struct {
+	VaultAddress string `json:"vault_address"`
+	EnginePath   string `json:"engine_path"`
+	KeyName      string `json:"key_name"`
+	// SakuraKMS is the metadata of the embedded Sakura Cloud KMS ciphertext,
+	// or nil if the entry was not encrypted by Sakura Cloud KMS.
+	SakuraKMS *Ciphertext `json:"sakura_kms,omitempty"`
+}
+
+// InspectFile reads the metadata of a SOPS-encrypted file without decrypting it.
+// The format is detected from the file extension unless format is given
+// ("yaml", "json", "dotenv", "ini" or "binary"). If path is "-", stdin is read.
+func InspectFile(path, format string) (*FileInfo, error) {
+	tree, name, err := loadSOPSFile(path, format)
+	if err != nil {
+		return nil, err
+	}
+	return newFileInfo(path, name, tree), nil
+}
+
+func newFileInfo(path, format string, tree *sops.Tree) *FileInfo {
+	info := &FileInfo{
+		Path:            path,
+		Format:          format,
+		SOPSVersion:     tree.Metadata.Version,
+		LastModified:    tree.Metadata.LastModified,
+		ShamirThreshold: tree.Metadata.ShamirThreshold,
+	}
+	for _, group := range tree.Metadata.KeyGroups {
+		var g KeyGroupInfo
+		for _, key := range group {
+			k := KeyInfo{
+				Type:       key.TypeToIdentifier(),
+				Identifier: key.ToString(),
+			}
+			if createdAt, ok := key.ToMap()["created_at"].(string); ok {
+				k.CreatedAt = createdAt
+			}
+			if vk, ok := key.(*hcvault.MasterKey); ok {
+				k.Vault = &VaultKeyInfo{
+					VaultAddress: vk.VaultAddress,
+					EnginePath:   vk.EnginePath,
+					KeyName:      vk.KeyName,
+				}
+				if ct, err := ParseCiphertext(vk.EncryptedKey); err == nil {
+					k.Vault.SakuraKMS = ct
+				}
+			}
+			g.Keys = append(g.Keys, k)
+		}
+		info.KeyGroups = append(info.KeyGroups, g)
+	}
+	return info
+}
+
+// RunInspect runs the inspect subcommand.
+// Each argument is either a path to a SOPS-encrypted file or a "vault:v1:" ciphertext.
+// It works offline and does not require credentials.
+func RunInspect(ctx context.Context, args []string, w io.Writer) (int, error) {
+	fs := flag.NewFlagSet("inspect", flag.ContinueOnError)
+	asJSON := fs.Bool("json", false, "output in JSON format")
+	inputType := fs.String("input-type", "", "format of the input files (yaml, json, dotenv, ini, binary); detected from the extension by default")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: sops-sakura-kms inspect [options] <file|vault:v1:ciphertext>...\n")
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return ExitCodeError, err
+	}
+	if fs.NArg() == 0 {
+		fs.Usage()
+		return ExitCodeError, fmt.Errorf("no files or ciphertexts given")
+	}
+
+	var results []any
+	for _, arg := range fs.Args() {
+		if err := ctx.Err(); err != nil {
+			return ExitCodeError, err
+		}
+		if strings.HasPrefix(arg, VaultPrefix) {
+			ct, err := ParseCiphertext(arg)
+			if err != nil {
+				return ExitCodeError, err
+			}
+			results = append(results, ct)
+			continue
+		}
+		info, err := InspectFile(arg, *inputType)
+		if err != nil {
+			return ExitCodeError, err
+		}
+		results = append(results, info)
+	}
+
+	if *asJSON {
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		for _, r := range results {
+			if err := enc.Encode(r); err != nil {
+				return ExitCodeError, err
+			}
+		}
+		return 0, nil
+	}
+	for i, r := range results {
+		if i > 0 {
+			fmt.Fprintln(w)
+		}
+		switch r := r.(type) {
+		case *Ciphertext:
+			printCiphertext(w, r)
+		case *FileInfo:
+			printFileInfo(w, r)
+		}
+	}
+	return 0, nil
+}
+
+func printCiphertext(w io.Writer, ct *Ciphertext) {
+	fmt.Fprintf(w, "Sakura Cloud KMS ciphertext\n")
+	fmt.Fprintf(w, "  key_id:      %s\n", ct.KeyID)
+	fmt.Fprintf(w, "  key_version: %d\n", ct.KeyVersion)
+	fmt.Fprintf(w, "  algorithm:   %s\n", ct.Algorithm)
+}
+
+func printFileInfo(w io.Writer, info *FileInfo) {
+	fmt.Fprintf(w, "%s\n", info.Path)
+	fmt.Fprintf(w, "  format:        %s\n", info.Format)
+	fmt.Fprintf(w, "  sops_version:  %s\n", info.SOPSVersion)
+	fmt.Fprintf(w, "  last_modified: %s\n", info.LastModified.Format(time.RFC3339))
+	if info.ShamirThreshold > 0 {
+		fmt.Fprintf(w, "  shamir_threshold: %d\n", info.ShamirThreshold)
+	}
+	for i, g := range info.KeyGroups {
+		fmt.Fprintf(w, "  key group %d:\n", i+1)
+		for _, k := range g.Keys {
+			fmt.Fprintf(w, "    - %s: %s\n", k.Type, k.Identifier)
+			if k.CreatedAt != "" {
+				fmt.Fprintf(w, "      created_at: %s\n", k.CreatedAt)
+			}
+			if k.Vault == nil {
+				continue
+			}
+			fmt.Fprintf(w, "      vault_address: %s\n", k.Vault.VaultAddress)
+			fmt.Fprintf(w, "      engine_path: %s\n", k.Vault.EnginePath)
+			fmt.Fprintf(w, "      key_name: %s\n", k.Vault.KeyName)
+			if ct := k.Vault.SakuraKMS; ct != nil {
+				fmt.Fprintf(w, "      sakura_kms: key_id=%s key_version=%d algorithm=%s\n", ct.KeyID, ct.KeyVersion, ct.Algorithm)
+			}
+		}
+	}
+}
@@ -0,0 +1,108 @@
+package ssk_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+
+	ssk "github.com/fujiwara/sops-sakura-kms"
+	"github.com/getsops/sops/v3"
+)
+
+func TestInspectFile(t *testing.T) {
+	_, srv := newTestTransit(t, "113702485493")
+	ageKey := newTestAgeKey(t)
+	dir := t.TempDir()
+
+	for format, plain := range testPlainFiles {
+		t.Run(format, func(t *testing.T) {
+			path := writeTestFile(t, dir, "secrets"+testFileExt[format], format, []byte(plain),
+				sops.KeyGroup{vaultKey(srv, "113702485493"), ageKey},
+			)
+			info, err := ssk.InspectFile(path, "")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if info.Format != format {
+				t.Errorf("Format = %q, want %q", info.Format, format)
+			}
+			if len(info.KeyGroups) != 1 || len(info.KeyGroups[0].Keys) != 2 {
+				t.Fatalf("unexpected key groups: %+v", info.KeyGroups)
+			}
+			vk := info.KeyGroups[0].Keys[0]
+			if vk.Type != "hc_vault" || vk.Vault == nil {
+				t.Fatalf("first key is not hc_vault: %+v", vk)
+			}
+			if vk.Vault.VaultAddress != srv.URL || vk.Vault.EnginePath != "transit" || vk.Vault.KeyName != "113702485493" {
+				t.Errorf("unexpected hc_vault entry: %+v", vk.Vault)
+			}
+			if vk.CreatedAt == "" {
+				t.Error("CreatedAt is empty")
+			}
+			if ct := vk.Vault.SakuraKMS; ct == nil || ct.KeyID != "113702485493" || ct.Algorithm != "aes-256-gcm" {
+				t.Errorf("unexpected Sakura KMS metadata: %+v", ct)
+			}
+			if ak := info.KeyGroups[0].Keys[1]; ak.Type != "age" || ak.Identifier != ageKey.Recipient {
+				t.Errorf("unexpected age entry: %+v", ak)
+			}
+		})
+	}
+}
+
+func TestInspectFileRepository(t *testing.T) {
+	info, err := ssk.InspectFile("test.enc.yml", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.SOPSVersion != "3.10.1" {
+		t.Errorf("SOPSVersion = %q, want 3.10.1", info.SOPSVersion)
+	}
+	ct := info.KeyGroups[0].Keys[0].Vault.SakuraKMS
+	if ct == nil || ct.KeyID != "113702485493" || ct.KeyVersion != 0 {
+		t.Errorf("unexpected Sakura KMS metadata: %+v", ct)
+	}
+}
+
+func TestRunInspect(t *testing.T) {
+	var buf bytes.Buffer
+	code, err := ssk.RunInspect(t.Context(), []string{"--json", "test.enc.yml", testCiphertext}, &buf)
+	if err != nil || code != 0 {
+		t.Fatalf("RunInspect() = %d, %v", code, err)
+	}
+	dec := json.NewDecoder(&buf)
+	var info ssk.FileInfo
+	if err := dec.Decode(&info); err != nil {
+		t.Fatal(err)
+	}
+	if info.Path != "test.enc.yml" {
+		t.Errorf("Path = %q, want test.enc.yml", info.Path)
+	}
+	var ct ssk.Ciphertext
+	if err := dec.Decode(&ct); err != nil {
+		t.Fatal(err)
+	}
+	if ct.KeyID != "113702485493" {
+		t.Errorf("KeyID = %q, want 113702485493", ct.KeyID)
+	}
+
+	buf.Reset()
+	if _, err := ssk.RunInspect(t.Context(), []string{"test.enc.yml"}, &buf); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(buf.String(), "sakura_kms: key_id=113702485493 key_version=0 algorithm=aes-256-gcm") {
+		t.Errorf("unexpected output:\n%s", buf.String())
+	}
+
+	if _, err := ssk.RunInspect(t.Context(), []string{"no-such-file.yaml"}, &buf); err == nil {
+		t.Error("expected error for missing file")
+	}
+
+	ctx, cancel := context.WithCancel(t.Context())
+	cancel()
+	if _, err := ssk.RunInspect(ctx, []string{"test.enc.yml"}, &buf); !errors.Is(err, context.Canceled) {
+		t.Errorf("expected context.Canceled, got %v", err)
+	}
+}
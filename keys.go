@@ -0,0 +1,217 @@
+package ssk
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/sacloud/kms-api-go"
+	v1 "github.com/sacloud/kms-api-go/apis/v1"
+)
+
+// DefaultPendingDays is the default number of days before a key scheduled
+// for deletion is destroyed.
+const DefaultPendingDays = 14
+
+const keysUsage = `Usage: sops-sakura-kms keys <command> [options]
+
+Commands:
+  list                          list keys
+  show <key_id>                 show a key
+  create --name <name>          create a key
+  rotate <key_id>               rotate a key
+  enable <key_id>               activate a key
+  disable <key_id>              suspend a key
+  schedule-delete <key_id>      schedule a key for deletion (--days, default 14; --yes)
+
+Run 'sops-sakura-kms keys <command> -h' for the options of a command.
+`
+
+// stringsFlag is a flag.Value that collects repeated string flags.
+type stringsFlag []string
+
+func (f *stringsFlag) String() string {
+	return strings.Join(*f, ",")
+}
+
+func (f *stringsFlag) Set(v string) error {
+	*f = append(*f, v)
+	return nil
+}
+
+// RunKeys runs the keys subcommand, managing Sakura Cloud KMS keys.
+// Credentials are read from environment variables as NewSakuraKMS does.
+func RunKeys(ctx context.Context, args []string, w io.Writer) (int, error) {
+	if len(args) == 0 {
+		fmt.Fprint(w, keysUsage)
+		return ExitCodeError, fmt.Errorf("no command given")
+	}
+	command, args := args[0], args[1:]
+
+	fs := flag.NewFlagSet("keys "+command, flag.ContinueOnError)
+	asJSON := fs.Bool("json", false, "output in JSON format")
+	var (
+		name, description string
+		tags              stringsFlag
+		days              int
+		yes               bool
+	)
+	argsUsage := " <key_id>"
+	switch command {
+	case "list":
+		argsUsage = ""
+	case "create":
+		argsUsage = ""
+		fs.StringVar(&name, "name", "", "key name (required)")
+		fs.StringVar(&description, "description", "", "key description")
+		fs.Var(&tags, "tag", "key tag (repeatable)")
+	case "schedule-delete":
+		fs.IntVar(&days, "days", DefaultPendingDays, "days before the key is destroyed (7-90)")
+		fs.BoolVar(&yes, "yes", false, "do not ask for confirmation")
+	case "show", "rotate", "enable", "disable":
+	case "-h", "-help", "--help", "help":
+		fmt.Fprint(w, keysUsage)
+		return 0, nil
+	default:
+		fmt.Fprint(w, keysUsage)
+		return ExitCodeError, fmt.Errorf("unknown keys command: %s", command)
+	}
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: sops-sakura-kms keys %s [options]%s\n", command, argsUsage)
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return ExitCodeError, err
+	}
+	var keyID string
+	if argsUsage != "" {
+		if fs.NArg() != 1 {
+			fs.Usage()
+			return ExitCodeError, fmt.Errorf("keys %s requires exactly one key ID", command)
+		}
+		keyID = fs.Arg(0)
+	} else if fs.NArg() > 0 {
+		fs.Usage()
+		return ExitCodeError, fmt.Errorf("unexpected arguments: %v", fs.Args())
+	}
+	if command == "create" && name == "" {
+		fs.Usage()
+		return ExitCodeError, fmt.Errorf("--name is required")
+	}
+	if command == "schedule-delete" && !yes {
+		if !IsStdinTerminal() {
+			return ExitCodeError, fmt.Errorf("keys schedule-delete requires --yes when stdin is not a terminal")
+		}
+		ok, err := (&TerminalConfirmer{}).Confirm(ctx, fmt.Sprintf("Schedule key %s for deletion in %d days?", keyID, days))
+		if err != nil {
+			return ExitCodeError, err
+		}
+		if !ok {
+			return ExitCodeError, fmt.Errorf("keys schedule-delete was canceled")
+		}
+	}
+
+	e, err := LoadEnv()
+	if err != nil {
+		return ExitCodeError, err
+	}
+	kmsOpts, err := e.KMSOptions()
+	if err != nil {
+		return ExitCodeError, err
+	}
+	c, err := NewSakuraKMS(kmsOpts...)
+	if err != nil {
+		return ExitCodeError, err
+	}
+	keys := c.Keys()
+
+	var result []v1.Key
+	switch command {
+	case "list":
+		result, err = keys.List(ctx)
+	case "show":
+		result, err = readKey(ctx, keys, keyID)
+	case "create":
+		req := v1.CreateKey{
+			Name:      name,
+			KeyOrigin: v1.KeyOriginEnumGenerated,
+			Tags:      append([]string{}, tags...),
+		}
+		if description != "" {
+			req.Description = v1.NewOptString(description)
+		}
+		var created *v1.CreateKey
+		if created, err = keys.Create(ctx, req); err == nil {
+			result, err = readKey(ctx, keys, created.ID)
+		}
+	case "rotate":
+		var key *v1.Key
+		key, err = keys.Rotate(ctx, keyID)
+		if err == nil {
+			result = []v1.Key{*key}
+		}
+	case "enable", "disable":
+		status := v1.ChangeKeyStatusStatusActive
+		if command == "disable" {
+			status = v1.ChangeKeyStatusStatusSuspended
+		}
+		if err = keys.ChangeStatus(ctx, keyID, status); err == nil {
+			result, err = readKey(ctx, keys, keyID)
+		}
+	case "schedule-delete":
+		if err = keys.ScheduleDestruction(ctx, keyID, days); err == nil {
+			result, err = readKey(ctx, keys, keyID)
+		}
+	}
+	if err != nil {
+		return ExitCodeError, fmt.Errorf("keys %s failed: %w", command, err)
+	}
+
+	if *asJSON {
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		var v any = result
+		if result == nil {
+			// an empty list, not null
+			v = []v1.Key{}
+		} else if command != "list" {
+			v = &result[0]
+		}
+		if err := enc.Encode(v); err != nil {
+			return ExitCodeError, err
+		}
+		return 0, nil
+	}
+	printKeys(w, result)
+	return 0, nil
+}
+
+func readKey(ctx context.Context, keys kms.KeyAPI, keyID string) ([]v1.Key, error) {
+	key, err := keys.Read(ctx, keyID)
+	if err != nil {
+		return nil, err
+	}
+	return []v1.Key{*key}, nil
+}
+
+func printKeys(w io.Writer, keys []v1.Key) {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "ID\tNAME\tSTATUS\tVERSION\tORIGIN\tCREATED\tTAGS")
+	for _, k := range keys {
+		version := "-"
+		if v, ok := k.LatestVersion.Get(); ok {
+			version = fmt.Sprint(v)
+		}
+		tags := "-"
+		if len(k.Tags) > 0 {
+			tags = strings.Join(k.Tags, ",")
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\t%s\n",
+			k.ID, k.Name, k.Status, version, k.KeyOrigin, k.CreatedAt, tags)
+	}
+	tw.Flush()
+}
@@ -0,0 +1,125 @@
+package ssk_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"strings"
+	"testing"
+
+	ssk "github.com/fujiwara/sops-sakura-kms"
+	v1 "github.com/sacloud/kms-api-go/apis/v1"
+)
+
+func runKeys(t *testing.T, args ...string) string {
+	t.Helper()
+	var buf bytes.Buffer
+	code, err := ssk.RunKeys(context.Background(), args, &buf)
+	if err != nil || code != 0 {
+		t.Fatalf("keys %v = %d, %v", args, code, err)
+	}
+	return buf.String()
+}
+
+func runKeysJSON(t *testing.T, args ...string) v1.Key {
+	t.Helper()
+	var key v1.Key
+	out := runKeys(t, append([]string{args[0], "--json"}, args[1:]...)...)
+	if err := json.Unmarshal([]byte(out), &key); err != nil {
+		t.Fatalf("invalid JSON: %v\n%s", err, out)
+	}
+	return key
+}
+
+func TestKeys(t *testing.T) {
+	f, srv := newFakeKMS(t, "111111111111")
+	setFakeKMSEnv(t, srv.URL)
+
+	created := runKeysJSON(t, "create", "--name", "app", "--description", "for app", "--tag", "env=prod", "--tag", "team=a")
+	if created.Name != "app" || created.Status != v1.KeyStatusEnumActive {
+		t.Errorf("unexpected created key: %+v", created)
+	}
+	if strings.Join(created.Tags, ",") != "env=prod,team=a" {
+		t.Errorf("tags = %v", created.Tags)
+	}
+
+	out := runKeys(t, "list")
+	lines := strings.Split(strings.TrimSpace(out), "\n")
+	if len(lines) != 3 {
+		t.Fatalf("expected header and 2 keys, got:\n%s", out)
+	}
+	if !strings.HasPrefix(lines[0], "ID ") || !strings.Contains(lines[2], created.ID) || !strings.Contains(lines[2], "env=prod,team=a") {
+		t.Errorf("unexpected list output:\n%s", out)
+	}
+
+	var list []v1.Key
+	if err := json.Unmarshal([]byte(runKeys(t, "list", "--json")), &list); err != nil {
+		t.Fatal(err)
+	}
+	if len(list) != 2 || list[0].ID != "111111111111" || list[1].ID != created.ID {
+		t.Errorf("unexpected list: %+v", list)
+	}
+
+	if k := runKeysJSON(t, "rotate", created.ID); k.LatestVersion.Or(0) != 1 {
+		t.Errorf("latest version after rotate = %v, want 1", k.LatestVersion)
+	}
+	if k := runKeysJSON(t, "disable", created.ID); k.Status != v1.KeyStatusEnumSuspended {
+		t.Errorf("status after disable = %s", k.Status)
+	}
+	if k := runKeysJSON(t, "enable", created.ID); k.Status != v1.KeyStatusEnumActive {
+		t.Errorf("status after enable = %s", k.Status)
+	}
+	if k := runKeysJSON(t, "schedule-delete", "--days", "30", "--yes", created.ID); k.Status != v1.KeyStatusEnumPendingDestruction {
+		t.Errorf("status after schedule-delete = %s", k.Status)
+	}
+	if k, _ := f.key(created.ID); k.Status != v1.KeyStatusEnumPendingDestruction {
+		t.Errorf("fake key status = %s", k.Status)
+	}
+	if !strings.Contains(runKeys(t, "show", "111111111111"), "key-111111111111") {
+		t.Error("show should print the key name")
+	}
+}
+
+func TestKeysErrors(t *testing.T) {
+	_, srv := newFakeKMS(t, "111111111111")
+	setFakeKMSEnv(t, srv.URL)
+
+	for _, args := range [][]string{
+		{},
+		{"unknown"},
+		{"show"},
+		{"show", "1", "2"},
+		{"create"},
+		{"show", "999999999999"},
+		{"schedule-delete", "--days", "3", "--yes", "111111111111"},
+	} {
+		code, err := ssk.RunKeys(context.Background(), args, &bytes.Buffer{})
+		if err == nil || code != ssk.ExitCodeError {
+			t.Errorf("keys %v: expected an error, got %d, %v", args, code, err)
+		}
+	}
+}
+
+func TestKeysListEmptyJSON(t *testing.T) {
+	_, srv := newFakeKMS(t)
+	setFakeKMSEnv(t, srv.URL)
+	if out := strings.TrimSpace(runKeys(t, "list", "--json")); out != "[]" {
+		t.Errorf("keys list --json with no keys = %s, want []", out)
+	}
+}
+
+func TestKeysScheduleDeleteRequiresYes(t *testing.T) {
+	f, srv := newFakeKMS(t, "111111111111")
+	setFakeKMSEnv(t, srv.URL)
+	isTerminal := ssk.IsStdinTerminal
+	ssk.IsStdinTerminal = func() bool { return false }
+	t.Cleanup(func() { ssk.IsStdinTerminal = isTerminal })
+
+	code, err := ssk.RunKeys(context.Background(), []string{"schedule-delete", "111111111111"}, &bytes.Buffer{})
+	if err == nil || code != ssk.ExitCodeError || !strings.Contains(err.Error(), "--yes") {
+		t.Errorf("expected an error requiring --yes, got %d, %v", code, err)
+	}
+	if k, _ := f.key("111111111111"); k.Status != v1.KeyStatusEnumActive {
+		t.Errorf("the key was scheduled for deletion without --yes: %s", k.Status)
+	}
+}
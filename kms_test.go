@@ -1,7 +1,11 @@
 package ssk_test
 
 import (
+	"fmt"
+	"net/http/httptrace"
 	"os"
+	"sync"
+	"sync/atomic"
 	"testing"
 
 	ssk "github.com/fujiwara/sops-sakura-kms"
@@ -33,3 +37,67 @@ func TestEncryptDecrypt(t *testing.T) {
 		t.Fatalf("decrypted text does not match original plaintext: got %q, want %q", decrypted, plaintext)
 	}
 }
+
+func TestSakuraKMSConcurrent(t *testing.T) {
+	keyID := "113702485493"
+	_, srv := newFakeKMS(t, keyID)
+	c, err := ssk.NewSakuraKMSWithClient(newFakeKMSClient(t, srv))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var wg sync.WaitGroup
+	for i := range 16 {
+		wg.Go(func() {
+			plaintext := []byte(fmt.Sprintf("secret-%d", i))
+			ciphertext, err := c.Encrypt(t.Context(), keyID, plaintext)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			decrypted, err := c.Decrypt(t.Context(), keyID, ciphertext)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			if string(decrypted) != string(plaintext) {
+				t.Errorf("decrypted = %q, want %q", decrypted, plaintext)
+			}
+		})
+	}
+	wg.Wait()
+}
+
+func TestSakuraKMSKeepAlive(t *testing.T) {
+	keyID := "113702485493"
+	_, srv := newFakeKMS(t, keyID)
+	c, err := ssk.NewSakuraKMSWithClient(newFakeKMSClient(t, srv))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the connections of a parallel batch are kept for the next batches
+	const parallel = 16
+	var newConns atomic.Int32
+	ctx := httptrace.WithClientTrace(t.Context(), &httptrace.ClientTrace{
+		GotConn: func(info httptrace.GotConnInfo) {
+			if !info.Reused {
+				newConns.Add(1)
+			}
+		},
+	})
+	for range 5 {
+		var wg sync.WaitGroup
+		for range parallel {
+			wg.Go(func() {
+				if _, err := c.Encrypt(ctx, keyID, []byte("secret")); err != nil {
+					t.Error(err)
+				}
+			})
+		}
+		wg.Wait()
+	}
+	if n := newConns.Load(); n > parallel {
+		t.Errorf("%d connections were opened for %d parallel requests", n, parallel)
+	}
+}
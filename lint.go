@@ -0,0 +1,390 @@
+package ssk
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/getsops/sops/v3"
+	"github.com/getsops/sops/v3/hcvault"
+	"go.yaml.in/yaml/v3"
+)
+
+// DefaultLintPolicyFile is the default policy file of the lint subcommand.
+const DefaultLintPolicyFile = ".sops-lint.yaml"
+
+// ExitCodeLintViolations is returned by the lint subcommand when any violation is found.
+const ExitCodeLintViolations = 2
+
+// KeyTypeSakuraKMS is the key type of hc_vault entries encrypted by Sakura Cloud KMS
+// in lint policies. Other hc_vault entries have the type hc_vault.
+const KeyTypeSakuraKMS = "sakura_kms"
+
+// Checks of LintViolation.
+const (
+	LintRequiredKey      = "required_key"
+	LintForbiddenKeyType = "forbidden_key_type"
+	LintLocalVault       = "local_vault"
+	LintMaxDataKeyAge    = "max_data_key_age"
+	LintEncryptedRegex   = "encrypted_regex"
+)
+
+// LintPolicy is the policy evaluated by the lint subcommand.
+//
+//	rules:
+//	  - name: production
+//	    path_regex: ^secrets/prod/
+//	    required_keys:
+//	      - sakura_kms:123456789012
+//	      - age:*
+//	    forbidden_key_types: [pgp]
+//	    local_vault_only: true
+//	    max_data_key_age: 90d
+//	    encrypted_regex: ^(data|stringData)$
+type LintPolicy struct {
+	Rules []LintRule `yaml:"rules" json:"rules"`
+}
+
+// LintRule is a rule of LintPolicy.
+type LintRule struct {
+	// Name identifies the rule in the reports.
+	Name string `yaml:"name" json:"name"`
+	// PathRegex selects the files the rule applies to, matched against the
+	// path relative to the directory of the policy file. Empty matches all files.
+	PathRegex string `yaml:"path_regex" json:"path_regex,omitempty"`
+	// RequiredKeys are "type:identifier" or "type:*" entries that must be present,
+	// e.g. "sakura_kms:123456789012" or "age:*".
+	RequiredKeys []string `yaml:"required_keys" json:"required_keys,omitempty"`
+	// ForbiddenKeyTypes are the key types that must not be present.
+	ForbiddenKeyTypes []string `yaml:"forbidden_key_types" json:"forbidden_key_types,omitempty"`
+	// LocalVaultOnly forbids hc_vault entries pointing at non-loopback addresses.
+	LocalVaultOnly bool `yaml:"local_vault_only" json:"local_vault_only,omitempty"`
+	// MaxDataKeyAge is the maximum age of the data key, computed from lastmodified
+	// (e.g. "90d", "720h").
+	MaxDataKeyAge string `yaml:"max_data_key_age" json:"max_data_key_age,omitempty"`
+	// EncryptedRegex is the encrypted_regex the files must be encrypted with.
+	EncryptedRegex string `yaml:"encrypted_regex" json:"encrypted_regex,omitempty"`
+
+	pathRegexp *regexp.Regexp
+	maxAge     time.Duration
+}
+
+// LintViolation is a violation of a LintRule.
+type LintViolation struct {
+	// Path is the encrypted file or the creation rule of .sops.yaml.
+	Path    string `json:"path"`
+	Rule    string `json:"rule"`
+	Check   string `json:"check"`
+	Message string `json:"message"`
+}
+
+// LoadLintPolicy reads and validates a lint policy file.
+func LoadLintPolicy(path string) (*LintPolicy, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %s: %w", path, err)
+	}
+	var p LintPolicy
+	if err := yaml.Unmarshal(b, &p); err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %w", path, err)
+	}
+	if err := p.Compile(); err != nil {
+		return nil, fmt.Errorf("invalid policy %s: %w", path, err)
+	}
+	return &p, nil
+}
+
+// Compile validates the rules of the policy and prepares them for Lint,
+// naming the unnamed rules. Lint calls it, so a policy built in code can
+// be passed to Lint without it.
+func (p *LintPolicy) Compile() error {
+	for i := range p.Rules {
+		r := &p.Rules[i]
+		if r.Name == "" {
+			r.Name = fmt.Sprintf("rules[%d]", i)
+		}
+		var err error
+		if r.pathRegexp, err = regexp.Compile(r.PathRegex); err != nil {
+			return fmt.Errorf("%s: invalid path_regex: %w", r.Name, err)
+		}
+		for _, k := range r.RequiredKeys {
+			if t, _, _ := strings.Cut(k, ":"); t == "" {
+				return fmt.Errorf("%s: invalid required key %q", r.Name, k)
+			}
+		}
+		r.maxAge = 0
+		if r.MaxDataKeyAge != "" {
+			if r.maxAge, err = parseDays(r.MaxDataKeyAge); err != nil {
+				return fmt.Errorf("%s: invalid max_data_key_age: %w", r.Name, err)
+			}
+		}
+	}
+	return nil
+}
+
+// parseDays parses a duration with an optional "d" (days) unit, e.g. "90d" or "720h".
+func parseDays(s string) (time.Duration, error) {
+	if days, ok := strings.CutSuffix(s, "d"); ok {
+		n, err := strconv.Atoi(days)
+		if err != nil {
+			return 0, err
+		}
+		return time.Duration(n) * 24 * time.Hour, nil
+	}
+	return time.ParseDuration(s)
+}
+
+// lintKey is a key entry of an encrypted file or a creation rule.
+type lintKey struct {
+	Type         string
+	ID           string
+	VaultAddress string
+}
+
+func (k lintKey) String() string {
+	if k.ID == "" {
+		return k.Type
+	}
+	return k.Type + ":" + k.ID
+}
+
+// fileLintKeys returns the key entries of an encrypted file.
+func fileLintKeys(tree *sops.Tree) []lintKey {
+	var keys []lintKey
+	for _, group := range tree.Metadata.KeyGroups {
+		for _, key := range group {
+			k := lintKey{Type: key.TypeToIdentifier(), ID: key.ToString()}
+			if vk, ok := key.(*hcvault.MasterKey); ok {
+				k.VaultAddress = vk.VaultAddress
+				if id := sakuraKMSKeyID(key); id != "" {
+					k.Type, k.ID = KeyTypeSakuraKMS, id
+				}
+			}
+			keys = append(keys, k)
+		}
+	}
+	return keys
+}
+
+// ruleLintKeys returns the key entries of a creation rule. hc_vault URIs
+// on a loopback address are assumed to be Sakura Cloud KMS keys served by the wrapper.
+func ruleLintKeys(r *sopsCreationRule) []lintKey {
+	var keys []lintKey
+	for _, uri := range r.vaultURIs() {
+		k := lintKey{Type: "hc_vault", ID: uri}
+		if u, err := url.Parse(uri); err == nil {
+			k.VaultAddress = u.Scheme + "://" + u.Host
+			if isLoopback(k.VaultAddress) && path.Dir(u.Path) == "/v1/transit/keys" {
+				k.Type, k.ID = KeyTypeSakuraKMS, path.Base(u.Path)
+			}
+		}
+		keys = append(keys, k)
+	}
+	add := func(typ string, ids ...string) {
+		for _, id := range ids {
+			keys = append(keys, lintKey{Type: typ, ID: id})
+		}
+	}
+	add("age", stringOrList(r.Age)...)
+	add("pgp", stringOrList(r.PGP)...)
+	add("kms", stringOrList(r.KMS)...)
+	add("gcp_kms", stringOrList(r.GCPKMS)...)
+	add("azure_kv", stringOrList(r.AzureKeyVault)...)
+	add("hckms", r.HCKms...)
+	for _, g := range r.KeyGroups {
+		add("age", g.Age...)
+		add("pgp", g.PGP...)
+		for range g.KMS {
+			add("kms", "")
+		}
+		for range g.GCPKMS {
+			add("gcp_kms", "")
+		}
+		for range g.AzureKV {
+			add("azure_kv", "")
+		}
+		for range g.HCKms {
+			add("hckms", "")
+		}
+	}
+	return keys
+}
+
+// isLoopback reports whether the host of a Vault address is a loopback address.
+func isLoopback(addr string) bool {
+	u, err := url.Parse(addr)
+	if err != nil {
+		return false
+	}
+	host := u.Hostname()
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// checkKeys evaluates the key checks of the rule.
+func (r *LintRule) checkKeys(keys []lintKey) []LintViolation {
+	var vs []LintViolation
+	for _, req := range r.RequiredKeys {
+		typ, id, _ := strings.Cut(req, ":")
+		if !slices.ContainsFunc(keys, func(k lintKey) bool {
+			return k.Type == typ && (id == "" || id == "*" || k.ID == id)
+		}) {
+			vs = append(vs, LintViolation{Check: LintRequiredKey, Message: fmt.Sprintf("required key %s is missing", req)})
+		}
+	}
+	for _, k := range keys {
+		if slices.Contains(r.ForbiddenKeyTypes, k.Type) {
+			vs = append(vs, LintViolation{Check: LintForbiddenKeyType, Message: fmt.Sprintf("key %s has a forbidden type", k)})
+		}
+		if r.LocalVaultOnly && k.VaultAddress != "" && !isLoopback(k.VaultAddress) {
+			vs = append(vs, LintViolation{Check: LintLocalVault, Message: fmt.Sprintf("key %s points at non-local Vault address %s", k, k.VaultAddress)})
+		}
+	}
+	return vs
+}
+
+// Lint evaluates policy against the encrypted files in paths and the creation
+// rules of the .sops.yaml at configPath (if not empty) that apply to them.
+// Paths are matched relative to root, the directory of the policy file.
+func Lint(policy *LintPolicy, root, configPath string, paths []string, now time.Time) ([]LintViolation, error) {
+	if err := policy.Compile(); err != nil {
+		return nil, err
+	}
+	var conf *sopsConfig
+	configRoot := ""
+	if configPath != "" {
+		var err error
+		if conf, err = loadSOPSConfig(configPath); err != nil {
+			return nil, err
+		}
+		configRoot = filepath.Dir(configPath)
+	}
+	var violations []LintViolation
+	checkedRules := map[string]bool{}
+	for _, p := range paths {
+		rel := relSlash(root, p)
+		tree, _, err := loadSOPSFile(p, "")
+		if err != nil {
+			return nil, err
+		}
+		keys := fileLintKeys(tree)
+		for i := range policy.Rules {
+			r := &policy.Rules[i]
+			if !r.pathRegexp.MatchString(rel) {
+				continue
+			}
+			vs := r.checkKeys(keys)
+			if r.maxAge > 0 && now.Sub(tree.Metadata.LastModified) > r.maxAge {
+				vs = append(vs, LintViolation{Check: LintMaxDataKeyAge, Message: fmt.Sprintf(
+					"data key was last modified at %s, older than %s", tree.Metadata.LastModified.Format(time.RFC3339), r.MaxDataKeyAge)})
+			}
+			if r.EncryptedRegex != "" && tree.Metadata.EncryptedRegex != r.EncryptedRegex {
+				vs = append(vs, LintViolation{Check: LintEncryptedRegex, Message: fmt.Sprintf(
+					"encrypted_regex is %q, want %q", tree.Metadata.EncryptedRegex, r.EncryptedRegex)})
+			}
+			for _, v := range vs {
+				v.Path, v.Rule = p, r.Name
+				violations = append(violations, v)
+			}
+
+			if conf == nil {
+				continue
+			}
+			idx, cr := matchCreationRule(conf, relSlash(configRoot, p))
+			key := fmt.Sprintf("%d/%d", i, idx)
+			if cr == nil || checkedRules[key] {
+				continue
+			}
+			checkedRules[key] = true
+			vs = r.checkKeys(ruleLintKeys(cr))
+			if r.EncryptedRegex != "" && cr.EncryptedRegex != r.EncryptedRegex {
+				vs = append(vs, LintViolation{Check: LintEncryptedRegex, Message: fmt.Sprintf(
+					"encrypted_regex is %q, want %q", cr.EncryptedRegex, r.EncryptedRegex)})
+			}
+			for _, v := range vs {
+				v.Path, v.Rule = fmt.Sprintf("%s:creation_rules[%d]", configPath, idx), r.Name
+				violations = append(violations, v)
+			}
+		}
+	}
+	return violations, nil
+}
+
+// matchCreationRule returns the first creation rule matching path, as sops does.
+func matchCreationRule(conf *sopsConfig, path string) (int, *sopsCreationRule) {
+	for i := range conf.CreationRules {
+		re, err := regexp.Compile(conf.CreationRules[i].PathRegex)
+		if err == nil && re.MatchString(path) {
+			return i, &conf.CreationRules[i]
+		}
+	}
+	return -1, nil
+}
+
+func relSlash(root, path string) string {
+	rel, err := filepath.Rel(root, path)
+	if err != nil {
+		return filepath.ToSlash(path)
+	}
+	return filepath.ToSlash(rel)
+}
+
+// RunLint runs the lint subcommand, checking encrypted files and .sops.yaml against a policy.
+func RunLint(ctx context.Context, args []string, w io.Writer) (int, error) {
+	fs, _, err := envFlagSet("lint", "lint [options] [<file|dir|glob>...]")
+	if err != nil {
+		return ExitCodeError, err
+	}
+	policyPath := fs.String("policy", DefaultLintPolicyFile, "policy file")
+	asJSON := fs.Bool("json", false, "output the violations in JSON format")
+	if err := fs.Parse(args); err != nil {
+		return ExitCodeError, err
+	}
+	policy, err := LoadLintPolicy(*policyPath)
+	if err != nil {
+		return ExitCodeError, err
+	}
+	configPath, err := findSOPSConfig(".")
+	if err != nil {
+		configPath = ""
+	}
+	paths, err := findTargetFiles(fs.Args())
+	if err != nil {
+		return ExitCodeError, err
+	}
+	violations, err := Lint(policy, filepath.Dir(*policyPath), configPath, paths, time.Now())
+	if err != nil {
+		return ExitCodeError, err
+	}
+
+	if *asJSON {
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(append([]LintViolation{}, violations...)); err != nil {
+			return ExitCodeError, err
+		}
+	} else {
+		for _, v := range violations {
+			fmt.Fprintf(w, "%s: [%s] %s: %s\n", v.Path, v.Rule, v.Check, v.Message)
+		}
+		fmt.Fprintf(w, "%d files checked, %d violations\n", len(paths), len(violations))
+	}
+	if len(violations) > 0 {
+		return ExitCodeLintViolations, nil
+	}
+	return 0, nil
+}
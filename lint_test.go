@@ -0,0 +1,140 @@
+package ssk_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"testing"
+	"time"
+
+	ssk "github.com/fujiwara/sops-sakura-kms"
+	"github.com/getsops/sops/v3"
+)
+
+const testLintPolicy = `rules:
+  - name: production
+    path_regex: ^prod/
+    required_keys:
+      - sakura_kms:111111111111
+      - age:*
+    forbidden_key_types: [pgp]
+    local_vault_only: true
+    max_data_key_age: 30d
+  - name: dev
+    path_regex: ^dev/
+    encrypted_regex: ^data$
+`
+
+func TestRunLint(t *testing.T) {
+	dir := t.TempDir()
+	ageKey := newTestAgeKey(t)
+	_, transit := newTestTransit(t, "111111111111")
+	plain := []byte(testPlainFiles["yaml"])
+	sakura := vaultKey(transit, "111111111111")
+	writeTestFile(t, dir, "prod/good.enc.yaml", "yaml", plain, sops.KeyGroup{sakura, ageKey})
+	writeTestFile(t, dir, "prod/noage.enc.yaml", "yaml", plain, sops.KeyGroup{sakura})
+	remote := writeTestFile(t, dir, "prod/remote.enc.yaml", "yaml", plain, sops.KeyGroup{sakura, ageKey})
+	old := writeTestFile(t, dir, "prod/old.enc.yaml", "yaml", plain, sops.KeyGroup{sakura, ageKey})
+	writeTestFile(t, dir, "dev/app.enc.yaml", "yaml", plain, sops.KeyGroup{sakura})
+	transit.Close()
+
+	replace := func(path, pattern, repl string) {
+		b, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b = regexp.MustCompile(pattern).ReplaceAll(b, []byte(repl))
+		if err := os.WriteFile(path, b, 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	replace(remote, `vault_address: \S+`, "vault_address: https://vault.example.com:8200")
+	replace(old, `lastmodified: "[^"]+"`, `lastmodified: "2000-01-01T00:00:00Z"`)
+
+	files := map[string]string{
+		".sops-lint.yaml": testLintPolicy,
+		".sops.yaml":      "creation_rules:\n  - path_regex: ^prod/\n    hc_vault_transit_uri: http://127.0.0.1:8200/v1/transit/keys/111111111111\n",
+	}
+	for name, content := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	t.Chdir(dir)
+
+	var out bytes.Buffer
+	code, err := ssk.RunCLI(context.Background(), []string{"lint", "--json", "."}, &out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if code != ssk.ExitCodeLintViolations {
+		t.Errorf("exit code = %d, want %d", code, ssk.ExitCodeLintViolations)
+	}
+	var violations []ssk.LintViolation
+	if err := json.Unmarshal(out.Bytes(), &violations); err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, v := range violations {
+		got = append(got, v.Path+" "+v.Rule+" "+v.Check)
+	}
+	slices.Sort(got)
+	want := []string{
+		".sops.yaml:creation_rules[0] production required_key",
+		"dev/app.enc.yaml dev encrypted_regex",
+		"prod/noage.enc.yaml production required_key",
+		"prod/old.enc.yaml production max_data_key_age",
+		"prod/remote.enc.yaml production local_vault",
+	}
+	if !slices.Equal(got, want) {
+		t.Errorf("unexpected violations:\n%v\nwant:\n%v", got, want)
+	}
+
+	// no violations after adding age to the creation rule
+	conf := files[".sops.yaml"] + "    age: " + ageKey.ToString() + "\n"
+	if err := os.WriteFile(".sops.yaml", []byte(conf), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	out.Reset()
+	code, err = ssk.RunCLI(context.Background(), []string{"lint", "prod/good.enc.yaml"}, &out)
+	if err != nil || code != 0 {
+		t.Errorf("lint: code=%d err=%v\n%s", code, err, out.String())
+	}
+}
+
+func TestLoadLintPolicyInvalid(t *testing.T) {
+	for _, policy := range []string{
+		"rules:\n  - path_regex: (\n",
+		"rules:\n  - max_data_key_age: 3 weeks\n",
+		"rules:\n  - required_keys: [':x']\n",
+	} {
+		path := filepath.Join(t.TempDir(), "policy.yaml")
+		os.WriteFile(path, []byte(policy), 0o644)
+		if _, err := ssk.LoadLintPolicy(path); err == nil {
+			t.Errorf("expected error for %q", policy)
+		}
+	}
+}
+
+func TestLintPolicyInCode(t *testing.T) {
+	dir := t.TempDir()
+	ageKey := newTestAgeKey(t)
+	path := writeTestFile(t, dir, "prod/a.enc.yaml", "yaml", []byte(testPlainFiles["yaml"]), sops.KeyGroup{ageKey})
+	policy := &ssk.LintPolicy{Rules: []ssk.LintRule{{PathRegex: "^prod/", ForbiddenKeyTypes: []string{"age"}, MaxDataKeyAge: "30d"}}}
+	violations, err := ssk.Lint(policy, dir, "", []string{path}, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(violations) != 1 || violations[0].Rule != "rules[0]" {
+		t.Errorf("unexpected violations: %+v", violations)
+	}
+
+	policy.Rules[0].PathRegex = "("
+	if _, err := ssk.Lint(policy, dir, "", []string{path}, time.Now()); err == nil {
+		t.Error("expected an error for an invalid path_regex")
+	}
+}
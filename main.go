@@ -2,20 +2,25 @@ package ssk
 
 import (
 	"context"
+	"crypto/subtle"
 	"encoding/base64"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"log/slog"
+	"net"
 	"net/http"
 	"os"
 	"os/exec"
+	"os/signal"
 	"slices"
+	"strconv"
 	"strings"
 	"syscall"
 	"time"
 
 	"github.com/mattn/go-isatty"
+	v1 "github.com/sacloud/kms-api-go/apis/v1"
 	"github.com/sacloud/saclient-go"
 )
 
@@ -25,6 +30,10 @@ const (
 
 	// ExitCodeError is the exit code returned when an error occurs in the application.
 	ExitCodeError = 1
+
+	// MaxRequestBodySize is the maximum size of the request body of the transit API.
+	// SOPS sends data keys of 32 bytes.
+	MaxRequestBodySize = 1 << 20
 )
 
 // IsStdinTerminal reports whether stdin is a terminal. It is a
@@ -35,21 +44,71 @@ var IsStdinTerminal = func() bool {
 }
 
 // NewMux creates a new HTTP ServeMux with Vault Transit Engine compatible API endpoints.
-func NewMux(cipher Cipher) *http.ServeMux {
+func NewMux(cipher Cipher, opts ...HandlerOption) *http.ServeMux {
+	o := newHandlerOptions(opts)
 	mux := http.NewServeMux()
-	mux.HandleFunc("GET /health", healthCheckHandler)
-	mux.HandleFunc("PUT /v1/transit/encrypt/{key_id}", EncryptHandlerFunc(cipher))
-	mux.HandleFunc("PUT /v1/transit/decrypt/{key_id}", DecryptHandlerFunc(cipher))
+	mux.HandleFunc("GET /health", healthCheckHandlerFunc(o.session))
+	mux.HandleFunc("GET /v1/auth/token/lookup-self", requireToken(o.token, tokenLookupHandlerFunc()))
+	mux.HandleFunc("PUT /v1/transit/encrypt/{key_id}", requireToken(o.token, o.session.handler(false, resolveKey(cipher, allowKey(o, cipher, EncryptHandlerFunc(cipher))))))
+	mux.HandleFunc("PUT /v1/transit/decrypt/{key_id}", requireToken(o.token, o.session.handler(true, allowKey(o, cipher, decryptHandlerFunc(cipher, o)))))
 	return mux
 }
 
-func healthCheckHandler(w http.ResponseWriter, r *http.Request) {
-	w.WriteHeader(http.StatusOK)
+// allowKey wraps h to reject requests with the keys not allowed by WithAllowedKeys.
+// Key aliases of decrypt requests are checked by the handler after resolved.
+func allowKey(o *handlerOptions, cipher Cipher, h http.HandlerFunc) http.HandlerFunc {
+	if len(o.allowedKeys) == 0 {
+		return h
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		if keyID := r.PathValue(KeyIDPathParam); !o.keyAllowed(keyID) && !isKeyAlias(cipher, keyID) {
+			errorResponse(w, fmt.Errorf("permission denied: key %s is not allowed", keyID), http.StatusForbidden)
+			return
+		}
+		h(w, r)
+	}
+}
+
+// requireToken wraps h to reject requests without the token in the X-Vault-Token header.
+// An empty token accepts any request.
+func requireToken(token string, h http.HandlerFunc) http.HandlerFunc {
+	if token == "" {
+		return h
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		got := r.Header.Get("X-Vault-Token")
+		if subtle.ConstantTimeCompare([]byte(got), []byte(token)) != 1 {
+			errorResponse(w, errors.New("permission denied"), http.StatusForbidden)
+			return
+		}
+		h(w, r)
+	}
+}
+
+// healthCheckHandlerFunc returns a handler that reports 503 after the session expired.
+func healthCheckHandlerFunc(s *session) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !s.healthy() {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}
+}
+
+// tokenLookupHandlerFunc returns a handler that reports the pid of the server
+// to the clients with the token, so that `agent -k` signals only its agent.
+func tokenLookupHandlerFunc() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		jsonResponse(w, http.StatusOK, &VaultTokenLookupResponse{
+			Meta: map[string]string{"pid": strconv.Itoa(os.Getpid())},
+		})
+	}
 }
 
 // newServer creates a new HTTP server with Vault Transit Engine compatible API.
-func newServer(cipher Cipher, addr string) *http.Server {
-	mux := NewMux(cipher)
+func newServer(cipher Cipher, addr string, opts ...HandlerOption) *http.Server {
+	mux := NewMux(cipher, opts...)
 	return &http.Server{Addr: addr, Handler: mux}
 }
 
@@ -62,25 +121,206 @@ func RunWrapper(ctx context.Context, args []string) (int, error) {
 	if err != nil {
 		return ExitCodeError, fmt.Errorf("failed to load environment variables: %w", err)
 	}
+	return RunWrapperWithEnv(ctx, e, args)
+}
+
+// RunWrapperWithEnv is like RunWrapper, but uses the given Env instead of loading it
+// from environment variables. In server-only mode, the configuration is
+// reloaded from environment variables (and SSK_ENV_FILE) on SIGHUP.
+func RunWrapperWithEnv(ctx context.Context, e *Env, args []string) (int, error) {
+	return runWrapper(ctx, e, args, LoadEnv)
+}
+
+// runWrapper runs the wrapper with e. load loads the Env again to reload the
+// configuration in server-only mode.
+func runWrapper(ctx context.Context, e *Env, args []string, load func() (*Env, error)) (int, error) {
 	slog.Debug("Parsed command-line arguments", "env", e)
+	if err := e.applyLogLevel(); err != nil {
+		return ExitCodeError, err
+	}
 
-	slog.Info("Starting Vault-compatible API server for Sakura KMS", "key_id", e.KMSKeyID, "addr", e.ServerAddr)
+	limits, err := e.SessionLimits()
+	if err != nil {
+		return ExitCodeError, err
+	}
 
-	// Start server
-	addEnv, shutdown, err := RunServer(ctx, e.ServerAddr, e.KMSKeyID)
+	cipher, mismatch, policy, err := newServerConfig(e)
 	if err != nil {
-		return ExitCodeError, fmt.Errorf("failed to start server: %w", err)
+		return ExitCodeError, err
 	}
-	defer shutdown(context.Background())
 
-	if e.ServerOnly {
-		slog.Info("Server is running in server-only mode")
-		<-ctx.Done()
-		return 0, nil
+	if e.Preflight && e.KMSKeyID != "" {
+		key, err := cipher.Preflight(ctx, e.KMSKeyID, e.PreflightRoundTrip)
+		if err != nil {
+			return ExitCodeError, err
+		}
+		slog.Info("Preflight check passed", "key_id", key.ID, "name", key.Name, "round_trip", e.PreflightRoundTrip)
 	}
 
-	slog.Info("Server started successfully, executing", "command", e.Command, "args", args)
+	if !e.ServerOnly && e.isNativeCommand(args) {
+		slog.Info("Running natively", "subcommand", args[0], "args", args[1:])
+		return runNative(ctx, cipher, mismatch, args)
+	}
 
+	var agent *AgentState
+	if !e.ServerOnly && !e.NoAgent {
+		if agent, err = FindAgent(ctx, e.agentDir()); err != nil {
+			slog.Warn("failed to find the agent", "error", err)
+		}
+	}
+
+	var addEnv map[string]string
+	if agent != nil {
+		slog.Info("Using the running agent, executing", "pid", agent.PID, "addr", agent.Addr, "command", e.Command, "args", args)
+		addEnv = agent.Env(e.KMSKeyID)
+	} else {
+		// Start server
+		slog.Info("Starting Vault-compatible API server for Sakura KMS", "key_id", e.KMSKeyID, "addr", e.ServerAddr)
+		serverCtx, cancel := context.WithCancelCause(ctx)
+		defer cancel(nil)
+		limits.OnExpire = cancel
+		// the session is kept on reload
+		sessionOpt := WithSessionLimits(limits)
+		opts := []Option{WithCipher(cipher), WithHandlerOptions(append([]HandlerOption{sessionOpt}, policy...)...)}
+		var reloader *Reloader
+		if e.ServerOnly {
+			reloader = NewReloader()
+			opts = append(opts, WithReloader(reloader))
+			listeners, err := SystemdListeners()
+			if err != nil {
+				return ExitCodeError, err
+			}
+			if len(listeners) > 0 {
+				if len(listeners) > 1 {
+					slog.Warn("systemd passed multiple sockets, using the first one", "count", len(listeners))
+				}
+				slog.Info("Using the socket passed by systemd", "addr", listeners[0].Addr())
+				opts = append(opts, WithListener(listeners[0]))
+			}
+		}
+		var shutdown func(context.Context) error
+		addEnv, shutdown, err = RunServer(serverCtx, e.ServerAddr, e.KMSKeyID, opts...)
+		if err != nil {
+			return ExitCodeError, fmt.Errorf("failed to start server: %w", err)
+		}
+		defer shutdown(context.Background())
+
+		if e.ServerOnly {
+			reload := func() {
+				reloader.Reload(func() (Cipher, []HandlerOption, error) {
+					ne, err := load()
+					if err != nil {
+						return nil, nil, err
+					}
+					warnNotReloaded(e, ne)
+					cipher, _, policy, err := newServerConfig(ne)
+					if err != nil {
+						return nil, nil, err
+					}
+					if err := ne.applyLogLevel(); err != nil {
+						return nil, nil, err
+					}
+					return cipher, append([]HandlerOption{sessionOpt}, policy...), nil
+				})
+			}
+			return serveUntilDone(serverCtx, strings.TrimPrefix(addEnv["VAULT_ADDR"], "http://"), shutdown, reload)
+		}
+		slog.Info("Server started successfully, executing", "command", e.Command, "args", args)
+	}
+
+	env := childEnviron()
+	for k, v := range addEnv {
+		env = append(env, k+"="+v)
+	}
+	code, err := runCommand(ctx, e.Command, args, env, slices.Contains(args, "exec-env"))
+	if code != 0 && e.KMSKeyID == "" {
+		slog.Warn("command exited with error. If you need to encrypt, set SAKURA_KMS_KEY_ID or configure hc_vault_transit_uri in .sops.yaml")
+	}
+	return code, err
+}
+
+// newServerConfig returns the cipher, the key ID mismatch mode and the request
+// handling options configured in e. The options include WithKeyIDMismatch.
+func newServerConfig(e *Env) (*SakuraKMS, KeyIDMismatchMode, []HandlerOption, error) {
+	kmsOpts, err := e.KMSOptions()
+	if err != nil {
+		return nil, "", nil, err
+	}
+	mismatch, err := ParseKeyIDMismatchMode(e.KeyIDMismatch)
+	if err != nil {
+		return nil, "", nil, fmt.Errorf("invalid SSK_KEY_ID_MISMATCH: %w", err)
+	}
+	confirm, err := e.ConfirmPolicy()
+	if err != nil {
+		return nil, "", nil, err
+	}
+	cipher, err := NewSakuraKMS(kmsOpts...)
+	if err != nil {
+		return nil, "", nil, fmt.Errorf("failed to create cipher: %w", err)
+	}
+	opts := []HandlerOption{WithKeyIDMismatch(mismatch), WithAllowedKeys(e.resolveAliases(e.AllowedKeys)...)}
+	if confirm != nil {
+		opts = append(opts, WithConfirm(*confirm))
+	}
+	return cipher, mismatch, opts, nil
+}
+
+// warnNotReloaded logs the settings changed in next that need a restart to take effect.
+func warnNotReloaded(cur, next *Env) {
+	for name, changed := range map[string]bool{
+		"SSK_SERVER_ADDR":  cur.ServerAddr != next.ServerAddr,
+		"SSK_MAX_LIFETIME": cur.MaxLifetime != next.MaxLifetime,
+		"SSK_IDLE_TIMEOUT": cur.IdleTimeout != next.IdleTimeout,
+		"SSK_MAX_DECRYPTS": cur.MaxDecrypts != next.MaxDecrypts,
+	} {
+		if changed {
+			slog.Warn("the setting is not reloaded; restart the server to change it", "name", name)
+		}
+	}
+}
+
+// serveUntilDone waits for ctx in server-only mode, notifying the service
+// manager of the state and sending watchdog pings if it is under systemd.
+// reload is called on SIGHUP.
+func serveUntilDone(ctx context.Context, addr string, shutdown func(context.Context) error, reload func()) (int, error) {
+	slog.Info("Server is running in server-only mode", "addr", addr)
+	sdNotify("READY=1\nSTATUS=Listening on " + addr)
+	interval, err := SdWatchdogInterval()
+	if err != nil {
+		slog.Warn("watchdog is disabled", "error", err)
+	} else if interval > 0 {
+		slog.Info("Sending watchdog pings to systemd", "interval", interval)
+		go runSdWatchdog(ctx, interval, addr)
+	}
+	hup := make(chan os.Signal, 1)
+	if len(reloadSignals) > 0 {
+		signal.Notify(hup, reloadSignals...)
+		defer signal.Stop(hup)
+	}
+loop:
+	for {
+		select {
+		case <-ctx.Done():
+			break loop
+		case <-hup:
+			slog.Info("Reloading the configuration")
+			reload()
+		}
+	}
+	if cause := context.Cause(ctx); errors.Is(cause, ErrSessionExpired) {
+		slog.Info("Server stopped", "reason", cause)
+	}
+	sdNotify("STOPPING=1")
+	if err := shutdown(context.Background()); err != nil {
+		slog.Warn("failed to shut down the server", "error", err)
+	}
+	return 0, nil
+}
+
+// runCommand runs the command with env and returns its exit code.
+// interactive is true when the command may launch an interactive program
+// (e.g. `sops exec-env`).
+func runCommand(ctx context.Context, name string, args []string, env []string, interactive bool) (int, error) {
 	// Execute command. `sops exec-env` from a tty typically launches an
 	// interactive program (mysql cli, editor, ...) that wants to handle
 	// Ctrl-C on its own — and possibly receive many of them. SIGINT
@@ -94,29 +334,22 @@ func RunWrapper(ctx context.Context, args []string) (int, error) {
 	// short WaitDelay as the SIGKILL escalation grace period. This
 	// lets the child (sops itself, an editor under `sops -i`, a batch
 	// process under non-tty `exec-env`, ...) clean up before exiting.
-	isExecEnv := slices.Contains(args, "exec-env")
 	var cmd *exec.Cmd
-	if isExecEnv && IsStdinTerminal() {
-		cmd = exec.Command(e.Command, args...)
+	if interactive && IsStdinTerminal() {
+		cmd = exec.Command(name, args...)
 	} else {
-		cmd = exec.CommandContext(ctx, e.Command, args...)
+		cmd = exec.CommandContext(ctx, name, args...)
 		cmd.Cancel = func() error {
 			return cmd.Process.Signal(syscall.SIGTERM)
 		}
 		cmd.WaitDelay = 5 * time.Second
 	}
-	cmd.Env = os.Environ()
-	for k, v := range addEnv {
-		cmd.Env = append(cmd.Env, k+"="+v)
-	}
+	cmd.Env = env
 	cmd.Stdin = os.Stdin
 	cmd.Stdout = os.Stdout
 	cmd.Stderr = os.Stderr
 
 	if err := cmd.Run(); err != nil {
-		if e.KMSKeyID == "" {
-			slog.Warn("command exited with error. If you need to encrypt, set SAKURA_KMS_KEY_ID or configure hc_vault_transit_uri in .sops.yaml")
-		}
 		var exitErr *exec.ExitError
 		if errors.As(err, &exitErr) {
 			return exitErr.ExitCode(), nil
@@ -130,8 +363,47 @@ func RunWrapper(ctx context.Context, args []string) (int, error) {
 type Option func(*serverOptions)
 
 type serverOptions struct {
-	cipher Cipher
-	client saclient.ClientAPI
+	cipher     Cipher
+	client     saclient.ClientAPI
+	kmsOptions []SakuraKMSOption
+	handler    []HandlerOption
+	listener   net.Listener
+	reloader   *Reloader
+}
+
+func newServerOptions(opts []Option) *serverOptions {
+	o := &serverOptions{}
+	for _, opt := range opts {
+		opt(o)
+	}
+	return o
+}
+
+// HandlerOption is a functional option for the request handling of NewMux and
+// DecryptHandlerFunc. Use WithHandlerOptions to pass them to RunServer.
+type HandlerOption func(*handlerOptions)
+
+type handlerOptions struct {
+	keyIDMismatch KeyIDMismatchMode
+	token         string
+	session       *session
+	confirm       *confirmGate
+	allowedKeys   []string
+}
+
+// keyAllowed reports whether the server accepts requests with keyID.
+func (o *handlerOptions) keyAllowed(keyID string) bool {
+	return len(o.allowedKeys) == 0 || slices.Contains(o.allowedKeys, keyID)
+}
+
+func newHandlerOptions(opts []HandlerOption) *handlerOptions {
+	o := &handlerOptions{
+		keyIDMismatch: KeyIDMismatchReject,
+	}
+	for _, opt := range opts {
+		opt(o)
+	}
+	return o
 }
 
 // WithCipher sets a custom Cipher implementation. Useful for testing.
@@ -149,37 +421,119 @@ func WithClient(c saclient.ClientAPI) Option {
 	}
 }
 
+// WithKMSOptions sets options for the Sakura Cloud KMS cipher created by RunServer.
+// It is ignored when WithCipher is used.
+func WithKMSOptions(opts ...SakuraKMSOption) Option {
+	return func(o *serverOptions) {
+		o.kmsOptions = append(o.kmsOptions, opts...)
+	}
+}
+
+// WithHandlerOptions sets options for the request handling of the server.
+func WithHandlerOptions(opts ...HandlerOption) Option {
+	return func(o *serverOptions) {
+		o.handler = append(o.handler, opts...)
+	}
+}
+
+// WithKeyIDMismatch sets how decrypt requests are handled when the path key ID
+// differs from the key ID embedded in the ciphertext. The default is KeyIDMismatchReject.
+func WithKeyIDMismatch(mode KeyIDMismatchMode) HandlerOption {
+	return func(o *handlerOptions) {
+		o.keyIDMismatch = mode
+	}
+}
+
+// WithToken requires the token in the X-Vault-Token header of the transit API
+// requests. Requests without the token are rejected with 403, as Vault does.
+// Without this option, any token is accepted.
+func WithToken(token string) HandlerOption {
+	return func(o *handlerOptions) {
+		o.token = token
+	}
+}
+
+// WithSessionLimits limits the lifetime, idle time and number of decrypt
+// operations of the server. When a limit is reached, requests are rejected
+// with 403 and the server is shut down as the shutdown function returned by
+// RunServer does; then limits.OnExpire is called.
+func WithSessionLimits(limits SessionLimits) HandlerOption {
+	var s *session
+	if limits.enabled() {
+		s = newSession(limits)
+	}
+	return func(o *handlerOptions) {
+		o.session = s
+	}
+}
+
+// WithConfirm requires the user's approval for decrypt requests with the keys
+// of the policy. Denied requests are rejected with 403.
+func WithConfirm(p ConfirmPolicy) HandlerOption {
+	g := newConfirmGate(p)
+	return func(o *handlerOptions) {
+		o.confirm = g
+	}
+}
+
+// WithListener serves on ln (e.g. a socket passed by systemd) instead of listening on addr.
+func WithListener(ln net.Listener) Option {
+	return func(o *serverOptions) {
+		o.listener = ln
+	}
+}
+
+// WithAllowedKeys restricts the keys the server accepts. Requests with other
+// keys are rejected with 403. Without this option, all keys are accepted.
+func WithAllowedKeys(keyIDs ...string) HandlerOption {
+	return func(o *handlerOptions) {
+		o.allowedKeys = keyIDs
+	}
+}
+
 // RunServer starts the Vault Transit Engine compatible API server.
 // Without options, it uses Sakura Cloud KMS with credentials from environment variables.
 // Use WithCipher to provide a custom cipher, or WithClient to provide a pre-configured saclient.
 // Returns environment variables to configure SOPS, a shutdown function, and any error that occurred.
 func RunServer(ctx context.Context, addr, keyID string, opts ...Option) (map[string]string, func(context.Context) error, error) {
-	var o serverOptions
-	for _, opt := range opts {
-		opt(&o)
-	}
+	o := newServerOptions(opts)
 	if o.cipher == nil {
 		var (
 			cipher Cipher
 			err    error
 		)
 		if o.client != nil {
-			cipher, err = NewSakuraKMSWithClient(o.client)
+			cipher, err = NewSakuraKMSWithClient(o.client, o.kmsOptions...)
 		} else {
-			cipher, err = NewSakuraKMS()
+			cipher, err = NewSakuraKMS(o.kmsOptions...)
 		}
 		if err != nil {
 			return nil, nil, fmt.Errorf("failed to create cipher: %w", err)
 		}
 		o.cipher = cipher
 	}
-	return runServer(ctx, addr, keyID, o.cipher)
+	return runServer(ctx, addr, keyID, o.cipher, opts...)
 }
 
-func runServer(ctx context.Context, addr, keyID string, cipher Cipher) (map[string]string, func(context.Context) error, error) {
-	server := newServer(cipher, addr)
+func runServer(ctx context.Context, addr, keyID string, cipher Cipher, opts ...Option) (map[string]string, func(context.Context) error, error) {
+	o := newServerOptions(opts)
+	ln := o.listener
+	if ln == nil {
+		var err error
+		if ln, err = net.Listen("tcp", addr); err != nil {
+			return nil, nil, fmt.Errorf("failed to listen on %s: %w", addr, err)
+		}
+	}
+	// the actual address, for a port 0 (random port) in addr or a listener
+	addr = ln.Addr().String()
+	ho := newHandlerOptions(o.handler)
+	server := newServer(cipher, addr, o.handler...)
+	if o.reloader != nil {
+		o.reloader.set(server.Handler)
+		server.Handler = o.reloader
+	}
 	go func() {
-		if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+		if err := server.Serve(ln); err != nil && err != http.ErrServerClosed {
 			slog.Error("server error", "error", err)
 		}
 	}()
@@ -187,10 +541,18 @@ func runServer(ctx context.Context, addr, keyID string, cipher Cipher) (map[stri
 	if err := waitForServer(ctx, fmt.Sprintf("http://%s/health", addr)); err != nil {
 		return nil, nil, fmt.Errorf("failed to start server: %w", err)
 	}
+	if ho.session != nil {
+		ho.session.start()
+		go ho.session.watch(ctx, server.Shutdown)
+	}
 
+	token := ho.token
+	if token == "" {
+		token = "dummy"
+	}
 	env := map[string]string{
 		"VAULT_ADDR":  "http://" + addr,
-		"VAULT_TOKEN": "dummy",
+		"VAULT_TOKEN": token,
 	}
 	if keyID != "" {
 		env["SOPS_VAULT_URIS"] = fmt.Sprintf("http://%s/v1/transit/encrypt/%s", addr, keyID)
@@ -217,17 +579,22 @@ func waitForServer(ctx context.Context, healthURL string) error {
 }
 
 // readRequest decodes JSON request body into the specified type.
-// Validates Content-Type header and decodes the request body.
-func readRequest[T any](r *http.Request) (*T, error) {
+// Validates Content-Type header and decodes the request body, which is limited
+// to MaxRequestBodySize. It returns the status code for the error.
+func readRequest[T any](w http.ResponseWriter, r *http.Request) (*T, int, error) {
 	contentType := r.Header.Get("Content-Type")
 	if contentType != "" && !strings.HasPrefix(contentType, "application/json") {
-		return nil, fmt.Errorf("invalid content-type: %s", contentType)
+		return nil, http.StatusBadRequest, fmt.Errorf("invalid content-type: %s", contentType)
 	}
 	var req T
-	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		return nil, err
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, MaxRequestBodySize)).Decode(&req); err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			return nil, http.StatusRequestEntityTooLarge, fmt.Errorf("request body is larger than %d bytes", MaxRequestBodySize)
+		}
+		return nil, http.StatusBadRequest, err
 	}
-	return &req, nil
+	return &req, http.StatusOK, nil
 }
 
 // jsonResponse writes a JSON response with the given status code and body.
@@ -252,9 +619,9 @@ func EncryptHandlerFunc(cipher Cipher) func(w http.ResponseWriter, r *http.Reque
 	return func(w http.ResponseWriter, r *http.Request) {
 		keyID := r.PathValue(KeyIDPathParam)
 		slog.Debug("Encrypting data with Sakura KMS", "key_id", keyID)
-		req, err := readRequest[VaultEncryptRequest](r)
+		req, status, err := readRequest[VaultEncryptRequest](w, r)
 		if err != nil {
-			errorResponse(w, err, http.StatusBadRequest)
+			errorResponse(w, err, status)
 			return
 		}
 		// Decode base64-encoded plaintext
@@ -263,26 +630,49 @@ func EncryptHandlerFunc(cipher Cipher) func(w http.ResponseWriter, r *http.Reque
 			errorResponse(w, fmt.Errorf("invalid base64 plaintext: %w", err), http.StatusBadRequest)
 			return
 		}
-		ciphertext, err := cipher.Encrypt(r.Context(), keyID, plaintext)
+		var algo v1.KeyEncryptAlgoEnum
+		if req.Type != "" {
+			if algo, err = ParseAlgorithm(req.Type); err != nil {
+				errorResponse(w, err, http.StatusBadRequest)
+				return
+			}
+		}
+		var ciphertext string
+		if ac, ok := cipher.(AlgorithmCipher); ok {
+			ciphertext, algo, err = ac.EncryptWithAlgorithm(r.Context(), keyID, plaintext, algo)
+		} else if algo != "" {
+			errorResponse(w, fmt.Errorf("cipher does not support selecting algorithm %s", algo), http.StatusBadRequest)
+			return
+		} else {
+			ciphertext, err = cipher.Encrypt(r.Context(), keyID, plaintext)
+		}
 		if err != nil {
 			errorResponse(w, err, http.StatusInternalServerError)
 			return
 		}
 		res := &VaultEncryptResponse{
 			Ciphertext: VaultPrefix + ciphertext,
+			Algorithm:  string(algo),
 		}
 		jsonResponse(w, http.StatusOK, res)
 	}
 }
 
 // DecryptHandlerFunc returns an HTTP handler for Vault Transit Engine decrypt endpoint.
-func DecryptHandlerFunc(cipher Cipher) func(w http.ResponseWriter, r *http.Request) {
+// If the ciphertext is a Sakura Cloud KMS blob, the key ID embedded in it is
+// checked against the path key ID according to WithKeyIDMismatch. If the path
+// has a key alias and the cipher is a KeyResolver, the embedded key ID is used.
+func DecryptHandlerFunc(cipher Cipher, opts ...HandlerOption) func(w http.ResponseWriter, r *http.Request) {
+	return decryptHandlerFunc(cipher, newHandlerOptions(opts))
+}
+
+func decryptHandlerFunc(cipher Cipher, o *handlerOptions) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		keyID := r.PathValue(KeyIDPathParam)
 		slog.Debug("Decrypting data with Sakura KMS", "key_id", keyID)
-		req, err := readRequest[VaultDecryptRequest](r)
+		req, status, err := readRequest[VaultDecryptRequest](w, r)
 		if err != nil {
-			errorResponse(w, err, http.StatusBadRequest)
+			errorResponse(w, err, status)
 			return
 		}
 		body := strings.TrimPrefix(req.Ciphertext, VaultPrefix)
@@ -290,6 +680,35 @@ func DecryptHandlerFunc(cipher Cipher) func(w http.ResponseWriter, r *http.Reque
 			errorResponse(w, fmt.Errorf("invalid ciphertext format"), http.StatusBadRequest)
 			return
 		}
+		alias := isKeyAlias(cipher, keyID)
+		if ct, err := ParseCiphertext(body); err != nil {
+			slog.Debug("ciphertext is not a Sakura KMS blob, skipping key ID check", "error", err)
+			if alias {
+				if keyID, err = cipher.(KeyResolver).ResolveKeyID(r.Context(), keyID); err != nil {
+					errorResponse(w, err, keyAliasErrorStatus(err))
+					return
+				}
+			}
+		} else if alias {
+			// the ciphertext records the resource ID, so changing the alias does not break decryption
+			slog.Debug("using the key ID embedded in the ciphertext for the key alias", "alias", keyID, "key_id", ct.KeyID)
+			keyID = ct.KeyID
+		} else if ct.KeyID != keyID {
+			if o.keyIDMismatch != KeyIDMismatchCorrect {
+				errorResponse(w, fmt.Errorf("key ID mismatch: path has %s but ciphertext was encrypted with %s", keyID, ct.KeyID), http.StatusBadRequest)
+				return
+			}
+			slog.Warn("key ID mismatch, using the key ID embedded in the ciphertext", "path_key_id", keyID, "key_id", ct.KeyID)
+			keyID = ct.KeyID
+		}
+		if !o.keyAllowed(keyID) {
+			errorResponse(w, fmt.Errorf("permission denied: key %s is not allowed", keyID), http.StatusForbidden)
+			return
+		}
+		if err := o.confirm.approve(r.Context(), keyID, r.RemoteAddr); err != nil {
+			errorResponse(w, err, http.StatusForbidden)
+			return
+		}
 		plaintext, err := cipher.Decrypt(r.Context(), keyID, body)
 		if err != nil {
 			errorResponse(w, err, http.StatusInternalServerError)
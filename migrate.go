@@ -0,0 +1,321 @@
+package ssk
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"slices"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"github.com/getsops/sops/v3"
+	"github.com/getsops/sops/v3/hcvault"
+	"github.com/getsops/sops/v3/keys"
+)
+
+// Statuses of MigrateResult.
+const (
+	MigrateUpdated   = "updated"
+	MigrateUnchanged = "unchanged"
+	MigrateSkipped   = "skipped"
+	MigrateFailed    = "failed"
+)
+
+// migrateKeyTypes are the key types that can be removed by migrate.
+var migrateKeyTypes = []string{"age", "pgp", "hc_vault", "kms", "gcp_kms", "azure_kv", "hckms"}
+
+// DefaultMigrateParallel is the default number of files migrated in parallel.
+const DefaultMigrateParallel = 4
+
+// MigrateOptions configures MigrateFiles.
+type MigrateOptions struct {
+	// KeyID is the Sakura Cloud KMS key that protects every file after migration.
+	KeyID string
+	// Remove lists the key types to remove from the files, as in the SOPS
+	// metadata (age, pgp, hc_vault, kms, gcp_kms, azure_kv, hckms).
+	// hc_vault removes only the keys not encrypted by Sakura Cloud KMS.
+	Remove []string
+	// DryRun reports the changes without writing the files.
+	DryRun bool
+	// Parallel is the number of files migrated in parallel.
+	Parallel int
+	// ServerAddr is the address of the Vault-compatible server recorded in the new key entries.
+	ServerAddr string
+	// KeyIDMismatch is how the key IDs of existing Sakura Cloud KMS entries are handled.
+	KeyIDMismatch KeyIDMismatchMode
+}
+
+// MigrateResult is the result of migrating a file.
+type MigrateResult struct {
+	Path    string   `json:"path"`
+	Status  string   `json:"status"`
+	Added   []string `json:"added,omitempty"`
+	Removed []string `json:"removed,omitempty"`
+	Message string   `json:"message,omitempty"`
+}
+
+// MigrateFiles adds the Sakura Cloud KMS key opts.KeyID to SOPS files and removes
+// the keys of the types in opts.Remove. The data key of each file is decrypted
+// with any of its existing keys (Sakura Cloud KMS with c; age, PGP, HashiCorp
+// Vault and so on with the local SOPS key service) and encrypted through the
+// built-in Vault-compatible server with c, started on a random local port
+// for the migration. The new key entries point to opts.ServerAddr, so the
+// files work with the wrapper as if they were encrypted through it.
+// The results are returned in the order of paths; the files not migrated
+// before ctx is canceled are reported as failed.
+func MigrateFiles(ctx context.Context, c Cipher, paths []string, opts MigrateOptions) ([]MigrateResult, error) {
+	token, err := newAgentToken()
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate a token: %w", err)
+	}
+	// the server is shut down after the files, even if ctx is canceled
+	addEnv, shutdown, err := RunServer(context.WithoutCancel(ctx), "127.0.0.1:0", "", WithCipher(c), WithHandlerOptions(WithToken(token), WithKeyIDMismatch(opts.KeyIDMismatch)))
+	if err != nil {
+		return nil, fmt.Errorf("failed to start server: %w", err)
+	}
+	defer shutdown(context.Background())
+	server := migrateServer{addr: addEnv["VAULT_ADDR"], token: token}
+
+	results := make([]MigrateResult, len(paths))
+	sem := make(chan struct{}, max(opts.Parallel, 1))
+	var wg sync.WaitGroup
+	for i, path := range paths {
+		select {
+		case sem <- struct{}{}:
+		case <-ctx.Done():
+			results[i] = MigrateResult{Path: path, Status: MigrateFailed, Message: ctx.Err().Error()}
+			continue
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer func() { <-sem }()
+			results[i] = migrateFile(ctx, c, server, path, opts)
+			slog.Debug("migrated", "path", path, "status", results[i].Status)
+		}()
+	}
+	wg.Wait()
+	return results, nil
+}
+
+// migrateServer is the built-in server that encrypts the data keys.
+type migrateServer struct {
+	addr  string
+	token string
+}
+
+// encrypt encrypts dataKey with keyID through the server, as sops does for
+// an hc_vault key.
+func (s migrateServer) encrypt(ctx context.Context, keyID string, dataKey []byte) (string, error) {
+	key := hcvault.NewMasterKey(s.addr, "transit", keyID)
+	hcvault.Token(s.token).ApplyToMasterKey(key)
+	if err := key.EncryptContext(ctx, dataKey); err != nil {
+		return "", err
+	}
+	return key.EncryptedKey, nil
+}
+
+func migrateFile(ctx context.Context, c Cipher, server migrateServer, path string, opts MigrateOptions) MigrateResult {
+	result := MigrateResult{Path: path}
+	fail := func(err error) MigrateResult {
+		result.Status = MigrateFailed
+		result.Message = err.Error()
+		return result
+	}
+	if err := ctx.Err(); err != nil {
+		return fail(err)
+	}
+	tree, _, err := loadSOPSFile(path, "")
+	if err != nil {
+		return fail(err)
+	}
+	groups := tree.Metadata.KeyGroups
+	if len(groups) != 1 {
+		result.Status = MigrateSkipped
+		result.Message = fmt.Sprintf("%d key groups (Shamir); update the key groups with sops updatekeys", len(groups))
+		return result
+	}
+
+	var group sops.KeyGroup
+	hasKey := false
+	for _, key := range groups[0] {
+		sakuraKeyID := sakuraKMSKeyID(key)
+		if sakuraKeyID == opts.KeyID {
+			hasKey = true
+		}
+		if sakuraKeyID == "" && slices.Contains(opts.Remove, key.TypeToIdentifier()) {
+			result.Removed = append(result.Removed, key.TypeToIdentifier()+":"+key.ToString())
+			continue
+		}
+		group = append(group, key)
+	}
+	if hasKey && len(result.Removed) == 0 {
+		result.Status = MigrateUnchanged
+		return result
+	}
+
+	dataKey, err := tree.Metadata.GetDataKeyWithKeyServices(keyServices(c, opts.KeyIDMismatch), nil)
+	if err != nil {
+		return fail(fmt.Errorf("failed to decrypt the data key: %w", err))
+	}
+	if !hasKey {
+		key := &hcvault.MasterKey{
+			VaultAddress: "http://" + opts.ServerAddr,
+			EnginePath:   "transit",
+			KeyName:      opts.KeyID,
+			CreationDate: time.Now().UTC(),
+		}
+		if !opts.DryRun {
+			if key.EncryptedKey, err = server.encrypt(ctx, opts.KeyID, dataKey); err != nil {
+				return fail(fmt.Errorf("failed to encrypt the data key: %w", err))
+			}
+		}
+		group = append(group, key)
+		result.Added = append(result.Added, key.TypeToIdentifier()+":"+key.ToString())
+	}
+	tree.Metadata.KeyGroups = []sops.KeyGroup{group}
+
+	result.Status = MigrateUpdated
+	if opts.DryRun {
+		return result
+	}
+	store, _ := sopsStore(path, "")
+	b, err := store.EmitEncryptedFile(*tree)
+	if err != nil {
+		return fail(fmt.Errorf("failed to emit %s: %w", path, err))
+	}
+	if err := writeFileAtomic(path, b); err != nil {
+		return fail(err)
+	}
+	return result
+}
+
+// sakuraKMSKeyID returns the Sakura Cloud KMS key ID of an hc_vault key
+// encrypted by Sakura Cloud KMS, or "" for other keys.
+func sakuraKMSKeyID(key keys.MasterKey) string {
+	vk, ok := key.(*hcvault.MasterKey)
+	if !ok {
+		return ""
+	}
+	ct, err := ParseCiphertext(strings.TrimPrefix(vk.EncryptedKey, VaultPrefix))
+	if err != nil {
+		return ""
+	}
+	return ct.KeyID
+}
+
+// RunMigrate runs the migrate subcommand, adding a Sakura Cloud KMS key to the
+// SOPS files in the given files and directories.
+func RunMigrate(ctx context.Context, args []string, w io.Writer) (int, error) {
+	fs, e, err := envFlagSet("migrate", "migrate [options] [<file|dir>...]")
+	if err != nil {
+		return ExitCodeError, err
+	}
+	var remove stringsFlag
+	fs.Var(&remove, "remove", "remove the keys of this type: "+strings.Join(migrateKeyTypes, ", ")+" (repeatable)")
+	dryRun := fs.Bool("dry-run", false, "report the changes without writing the files")
+	parallel := fs.Int("parallel", DefaultMigrateParallel, "number of files migrated in parallel")
+	asJSON := fs.Bool("json", false, "output the report in JSON format")
+	if err := fs.Parse(args); err != nil {
+		return ExitCodeError, err
+	}
+	if e.KMSKeyID == "" {
+		return ExitCodeError, errors.New("no KMS key ID; set --key-id or SAKURA_KMS_KEY_ID")
+	}
+	for _, t := range remove {
+		if !slices.Contains(migrateKeyTypes, t) {
+			return ExitCodeError, fmt.Errorf("unknown key type %q for --remove (must be one of %s)", t, strings.Join(migrateKeyTypes, ", "))
+		}
+	}
+	mismatch, err := ParseKeyIDMismatchMode(e.KeyIDMismatch)
+	if err != nil {
+		return ExitCodeError, fmt.Errorf("invalid SSK_KEY_ID_MISMATCH: %w", err)
+	}
+	kmsOpts, err := e.KMSOptions()
+	if err != nil {
+		return ExitCodeError, err
+	}
+	c, err := NewSakuraKMS(kmsOpts...)
+	if err != nil {
+		return ExitCodeError, fmt.Errorf("failed to create cipher: %w", err)
+	}
+	if _, err := c.Preflight(ctx, e.KMSKeyID, false); err != nil {
+		return ExitCodeError, err
+	}
+	// the files record the resource ID, so that an alias is not compared with the existing entries
+	keyID, err := c.ResolveKeyID(ctx, e.KMSKeyID)
+	if err != nil {
+		return ExitCodeError, err
+	}
+
+	roots := fs.Args()
+	if len(roots) == 0 {
+		roots = []string{"."}
+	}
+	paths, err := findSOPSFiles(roots)
+	if err != nil {
+		return ExitCodeError, err
+	}
+	results, err := MigrateFiles(ctx, c, paths, MigrateOptions{
+		KeyID:         keyID,
+		Remove:        remove,
+		DryRun:        *dryRun,
+		Parallel:      *parallel,
+		ServerAddr:    e.ServerAddr,
+		KeyIDMismatch: mismatch,
+	})
+	if err != nil {
+		return ExitCodeError, err
+	}
+
+	code := 0
+	counts := map[string]int{}
+	for _, r := range results {
+		counts[r.Status]++
+		if r.Status == MigrateFailed {
+			code = ExitCodeError
+		}
+	}
+	if *asJSON {
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(results); err != nil {
+			return ExitCodeError, err
+		}
+		return code, nil
+	}
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	for _, r := range results {
+		status := r.Status
+		if *dryRun && status == MigrateUpdated {
+			status = "would update"
+		}
+		var changes []string
+		for _, k := range r.Added {
+			changes = append(changes, "+"+k)
+		}
+		for _, k := range r.Removed {
+			changes = append(changes, "-"+k)
+		}
+		if r.Message != "" {
+			changes = append(changes, r.Message)
+		}
+		if len(changes) > 0 {
+			fmt.Fprintf(tw, "%s\t%s\t%s\n", status, r.Path, strings.Join(changes, " "))
+		} else {
+			fmt.Fprintf(tw, "%s\t%s\n", status, r.Path)
+		}
+	}
+	tw.Flush()
+	fmt.Fprintf(w, "%d files: %d updated, %d unchanged, %d skipped, %d failed\n", len(results),
+		counts[MigrateUpdated], counts[MigrateUnchanged], counts[MigrateSkipped], counts[MigrateFailed])
+	if *dryRun {
+		fmt.Fprintln(w, "dry run: no files were written")
+	}
+	return code, nil
+}
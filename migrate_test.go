@@ -0,0 +1,173 @@
+package ssk_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	ssk "github.com/fujiwara/sops-sakura-kms"
+	"github.com/getsops/sops/v3"
+)
+
+func TestRunMigrate(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	ageKey := newTestAgeKey(t)
+	_, transit := newTestTransit(t, "111111111111")
+	plain := []byte(testPlainFiles["yaml"])
+	ageFile := writeTestFile(t, dir, "a.enc.yaml", "yaml", plain, sops.KeyGroup{ageKey})
+	jsonFile := writeTestFile(t, dir, "sub/b.json", "json", []byte(testPlainFiles["json"]), sops.KeyGroup{ageKey})
+	sakuraFile := writeTestFile(t, dir, "c.enc.yaml", "yaml", plain, sops.KeyGroup{vaultKey(transit, "111111111111")})
+	shamirFile := writeTestFile(t, dir, "d.enc.yaml", "yaml", plain,
+		sops.KeyGroup{ageKey}, sops.KeyGroup{vaultKey(transit, "111111111111")})
+	writeTestFile(t, dir, ".git/e.enc.yaml", "yaml", plain, sops.KeyGroup{ageKey})
+	if err := os.WriteFile(filepath.Join(dir, "plain.yaml"), plain, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	transit.Close()
+
+	_, kmsSrv := newFakeKMS(t, "111111111111")
+	setFakeKMSEnv(t, kmsSrv.URL)
+	t.Setenv("SAKURA_KMS_KEY_ID", "111111111111")
+
+	before, _ := os.ReadFile(ageFile)
+	var out bytes.Buffer
+	code, err := ssk.RunCLI(ctx, []string{"migrate", "--dry-run", "--json", dir}, &out)
+	if err != nil || code != 0 {
+		t.Fatalf("migrate --dry-run: code=%d err=%v", code, err)
+	}
+	var results []ssk.MigrateResult
+	if err := json.Unmarshal(out.Bytes(), &results); err != nil {
+		t.Fatal(err)
+	}
+	statuses := map[string]string{}
+	for _, r := range results {
+		statuses[r.Path] = r.Status
+	}
+	want := map[string]string{
+		ageFile:    ssk.MigrateUpdated,
+		jsonFile:   ssk.MigrateUpdated,
+		sakuraFile: ssk.MigrateUnchanged,
+		shamirFile: ssk.MigrateSkipped,
+	}
+	if len(statuses) != len(want) {
+		t.Errorf("unexpected results: %v", statuses)
+	}
+	for path, status := range want {
+		if statuses[path] != status {
+			t.Errorf("%s: status = %q, want %q", path, statuses[path], status)
+		}
+	}
+	if after, _ := os.ReadFile(ageFile); !bytes.Equal(before, after) {
+		t.Error("dry run must not write the files")
+	}
+
+	out.Reset()
+	code, err = ssk.RunCLI(ctx, []string{"migrate", "--remove", "age", "--parallel", "2", dir}, &out)
+	if err != nil || code != 0 {
+		t.Fatalf("migrate: code=%d err=%v\n%s", code, err, out.String())
+	}
+	if !strings.Contains(out.String(), "4 files: 2 updated, 1 unchanged, 1 skipped, 0 failed") {
+		t.Errorf("unexpected report:\n%s", out.String())
+	}
+
+	// the migrated files are decryptable with Sakura Cloud KMS only
+	t.Setenv("SOPS_AGE_KEY", "")
+	for _, path := range []string{ageFile, jsonFile} {
+		info, err := ssk.InspectFile(path, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		keys := info.KeyGroups[0].Keys
+		if len(keys) != 1 || keys[0].Type != "hc_vault" || keys[0].Vault == nil || keys[0].Vault.SakuraKMS == nil || keys[0].Vault.SakuraKMS.KeyID != "111111111111" {
+			t.Errorf("%s: unexpected keys %+v", path, keys)
+		}
+		out.Reset()
+		code, err := ssk.RunCLI(ctx, []string{"export", "--format", "json", path}, &out)
+		if err != nil || code != 0 {
+			t.Fatalf("export %s: code=%d err=%v", path, code, err)
+		}
+		if !strings.Contains(out.String(), `"foo_bar": "baz"`) {
+			t.Errorf("unexpected values of %s: %s", path, out.String())
+		}
+	}
+	if st, _ := os.Stat(ageFile); st.Mode().Perm() != 0o600 {
+		t.Errorf("permission changed: %v", st.Mode())
+	}
+
+	out.Reset()
+	code, err = ssk.RunCLI(ctx, []string{"migrate", dir}, &out)
+	if err != nil || code != 0 {
+		t.Fatalf("migrate again: code=%d err=%v", code, err)
+	}
+	if !strings.Contains(out.String(), "4 files: 0 updated, 3 unchanged, 1 skipped, 0 failed") {
+		t.Errorf("unexpected report:\n%s", out.String())
+	}
+}
+
+func TestRunMigrateKeyAlias(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	ageFile := writeTestFile(t, dir, "a.enc.yaml", "yaml", []byte(testPlainFiles["yaml"]), sops.KeyGroup{newTestAgeKey(t)})
+	_, kmsSrv := newFakeKMS(t, "111111111111")
+	setFakeKMSEnv(t, kmsSrv.URL)
+	t.Setenv("SAKURA_KMS_KEY_ID", "prod-app")
+	t.Setenv("SSK_KEY_ALIASES", "prod-app=111111111111")
+
+	var out bytes.Buffer
+	for _, want := range []string{"1 updated", "1 unchanged"} {
+		out.Reset()
+		code, err := ssk.RunCLI(ctx, []string{"migrate", "--remove", "age", dir}, &out)
+		if err != nil || code != 0 {
+			t.Fatalf("migrate: code=%d err=%v\n%s", code, err, out.String())
+		}
+		if !strings.Contains(out.String(), want) {
+			t.Errorf("unexpected report, want %s:\n%s", want, out.String())
+		}
+	}
+
+	// the resource ID is recorded, and the file is decrypted natively
+	info, err := ssk.InspectFile(ageFile, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys := info.KeyGroups[0].Keys
+	if len(keys) != 1 || keys[0].Vault == nil || keys[0].Vault.KeyName != "111111111111" {
+		t.Errorf("unexpected keys %+v", keys)
+	}
+	t.Setenv("SOPS_AGE_KEY", "")
+	out.Reset()
+	if code, err := ssk.RunCLI(ctx, []string{"export", "--format", "json", ageFile}, &out); err != nil || code != 0 {
+		t.Fatalf("export: code=%d err=%v", code, err)
+	}
+}
+
+func TestMigrateFilesCanceled(t *testing.T) {
+	dir := t.TempDir()
+	ageKey := newTestAgeKey(t)
+	plain := []byte(testPlainFiles["yaml"])
+	var paths []string
+	for _, name := range []string{"a.enc.yaml", "b.enc.yaml"} {
+		paths = append(paths, writeTestFile(t, dir, name, "yaml", plain, sops.KeyGroup{ageKey}))
+	}
+	_, kmsSrv := newFakeKMS(t, "111111111111")
+	c, err := ssk.NewSakuraKMSWithClient(newFakeKMSClient(t, kmsSrv))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	results, err := ssk.MigrateFiles(ctx, c, paths, ssk.MigrateOptions{KeyID: "111111111111", ServerAddr: "127.0.0.1:8200"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, r := range results {
+		if r.Status != ssk.MigrateFailed || !strings.Contains(r.Message, "canceled") {
+			t.Errorf("%s: unexpected result %+v", r.Path, r)
+		}
+	}
+}
@@ -0,0 +1,233 @@
+package ssk
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/getsops/sops/v3"
+	sopsaes "github.com/getsops/sops/v3/aes"
+	"github.com/getsops/sops/v3/cmd/sops/common"
+	sopsexec "github.com/getsops/sops/v3/cmd/sops/subcommand/exec"
+	"github.com/getsops/sops/v3/keyservice"
+	"github.com/getsops/sops/v3/stores"
+	"google.golang.org/grpc"
+)
+
+// cipherKeyService is a SOPS key service that decrypts hc_vault data keys
+// encrypted by Sakura Cloud KMS directly with a Cipher, without the
+// Vault-compatible HTTP server. Other keys are left to the next key service.
+type cipherKeyService struct {
+	cipher        Cipher
+	keyIDMismatch KeyIDMismatchMode
+}
+
+var _ keyservice.KeyServiceClient = (*cipherKeyService)(nil)
+
+func (s *cipherKeyService) Encrypt(ctx context.Context, req *keyservice.EncryptRequest, _ ...grpc.CallOption) (*keyservice.EncryptResponse, error) {
+	return nil, errors.New("encryption is not supported by the native key service")
+}
+
+func (s *cipherKeyService) Decrypt(ctx context.Context, req *keyservice.DecryptRequest, _ ...grpc.CallOption) (*keyservice.DecryptResponse, error) {
+	vk := req.GetKey().GetVaultKey()
+	if vk == nil {
+		return nil, errors.New("not an hc_vault key")
+	}
+	ciphertext := strings.TrimPrefix(string(req.GetCiphertext()), VaultPrefix)
+	ct, err := ParseCiphertext(ciphertext)
+	if err != nil {
+		return nil, err
+	}
+	keyID := vk.KeyName
+	if !IsKeyResourceID(keyID) {
+		// key_name is a key alias: the ciphertext records the resource ID,
+		// so changing the alias does not break decryption
+		slog.Debug("using the key ID embedded in the ciphertext for the key alias", "alias", keyID, "key_id", ct.KeyID)
+		keyID = ct.KeyID
+	} else if ct.KeyID != keyID {
+		if s.keyIDMismatch != KeyIDMismatchCorrect {
+			return nil, fmt.Errorf("key ID mismatch: key_name is %s but ciphertext was encrypted with %s", keyID, ct.KeyID)
+		}
+		slog.Warn("key ID mismatch, using the key ID embedded in the ciphertext", "key_name", keyID, "key_id", ct.KeyID)
+		keyID = ct.KeyID
+	}
+	plaintext, err := s.cipher.Decrypt(ctx, keyID, ciphertext)
+	if err != nil {
+		return nil, err
+	}
+	return &keyservice.DecryptResponse{Plaintext: plaintext}, nil
+}
+
+// localKeyService is the local SOPS key service for keys other than Sakura
+// Cloud KMS. It refuses hc_vault keys encrypted by Sakura Cloud KMS, which
+// would otherwise be sent to the Vault-compatible server that is not running.
+type localKeyService struct {
+	keyservice.KeyServiceClient
+}
+
+func newLocalKeyService() keyservice.KeyServiceClient {
+	return localKeyService{keyservice.NewLocalClient()}
+}
+
+func (s localKeyService) Decrypt(ctx context.Context, req *keyservice.DecryptRequest, opts ...grpc.CallOption) (*keyservice.DecryptResponse, error) {
+	if req.GetKey().GetVaultKey() != nil {
+		if _, err := ParseCiphertext(strings.TrimPrefix(string(req.GetCiphertext()), VaultPrefix)); err == nil {
+			return nil, errors.New("Sakura Cloud KMS keys are decrypted by the native key service only")
+		}
+	}
+	return s.KeyServiceClient.Decrypt(ctx, req, opts...)
+}
+
+// keyServices returns the key services to decrypt SOPS files in-process.
+func keyServices(cipher Cipher, mismatch KeyIDMismatchMode) []keyservice.KeyServiceClient {
+	return []keyservice.KeyServiceClient{
+		&cipherKeyService{cipher: cipher, keyIDMismatch: mismatch},
+		newLocalKeyService(),
+	}
+}
+
+// decryptSOPSFile decrypts a SOPS file in-process. Data keys encrypted by
+// Sakura Cloud KMS are decrypted with cipher; other keys (age, PGP, ...)
+// are decrypted with the local SOPS key service.
+func decryptSOPSFile(ctx context.Context, cipher Cipher, mismatch KeyIDMismatchMode, path, format string) (*sops.Tree, string, error) {
+	tree, name, err := loadSOPSFile(path, format)
+	if err != nil {
+		return nil, "", err
+	}
+	_, err = common.DecryptTree(common.DecryptTreeOpts{
+		Tree:        tree,
+		KeyServices: keyServices(cipher, mismatch),
+		Cipher:      sopsaes.NewCipher(),
+	})
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to decrypt %s: %w", path, err)
+	}
+	return tree, name, nil
+}
+
+// isNativeCommand reports whether args should run natively instead of with sops:
+// the command is exec-env or exec-file, and SSK_NATIVE is set or the sops
+// command is not found.
+func (e *Env) isNativeCommand(args []string) bool {
+	if len(args) == 0 || (args[0] != "exec-env" && args[0] != "exec-file") {
+		return false
+	}
+	if e.Native {
+		return true
+	}
+	if _, err := exec.LookPath(e.Command); err != nil {
+		slog.Warn("command not found, running natively without sops (set SSK_NATIVE=true to silence this)", "command", e.Command, "subcommand", args[0], "error", err)
+		return true
+	}
+	return false
+}
+
+// runNative runs `exec-env` or `exec-file` in-process, compatible with
+// `sops exec-env <file> <command>` and `sops exec-file <file> <command>`.
+func runNative(ctx context.Context, cipher Cipher, mismatch KeyIDMismatchMode, args []string) (int, error) {
+	subcommand, args := args[0], args[1:]
+	fs := flag.NewFlagSet(subcommand, flag.ContinueOnError)
+	inputType := fs.String("input-type", "", "format of the encrypted file (yaml, json, dotenv, ini, binary)")
+	var pristine *bool
+	var outputType, filename *string
+	if subcommand == "exec-env" {
+		pristine = fs.Bool("pristine", false, "insert only the decrypted values into the environment")
+	} else {
+		outputType = fs.String("output-type", "", "format of the decrypted file; same as the input by default")
+		filename = fs.String("filename", "", "filename for the temporary file")
+		fs.Bool("no-fifo", true, "accepted for compatibility; a regular file is always used")
+	}
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: sops-sakura-kms %s [options] <file> <command>\n", subcommand)
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return ExitCodeError, err
+	}
+	if fs.NArg() != 2 {
+		fs.Usage()
+		return ExitCodeError, fmt.Errorf("%s requires a file and a command", subcommand)
+	}
+	path, command := fs.Arg(0), fs.Arg(1)
+
+	tree, _, err := decryptSOPSFile(ctx, cipher, mismatch, path, *inputType)
+	if err != nil {
+		return ExitCodeError, err
+	}
+
+	if subcommand == "exec-env" {
+		vars, err := treeToEnv(tree)
+		if err != nil {
+			return ExitCodeError, err
+		}
+		var env []string
+		if !*pristine {
+			env = childEnviron()
+		}
+		return runShell(ctx, command, append(env, vars...), true)
+	}
+
+	format := *outputType
+	if format == "" {
+		format = *inputType
+	}
+	store, _ := sopsStore(path, format)
+	plaintext, err := store.EmitPlainFile(tree.Branches)
+	if err != nil {
+		return ExitCodeError, fmt.Errorf("failed to emit %s: %w", path, err)
+	}
+	dir, err := os.MkdirTemp("", ".sops")
+	if err != nil {
+		return ExitCodeError, err
+	}
+	defer os.RemoveAll(dir)
+	name := *filename
+	if name == "" {
+		name = sopsexec.FallbackFilename
+	} else if !filepath.IsLocal(name) {
+		return ExitCodeError, fmt.Errorf("the provided filename is not a local path: %s", name)
+	}
+	tmpfile := filepath.Join(dir, name)
+	if err := os.WriteFile(tmpfile, plaintext, 0o600); err != nil {
+		return ExitCodeError, err
+	}
+	return runShell(ctx, strings.ReplaceAll(command, "{}", tmpfile), childEnviron(), false)
+}
+
+// treeToEnv converts the top-level values of a decrypted tree to KEY=VALUE pairs, as `sops exec-env` does.
+func treeToEnv(tree *sops.Tree) ([]string, error) {
+	var env []string
+	for _, item := range tree.Branches[0] {
+		if _, ok := item.Key.(sops.Comment); ok {
+			continue
+		}
+		if stores.IsComplexValue(item.Value) {
+			return nil, fmt.Errorf("cannot use complex value in environment; offending key %v", item.Key)
+		}
+		key, ok := item.Key.(string)
+		if !ok {
+			return nil, fmt.Errorf("cannot use non-string keys in environment, got %T", item.Key)
+		}
+		if strings.Contains(key, "=") {
+			return nil, fmt.Errorf("cannot use keys with '=' in environment: %s", key)
+		}
+		value, ok := item.Value.(string)
+		if !ok {
+			value = stores.ValToString(item.Value)
+		}
+		env = append(env, key+"="+value)
+	}
+	return env, nil
+}
+
+// runShell runs command with the platform shell, as sops does.
+func runShell(ctx context.Context, command string, env []string, interactive bool) (int, error) {
+	shell := sopsexec.BuildCommand(command)
+	return runCommand(ctx, shell.Path, shell.Args[1:], env, interactive)
+}
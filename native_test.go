@@ -0,0 +1,182 @@
+package ssk_test
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	ssk "github.com/fujiwara/sops-sakura-kms"
+	"github.com/getsops/sops/v3"
+)
+
+// setupNative writes an encrypted YAML file protected by a Sakura Cloud KMS
+// key and configures the wrapper to run natively against the fake KMS.
+// The Vault-compatible server used for encryption is closed, so decryption
+// must not go through HTTP.
+func setupNative(t *testing.T, plain string) string {
+	t.Helper()
+	_, srv := newTestTransit(t, "111111111111")
+	path := writeTestFile(t, t.TempDir(), "secrets.enc.yaml", "yaml", []byte(plain),
+		sops.KeyGroup{vaultKey(srv, "111111111111")})
+	srv.Close()
+
+	_, kmsSrv := newFakeKMS(t, "111111111111")
+	setFakeKMSEnv(t, kmsSrv.URL)
+	t.Setenv("SAKURA_KMS_KEY_ID", "")
+	t.Setenv("SSK_NATIVE", "true")
+	return path
+}
+
+func TestNativeExecEnv(t *testing.T) {
+	path := setupNative(t, "FOO: bar\nANSWER: 42\n")
+	t.Setenv("SSK_TEST_INHERITED", "yes")
+
+	tests := []struct {
+		name string
+		args []string
+		want int
+	}{
+		{
+			name: "values in env",
+			args: []string{"exec-env", path, `test "$FOO" = bar && test "$ANSWER" = 42 && test "$SSK_TEST_INHERITED" = yes`},
+			want: 0,
+		},
+		{
+			name: "exit code",
+			args: []string{"exec-env", path, "exit 3"},
+			want: 3,
+		},
+		{
+			name: "pristine",
+			args: []string{"exec-env", "--pristine", path, `test "$FOO" = bar && test -z "$SSK_TEST_INHERITED"`},
+			want: 0,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			code, err := ssk.RunWrapper(context.Background(), tt.args)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if code != tt.want {
+				t.Errorf("exit code = %d, want %d", code, tt.want)
+			}
+		})
+	}
+}
+
+func TestNativeKeyAlias(t *testing.T) {
+	// key_name is the name of the KMS key, not the resource ID
+	_, srv := newTestTransit(t, "111111111111")
+	path := writeTestFile(t, t.TempDir(), "secrets.enc.yaml", "yaml", []byte("FOO: bar\n"),
+		sops.KeyGroup{vaultKey(srv, "key-111111111111")})
+	srv.Close()
+
+	_, kmsSrv := newFakeKMS(t, "111111111111")
+	setFakeKMSEnv(t, kmsSrv.URL)
+	t.Setenv("SAKURA_KMS_KEY_ID", "")
+	t.Setenv("SSK_NATIVE", "true")
+	code, err := ssk.RunWrapper(context.Background(), []string{"exec-env", path, `test "$FOO" = bar`})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if code != 0 {
+		t.Errorf("exit code = %d, want 0", code)
+	}
+}
+
+func TestNativeExecEnvFileCredentials(t *testing.T) {
+	path := setupNative(t, "FOO: bar\n")
+	for _, name := range []string{"SAKURA_ACCESS_TOKEN", "SAKURA_ACCESS_TOKEN_SECRET"} {
+		t.Setenv(name, "")
+		os.Unsetenv(name)
+	}
+	envPath := filepath.Join(t.TempDir(), "ssk.env")
+	writeEnvFile(t, envPath, "SAKURA_ACCESS_TOKEN=token-from-env-file\nSAKURA_ACCESS_TOKEN_SECRET=secret-from-env-file\n")
+	t.Setenv("SSK_ENV_FILE", envPath)
+
+	// the credentials from SSK_ENV_FILE are used for the KMS, but not passed to the command
+	code, err := ssk.RunWrapper(context.Background(), []string{"exec-env", path,
+		`test "$FOO" = bar && test -z "${SAKURA_ACCESS_TOKEN+set}" && test -z "${SAKURA_ACCESS_TOKEN_SECRET+set}"`})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if code != 0 {
+		t.Errorf("exit code = %d, want 0", code)
+	}
+}
+
+func TestNativeExecFile(t *testing.T) {
+	path := setupNative(t, "FOO: bar\n")
+	marker := filepath.Join(t.TempDir(), "marker")
+
+	code, err := ssk.RunWrapper(context.Background(), []string{
+		"exec-file", "--output-type", "json", "--filename", "secrets.json", path,
+		`grep -q '"FOO": "bar"' {} && echo {} > ` + marker,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if code != 0 {
+		t.Fatalf("exit code = %d, want 0", code)
+	}
+	b, err := os.ReadFile(marker)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpfile := strings.TrimSpace(string(b))
+	if filepath.Base(tmpfile) != "secrets.json" {
+		t.Errorf("temporary file = %s, want secrets.json", tmpfile)
+	}
+	if _, err := os.Stat(tmpfile); !os.IsNotExist(err) {
+		t.Errorf("temporary file %s should be removed: %v", tmpfile, err)
+	}
+}
+
+func TestNativeFallbackWithoutSOPS(t *testing.T) {
+	path := setupNative(t, "FOO: bar\n")
+	t.Setenv("SSK_NATIVE", "false")
+	t.Setenv("SSK_COMMAND", "sops-not-installed")
+
+	code, err := ssk.RunWrapper(context.Background(), []string{"exec-env", path, `test "$FOO" = bar`})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if code != 0 {
+		t.Errorf("exit code = %d, want 0", code)
+	}
+}
+
+func TestNativeAgeKey(t *testing.T) {
+	_, kmsSrv := newFakeKMS(t)
+	setFakeKMSEnv(t, kmsSrv.URL)
+	t.Setenv("SSK_NATIVE", "true")
+	path := writeTestFile(t, t.TempDir(), "secrets.enc.yaml", "yaml", []byte("FOO: bar\n"),
+		sops.KeyGroup{newTestAgeKey(t)})
+
+	code, err := ssk.RunWrapper(context.Background(), []string{"exec-env", path, `test "$FOO" = bar`})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if code != 0 {
+		t.Errorf("exit code = %d, want 0", code)
+	}
+}
+
+func TestNativeErrors(t *testing.T) {
+	path := setupNative(t, "foo:\n  bar: baz\n")
+	for _, args := range [][]string{
+		{"exec-env", path, "true"}, // nested value
+		{"exec-env", path},
+		{"exec-env", "--user", "nobody", path, "true"},
+		{"exec-env", filepath.Join(t.TempDir(), "missing.yaml"), "true"},
+		{"exec-file", "--filename", "../escape", path, "true"},
+	} {
+		code, err := ssk.RunWrapper(context.Background(), args)
+		if err == nil || code != ssk.ExitCodeError {
+			t.Errorf("%v: expected an error, got %d, %v", args, code, err)
+		}
+	}
+}
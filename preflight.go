@@ -0,0 +1,104 @@
+package ssk
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/ogen-go/ogen/validate"
+	v1 "github.com/sacloud/kms-api-go/apis/v1"
+)
+
+// PreflightError is returned by SakuraKMS.Preflight when a check fails.
+type PreflightError struct {
+	// KeyID is the KMS resource ID being checked.
+	KeyID string
+	// Check is the name of the failed check.
+	Check string
+	// Hint is a human-readable remediation hint.
+	Hint string
+	// Err is the underlying error.
+	Err error
+}
+
+func (e *PreflightError) Error() string {
+	msg := fmt.Sprintf("preflight check %q failed for key %s: %s", e.Check, e.KeyID, e.Err)
+	if e.Hint != "" {
+		msg += " (" + e.Hint + ")"
+	}
+	return msg
+}
+
+func (e *PreflightError) Unwrap() error {
+	return e.Err
+}
+
+// Preflight checks that keyID can be used before running SOPS:
+// the credentials are valid, the key exists and its status is active.
+// If roundTrip is true, it also encrypts and decrypts random data with the key.
+// It returns the key on success, or a *PreflightError describing the failed check.
+// keyID may be an alias, resolved by ResolveKeyID.
+func (c *SakuraKMS) Preflight(ctx context.Context, keyID string, roundTrip bool) (*v1.Key, error) {
+	resolved, err := c.ResolveKeyID(ctx, keyID)
+	if err != nil {
+		pe := &PreflightError{KeyID: keyID, Check: "alias", Err: err}
+		if errors.Is(err, ErrKeyAlias) {
+			pe.Hint = "set the 12-digit KMS resource ID, an alias in key_aliases, or the name of a key"
+		}
+		return nil, pe
+	}
+	key, err := c.keyOp.Read(ctx, resolved)
+	if err != nil {
+		pe := &PreflightError{KeyID: keyID, Check: "lookup", Err: err}
+		switch kmsStatusCode(err) {
+		case http.StatusUnauthorized:
+			pe.Check = "credentials"
+			pe.Hint = "check SAKURA_ACCESS_TOKEN and SAKURA_ACCESS_TOKEN_SECRET"
+		case http.StatusForbidden:
+			pe.Check = "credentials"
+			pe.Hint = "the API key is not permitted to use KMS"
+		case http.StatusNotFound:
+			pe.Check = "exists"
+			pe.Hint = "check SAKURA_KMS_KEY_ID; it must be the 12-digit KMS resource ID or an alias"
+		}
+		return nil, pe
+	}
+	if key.Status != v1.KeyStatusEnumActive {
+		return key, &PreflightError{
+			KeyID: keyID,
+			Check: "enabled",
+			Err:   fmt.Errorf("key %q is %s", key.Name, key.Status),
+			Hint:  "activate the key or use another key",
+		}
+	}
+	if !roundTrip {
+		return key, nil
+	}
+
+	probe := make([]byte, 32)
+	rand.Read(probe)
+	ciphertext, err := c.Encrypt(ctx, keyID, probe)
+	if err != nil {
+		return key, &PreflightError{KeyID: keyID, Check: "encrypt", Err: err}
+	}
+	plaintext, err := c.Decrypt(ctx, keyID, ciphertext)
+	if err != nil {
+		return key, &PreflightError{KeyID: keyID, Check: "decrypt", Err: err}
+	}
+	if !bytes.Equal(plaintext, probe) {
+		return key, &PreflightError{KeyID: keyID, Check: "decrypt", Err: errors.New("round-trip plaintext mismatch")}
+	}
+	return key, nil
+}
+
+// kmsStatusCode returns the HTTP status code of a failed KMS API call, or 0 if unknown.
+func kmsStatusCode(err error) int {
+	var unexpected *validate.UnexpectedStatusCodeError
+	if errors.As(err, &unexpected) {
+		return unexpected.StatusCode
+	}
+	return 0
+}
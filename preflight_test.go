@@ -0,0 +1,111 @@
+package ssk_test
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	ssk "github.com/fujiwara/sops-sakura-kms"
+	v1 "github.com/sacloud/kms-api-go/apis/v1"
+)
+
+func TestPreflight(t *testing.T) {
+	f, srv := newFakeKMS(t, "111111111111", "222222222222")
+	f.setStatus("222222222222", v1.KeyStatusEnumSuspended)
+	c, err := ssk.NewSakuraKMSWithClient(newFakeKMSClient(t, srv))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name      string
+		keyID     string
+		roundTrip bool
+		wantCheck string
+	}{
+		{name: "active", keyID: "111111111111"},
+		{name: "active with round-trip", keyID: "111111111111", roundTrip: true},
+		{name: "suspended", keyID: "222222222222", wantCheck: "enabled"},
+		{name: "not found", keyID: "999999999999", wantCheck: "exists"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			key, err := c.Preflight(context.Background(), tt.keyID, tt.roundTrip)
+			if tt.wantCheck == "" {
+				if err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				if key.ID != tt.keyID {
+					t.Errorf("key ID = %q, want %q", key.ID, tt.keyID)
+				}
+				return
+			}
+			var pe *ssk.PreflightError
+			if !errors.As(err, &pe) {
+				t.Fatalf("expected *PreflightError, got %v", err)
+			}
+			if pe.Check != tt.wantCheck {
+				t.Errorf("check = %q, want %q (%v)", pe.Check, tt.wantCheck, err)
+			}
+			if pe.Hint == "" {
+				t.Errorf("expected a hint, got none: %v", err)
+			}
+		})
+	}
+}
+
+func TestPreflightUnauthorized(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+	}))
+	t.Cleanup(srv.Close)
+	c, err := ssk.NewSakuraKMSWithClient(newFakeKMSClient(t, srv))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = c.Preflight(context.Background(), "111111111111", false)
+	var pe *ssk.PreflightError
+	if !errors.As(err, &pe) {
+		t.Fatalf("expected *PreflightError, got %v", err)
+	}
+	if pe.Check != "credentials" {
+		t.Errorf("check = %q, want credentials", pe.Check)
+	}
+	if !strings.Contains(err.Error(), "SAKURA_ACCESS_TOKEN") {
+		t.Errorf("error should mention credentials env: %v", err)
+	}
+}
+
+func TestRunWrapperPreflight(t *testing.T) {
+	f, srv := newFakeKMS(t, "111111111111")
+	f.setStatus("111111111111", v1.KeyStatusEnumRestricted)
+	setFakeKMSEnv(t, srv.URL)
+	t.Setenv("SAKURA_KMS_KEY_ID", "111111111111")
+	t.Setenv("SSK_PREFLIGHT", "true")
+	t.Setenv("SSK_COMMAND", "sh")
+
+	marker := t.TempDir() + "/ran"
+	code, err := ssk.RunWrapper(context.Background(), []string{"-c", "touch " + marker})
+	if err == nil {
+		t.Fatal("expected preflight error")
+	}
+	if code != ssk.ExitCodeError {
+		t.Errorf("exit code = %d, want %d", code, ssk.ExitCodeError)
+	}
+	if _, statErr := os.Stat(marker); statErr == nil {
+		t.Error("command must not run when preflight fails")
+	}
+
+	f.setStatus("111111111111", v1.KeyStatusEnumActive)
+	code, err = ssk.RunWrapper(context.Background(), []string{"-c", "touch " + marker})
+	if err != nil || code != 0 {
+		t.Fatalf("RunWrapper = %d, %v", code, err)
+	}
+	if _, err := os.Stat(marker); err != nil {
+		t.Errorf("command did not run: %v", err)
+	}
+}
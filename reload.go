@@ -0,0 +1,239 @@
+package ssk
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"reflect"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Reloader serves requests with a handler that can be swapped while the
+// server is running, e.g. on SIGHUP in server-only mode. The listener and the
+// connections are kept; in-flight requests are completed by the old handler.
+// It also serves GET /metrics with the reload metrics in the Prometheus text format.
+type Reloader struct {
+	handler atomic.Pointer[http.Handler]
+
+	mu          sync.Mutex
+	successes   int
+	failures    int
+	lastOK      bool
+	lastSuccess time.Time
+}
+
+// NewReloader returns a Reloader. Use it with WithReloader.
+func NewReloader() *Reloader {
+	return &Reloader{}
+}
+
+// WithReloader serves the requests through r, so that Reload can swap the cipher and options.
+func WithReloader(r *Reloader) Option {
+	return func(o *serverOptions) {
+		o.reloader = r
+	}
+}
+
+// set sets the handler of the initial configuration.
+func (r *Reloader) set(h http.Handler) {
+	r.handler.Store(&h)
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.lastOK = true
+	r.lastSuccess = time.Now()
+}
+
+// Reload creates a cipher and the options with load, and swaps the handler
+// of the server atomically. If load fails, the server keeps the current ones.
+// The result is logged and recorded in the metrics.
+func (r *Reloader) Reload(load func() (Cipher, []HandlerOption, error)) error {
+	cipher, opts, err := load()
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.lastOK = err == nil
+	if err != nil {
+		r.failures++
+		slog.Error("failed to reload the configuration, keeping the current one", "error", err)
+		return err
+	}
+	var h http.Handler = NewMux(cipher, opts...)
+	r.handler.Store(&h)
+	r.successes++
+	r.lastSuccess = time.Now()
+	slog.Info("Configuration reloaded")
+	return nil
+}
+
+// ServeHTTP implements http.Handler.
+func (r *Reloader) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if req.Method == http.MethodGet && req.URL.Path == "/metrics" {
+		r.serveMetrics(w)
+		return
+	}
+	h := r.handler.Load()
+	if h == nil {
+		http.Error(w, "server is not ready", http.StatusServiceUnavailable)
+		return
+	}
+	(*h).ServeHTTP(w, req)
+}
+
+func (r *Reloader) serveMetrics(w http.ResponseWriter) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	lastOK := 0
+	if r.lastOK {
+		lastOK = 1
+	}
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	fmt.Fprintln(w, "# HELP ssk_config_reloads_total Number of configuration reloads.")
+	fmt.Fprintln(w, "# TYPE ssk_config_reloads_total counter")
+	fmt.Fprintf(w, "ssk_config_reloads_total{result=\"success\"} %d\n", r.successes)
+	fmt.Fprintf(w, "ssk_config_reloads_total{result=\"failure\"} %d\n", r.failures)
+	fmt.Fprintln(w, "# HELP ssk_config_last_reload_successful Whether the last configuration reload succeeded.")
+	fmt.Fprintln(w, "# TYPE ssk_config_last_reload_successful gauge")
+	fmt.Fprintf(w, "ssk_config_last_reload_successful %d\n", lastOK)
+	fmt.Fprintln(w, "# HELP ssk_config_last_reload_success_timestamp_seconds Timestamp of the last successful configuration load.")
+	fmt.Fprintln(w, "# TYPE ssk_config_last_reload_success_timestamp_seconds gauge")
+	fmt.Fprintf(w, "ssk_config_last_reload_success_timestamp_seconds %d\n", r.lastSuccess.Unix())
+}
+
+// envOverlay holds the original values of the environment variables it set,
+// to restore them when the variables are set again.
+type envOverlay struct {
+	mu   sync.Mutex
+	orig map[string]*string
+}
+
+// envFileVars are the variables set from SSK_ENV_FILE.
+var envFileVars envOverlay
+
+// set restores the variables set by the previous call, and sets vars to the
+// environment, overriding the existing ones. So variables removed from vars
+// are unset.
+func (o *envOverlay) set(vars map[string]string) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.restoreLocked()
+	o.orig = make(map[string]*string, len(vars))
+	for k, v := range vars {
+		if old, ok := os.LookupEnv(k); ok {
+			o.orig[k] = &old
+		} else {
+			o.orig[k] = nil
+		}
+		os.Setenv(k, v)
+	}
+}
+
+// restore restores the variables set by set.
+func (o *envOverlay) restore() {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.restoreLocked()
+}
+
+// original returns env with the variables in names that were set by set
+// replaced with their original values, or removed if they were not set.
+func (o *envOverlay) original(env []string, names []string) []string {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	for _, name := range names {
+		v, ok := o.orig[name]
+		if !ok {
+			continue
+		}
+		env = slices.DeleteFunc(env, func(kv string) bool {
+			return strings.HasPrefix(kv, name+"=")
+		})
+		if v != nil {
+			env = append(env, name+"="+*v)
+		}
+	}
+	return env
+}
+
+func (o *envOverlay) restoreLocked() {
+	for k, v := range o.orig {
+		if v == nil {
+			os.Unsetenv(k)
+		} else {
+			os.Setenv(k, *v)
+		}
+	}
+	o.orig = nil
+}
+
+// applyEnvFile sets the variables in the dotenv file at path to the environment,
+// overriding the existing ones. The variables set by the previous call are
+// restored first, so that variables removed from the file are unset on reload.
+func applyEnvFile(path string) error {
+	vars, err := readEnvFile(path)
+	if err != nil {
+		return err
+	}
+	envFileVars.set(vars)
+	return nil
+}
+
+// childEnviron returns the environment for the child processes: the current
+// environment without the credentials set from SSK_ENV_FILE, which are for
+// sops-sakura-kms only. The variables of the fields with the "secret" tag are
+// restored to their values before the env file was applied.
+func childEnviron() []string {
+	var names []string
+	t := reflect.TypeFor[Env]()
+	for i := 0; i < t.NumField(); i++ {
+		if field := t.Field(i); field.Tag.Get("secret") != "" {
+			for name := range strings.SplitSeq(field.Tag.Get("env"), ",") {
+				names = append(names, strings.TrimSpace(name))
+			}
+		}
+	}
+	return envFileVars.original(os.Environ(), names)
+}
+
+// readEnvFile reads a dotenv file: KEY=VALUE lines, optionally prefixed with
+// "export" and quoted with single or double quotes. Empty lines and lines
+// starting with # are ignored.
+func readEnvFile(path string) (map[string]string, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read the env file: %w", err)
+	}
+	vars := make(map[string]string)
+	scanner := bufio.NewScanner(bytes.NewReader(b))
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		line = strings.TrimPrefix(line, "export ")
+		key, value, ok := strings.Cut(line, "=")
+		key = strings.TrimSpace(key)
+		if !ok || key == "" || strings.ContainsAny(key, " \t") {
+			return nil, fmt.Errorf("%s:%d: invalid line", path, n)
+		}
+		value = strings.TrimSpace(value)
+		if len(value) >= 2 && value[0] == '\'' && value[len(value)-1] == '\'' {
+			value = value[1 : len(value)-1]
+		} else if len(value) >= 2 && value[0] == '"' && value[len(value)-1] == '"' {
+			if value, err = strconv.Unquote(value); err != nil {
+				return nil, fmt.Errorf("%s:%d: invalid quoted value: %w", path, n, err)
+			}
+		}
+		if key == "SSK_ENV_FILE" {
+			continue
+		}
+		vars[key] = value
+	}
+	return vars, scanner.Err()
+}
@@ -0,0 +1,262 @@
+package ssk_test
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"slices"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	ssk "github.com/fujiwara/sops-sakura-kms"
+)
+
+func encryptStatus(t *testing.T, addr, keyID string) int {
+	t.Helper()
+	req, _ := http.NewRequest(http.MethodPut, addr+"/v1/transit/encrypt/"+keyID, strings.NewReader(`{"plaintext":"aGVsbG8="}`))
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	return resp.StatusCode
+}
+
+func getMetrics(t *testing.T, addr string) string {
+	t.Helper()
+	resp, err := http.Get(addr + "/metrics")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	b, _ := io.ReadAll(resp.Body)
+	return string(b)
+}
+
+func TestReloader(t *testing.T) {
+	r := ssk.NewReloader()
+	env, shutdown, err := ssk.RunServer(context.Background(), freeAddr(t), "",
+		ssk.WithCipher(&mockCipher{}), ssk.WithReloader(r), ssk.WithHandlerOptions(ssk.WithAllowedKeys("key-a")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer shutdown(context.Background())
+	addr := env["VAULT_ADDR"]
+
+	if code := encryptStatus(t, addr, "key-a"); code != http.StatusOK {
+		t.Errorf("key-a: status = %d", code)
+	}
+	if code := encryptStatus(t, addr, "key-b"); code != http.StatusForbidden {
+		t.Errorf("key-b: status = %d, want 403", code)
+	}
+
+	err = r.Reload(func() (ssk.Cipher, []ssk.HandlerOption, error) {
+		return &mockCipher{}, []ssk.HandlerOption{ssk.WithAllowedKeys("key-b")}, nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if code := encryptStatus(t, addr, "key-b"); code != http.StatusOK {
+		t.Errorf("key-b after reload: status = %d", code)
+	}
+	if code := encryptStatus(t, addr, "key-a"); code != http.StatusForbidden {
+		t.Errorf("key-a after reload: status = %d, want 403", code)
+	}
+
+	if err := r.Reload(func() (ssk.Cipher, []ssk.HandlerOption, error) { return nil, nil, errors.New("broken") }); err == nil {
+		t.Error("expected an error")
+	}
+	if code := encryptStatus(t, addr, "key-b"); code != http.StatusOK {
+		t.Errorf("key-b after failed reload: status = %d", code)
+	}
+	metrics := getMetrics(t, addr)
+	for _, want := range []string{
+		`ssk_config_reloads_total{result="success"} 1`,
+		`ssk_config_reloads_total{result="failure"} 1`,
+		"ssk_config_last_reload_successful 0",
+		"ssk_config_last_reload_success_timestamp_seconds ",
+	} {
+		if !strings.Contains(metrics, want) {
+			t.Errorf("metrics do not contain %q:\n%s", want, metrics)
+		}
+	}
+}
+
+func TestLoadEnvFile(t *testing.T) {
+	t.Setenv("SSK_ALLOWED_KEYS", "from-env")
+	t.Setenv("SSK_LOG_LEVEL", "")
+	t.Setenv("SSK_COMMAND", "")
+	path := filepath.Join(t.TempDir(), "ssk.env")
+	writeEnvFile(t, path, `# comment
+export SSK_ALLOWED_KEYS="111111111111,222222222222"
+SSK_LOG_LEVEL='debug'
+
+SSK_COMMAND = /usr/local/bin/sops
+`)
+	t.Setenv("SSK_ENV_FILE", path)
+	e, err := ssk.LoadEnv()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(e.AllowedKeys, []string{"111111111111", "222222222222"}) || e.LogLevel != "debug" || e.Command != "/usr/local/bin/sops" || e.EnvFile != path {
+		t.Errorf("unexpected env: %+v", e)
+	}
+
+	// variables removed from the file are restored
+	writeEnvFile(t, path, "SSK_LOG_LEVEL=warn\n")
+	e, err = ssk.LoadEnv()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(e.AllowedKeys, []string{"from-env"}) || e.LogLevel != "warn" || e.Command != "sops" {
+		t.Errorf("unexpected env after reload: %+v", e)
+	}
+
+	writeEnvFile(t, path, "not a variable\n")
+	if _, err := ssk.LoadEnv(); err == nil || !strings.Contains(err.Error(), "ssk.env:1") {
+		t.Errorf("expected an error for an invalid line: %v", err)
+	}
+}
+
+func TestServerOnlyReloadOnSIGHUP(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("SIGHUP is not available on Windows")
+	}
+	_, srv := newFakeKMS(t, "111111111111", "222222222222")
+	setFakeKMSEnv(t, srv.URL)
+	envPath := filepath.Join(t.TempDir(), "ssk.env")
+	writeEnvFile(t, envPath, "SSK_ALLOWED_KEYS=111111111111\n")
+	addr := freeAddr(t)
+
+	cmd := exec.Command(os.Args[0])
+	cmd.Env = append(os.Environ(),
+		"SSK_TEST_HELPER=1",
+		"SSK_TEST_ARGS=",
+		"SSK_SERVER_ONLY=true",
+		"SAKURA_KMS_KEY_ID=",
+		"SSK_SERVER_ADDR="+addr,
+		"SSK_ENV_FILE="+envPath,
+	)
+	cmd.Stderr = os.Stderr
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer cmd.Process.Kill()
+	base := "http://" + addr
+	waitMetrics := func(want string) {
+		t.Helper()
+		for range 100 {
+			if resp, err := http.Get(base + "/metrics"); err == nil {
+				b, _ := io.ReadAll(resp.Body)
+				resp.Body.Close()
+				if strings.Contains(string(b), want) {
+					return
+				}
+			}
+			time.Sleep(50 * time.Millisecond)
+		}
+		t.Fatalf("metrics did not contain %q", want)
+	}
+	waitMetrics("ssk_config_last_reload_successful 1")
+	if code := encryptStatus(t, base, "222222222222"); code != http.StatusForbidden {
+		t.Errorf("222222222222: status = %d, want 403", code)
+	}
+
+	writeEnvFile(t, envPath, "SSK_ALLOWED_KEYS=222222222222\n")
+	cmd.Process.Signal(syscall.SIGHUP)
+	waitMetrics(`ssk_config_reloads_total{result="success"} 1`)
+	if code := encryptStatus(t, base, "222222222222"); code != http.StatusOK {
+		t.Errorf("222222222222 after reload: status = %d, want 200", code)
+	}
+	if code := encryptStatus(t, base, "111111111111"); code != http.StatusForbidden {
+		t.Errorf("111111111111 after reload: status = %d, want 403", code)
+	}
+
+	writeEnvFile(t, envPath, "SSK_KEY_ID_MISMATCH=invalid\n")
+	cmd.Process.Signal(syscall.SIGHUP)
+	waitMetrics(`ssk_config_reloads_total{result="failure"} 1`)
+	waitMetrics("ssk_config_last_reload_successful 0")
+	if code := encryptStatus(t, base, "222222222222"); code != http.StatusOK {
+		t.Errorf("222222222222 after failed reload: status = %d, want 200", code)
+	}
+
+	cmd.Process.Signal(syscall.SIGTERM)
+	if err := waitWithTimeout(t, cmd, 10*time.Second); err != nil {
+		t.Errorf("server exited with error: %v", err)
+	}
+}
+
+func TestExecServerOnlyReloadKeepsFlags(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("SIGHUP is not available on Windows")
+	}
+	_, srv := newFakeKMS(t, "111111111111", "222222222222")
+	setFakeKMSEnv(t, srv.URL)
+	envPath := filepath.Join(t.TempDir(), "ssk.env")
+	writeEnvFile(t, envPath, "SSK_LOG_LEVEL=info\n")
+	addr := freeAddr(t)
+
+	cmd := exec.Command(os.Args[0])
+	cmd.Env = append(os.Environ(),
+		"SSK_TEST_HELPER=1",
+		"SSK_TEST_CLI=1",
+		"SSK_TEST_ARGS="+strings.Join([]string{"exec", "--server-only", "--allowed-keys", "111111111111", "--server-addr", addr}, "\x1f"),
+		"SSK_ALLOWED_KEYS=",
+		"SAKURA_KMS_KEY_ID=",
+		"SSK_ENV_FILE="+envPath,
+	)
+	cmd.Stderr = os.Stderr
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer cmd.Process.Kill()
+	base := "http://" + addr
+	waitMetrics := func(want string) {
+		t.Helper()
+		for range 100 {
+			if resp, err := http.Get(base + "/metrics"); err == nil {
+				b, _ := io.ReadAll(resp.Body)
+				resp.Body.Close()
+				if strings.Contains(string(b), want) {
+					return
+				}
+			}
+			time.Sleep(50 * time.Millisecond)
+		}
+		t.Fatalf("metrics did not contain %q", want)
+	}
+	waitMetrics("ssk_config_last_reload_successful 1")
+	if code := encryptStatus(t, base, "222222222222"); code != http.StatusForbidden {
+		t.Errorf("222222222222: status = %d, want 403", code)
+	}
+
+	// the policy set with the flags is kept on reload
+	writeEnvFile(t, envPath, "SSK_LOG_LEVEL=debug\n")
+	cmd.Process.Signal(syscall.SIGHUP)
+	waitMetrics(`ssk_config_reloads_total{result="success"} 1`)
+	if code := encryptStatus(t, base, "222222222222"); code != http.StatusForbidden {
+		t.Errorf("222222222222 after reload: status = %d, want 403", code)
+	}
+	if code := encryptStatus(t, base, "111111111111"); code != http.StatusOK {
+		t.Errorf("111111111111 after reload: status = %d, want 200", code)
+	}
+
+	cmd.Process.Signal(syscall.SIGTERM)
+	if err := waitWithTimeout(t, cmd, 10*time.Second); err != nil {
+		t.Errorf("server exited with error: %v", err)
+	}
+}
+
+func writeEnvFile(t *testing.T, path, content string) {
+	t.Helper()
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+}
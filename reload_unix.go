@@ -0,0 +1,11 @@
+//go:build !windows
+
+package ssk
+
+import (
+	"os"
+	"syscall"
+)
+
+// reloadSignals are the signals to reload the configuration in server-only mode.
+var reloadSignals = []os.Signal{syscall.SIGHUP}
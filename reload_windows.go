@@ -0,0 +1,9 @@
+//go:build windows
+
+package ssk
+
+import "os"
+
+// reloadSignals are the signals to reload the configuration in server-only mode.
+// Windows has no SIGHUP.
+var reloadSignals []os.Signal
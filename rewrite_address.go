@@ -0,0 +1,99 @@
+package ssk
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/url"
+	"slices"
+	"strings"
+
+	"github.com/getsops/sops/v3/hcvault"
+)
+
+// RewriteAddress rewrites the vault_address of the hc_vault entries encrypted
+// by Sakura Cloud KMS in a SOPS file to "to". If from is not empty, only the
+// entries with the address are rewritten. Other entries, the encrypted values
+// and the MAC are not changed. It returns the previous addresses of the
+// rewritten entries; the file is written only if any entry is rewritten and dryRun is false.
+func RewriteAddress(path, from, to string, dryRun bool) ([]string, error) {
+	tree, _, err := loadSOPSFile(path, "")
+	if err != nil {
+		return nil, err
+	}
+	var rewritten []string
+	for _, group := range tree.Metadata.KeyGroups {
+		for _, key := range group {
+			vk, ok := key.(*hcvault.MasterKey)
+			if !ok || sakuraKMSKeyID(key) == "" || vk.VaultAddress == to {
+				continue
+			}
+			if from != "" && vk.VaultAddress != from {
+				continue
+			}
+			rewritten = append(rewritten, vk.VaultAddress)
+			vk.VaultAddress = to
+		}
+	}
+	if len(rewritten) == 0 || dryRun {
+		return rewritten, nil
+	}
+	store, _ := sopsStore(path, "")
+	b, err := store.EmitEncryptedFile(*tree)
+	if err != nil {
+		return nil, fmt.Errorf("failed to emit %s: %w", path, err)
+	}
+	if err := writeFileAtomic(path, b); err != nil {
+		return nil, err
+	}
+	return rewritten, nil
+}
+
+// RunRewriteAddress runs the rewrite-address subcommand.
+func RunRewriteAddress(ctx context.Context, args []string, w io.Writer) (int, error) {
+	fs, e, err := envFlagSet("rewrite-address", "rewrite-address [options] [<file|dir|glob>...]")
+	if err != nil {
+		return ExitCodeError, err
+	}
+	from := fs.String("from", "", "rewrite only the entries with this vault_address (default: all)")
+	to := fs.String("to", "", "new vault_address (default: http://<server-addr>)")
+	dryRun := fs.Bool("dry-run", false, "report the changes without writing the files")
+	if err := fs.Parse(args); err != nil {
+		return ExitCodeError, err
+	}
+	if *to == "" {
+		*to = "http://" + e.ServerAddr
+	}
+	if u, err := url.Parse(*to); err != nil || u.Scheme == "" || u.Host == "" {
+		return ExitCodeError, fmt.Errorf("invalid address %q; must be like http://127.0.0.1:8200", *to)
+	}
+	paths, err := findTargetFiles(fs.Args())
+	if err != nil {
+		return ExitCodeError, err
+	}
+
+	verb := "updated"
+	if *dryRun {
+		verb = "would update"
+	}
+	var updated, failed int
+	for _, path := range paths {
+		rewritten, err := RewriteAddress(path, *from, *to, *dryRun)
+		if err != nil {
+			failed++
+			fmt.Fprintf(w, "failed %s: %s\n", path, err)
+			continue
+		}
+		if len(rewritten) == 0 {
+			continue
+		}
+		updated++
+		slices.Sort(rewritten)
+		fmt.Fprintf(w, "%s %s: %s -> %s\n", verb, path, strings.Join(slices.Compact(rewritten), ", "), *to)
+	}
+	fmt.Fprintf(w, "%d files: %d %s, %d failed\n", len(paths), updated, verb, failed)
+	if failed > 0 {
+		return ExitCodeError, fmt.Errorf("failed to rewrite %d files", failed)
+	}
+	return 0, nil
+}
@@ -0,0 +1,84 @@
+package ssk_test
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"strings"
+	"testing"
+
+	ssk "github.com/fujiwara/sops-sakura-kms"
+	"github.com/getsops/sops/v3"
+)
+
+func TestRunRewriteAddress(t *testing.T) {
+	dir := t.TempDir()
+	ageKey := newTestAgeKey(t)
+	_, transit := newTestTransit(t, "111111111111")
+	path := writeTestFile(t, dir, "a.enc.yaml", "yaml", []byte(testPlainFiles["yaml"]),
+		sops.KeyGroup{vaultKey(transit, "111111111111"), ageKey})
+	transit.Close()
+	before, _ := os.ReadFile(path)
+
+	_, kmsSrv := newFakeKMS(t, "111111111111")
+	setFakeKMSEnv(t, kmsSrv.URL)
+	t.Setenv("SSK_SERVER_ADDR", "127.0.0.1:18200")
+	ctx := context.Background()
+
+	var out bytes.Buffer
+	code, err := ssk.RunCLI(ctx, []string{"rewrite-address", "--dry-run", path}, &out)
+	if err != nil || code != 0 {
+		t.Fatalf("code=%d err=%v", code, err)
+	}
+	if !strings.Contains(out.String(), "would update "+path+": "+transit.URL+" -> http://127.0.0.1:18200") {
+		t.Errorf("unexpected output: %s", out.String())
+	}
+	if after, _ := os.ReadFile(path); !bytes.Equal(before, after) {
+		t.Error("dry run must not write the file")
+	}
+
+	out.Reset()
+	code, err = ssk.RunCLI(ctx, []string{"rewrite-address", "--from", transit.URL, dir}, &out)
+	if err != nil || code != 0 {
+		t.Fatalf("code=%d err=%v", code, err)
+	}
+	info, err := ssk.InspectFile(path, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys := info.KeyGroups[0].Keys
+	if keys[0].Vault.VaultAddress != "http://127.0.0.1:18200" || keys[0].Vault.KeyName != "111111111111" || keys[1].Type != "age" {
+		t.Errorf("unexpected keys: %+v", keys)
+	}
+	after, _ := os.ReadFile(path)
+	for _, field := range []string{"mac:", "answer:", "bar:"} {
+		if lineOf(before, field) != lineOf(after, field) {
+			t.Errorf("%s changed:\n%s\n%s", field, lineOf(before, field), lineOf(after, field))
+		}
+	}
+
+	// the file is still decryptable with Sakura Cloud KMS, and the MAC matches
+	t.Setenv("SOPS_AGE_KEY", "")
+	t.Setenv("SSK_NATIVE", "true")
+	out.Reset()
+	code, err = ssk.RunCLI(ctx, []string{"export", path}, &out)
+	if err != nil || code != 0 || !strings.Contains(out.String(), "foo_bar=baz") {
+		t.Errorf("export: code=%d err=%v\n%s", code, err, out.String())
+	}
+
+	// nothing to rewrite
+	out.Reset()
+	code, err = ssk.RunCLI(ctx, []string{"rewrite-address", path}, &out)
+	if err != nil || code != 0 || !strings.Contains(out.String(), "1 files: 0 updated, 0 failed") {
+		t.Errorf("code=%d err=%v\n%s", code, err, out.String())
+	}
+}
+
+func lineOf(b []byte, prefix string) string {
+	for _, line := range strings.Split(string(b), "\n") {
+		if strings.HasPrefix(strings.TrimSpace(line), prefix) {
+			return line
+		}
+	}
+	return ""
+}
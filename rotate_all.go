@@ -0,0 +1,210 @@
+package ssk
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+)
+
+// RotateResult is the result of rotating the data key of a file.
+type RotateResult struct {
+	Path     string        `json:"path"`
+	OK       bool          `json:"ok"`
+	Error    string        `json:"error,omitempty"`
+	Duration time.Duration `json:"duration"`
+}
+
+// RotateSummary is the summary of the rotate-all subcommand.
+type RotateSummary struct {
+	StartedAt  time.Time      `json:"started_at"`
+	FinishedAt time.Time      `json:"finished_at"`
+	UpdateKeys bool           `json:"updatekeys"`
+	Rotated    int            `json:"rotated"`
+	Failed     int            `json:"failed"`
+	Results    []RotateResult `json:"results"`
+}
+
+// rotateFile runs `sops updatekeys -y` (if updateKeys) and `sops rotate -i` for path.
+func rotateFile(ctx context.Context, command, path string, env []string, updateKeys bool) RotateResult {
+	start := time.Now()
+	result := RotateResult{Path: path}
+	var steps [][]string
+	if updateKeys {
+		steps = append(steps, []string{"updatekeys", "-y", path})
+	}
+	steps = append(steps, []string{"rotate", "-i", path})
+	for _, args := range steps {
+		cmd := exec.CommandContext(ctx, command, args...)
+		cmd.Env = env
+		out, err := cmd.CombinedOutput()
+		if err != nil {
+			msg := strings.TrimSpace(string(out))
+			if msg == "" {
+				msg = err.Error()
+			}
+			result.Error = fmt.Sprintf("%s %s: %s", command, args[0], msg)
+			break
+		}
+	}
+	result.OK = result.Error == ""
+	result.Duration = time.Since(start)
+	return result
+}
+
+// RunRotateAll runs the rotate-all subcommand, rotating the data keys of SOPS
+// files in parallel through a single Vault-compatible server.
+func RunRotateAll(ctx context.Context, args []string, w io.Writer) (int, error) {
+	fs, e, err := envFlagSet("rotate-all", "rotate-all [options] [<file|dir|glob>...]")
+	if err != nil {
+		return ExitCodeError, err
+	}
+	updateKeys := fs.Bool("updatekeys", false, "run sops updatekeys before rotating, applying the keys of .sops.yaml")
+	parallel := fs.Int("parallel", DefaultMigrateParallel, "number of files rotated in parallel")
+	dryRun := fs.Bool("dry-run", false, "list the files without rotating them")
+	summaryPath := fs.String("summary", "", "write the summary to this file instead of stdout")
+	asJSON := fs.Bool("json", false, "write the summary in JSON format")
+	if err := fs.Parse(args); err != nil {
+		return ExitCodeError, err
+	}
+	paths, err := findTargetFiles(fs.Args())
+	if err != nil {
+		return ExitCodeError, err
+	}
+	if len(paths) == 0 {
+		return ExitCodeError, errors.New("no SOPS files found")
+	}
+	if *dryRun {
+		for _, p := range paths {
+			fmt.Fprintln(w, p)
+		}
+		fmt.Fprintf(w, "%d files would be rotated\n", len(paths))
+		return 0, nil
+	}
+
+	kmsOpts, err := e.KMSOptions()
+	if err != nil {
+		return ExitCodeError, err
+	}
+	mismatch, err := ParseKeyIDMismatchMode(e.KeyIDMismatch)
+	if err != nil {
+		return ExitCodeError, fmt.Errorf("invalid SSK_KEY_ID_MISMATCH: %w", err)
+	}
+	cipher, err := NewSakuraKMS(kmsOpts...)
+	if err != nil {
+		return ExitCodeError, fmt.Errorf("failed to create cipher: %w", err)
+	}
+	slog.Info("Starting Vault-compatible API server for Sakura KMS", "key_id", e.KMSKeyID, "addr", e.ServerAddr)
+	addEnv, shutdown, err := RunServer(ctx, e.ServerAddr, e.KMSKeyID, WithCipher(cipher), WithHandlerOptions(WithKeyIDMismatch(mismatch)))
+	if err != nil {
+		return ExitCodeError, fmt.Errorf("failed to start server: %w", err)
+	}
+	defer shutdown(context.Background())
+	env := childEnviron()
+	for k, v := range addEnv {
+		env = append(env, k+"="+v)
+	}
+
+	summary := RotateSummary{
+		StartedAt:  time.Now(),
+		UpdateKeys: *updateKeys,
+		Results:    make([]RotateResult, len(paths)),
+	}
+	var (
+		mu   sync.Mutex
+		done int
+		wg   sync.WaitGroup
+	)
+	sem := make(chan struct{}, max(*parallel, 1))
+	for i, path := range paths {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func() {
+			defer wg.Done()
+			defer func() { <-sem }()
+			r := rotateFile(ctx, e.Command, path, env, *updateKeys)
+			mu.Lock()
+			defer mu.Unlock()
+			summary.Results[i] = r
+			done++
+			status := "ok"
+			if !r.OK {
+				status = "FAIL"
+			}
+			fmt.Fprintf(w, "[%d/%d] %-4s %s (%s)\n", done, len(paths), status, path, r.Duration.Round(time.Millisecond))
+			if !r.OK {
+				fmt.Fprintf(w, "      %s\n", r.Error)
+			}
+		}()
+	}
+	wg.Wait()
+	summary.FinishedAt = time.Now()
+	for _, r := range summary.Results {
+		if r.OK {
+			summary.Rotated++
+		} else {
+			summary.Failed++
+		}
+	}
+
+	if *summaryPath == "" {
+		fmt.Fprintln(w)
+		*summaryPath = "-"
+	}
+	err = writeOutput(*summaryPath, w, func(w io.Writer) error {
+		if *asJSON {
+			enc := json.NewEncoder(w)
+			enc.SetIndent("", "  ")
+			return enc.Encode(summary)
+		}
+		return writeRotateSummary(w, &summary)
+	})
+	if err != nil {
+		return ExitCodeError, err
+	}
+	if summary.Failed > 0 {
+		return ExitCodeError, fmt.Errorf("failed to rotate %d of %d files", summary.Failed, len(paths))
+	}
+	return 0, nil
+}
+
+// writeRotateSummary writes the summary in Markdown, to be pasted into a change ticket.
+func writeRotateSummary(w io.Writer, s *RotateSummary) error {
+	operation := "sops rotate"
+	if s.UpdateKeys {
+		operation = "sops updatekeys + sops rotate"
+	}
+	fmt.Fprintln(w, "## SOPS data key rotation")
+	fmt.Fprintln(w)
+	fmt.Fprintf(w, "- Started: %s\n", s.StartedAt.UTC().Format(time.RFC3339))
+	fmt.Fprintf(w, "- Finished: %s\n", s.FinishedAt.UTC().Format(time.RFC3339))
+	fmt.Fprintf(w, "- Operation: %s\n", operation)
+	fmt.Fprintf(w, "- Files: %d (%d rotated, %d failed)\n", len(s.Results), s.Rotated, s.Failed)
+	if s.Failed > 0 {
+		fmt.Fprintln(w)
+		fmt.Fprintln(w, "### Failed")
+		fmt.Fprintln(w)
+		for _, r := range s.Results {
+			if !r.OK {
+				fmt.Fprintf(w, "- `%s`: %s\n", r.Path, strings.ReplaceAll(r.Error, "\n", " "))
+			}
+		}
+	}
+	if s.Rotated > 0 {
+		fmt.Fprintln(w)
+		fmt.Fprintln(w, "### Rotated")
+		fmt.Fprintln(w)
+		for _, r := range s.Results {
+			if r.OK {
+				fmt.Fprintf(w, "- `%s`\n", r.Path)
+			}
+		}
+	}
+	return nil
+}
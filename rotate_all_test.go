@@ -0,0 +1,84 @@
+package ssk_test
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+
+	ssk "github.com/fujiwara/sops-sakura-kms"
+	"github.com/getsops/sops/v3"
+)
+
+func TestRunRotateAll(t *testing.T) {
+	dir := t.TempDir()
+	_, transit := newTestTransit(t, "111111111111")
+	plain := []byte(testPlainFiles["yaml"])
+	for _, name := range []string{"a.enc.yaml", "b.enc.yaml", "bad.enc.yaml"} {
+		writeTestFile(t, dir, name, "yaml", plain, sops.KeyGroup{vaultKey(transit, "111111111111")})
+	}
+	transit.Close()
+
+	// fake sops records the arguments and fails for bad.enc.yaml
+	log := filepath.Join(t.TempDir(), "sops.log")
+	script := `#!/bin/sh
+test -n "$VAULT_ADDR" || exit 2
+echo "$VAULT_ADDR $*" >> ` + log + `
+case "$*" in *bad*) echo "could not decrypt data key" >&2; exit 1;; esac
+`
+	sopsPath := filepath.Join(t.TempDir(), "sops")
+	if err := os.WriteFile(sopsPath, []byte(script), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	_, kmsSrv := newFakeKMS(t, "111111111111")
+	setFakeKMSEnv(t, kmsSrv.URL)
+	t.Setenv("SSK_COMMAND", sopsPath)
+	t.Setenv("SSK_SERVER_ADDR", freeAddr(t))
+	summary := filepath.Join(t.TempDir(), "summary.md")
+
+	var out bytes.Buffer
+	code, err := ssk.RunCLI(context.Background(), []string{"rotate-all", "--updatekeys", "--parallel", "2", "--summary", summary, dir}, &out)
+	if err == nil || code != ssk.ExitCodeError {
+		t.Errorf("code=%d err=%v, want failure", code, err)
+	}
+	if n := strings.Count(out.String(), "] ok "); n != 2 {
+		t.Errorf("unexpected progress:\n%s", out.String())
+	}
+
+	b, err := os.ReadFile(log)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(string(b)), "\n")
+	addrs := map[string]bool{}
+	var calls []string
+	for _, line := range lines {
+		addr, call, _ := strings.Cut(line, " ")
+		addrs[addr] = true
+		calls = append(calls, strings.ReplaceAll(call, dir+"/", ""))
+	}
+	if len(addrs) != 1 {
+		t.Errorf("all files must use a single server: %v", addrs)
+	}
+	slices.Sort(calls)
+	want := []string{
+		"rotate -i a.enc.yaml", "rotate -i b.enc.yaml",
+		"updatekeys -y a.enc.yaml", "updatekeys -y b.enc.yaml", "updatekeys -y bad.enc.yaml",
+	}
+	if !slices.Equal(calls, want) {
+		t.Errorf("unexpected sops calls:\n%v\nwant:\n%v", calls, want)
+	}
+
+	s, err := os.ReadFile(summary)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{"- Operation: sops updatekeys + sops rotate", "- Files: 3 (2 rotated, 1 failed)", "bad.enc.yaml`: " + sopsPath + " updatekeys: could not decrypt data key"} {
+		if !strings.Contains(string(s), want) {
+			t.Errorf("summary does not contain %q:\n%s", want, s)
+		}
+	}
+}
@@ -0,0 +1,173 @@
+package ssk
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// ErrSessionExpired is returned to clients after the session of the server expired.
+var ErrSessionExpired = errors.New("session expired")
+
+// SessionLimits limits the session of a long-running server (server-only mode
+// or an agent), so that a leaked token is not valid forever.
+// When any limit is reached, requests are rejected with 403 and the server is shut down.
+type SessionLimits struct {
+	// MaxLifetime is the maximum lifetime of the server. Zero means no limit.
+	MaxLifetime time.Duration
+	// IdleTimeout shuts down the server after no requests for the duration. Zero means no limit.
+	IdleTimeout time.Duration
+	// MaxDecrypts is the maximum number of decrypt operations. Zero means no limit.
+	MaxDecrypts int
+	// OnExpire is called with the reason (wrapping ErrSessionExpired) after the
+	// server is shut down on expiry.
+	OnExpire func(reason error)
+}
+
+func (l SessionLimits) enabled() bool {
+	return l.MaxLifetime > 0 || l.IdleTimeout > 0 || l.MaxDecrypts > 0
+}
+
+// session tracks the usage of a server against SessionLimits.
+type session struct {
+	limits SessionLimits
+
+	mu       sync.Mutex
+	started  time.Time
+	lastUsed time.Time
+	decrypts int
+	err      error
+	expired  chan struct{}
+}
+
+func newSession(limits SessionLimits) *session {
+	now := time.Now()
+	return &session{
+		limits:   limits,
+		started:  now,
+		lastUsed: now,
+		expired:  make(chan struct{}),
+	}
+}
+
+// start resets the clocks of the session when the server starts.
+func (s *session) start() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.started = time.Now()
+	s.lastUsed = s.started
+}
+
+// expire marks the session expired with the reason. It must be called with s.mu held.
+func (s *session) expire(reason error) {
+	if s.err != nil {
+		return
+	}
+	s.err = reason
+	close(s.expired)
+}
+
+// check expires the session if a time limit is reached at now, and returns
+// the error of the expired session or the time until the next check.
+func (s *session) check(now time.Time) (time.Duration, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.err != nil {
+		return 0, s.err
+	}
+	next := time.Duration(-1)
+	if l := s.limits.MaxLifetime; l > 0 {
+		left := s.started.Add(l).Sub(now)
+		if left <= 0 {
+			s.expire(fmt.Errorf("%w: max lifetime %s reached", ErrSessionExpired, l))
+			return 0, s.err
+		}
+		next = left
+	}
+	if l := s.limits.IdleTimeout; l > 0 {
+		left := s.lastUsed.Add(l).Sub(now)
+		if left <= 0 {
+			s.expire(fmt.Errorf("%w: idle for %s", ErrSessionExpired, l))
+			return 0, s.err
+		}
+		if next < 0 || left < next {
+			next = left
+		}
+	}
+	return next, nil
+}
+
+// use records a request, and returns an error if the session has expired.
+func (s *session) use(decrypt bool) error {
+	if _, err := s.check(time.Now()); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.lastUsed = time.Now()
+	if decrypt {
+		if m := s.limits.MaxDecrypts; m > 0 && s.decrypts >= m {
+			s.expire(fmt.Errorf("%w: max %d decrypt operations reached", ErrSessionExpired, m))
+			return s.err
+		}
+		s.decrypts++
+	}
+	return nil
+}
+
+// handler wraps h to reject requests after the session expired.
+func (s *session) handler(decrypt bool, h http.HandlerFunc) http.HandlerFunc {
+	if s == nil {
+		return h
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		if err := s.use(decrypt); err != nil {
+			errorResponse(w, err, http.StatusForbidden)
+			return
+		}
+		h(w, r)
+	}
+}
+
+// healthy reports whether the session has not expired.
+func (s *session) healthy() bool {
+	if s == nil {
+		return true
+	}
+	_, err := s.check(time.Now())
+	return err == nil
+}
+
+// watch shuts down the server with shutdown when the session expires, until ctx is done.
+func (s *session) watch(ctx context.Context, shutdown func(context.Context) error) {
+	for {
+		next, err := s.check(time.Now())
+		if err != nil {
+			break
+		}
+		var timeout <-chan time.Time
+		if next > 0 {
+			timeout = time.After(next)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-s.expired:
+		case <-timeout:
+		}
+	}
+	s.mu.Lock()
+	reason := s.err
+	s.mu.Unlock()
+	slog.Warn("Shutting down the server", "reason", reason)
+	if err := shutdown(context.Background()); err != nil {
+		slog.Error("failed to shut down the server", "error", err)
+	}
+	if s.limits.OnExpire != nil {
+		s.limits.OnExpire(reason)
+	}
+}
@@ -0,0 +1,144 @@
+package ssk_test
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	ssk "github.com/fujiwara/sops-sakura-kms"
+)
+
+func decryptRequest(t *testing.T, addr string) (int, string) {
+	t.Helper()
+	body := `{"ciphertext":"` + ssk.VaultPrefix + base64.StdEncoding.EncodeToString([]byte("secret")) + `"}`
+	req, _ := http.NewRequest(http.MethodPut, addr+"/v1/transit/decrypt/test-key", strings.NewReader(body))
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return 0, err.Error()
+	}
+	defer resp.Body.Close()
+	b, _ := io.ReadAll(resp.Body)
+	return resp.StatusCode, string(b)
+}
+
+func startSessionServer(t *testing.T, limits ssk.SessionLimits) (string, <-chan error) {
+	t.Helper()
+	expired := make(chan error, 1)
+	limits.OnExpire = func(reason error) { expired <- reason }
+	env, shutdown, err := ssk.RunServer(context.Background(), freeAddr(t), "", ssk.WithCipher(&mockCipher{}), ssk.WithHandlerOptions(ssk.WithSessionLimits(limits)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { shutdown(context.Background()) })
+	return env["VAULT_ADDR"], expired
+}
+
+func waitExpired(t *testing.T, expired <-chan error, want string) {
+	t.Helper()
+	select {
+	case reason := <-expired:
+		if !errors.Is(reason, ssk.ErrSessionExpired) || !strings.Contains(reason.Error(), want) {
+			t.Errorf("reason = %v, want %q", reason, want)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("session did not expire")
+	}
+}
+
+func TestSessionMaxDecrypts(t *testing.T) {
+	addr, expired := startSessionServer(t, ssk.SessionLimits{MaxDecrypts: 2})
+	for i := range 2 {
+		if code, body := decryptRequest(t, addr); code != http.StatusOK {
+			t.Fatalf("decrypt %d: %d %s", i, code, body)
+		}
+	}
+	code, body := decryptRequest(t, addr)
+	if code != http.StatusForbidden || !strings.Contains(body, "session expired: max 2 decrypt operations reached") {
+		t.Errorf("decrypt after the limit: %d %s", code, body)
+	}
+	waitExpired(t, expired, "max 2 decrypt operations")
+	if _, err := http.Get(addr + "/health"); err == nil {
+		t.Error("server is still running after expiry")
+	}
+}
+
+func TestSessionIdleTimeout(t *testing.T) {
+	addr, expired := startSessionServer(t, ssk.SessionLimits{IdleTimeout: 500 * time.Millisecond})
+	// requests keep the session alive
+	for range 4 {
+		time.Sleep(200 * time.Millisecond)
+		if code, body := decryptRequest(t, addr); code != http.StatusOK {
+			t.Fatalf("decrypt: %d %s", code, body)
+		}
+	}
+	select {
+	case reason := <-expired:
+		t.Fatalf("session expired while in use: %v", reason)
+	default:
+	}
+	waitExpired(t, expired, "idle for 500ms")
+}
+
+func TestSessionMaxLifetime(t *testing.T) {
+	addr, expired := startSessionServer(t, ssk.SessionLimits{MaxLifetime: 500 * time.Millisecond, IdleTimeout: time.Minute})
+	if code, body := decryptRequest(t, addr); code != http.StatusOK {
+		t.Fatalf("decrypt: %d %s", code, body)
+	}
+	waitExpired(t, expired, "max lifetime 500ms reached")
+	if code, body := decryptRequest(t, addr); code != 0 && code != http.StatusForbidden {
+		t.Errorf("decrypt after expiry: %d %s", code, body)
+	}
+}
+
+func TestSessionServerOnly(t *testing.T) {
+	t.Setenv("SAKURA_KMS_KEY_ID", "")
+	done := make(chan int)
+	go func() {
+		code, err := ssk.RunCLI(context.Background(), []string{"server", "--server-addr", freeAddr(t), "--max-lifetime", "1s"}, io.Discard)
+		if err != nil {
+			t.Error(err)
+		}
+		done <- code
+	}()
+	select {
+	case code := <-done:
+		if code != 0 {
+			t.Errorf("exit code = %d, want 0", code)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("server did not stop after the max lifetime")
+	}
+}
+
+func TestEnvSessionLimits(t *testing.T) {
+	t.Setenv("SSK_MAX_LIFETIME", "8h")
+	t.Setenv("SSK_IDLE_TIMEOUT", "30m")
+	t.Setenv("SSK_MAX_DECRYPTS", "100")
+	e, err := ssk.LoadEnv()
+	if err != nil {
+		t.Fatal(err)
+	}
+	l, err := e.SessionLimits()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if l.MaxLifetime != 8*time.Hour || l.IdleTimeout != 30*time.Minute || l.MaxDecrypts != 100 {
+		t.Errorf("unexpected limits: %+v", l)
+	}
+	if _, err := (&ssk.Env{IdleTimeout: -time.Minute}).SessionLimits(); err == nil {
+		t.Error("expected an error for a negative limit")
+	}
+	for name, value := range map[string]string{"SSK_MAX_LIFETIME": "8", "SSK_MAX_DECRYPTS": "x"} {
+		t.Run(name, func(t *testing.T) {
+			t.Setenv(name, value)
+			if _, err := ssk.LoadEnv(); err == nil {
+				t.Errorf("%s=%s: expected an error", name, value)
+			}
+		})
+	}
+}
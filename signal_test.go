@@ -19,18 +19,39 @@ import (
 // SSK_TEST_HELPER=1 is set, the binary runs RunWrapper instead of the
 // test suite so the signal tests can drive it as a real subprocess.
 // SSK_TEST_TTY=1 makes RunWrapper see stdin as a terminal regardless
-// of how the helper was launched.
+// of how the helper was launched. It also runs the detached agent
+// started by TestRunAgentDetached.
 func TestMain(m *testing.M) {
+	if os.Getenv("SSK_AGENT_READY_FD") != "" {
+		// started by `agent` as the detached agent
+		ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+		defer stop()
+		exitCode, _ := ssk.RunCLI(ctx, os.Args[1:], os.Stdout)
+		os.Exit(exitCode)
+	}
 	if os.Getenv("SSK_TEST_HELPER") == "1" {
 		ttyForced := os.Getenv("SSK_TEST_TTY") == "1"
 		ssk.IsStdinTerminal = func() bool { return ttyForced }
 		ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
 		defer stop()
 		args := strings.Split(os.Getenv("SSK_TEST_ARGS"), "\x1f")
-		exitCode, _ := ssk.RunWrapper(ctx, args)
+		run := ssk.RunWrapper
+		if os.Getenv("SSK_TEST_CLI") == "1" {
+			// the arguments are a subcommand of the CLI
+			run = func(ctx context.Context, args []string) (int, error) { return ssk.RunCLI(ctx, args, os.Stdout) }
+		}
+		exitCode, _ := run(ctx, args)
 		os.Exit(exitCode)
 	}
-	os.Exit(m.Run())
+	// do not read the user-level configuration file of the developer
+	dir, err := os.MkdirTemp("", "ssk-config")
+	if err != nil {
+		panic(err)
+	}
+	os.Setenv("XDG_CONFIG_HOME", dir)
+	code := m.Run()
+	os.RemoveAll(dir)
+	os.Exit(code)
 }
 
 func startWrapperHelper(t *testing.T, addr, args string, tty bool) *exec.Cmd {
@@ -0,0 +1,88 @@
+package ssk
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/getsops/sops/v3/config"
+	"go.yaml.in/yaml/v3"
+)
+
+// sopsConfig is the subset of .sops.yaml used by this tool.
+type sopsConfig struct {
+	CreationRules []sopsCreationRule `yaml:"creation_rules"`
+}
+
+type sopsCreationRule struct {
+	PathRegex       string         `yaml:"path_regex,omitempty"`
+	HCVaultURI      any            `yaml:"hc_vault_transit_uri,omitempty"` // string or []string
+	Age             any            `yaml:"age,omitempty"`                  // string or []string
+	PGP             any            `yaml:"pgp,omitempty"`                  // string or []string
+	KMS             any            `yaml:"kms,omitempty"`                  // string or []string
+	GCPKMS          any            `yaml:"gcp_kms,omitempty"`              // string or []string
+	AzureKeyVault   any            `yaml:"azure_keyvault,omitempty"`       // string or []string
+	HCKms           []string       `yaml:"hckms,omitempty"`
+	KeyGroups       []sopsKeyGroup `yaml:"key_groups,omitempty"`
+	ShamirThreshold int            `yaml:"shamir_threshold,omitempty"`
+	EncryptedRegex  string         `yaml:"encrypted_regex,omitempty"`
+}
+
+type sopsKeyGroup struct {
+	HCVault []string `yaml:"hc_vault,omitempty"`
+	Age     []string `yaml:"age,omitempty"`
+	PGP     []string `yaml:"pgp,omitempty"`
+	KMS     []any    `yaml:"kms,omitempty"`
+	GCPKMS  []any    `yaml:"gcp_kms,omitempty"`
+	AzureKV []any    `yaml:"azure_keyvault,omitempty"`
+	HCKms   []any    `yaml:"hckms,omitempty"`
+}
+
+// findSOPSConfig looks for .sops.yaml in dir and its parents, as sops does.
+func findSOPSConfig(dir string) (string, error) {
+	// FindConfigFile starts from the directory of the given path.
+	return config.FindConfigFile(filepath.Join(dir, ".sops.yaml"))
+}
+
+// loadSOPSConfig reads and parses a .sops.yaml file.
+func loadSOPSConfig(path string) (*sopsConfig, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %s: %w", path, err)
+	}
+	var conf sopsConfig
+	if err := yaml.Unmarshal(b, &conf); err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %w", path, err)
+	}
+	return &conf, nil
+}
+
+// vaultURIs returns the hc_vault transit URIs referenced by the rule.
+func (r *sopsCreationRule) vaultURIs() []string {
+	uris := stringOrList(r.HCVaultURI)
+	for _, g := range r.KeyGroups {
+		uris = append(uris, g.HCVault...)
+	}
+	return uris
+}
+
+// stringOrList converts a YAML value that is a comma-separated string or a list of strings.
+func stringOrList(v any) []string {
+	var out []string
+	switch v := v.(type) {
+	case string:
+		for _, s := range strings.Split(v, ",") {
+			if s = strings.TrimSpace(s); s != "" {
+				out = append(out, s)
+			}
+		}
+	case []any:
+		for _, s := range v {
+			if s, ok := s.(string); ok {
+				out = append(out, s)
+			}
+		}
+	}
+	return out
+}
@@ -0,0 +1,156 @@
+package ssk
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/getsops/sops/v3"
+	"github.com/getsops/sops/v3/cmd/sops/common"
+	"github.com/getsops/sops/v3/cmd/sops/formats"
+	"github.com/getsops/sops/v3/config"
+)
+
+// formatNames maps SOPS formats to the names used by the sops CLI (--input-type).
+var formatNames = map[formats.Format]string{
+	formats.Binary: "binary",
+	formats.Dotenv: "dotenv",
+	formats.Ini:    "ini",
+	formats.Json:   "json",
+	formats.Yaml:   "yaml",
+}
+
+// sopsStore returns the SOPS store for the path, or for format if it is not empty.
+func sopsStore(path, format string) (common.Store, string) {
+	f := formats.FormatForPathOrString(path, format)
+	return common.StoreForFormat(f, config.NewStoresConfig()), formatNames[f]
+}
+
+// loadSOPSFile reads and parses an encrypted SOPS file without decrypting it.
+// If path is "-", the file is read from stdin.
+// It returns the tree and the name of the detected format.
+func loadSOPSFile(path, format string) (*sops.Tree, string, error) {
+	var (
+		b   []byte
+		err error
+	)
+	if path == "-" {
+		b, err = io.ReadAll(os.Stdin)
+	} else {
+		b, err = os.ReadFile(path)
+	}
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to read %s: %w", path, err)
+	}
+	store, name := sopsStore(path, format)
+	tree, err := store.LoadEncryptedFile(b)
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to load %s as %s SOPS file: %w", path, name, err)
+	}
+	tree.FilePath = path
+	return &tree, name, nil
+}
+
+// maxSOPSFileSize is the size of the largest file detected as a SOPS file.
+const maxSOPSFileSize = 32 << 20
+
+// sopsSniffSize is the size of the head and the tail of a file read to detect a SOPS file.
+const sopsSniffSize = 64 << 10
+
+// nonSOPSExts are the extensions of files that are never SOPS files.
+var nonSOPSExts = []string{
+	".7z", ".a", ".bz2", ".class", ".dll", ".dylib", ".exe", ".gif", ".gz", ".ico", ".jar",
+	".jpeg", ".jpg", ".mp3", ".mp4", ".o", ".pdf", ".png", ".so", ".tar", ".tgz", ".webp",
+	".woff", ".woff2", ".xz", ".zip", ".zst",
+}
+
+// isSOPSFile reports whether path is a SOPS-encrypted file, detecting the format from the extension.
+// Only the head and the tail of a file are read unless it looks like a SOPS file:
+// the head must be text, and the tail must contain the SOPS metadata, which
+// sops writes at the end in every format.
+func isSOPSFile(path string) bool {
+	if slices.Contains(nonSOPSExts, strings.ToLower(filepath.Ext(path))) {
+		return false
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+	st, err := f.Stat()
+	if err != nil || st.Size() == 0 || st.Size() > maxSOPSFileSize {
+		return false
+	}
+	head := make([]byte, min(st.Size(), sopsSniffSize))
+	if _, err := f.ReadAt(head, 0); err != nil || bytes.IndexByte(head, 0) >= 0 {
+		return false
+	}
+	tail := make([]byte, min(st.Size(), sopsSniffSize))
+	if _, err := f.ReadAt(tail, st.Size()-int64(len(tail))); err != nil || !bytes.Contains(tail, []byte("sops")) {
+		return false
+	}
+	b, err := io.ReadAll(io.NewSectionReader(f, 0, st.Size()))
+	if err != nil {
+		return false
+	}
+	store, _ := sopsStore(path, "")
+	_, err = store.LoadEncryptedFile(b)
+	return err == nil
+}
+
+// findSOPSFiles returns the SOPS-encrypted files in roots.
+// Directories are walked recursively, skipping hidden directories such as .git.
+func findSOPSFiles(roots []string) ([]string, error) {
+	var files []string
+	for _, root := range roots {
+		err := filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+			if d.IsDir() {
+				if path != root && strings.HasPrefix(d.Name(), ".") {
+					return filepath.SkipDir
+				}
+				return nil
+			}
+			if d.Type().IsRegular() && isSOPSFile(path) {
+				files = append(files, path)
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return files, nil
+}
+
+// writeFileAtomic writes data to a temporary file and renames it to path,
+// keeping the permissions of the existing file.
+func writeFileAtomic(path string, data []byte) error {
+	st, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	f, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+	if _, err := f.Write(data); err != nil {
+		return err
+	}
+	if err := f.Chmod(st.Mode().Perm()); err != nil {
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), path)
+}
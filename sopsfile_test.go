@@ -0,0 +1,122 @@
+package ssk_test
+
+import (
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"filippo.io/age"
+	ssk "github.com/fujiwara/sops-sakura-kms"
+	"github.com/getsops/sops/v3"
+	sopsaes "github.com/getsops/sops/v3/aes"
+	sopsage "github.com/getsops/sops/v3/age"
+	"github.com/getsops/sops/v3/cmd/sops/common"
+	"github.com/getsops/sops/v3/cmd/sops/formats"
+	"github.com/getsops/sops/v3/config"
+	"github.com/getsops/sops/v3/hcvault"
+	"github.com/getsops/sops/v3/keys"
+	"github.com/getsops/sops/v3/version"
+)
+
+// testPlainFiles are plaintext documents in each format supported by SOPS.
+var testPlainFiles = map[string]string{
+	"yaml":   "foo:\n  bar: baz\nanswer: 42\n",
+	"json":   `{"foo":{"bar":"baz"},"answer":42}`,
+	"dotenv": "FOO=bar\nANSWER=42\n",
+	"ini":    "[foo]\nbar = baz\n",
+	"binary": "raw binary data\n",
+}
+
+// testFileExt maps formats to file extensions SOPS detects.
+var testFileExt = map[string]string{
+	"yaml":   ".yaml",
+	"json":   ".json",
+	"dotenv": ".env",
+	"ini":    ".ini",
+	"binary": ".bin",
+}
+
+// newTestTransit starts a Vault Transit compatible server backed by SakuraKMS
+// talking to a fake KMS with the given keys, and returns it.
+// VAULT_TOKEN is set so that the SOPS Vault client can talk to it.
+func newTestTransit(t *testing.T, keyIDs ...string) (*fakeKMS, *httptest.Server) {
+	t.Helper()
+	f, kmsSrv := newFakeKMS(t, keyIDs...)
+	c, err := ssk.NewSakuraKMSWithClient(newFakeKMSClient(t, kmsSrv))
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := httptest.NewServer(ssk.NewMux(c))
+	t.Cleanup(srv.Close)
+	t.Setenv("VAULT_TOKEN", "dummy")
+	return f, srv
+}
+
+// newTestAgeKey generates an age identity, makes it available to SOPS via
+// SOPS_AGE_KEY and returns a master key for its recipient.
+func newTestAgeKey(t *testing.T) *sopsage.MasterKey {
+	t.Helper()
+	id, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("SOPS_AGE_KEY", id.String())
+	mk, err := sopsage.MasterKeyFromRecipient(id.Recipient().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return mk
+}
+
+// encryptTestFile encrypts plain as a SOPS file of the given format, protected
+// by the given key groups, and returns the encrypted document.
+func encryptTestFile(t *testing.T, format string, plain []byte, groups ...sops.KeyGroup) []byte {
+	t.Helper()
+	store := common.StoreForFormat(formats.FormatFromString(format), config.NewStoresConfig())
+	branches, err := store.LoadPlainFile(plain)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tree := sops.Tree{
+		Branches: branches,
+		Metadata: sops.Metadata{
+			KeyGroups:         groups,
+			UnencryptedSuffix: "_unencrypted",
+			Version:           version.Version,
+		},
+	}
+	if len(groups) > 1 {
+		tree.Metadata.ShamirThreshold = len(groups)
+	}
+	dataKey, errs := tree.GenerateDataKey()
+	if len(errs) > 0 {
+		t.Fatalf("failed to generate data key: %v", errs)
+	}
+	if err := common.EncryptTree(common.EncryptTreeOpts{DataKey: dataKey, Tree: &tree, Cipher: sopsaes.NewCipher()}); err != nil {
+		t.Fatal(err)
+	}
+	b, err := store.EmitEncryptedFile(tree)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+// writeTestFile encrypts plain and writes it to dir/name, returning the path.
+func writeTestFile(t *testing.T, dir, name, format string, plain []byte, groups ...sops.KeyGroup) string {
+	t.Helper()
+	path := filepath.Join(dir, name)
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, encryptTestFile(t, format, plain, groups...), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// vaultKey returns an hc_vault master key for keyID on the test transit server.
+func vaultKey(srv *httptest.Server, keyID string) keys.MasterKey {
+	return hcvault.NewMasterKey(srv.URL, "transit", keyID)
+}
@@ -0,0 +1,124 @@
+package ssk
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+)
+
+// sdListenFDsStart is the first file descriptor passed by systemd socket activation.
+const sdListenFDsStart = 3
+
+// SystemdListeners returns the listeners passed by systemd socket activation
+// (LISTEN_FDS), or nil if the process was not socket-activated.
+// The environment variables of socket activation are unset, so that they are
+// not inherited by child processes.
+func SystemdListeners() ([]net.Listener, error) {
+	defer func() {
+		os.Unsetenv("LISTEN_PID")
+		os.Unsetenv("LISTEN_FDS")
+		os.Unsetenv("LISTEN_FDNAMES")
+	}()
+	if pid := os.Getenv("LISTEN_PID"); pid != "" && pid != strconv.Itoa(os.Getpid()) {
+		return nil, nil
+	}
+	v := os.Getenv("LISTEN_FDS")
+	if v == "" {
+		return nil, nil
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil || n < 0 {
+		return nil, fmt.Errorf("invalid LISTEN_FDS %q", v)
+	}
+	var listeners []net.Listener
+	for fd := sdListenFDsStart; fd < sdListenFDsStart+n; fd++ {
+		f := os.NewFile(uintptr(fd), "LISTEN_FD_"+strconv.Itoa(fd))
+		// FileListener duplicates the descriptor, so the original is closed
+		ln, err := net.FileListener(f)
+		f.Close()
+		if err != nil {
+			return nil, fmt.Errorf("failed to use the file descriptor %d passed by systemd: %w", fd, err)
+		}
+		listeners = append(listeners, ln)
+	}
+	return listeners, nil
+}
+
+// SdNotify sends the state (e.g. "READY=1") to the service manager through
+// NOTIFY_SOCKET. It returns false without an error if NOTIFY_SOCKET is not set.
+func SdNotify(state string) (bool, error) {
+	path := os.Getenv("NOTIFY_SOCKET")
+	if path == "" {
+		return false, nil
+	}
+	if path[0] == '@' {
+		// abstract namespace
+		path = "\x00" + path[1:]
+	}
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: path, Net: "unixgram"})
+	if err != nil {
+		return false, fmt.Errorf("failed to connect to NOTIFY_SOCKET: %w", err)
+	}
+	defer conn.Close()
+	if _, err := conn.Write([]byte(state)); err != nil {
+		return false, fmt.Errorf("failed to notify %q: %w", state, err)
+	}
+	return true, nil
+}
+
+// sdNotify is SdNotify logging errors.
+func sdNotify(state string) {
+	if _, err := SdNotify(state); err != nil {
+		slog.Warn("failed to notify systemd", "state", state, "error", err)
+	}
+}
+
+// SdWatchdogInterval returns the interval to send watchdog pings, half of
+// WATCHDOG_USEC, or 0 if the watchdog of the service manager is not enabled.
+func SdWatchdogInterval() (time.Duration, error) {
+	if pid := os.Getenv("WATCHDOG_PID"); pid != "" && pid != strconv.Itoa(os.Getpid()) {
+		return 0, nil
+	}
+	v := os.Getenv("WATCHDOG_USEC")
+	if v == "" {
+		return 0, nil
+	}
+	usec, err := strconv.ParseInt(v, 10, 64)
+	if err != nil || usec <= 0 {
+		return 0, fmt.Errorf("invalid WATCHDOG_USEC %q", v)
+	}
+	return time.Duration(usec) * time.Microsecond / 2, nil
+}
+
+// runSdWatchdog sends "WATCHDOG=1" every interval while the server at addr is
+// healthy, until ctx is done. A hung server stops the pings, so the service
+// manager restarts it.
+func runSdWatchdog(ctx context.Context, interval time.Duration, addr string) {
+	client := &http.Client{Timeout: interval}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		req, _ := http.NewRequestWithContext(ctx, http.MethodGet, "http://"+addr+"/health", nil)
+		resp, err := client.Do(req)
+		if err != nil {
+			slog.Warn("health check for the watchdog failed", "error", err)
+			continue
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			slog.Warn("health check for the watchdog failed", "status", resp.StatusCode)
+			continue
+		}
+		sdNotify("WATCHDOG=1")
+	}
+}
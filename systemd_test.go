@@ -0,0 +1,155 @@
+package ssk_test
+
+import (
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	ssk "github.com/fujiwara/sops-sakura-kms"
+)
+
+func TestSystemdSocketActivation(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("systemd is not available on Windows")
+	}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := ln.Addr().String()
+	lf, err := ln.(*net.TCPListener).File()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ln.Close()
+
+	// a short path, as the path of a unix socket is limited to about 100 bytes
+	dir, err := os.MkdirTemp("", "ssk")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	notifyPath := filepath.Join(dir, "notify")
+	notify, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: notifyPath, Net: "unixgram"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer notify.Close()
+	messages := make(chan string, 100)
+	go func() {
+		buf := make([]byte, 1024)
+		for {
+			n, err := notify.Read(buf)
+			if err != nil {
+				return
+			}
+			messages <- string(buf[:n])
+		}
+	}()
+	waitMessage := func(want string) {
+		t.Helper()
+		timeout := time.After(10 * time.Second)
+		for {
+			select {
+			case msg := <-messages:
+				if strings.HasPrefix(msg, want) {
+					return
+				}
+			case <-timeout:
+				t.Fatalf("did not receive %q", want)
+			}
+		}
+	}
+
+	cmd := exec.Command(os.Args[0])
+	cmd.Env = append(os.Environ(),
+		"SSK_TEST_HELPER=1",
+		"SSK_TEST_ARGS=",
+		"SSK_SERVER_ONLY=true",
+		"SAKURA_KMS_KEY_ID=",
+		"SSK_SERVER_ADDR="+freeAddr(t),
+		"LISTEN_FDS=1",
+		"NOTIFY_SOCKET="+notifyPath,
+		"WATCHDOG_USEC=200000",
+	)
+	cmd.ExtraFiles = []*os.File{lf}
+	cmd.Stderr = os.Stderr
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	lf.Close()
+	defer cmd.Process.Kill()
+
+	waitMessage("READY=1\nSTATUS=Listening on " + addr)
+	resp, err := http.Get("http://" + addr + "/health")
+	if err != nil {
+		t.Fatalf("server does not serve on the passed socket: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("health status = %d", resp.StatusCode)
+	}
+	waitMessage("WATCHDOG=1")
+
+	if err := cmd.Process.Signal(syscall.SIGTERM); err != nil {
+		t.Fatal(err)
+	}
+	waitMessage("STOPPING=1")
+	if err := waitWithTimeout(t, cmd, 10*time.Second); err != nil {
+		t.Errorf("server exited with error: %v", err)
+	}
+}
+
+func TestSystemdListenersNotActivated(t *testing.T) {
+	t.Setenv("LISTEN_PID", strconv.Itoa(os.Getpid()+1))
+	t.Setenv("LISTEN_FDS", "1")
+	lns, err := ssk.SystemdListeners()
+	if err != nil || lns != nil {
+		t.Errorf("listeners for another process: %v, %v", lns, err)
+	}
+	if os.Getenv("LISTEN_FDS") != "" {
+		t.Error("LISTEN_FDS is not unset")
+	}
+
+	t.Setenv("LISTEN_PID", strconv.Itoa(os.Getpid()))
+	t.Setenv("LISTEN_FDS", "x")
+	if _, err := ssk.SystemdListeners(); err == nil {
+		t.Error("expected an error for invalid LISTEN_FDS")
+	}
+}
+
+func TestSdNotifyWithoutSocket(t *testing.T) {
+	t.Setenv("NOTIFY_SOCKET", "")
+	if ok, err := ssk.SdNotify("READY=1"); ok || err != nil {
+		t.Errorf("SdNotify = %v, %v", ok, err)
+	}
+}
+
+func TestSdWatchdogInterval(t *testing.T) {
+	t.Setenv("WATCHDOG_PID", "")
+	t.Setenv("WATCHDOG_USEC", "30000000")
+	if d, err := ssk.SdWatchdogInterval(); err != nil || d != 15*time.Second {
+		t.Errorf("interval = %s, %v", d, err)
+	}
+	t.Setenv("WATCHDOG_PID", strconv.Itoa(os.Getpid()+1))
+	if d, err := ssk.SdWatchdogInterval(); err != nil || d != 0 {
+		t.Errorf("interval for another process = %s, %v", d, err)
+	}
+	t.Setenv("WATCHDOG_PID", "")
+	t.Setenv("WATCHDOG_USEC", "")
+	if d, err := ssk.SdWatchdogInterval(); err != nil || d != 0 {
+		t.Errorf("interval without watchdog = %s, %v", d, err)
+	}
+	t.Setenv("WATCHDOG_USEC", "-1")
+	if _, err := ssk.SdWatchdogInterval(); err == nil {
+		t.Error("expected an error for invalid WATCHDOG_USEC")
+	}
+}
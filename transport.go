@@ -0,0 +1,90 @@
+package ssk
+
+import (
+	"errors"
+	"iter"
+	"net/http"
+	"slices"
+	"time"
+
+	"github.com/hashicorp/go-retryablehttp"
+	"github.com/sacloud/saclient-go"
+)
+
+// kmsMaxIdleConnsPerHost is the number of idle connections to the KMS API
+// kept alive for reuse. net/http keeps only 2 by default
+// (http.DefaultMaxIdleConnsPerHost), so parallel requests, e.g. from
+// rotate-all, verify or a busy server, would open new connections.
+const kmsMaxIdleConnsPerHost = 32
+
+// kmsTransport sends the requests to the Sakura Cloud API with a pooled,
+// keep-alive HTTP client owned by the SakuraKMS. saclient does not allow
+// replacing its HTTP client, so the middleware replaces the last middleware
+// of saclient, which sends the request with it, keeping the retry settings.
+type kmsTransport struct {
+	client *retryablehttp.Client
+}
+
+func newKMSTransport(c saclient.ClientAPI) *kmsTransport {
+	t := http.DefaultTransport.(*http.Transport).Clone()
+	t.MaxIdleConns = kmsMaxIdleConnsPerHost * 4
+	t.MaxIdleConnsPerHost = kmsMaxIdleConnsPerHost
+	t.IdleConnTimeout = 90 * time.Second
+
+	// the same settings and defaults as saclient
+	settings := map[string]int64{
+		"RetryMax":          10,
+		"RetryWaitMin":      1,
+		"RetryWaitMax":      64,
+		"APIRequestTimeout": 300,
+	}
+	// a copy is populated, so that c can still be configured
+	if jc, ok := c.Dup().(interface{ JSON() map[string]any }); ok {
+		m := jc.JSON()
+		for key := range settings {
+			if n, ok := m[key].(int64); ok {
+				settings[key] = n
+			}
+		}
+	}
+	return &kmsTransport{client: &retryablehttp.Client{
+		HTTPClient: &http.Client{
+			Transport: t,
+			Timeout:   time.Duration(settings["APIRequestTimeout"]) * time.Second,
+		},
+		RetryMax:     int(settings["RetryMax"]),
+		RetryWaitMin: time.Duration(settings["RetryWaitMin"]) * time.Second,
+		RetryWaitMax: time.Duration(settings["RetryWaitMax"]) * time.Second,
+		CheckRetry:   retryablehttp.DefaultRetryPolicy,
+		Backoff:      retryablehttp.DefaultBackoff,
+	}}
+}
+
+// middleware runs the following middlewares of saclient, with the last one
+// replaced by do.
+func (t *kmsTransport) middleware(req *http.Request, pull func() (saclient.Middleware, bool)) (*http.Response, error) {
+	var chain []saclient.Middleware
+	for m, ok := pull(); ok; m, ok = pull() {
+		chain = append(chain, m)
+	}
+	if len(chain) == 0 {
+		return nil, errors.New("no next middleware")
+	}
+	chain[len(chain)-1] = t.do
+	next, stop := iter.Pull(slices.Values(chain))
+	defer stop()
+	m, _ := next()
+	return m(req, next)
+}
+
+// do sends the request with the pooled client, retrying as saclient does.
+func (t *kmsTransport) do(req *http.Request, pull func() (saclient.Middleware, bool)) (*http.Response, error) {
+	if _, ok := pull(); ok {
+		return nil, errors.New("the transport must be the last middleware")
+	}
+	r, err := retryablehttp.FromRequest(req)
+	if err != nil {
+		return nil, err
+	}
+	return t.client.Do(r)
+}
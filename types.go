@@ -2,14 +2,19 @@ package ssk
 
 // VaultEncryptRequest represents the request body for Vault Transit Engine encrypt API.
 // Plaintext must be base64-encoded string.
+// Type optionally selects the encryption algorithm, either a Sakura Cloud KMS
+// algorithm name (e.g. "aes-256-cbc") or a Vault key type (e.g. "aes256-gcm96").
 type VaultEncryptRequest struct {
 	Plaintext string `json:"plaintext"`
+	Type      string `json:"type,omitempty"`
 }
 
 // VaultEncryptResponse represents the response body for Vault Transit Engine encrypt API.
 // Ciphertext includes "vault:v1:" prefix followed by the encrypted data.
+// Algorithm is the encryption algorithm used, when the cipher reports it.
 type VaultEncryptResponse struct {
 	Ciphertext string `json:"ciphertext"`
+	Algorithm  string `json:"algorithm,omitempty"`
 }
 
 // VaultDecryptRequest represents the request body for Vault Transit Engine decrypt API.
@@ -29,3 +34,9 @@ type VaultDecryptResponse struct {
 type VaultErrorResponse struct {
 	Errors []string `json:"errors"`
 }
+
+// VaultTokenLookupResponse represents the response body for Vault token lookup-self API.
+// Meta has the "pid" of the server process, to identify an agent.
+type VaultTokenLookupResponse struct {
+	Meta map[string]string `json:"meta"`
+}
@@ -0,0 +1,362 @@
+package ssk
+
+import (
+	"context"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	sopsaes "github.com/getsops/sops/v3/aes"
+	"github.com/getsops/sops/v3/cmd/sops/common"
+	"github.com/getsops/sops/v3/hcvault"
+)
+
+// Exit codes of the verify subcommand.
+const (
+	// ExitCodeVerifyFailed is returned when any file fails verification.
+	ExitCodeVerifyFailed = 2
+	// ExitCodeNoFiles is returned when no SOPS files are found.
+	ExitCodeNoFiles = 3
+)
+
+// Report formats of the verify subcommand.
+const (
+	VerifyText  = "text"
+	VerifyJSON  = "json"
+	VerifyJUnit = "junit"
+)
+
+var verifyFormats = []string{VerifyText, VerifyJSON, VerifyJUnit}
+
+// DefaultVerifyParallel is the default number of files verified in parallel.
+const DefaultVerifyParallel = 8
+
+// VerifyResult is the result of verifying a SOPS file.
+type VerifyResult struct {
+	Path string `json:"path"`
+	OK   bool   `json:"ok"`
+	// Keys are the results of the Sakura Cloud KMS key entries of the file.
+	Keys  []VerifyKeyResult `json:"keys,omitempty"`
+	Error string            `json:"error,omitempty"`
+	// Duration is the time taken to verify the file.
+	Duration time.Duration `json:"duration"`
+}
+
+// VerifyKeyResult is the result of decrypting the data key with a Sakura Cloud KMS key entry.
+type VerifyKeyResult struct {
+	KeyID string `json:"key_id"`
+	OK    bool   `json:"ok"`
+	Error string `json:"error,omitempty"`
+}
+
+// VerifyFile checks that a SOPS file is decryptable: the data key is encrypted
+// by each Sakura Cloud KMS key entry of the file, the data key can be recovered
+// from the key groups (other key types are tried with the local SOPS key
+// service), and the MAC matches. The decrypted values are discarded.
+func VerifyFile(ctx context.Context, c Cipher, mismatch KeyIDMismatchMode, path string) VerifyResult {
+	start := time.Now()
+	result := verifyFile(ctx, c, mismatch, path)
+	result.Duration = time.Since(start)
+	return result
+}
+
+func verifyFile(ctx context.Context, c Cipher, mismatch KeyIDMismatchMode, path string) VerifyResult {
+	result := VerifyResult{Path: path}
+	// the data keys decrypted by the key entries are reused to decrypt the tree
+	c = &dataKeyCache{Cipher: c}
+	tree, _, err := loadSOPSFile(path, "")
+	if err != nil {
+		result.Error = err.Error()
+		return result
+	}
+	var errs []error
+	for _, group := range tree.Metadata.KeyGroups {
+		for _, key := range group {
+			keyID := sakuraKMSKeyID(key)
+			if keyID == "" {
+				continue
+			}
+			kr := VerifyKeyResult{KeyID: keyID, OK: true}
+			blob := strings.TrimPrefix(key.(*hcvault.MasterKey).EncryptedKey, VaultPrefix)
+			if _, err := c.Decrypt(ctx, keyID, blob); err != nil {
+				kr.OK = false
+				kr.Error = err.Error()
+				errs = append(errs, fmt.Errorf("key %s: %w", keyID, err))
+			}
+			result.Keys = append(result.Keys, kr)
+		}
+	}
+	_, err = common.DecryptTree(common.DecryptTreeOpts{
+		Tree:        tree,
+		KeyServices: keyServices(c, mismatch),
+		Cipher:      sopsaes.NewCipher(),
+	})
+	if err != nil {
+		errs = append(errs, err)
+	}
+	if len(errs) > 0 {
+		result.Error = errors.Join(errs...).Error()
+		return result
+	}
+	result.OK = true
+	return result
+}
+
+// dataKeyCache is a Cipher that remembers the decrypted data keys of a file,
+// so that a data key is decrypted by KMS only once.
+type dataKeyCache struct {
+	Cipher
+	mu   sync.Mutex
+	keys map[[2]string][]byte
+}
+
+func (c *dataKeyCache) Decrypt(ctx context.Context, keyID, ciphertext string) ([]byte, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	k := [2]string{keyID, ciphertext}
+	if b, ok := c.keys[k]; ok {
+		return b, nil
+	}
+	b, err := c.Cipher.Decrypt(ctx, keyID, ciphertext)
+	if err != nil {
+		return nil, err
+	}
+	if c.keys == nil {
+		c.keys = make(map[[2]string][]byte)
+	}
+	c.keys[k] = b
+	return b, nil
+}
+
+// VerifyFiles verifies files in parallel and returns the results in the order of paths.
+func VerifyFiles(ctx context.Context, c Cipher, mismatch KeyIDMismatchMode, paths []string, parallel int) []VerifyResult {
+	results := make([]VerifyResult, len(paths))
+	sem := make(chan struct{}, max(parallel, 1))
+	var wg sync.WaitGroup
+	for i, path := range paths {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func() {
+			defer wg.Done()
+			defer func() { <-sem }()
+			results[i] = VerifyFile(ctx, c, mismatch, path)
+		}()
+	}
+	wg.Wait()
+	return results
+}
+
+// findRuleFiles returns the SOPS files under the directory of the .sops.yaml
+// at configPath whose paths, relative to the directory, match a creation rule.
+func findRuleFiles(configPath string) ([]string, error) {
+	conf, err := loadSOPSConfig(configPath)
+	if err != nil {
+		return nil, err
+	}
+	var regexps []*regexp.Regexp
+	for _, rule := range conf.CreationRules {
+		re, err := regexp.Compile(rule.PathRegex)
+		if err != nil {
+			return nil, fmt.Errorf("invalid path_regex %q in %s: %w", rule.PathRegex, configPath, err)
+		}
+		regexps = append(regexps, re)
+	}
+	root := filepath.Dir(configPath)
+	files, err := findSOPSFiles([]string{root})
+	if err != nil {
+		return nil, err
+	}
+	return slices.DeleteFunc(files, func(path string) bool {
+		rel, err := filepath.Rel(root, path)
+		if err != nil {
+			return true
+		}
+		rel = filepath.ToSlash(rel)
+		return !slices.ContainsFunc(regexps, func(re *regexp.Regexp) bool { return re.MatchString(rel) })
+	}), nil
+}
+
+// findTargetFiles returns the files for the arguments of verify and lint.
+// Files are used as is, directories are searched for SOPS files, and glob
+// patterns are expanded to the SOPS files matching them.
+// Without arguments, the files matching the creation rules of .sops.yaml are
+// used, or all SOPS files under the current directory if .sops.yaml is not found.
+func findTargetFiles(args []string) ([]string, error) {
+	if len(args) == 0 {
+		if configPath, err := findSOPSConfig("."); err == nil {
+			return findRuleFiles(configPath)
+		}
+		return findSOPSFiles([]string{"."})
+	}
+	var files []string
+	for _, arg := range args {
+		if strings.ContainsAny(arg, "*?[") {
+			matches, err := filepath.Glob(arg)
+			if err != nil {
+				return nil, fmt.Errorf("invalid pattern %q: %w", arg, err)
+			}
+			found, err := findSOPSFiles(matches)
+			if err != nil {
+				return nil, err
+			}
+			files = append(files, found...)
+			continue
+		}
+		if st, err := os.Stat(arg); err == nil && st.IsDir() {
+			found, err := findSOPSFiles([]string{arg})
+			if err != nil {
+				return nil, err
+			}
+			files = append(files, found...)
+			continue
+		}
+		files = append(files, arg)
+	}
+	slices.Sort(files)
+	return slices.Compact(files), nil
+}
+
+// RunVerify runs the verify subcommand, checking that SOPS files are decryptable.
+func RunVerify(ctx context.Context, args []string, w io.Writer) (int, error) {
+	fs, e, err := envFlagSet("verify", "verify [options] [<file|dir|glob>...]")
+	if err != nil {
+		return ExitCodeError, err
+	}
+	format := fs.String("format", VerifyText, "report format ("+strings.Join(verifyFormats, ", ")+")")
+	output := fs.String("o", "-", "report file (- for stdout)")
+	parallel := fs.Int("parallel", DefaultVerifyParallel, "number of files verified in parallel")
+	allowEmpty := fs.Bool("allow-empty", false, "succeed when no SOPS files are found")
+	if err := fs.Parse(args); err != nil {
+		return ExitCodeError, err
+	}
+	if !slices.Contains(verifyFormats, *format) {
+		return ExitCodeError, fmt.Errorf("unsupported report format %q (must be one of %s)", *format, strings.Join(verifyFormats, ", "))
+	}
+	mismatch, err := ParseKeyIDMismatchMode(e.KeyIDMismatch)
+	if err != nil {
+		return ExitCodeError, fmt.Errorf("invalid SSK_KEY_ID_MISMATCH: %w", err)
+	}
+	kmsOpts, err := e.KMSOptions()
+	if err != nil {
+		return ExitCodeError, err
+	}
+	c, err := NewSakuraKMS(kmsOpts...)
+	if err != nil {
+		return ExitCodeError, fmt.Errorf("failed to create cipher: %w", err)
+	}
+	paths, err := findTargetFiles(fs.Args())
+	if err != nil {
+		return ExitCodeError, err
+	}
+	if len(paths) == 0 {
+		if *allowEmpty {
+			fmt.Fprintln(w, "no SOPS files found")
+			return 0, nil
+		}
+		return ExitCodeNoFiles, errors.New("no SOPS files found")
+	}
+
+	results := VerifyFiles(ctx, c, mismatch, paths, *parallel)
+	err = writeOutput(*output, w, func(w io.Writer) error {
+		return writeVerifyReport(w, *format, results)
+	})
+	if err != nil {
+		return ExitCodeError, err
+	}
+	for _, r := range results {
+		if !r.OK {
+			return ExitCodeVerifyFailed, nil
+		}
+	}
+	return 0, nil
+}
+
+func writeVerifyReport(w io.Writer, format string, results []VerifyResult) error {
+	failed := 0
+	for _, r := range results {
+		if !r.OK {
+			failed++
+		}
+	}
+	switch format {
+	case VerifyJSON:
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(results)
+	case VerifyJUnit:
+		return writeJUnit(w, results, failed)
+	}
+	for _, r := range results {
+		if r.OK {
+			fmt.Fprintf(w, "ok    %s\n", r.Path)
+			continue
+		}
+		fmt.Fprintf(w, "FAIL  %s\n", r.Path)
+		for _, line := range strings.Split(r.Error, "\n") {
+			fmt.Fprintf(w, "      %s\n", line)
+		}
+	}
+	fmt.Fprintf(w, "%d files: %d ok, %d failed\n", len(results), len(results)-failed, failed)
+	return nil
+}
+
+type junitTestSuites struct {
+	XMLName xml.Name         `xml:"testsuites"`
+	Suites  []junitTestSuite `xml:"testsuite"`
+}
+
+type junitTestSuite struct {
+	Name     string          `xml:"name,attr"`
+	Tests    int             `xml:"tests,attr"`
+	Failures int             `xml:"failures,attr"`
+	Time     string          `xml:"time,attr"`
+	Cases    []junitTestCase `xml:"testcase"`
+}
+
+type junitTestCase struct {
+	ClassName string        `xml:"classname,attr"`
+	Name      string        `xml:"name,attr"`
+	Time      string        `xml:"time,attr"`
+	Failure   *junitFailure `xml:"failure,omitempty"`
+}
+
+type junitFailure struct {
+	Message string `xml:"message,attr"`
+	Text    string `xml:",chardata"`
+}
+
+func writeJUnit(w io.Writer, results []VerifyResult, failed int) error {
+	suite := junitTestSuite{Name: "sops-sakura-kms verify", Tests: len(results), Failures: failed}
+	var total time.Duration
+	for _, r := range results {
+		total += r.Duration
+		tc := junitTestCase{
+			ClassName: "sops-sakura-kms.verify",
+			Name:      r.Path,
+			Time:      fmt.Sprintf("%.3f", r.Duration.Seconds()),
+		}
+		if !r.OK {
+			message, _, _ := strings.Cut(r.Error, "\n")
+			tc.Failure = &junitFailure{Message: message, Text: r.Error}
+		}
+		suite.Cases = append(suite.Cases, tc)
+	}
+	suite.Time = fmt.Sprintf("%.3f", total.Seconds())
+	io.WriteString(w, xml.Header)
+	enc := xml.NewEncoder(w)
+	enc.Indent("", "  ")
+	if err := enc.Encode(junitTestSuites{Suites: []junitTestSuite{suite}}); err != nil {
+		return err
+	}
+	_, err := io.WriteString(w, "\n")
+	return err
+}
@@ -0,0 +1,116 @@
+package ssk_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"encoding/xml"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+
+	ssk "github.com/fujiwara/sops-sakura-kms"
+	"github.com/getsops/sops/v3"
+)
+
+func TestRunVerify(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	_, transit := newTestTransit(t, "111111111111", "222222222222")
+	plain := []byte(testPlainFiles["yaml"])
+	okFile := writeTestFile(t, dir, "secrets/ok.enc.yaml", "yaml", plain, sops.KeyGroup{vaultKey(transit, "111111111111")})
+	disabledFile := writeTestFile(t, dir, "secrets/disabled.enc.yaml", "yaml", plain,
+		sops.KeyGroup{vaultKey(transit, "111111111111"), vaultKey(transit, "222222222222")})
+	tamperedFile := writeTestFile(t, dir, "secrets/tampered.enc.yaml", "yaml", plain, sops.KeyGroup{vaultKey(transit, "111111111111")})
+	writeTestFile(t, dir, "other/ignored.enc.yaml", "yaml", plain, sops.KeyGroup{vaultKey(transit, "222222222222")})
+	transit.Close()
+
+	b, _ := os.ReadFile(tamperedFile)
+	b = regexp.MustCompile(`lastmodified: "[^"]+"`).ReplaceAll(b, []byte(`lastmodified: "2000-01-01T00:00:00Z"`))
+	if err := os.WriteFile(tamperedFile, b, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	conf := "creation_rules:\n  - path_regex: ^secrets/\n    hc_vault_transit_uri: http://127.0.0.1:8200/v1/transit/keys/111111111111\n"
+	if err := os.WriteFile(filepath.Join(dir, ".sops.yaml"), []byte(conf), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	f, kmsSrv := newFakeKMS(t, "111111111111", "222222222222")
+	setFakeKMSEnv(t, kmsSrv.URL)
+	t.Setenv("SAKURA_KMS_KEY_ID", "")
+	f.setStatus("222222222222", "suspended")
+	t.Chdir(dir)
+	rel := func(p string) string {
+		r, _ := filepath.Rel(dir, p)
+		return r
+	}
+
+	// all files pass
+	var out bytes.Buffer
+	code, err := ssk.RunCLI(ctx, []string{"verify", okFile}, &out)
+	if err != nil || code != 0 {
+		t.Fatalf("verify: code=%d err=%v\n%s", code, err, out.String())
+	}
+	// the data key decrypted for the key entry is reused for the values
+	if n := len(f.requestUsers()); n != 1 {
+		t.Errorf("verify sent %d requests to KMS, want 1", n)
+	}
+
+	// files matching .sops.yaml rules
+	out.Reset()
+	code, err = ssk.RunCLI(ctx, []string{"verify", "--format", "json"}, &out)
+	if err != nil || code != ssk.ExitCodeVerifyFailed {
+		t.Fatalf("verify: code=%d err=%v\n%s", code, err, out.String())
+	}
+	var results []ssk.VerifyResult
+	if err := json.Unmarshal(out.Bytes(), &results); err != nil {
+		t.Fatal(err)
+	}
+	got := map[string]ssk.VerifyResult{}
+	for _, r := range results {
+		got[r.Path] = r
+	}
+	if len(got) != 3 {
+		t.Fatalf("unexpected results: %+v", results)
+	}
+	if !got[rel(okFile)].OK {
+		t.Errorf("%s must pass: %s", okFile, got[rel(okFile)].Error)
+	}
+	if r := got[rel(disabledFile)]; r.OK || len(r.Keys) != 2 || !r.Keys[0].OK || r.Keys[1].OK {
+		t.Errorf("%s must fail with the suspended key: %+v", disabledFile, r)
+	}
+	if r := got[rel(tamperedFile)]; r.OK || !strings.Contains(r.Error, "MAC") {
+		t.Errorf("%s must fail with the MAC: %+v", tamperedFile, r)
+	}
+
+	// JUnit report to a file
+	report := filepath.Join(t.TempDir(), "report.xml")
+	code, _ = ssk.RunCLI(ctx, []string{"verify", "--format", "junit", "-o", report, "secrets/*.yaml"}, &out)
+	if code != ssk.ExitCodeVerifyFailed {
+		t.Errorf("exit code = %d, want %d", code, ssk.ExitCodeVerifyFailed)
+	}
+	b, err = os.ReadFile(report)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var suites struct {
+		Suites []struct {
+			Tests    int `xml:"tests,attr"`
+			Failures int `xml:"failures,attr"`
+		} `xml:"testsuite"`
+	}
+	if err := xml.Unmarshal(b, &suites); err != nil {
+		t.Fatal(err)
+	}
+	if len(suites.Suites) != 1 || suites.Suites[0].Tests != 3 || suites.Suites[0].Failures != 2 {
+		t.Errorf("unexpected JUnit report:\n%s", b)
+	}
+
+	// no files
+	code, err = ssk.RunCLI(ctx, []string{"verify", "empty/*"}, &out)
+	if err == nil || code != ssk.ExitCodeNoFiles {
+		t.Errorf("exit code = %d, want %d", code, ssk.ExitCodeNoFiles)
+	}
+}
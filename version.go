@@ -4,26 +4,39 @@ import (
 	"context"
 	"fmt"
 	"io"
-	"os"
 	"os/exec"
 )
 
 var Version = "v0.5.1"
 
 func ShowVersion(ctx context.Context, w io.Writer) (int, error) {
-	// Ensure self Version is printed even if error occurs later
-	defer fmt.Fprintf(w, "sops-sakura-kms version %s\n", Version)
-
-	os.Setenv("SAKURA_KMS_KEY_ID", "dummy") // dummy value to pass LoadEnv
 	env, err := LoadEnv()
 	if err != nil {
+		fmt.Fprintf(w, "sops-sakura-kms version %s\n", Version)
 		return ExitCodeError, fmt.Errorf("failed to load environment variables: %w", err)
 	}
-	cmd := exec.CommandContext(ctx, env.Command, "--version", "--disable-version-check")
-	output, err := cmd.CombinedOutput()
+	return ShowVersionWithEnv(ctx, env, w)
+}
+
+// ShowVersionWithEnv is like ShowVersion, but uses the command configured in the given Env.
+func ShowVersionWithEnv(ctx context.Context, env *Env, w io.Writer) (int, error) {
+	// Ensure self Version is printed even if error occurs later
+	defer fmt.Fprintf(w, "sops-sakura-kms version %s\n", Version)
+
+	output, err := sopsVersionOutput(ctx, env.Command)
 	if err != nil {
-		return ExitCodeError, fmt.Errorf("failed to execute %s --version: %w", env.Command, err)
+		return ExitCodeError, err
 	}
 	w.Write(output)
 	return 0, nil
 }
+
+// sopsVersionOutput returns the output of `command --version`.
+func sopsVersionOutput(ctx context.Context, command string) ([]byte, error) {
+	cmd := exec.CommandContext(ctx, command, "--version", "--disable-version-check")
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		return nil, fmt.Errorf("failed to execute %s --version: %w", command, err)
+	}
+	return output, nil
+}